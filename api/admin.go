@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+// ---------------------------------------------------------------------------
+// Admin API – inspect and control the hub
+// ---------------------------------------------------------------------------
+
+// The /admin routes need "Authorization: Bearer <ADMIN_TOKEN>". Without an
+// ADMIN_TOKEN they don't exist.
+
+// Admin serves the /admin routes for hub.
+type Admin struct {
+	hub   *Hub
+	keys  *APIKeyStore
+	token string
+}
+
+// NewAdmin creates the admin API for hub and the API keys in keys.
+func NewAdmin(hub *Hub, keys *APIKeyStore, cfg *Config) *Admin {
+	return &Admin{hub: hub, keys: keys, token: cfg.AdminToken}
+}
+
+// Routes returns the admin router, to be mounted at /admin.
+func (a *Admin) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(a.Authenticate)
+	r.Get("/tickers", a.getTickers)
+	r.Post("/tickers/{ticker}/refresh", a.refreshTicker)
+	r.Get("/clients", a.getClients)
+	r.Delete("/clients/{id}", a.disconnectClient)
+	r.Get("/polling", a.getPolling)
+	r.Post("/polling/pause", a.pausePolling)
+	r.Post("/polling/resume", a.resumePolling)
+	r.Get("/keys", a.keys.getKeys)
+	r.Post("/keys", a.keys.createKey)
+	r.Delete("/keys/{id}", a.keys.revokeKey)
+	return r
+}
+
+// Authenticate rejects requests without the admin token.
+func (a *Admin) Authenticate(next http.Handler) http.Handler {
+	return requireBearer(a.token, "admin", "The admin API is disabled. Set ADMIN_TOKEN to enable it.")(next)
+}
+
+// requireBearer rejects requests without "Authorization: Bearer <token>",
+// naming realm in the challenge. With no token the routes answer 404 with
+// disabled.
+func requireBearer(token, realm, disabled string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				writeError(w, http.StatusNotFound, disabled)
+				return
+			}
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+				writeError(w, http.StatusUnauthorized, "Missing or invalid "+realm+" token.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AdminTicker is a tracked ticker as the admin API shows it.
+type AdminTicker struct {
+	Ticker          string     `json:"ticker"`
+	Type            string     `json:"type"`    // "stock", "index" or "crypto"
+	HasData         bool       `json:"hasData"` // false until a scrape finds the ticker
+	LastUpdated     time.Time  `json:"lastUpdated"`
+	Stale           bool       `json:"stale,omitempty"`
+	Seq             uint64     `json:"seq"`
+	Subscribers     int        `json:"subscribers"`
+	PinnedBy        []string   `json:"pinnedBy,omitempty"`       // server-side owners keeping it polled
+	ScrapeErrors    int        `json:"scrapeErrors"`             // failed scrapes since it was tracked
+	LastScrapeError *time.Time `json:"lastScrapeError"`          // null if none
+	FailuresInARow  int        `json:"failuresInARow,omitempty"` // for tickers without data, see TICKER_MAX_FAILURES
+}
+
+// AdminClient is a connected client as the admin API shows it.
+type AdminClient struct {
+	ID          string    `json:"id"`
+	Transport   string    `json:"transport"` // "websocket" or "sse"
+	Protocol    int       `json:"protocol"`
+	Encoding    string    `json:"encoding"`
+	ClientIP    string    `json:"clientIp"` // behind TRUSTED_PROXIES, the forwarded address
+	RequestID   string    `json:"requestId"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Session     string    `json:"session,omitempty"`  // first 8 characters of the session token
+	Detached    bool      `json:"detached,omitempty"` // lost its connection, waiting to be resumed
+	Tickers     []string  `json:"tickers"`
+	Watchlists  []string  `json:"watchlists,omitempty"`
+	Portfolios  []string  `json:"portfolios,omitempty"`
+
+	SendBuffered   int        `json:"sendBuffered"`   // messages waiting in the send buffer
+	SendBufferSize int        `json:"sendBufferSize"` // WS_CLIENT_SEND_BUFFER
+	PendingUpdates int        `json:"pendingUpdates"` // conflated quote updates not yet written
+	BehindSince    *time.Time `json:"behindSince"`    // null while keeping up
+}
+
+// PollingStatus is the state of the hub's poll loop.
+type PollingStatus struct {
+	Paused           bool       `json:"paused"`
+	PausedAt         *time.Time `json:"pausedAt"`
+	PollInterval     string     `json:"pollInterval"`
+	LastPollCycle    time.Time  `json:"lastPollCycle"`
+	LastPollDuration string     `json:"lastPollDuration"`
+}
+
+// adminTickers lists the tracked tickers, sorted.
+func (h *Hub) adminTickers() []AdminTicker {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	tickers := make([]AdminTicker, 0, len(h.store))
+	for t, e := range h.store {
+		at := AdminTicker{
+			Ticker:         t,
+			Type:           "crypto",
+			HasData:        e.StockData != nil || e.CryptoData != nil,
+			LastUpdated:    e.LastUpdated,
+			Stale:          e.Stale,
+			Seq:            e.Seq,
+			Subscribers:    len(h.subscribers[t]),
+			ScrapeErrors:   e.scrapeErrors,
+			FailuresInARow: e.failures,
+		}
+		switch {
+		case e.IsIndex:
+			at.Type = "index"
+		case e.IsStock:
+			at.Type = "stock"
+		}
+		if !e.lastScrapeError.IsZero() {
+			last := e.lastScrapeError
+			at.LastScrapeError = &last
+		}
+		for owner, pinned := range h.pins {
+			if _, ok := pinned[t]; ok {
+				at.PinnedBy = append(at.PinnedBy, owner)
+			}
+		}
+		sort.Strings(at.PinnedBy)
+		tickers = append(tickers, at)
+	}
+	sort.Slice(tickers, func(i, j int) bool { return tickers[i].Ticker < tickers[j].Ticker })
+	return tickers
+}
+
+// adminClients lists the connected and detached clients, oldest first.
+func (h *Hub) adminClients() []AdminClient {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]AdminClient, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c.adminView())
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ConnectedAt.Before(clients[j].ConnectedAt) })
+	return clients
+}
+
+// adminView describes c. Caller must hold h.mu.
+func (c *Client) adminView() AdminClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ac := AdminClient{
+		ID:             c.id,
+		Transport:      "websocket",
+		Protocol:       c.protocol,
+		Encoding:       c.encoding.String(),
+		ClientIP:       c.remote,
+		RequestID:      c.requestID,
+		ConnectedAt:    c.connectedAt,
+		Detached:       c.detached,
+		Tickers:        sortedKeys(c.tickers),
+		Watchlists:     sortedKeys(c.watchlists),
+		Portfolios:     sortedKeys(c.portfolios),
+		SendBuffered:   len(c.send),
+		SendBufferSize: cap(c.send),
+		PendingUpdates: len(c.updates),
+	}
+	if c.conn == nil {
+		ac.Transport = "sse"
+	}
+	if c.session != nil {
+		ac.Session = c.session.token[:8]
+	}
+	if !c.behindSince.IsZero() {
+		behind := c.behindSince
+		ac.BehindSince = &behind
+	}
+	return ac
+}
+
+// disconnectClient drops the client with the given id for good, telling it
+// why: its session ends with it, so it can't be resumed. It reports whether
+// the client was found.
+func (h *Hub) disconnectClient(id, reason string) bool {
+	h.mu.Lock()
+	var c *Client
+	for cl := range h.clients {
+		if cl.id == id {
+			c = cl
+			break
+		}
+	}
+	if c == nil {
+		h.mu.Unlock()
+		return false
+	}
+	c.mu.Lock()
+	c.closeMsg = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	if s := c.session; s != nil {
+		delete(h.sessions, s.token)
+		s.mu.Lock()
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+		s.mu.Unlock()
+	}
+	c.mu.Unlock()
+	h.forgetClient(c)
+	h.mu.Unlock()
+
+	// With send closed, the write pump sends closeMsg and hangs up, and an
+	// SSE stream ends.
+	c.log.Info("client disconnected", "reason", reason)
+	return true
+}
+
+// pollingPaused reports whether polling is paused.
+func (h *Hub) pollingPaused() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.paused
+}
+
+// setPaused pauses or resumes polling.
+func (h *Hub) setPaused(paused bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.paused == paused {
+		return
+	}
+	h.paused = paused
+	if paused {
+		h.pausedAt = time.Now()
+		h.log.Warn("polling paused")
+	} else {
+		h.pausedAt = time.Time{}
+		h.log.Info("polling resumed")
+	}
+}
+
+// pollingStatus reports the state of the poll loop.
+func (h *Hub) pollingStatus() PollingStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status := PollingStatus{
+		Paused:           h.paused,
+		PollInterval:     h.cfg.PollInterval.String(),
+		LastPollCycle:    h.lastPoll,
+		LastPollDuration: h.pollTook.String(),
+	}
+	if h.paused {
+		at := h.pausedAt
+		status.PausedAt = &at
+	}
+	return status
+}
+
+// ---------------------------------------------------------------------------
+// REST handlers
+// ---------------------------------------------------------------------------
+
+// getTickers is the handler for GET /admin/tickers.
+func (a *Admin) getTickers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, a.hub.adminTickers())
+}
+
+// refreshTicker is the handler for POST /admin/tickers/{ticker}/refresh. It
+// scrapes a tracked ticker right away, even while polling is paused.
+func (a *Admin) refreshTicker(w http.ResponseWriter, r *http.Request) {
+	ticker := normalizeTicker(chi.URLParam(r, "ticker"))
+	a.hub.mu.RLock()
+	_, tracked := a.hub.store[ticker]
+	a.hub.mu.RUnlock()
+	if !tracked {
+		writeError(w, http.StatusNotFound, "Ticker '"+ticker+"' isn't tracked.")
+		return
+	}
+	// The scrape outlives the request; it only needs its logger.
+	ctx := context.WithoutCancel(r.Context())
+	a.hub.forceScrape(withLogger(ctx, loggerFrom(ctx).With("component", "admin")), ticker)
+	writeJSON(w, r, http.StatusAccepted, map[string]string{"ticker": ticker, "status": "refreshing"})
+}
+
+// getClients is the handler for GET /admin/clients.
+func (a *Admin) getClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, a.hub.adminClients())
+}
+
+// disconnectClient is the handler for DELETE /admin/clients/{id}.
+func (a *Admin) disconnectClient(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !a.hub.disconnectClient(id, "disconnected by an administrator") {
+		writeError(w, http.StatusNotFound, "No client with id '"+id+"'.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getPolling is the handler for GET /admin/polling.
+func (a *Admin) getPolling(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, a.hub.pollingStatus())
+}
+
+// pausePolling is the handler for POST /admin/polling/pause.
+func (a *Admin) pausePolling(w http.ResponseWriter, r *http.Request) {
+	a.hub.setPaused(true)
+	writeJSON(w, r, http.StatusOK, a.hub.pollingStatus())
+}
+
+// resumePolling is the handler for POST /admin/polling/resume. The next
+// poll cycle runs at the usual time.
+func (a *Admin) resumePolling(w http.ResponseWriter, r *http.Request) {
+	a.hub.setPaused(false)
+	writeJSON(w, r, http.StatusOK, a.hub.pollingStatus())
+}
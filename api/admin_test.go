@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// adminRequest sends a request to a's routes with the given bearer token.
+func adminRequest(a *Admin, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	a.Routes().ServeHTTP(rr, req)
+	return rr
+}
+
+func newTestAdmin(t *testing.T) (*Admin, *Hub) {
+	t.Helper()
+	h := newTestHub(t)
+	h.cfg.AdminToken = "s3cret"
+	keys, _ := NewAPIKeyStore("")
+	h.UseAPIKeys(keys)
+	return NewAdmin(h, keys, h.cfg), h
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	a, _ := newTestAdmin(t)
+	if rr := adminRequest(a, "GET", "/tickers", ""); rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("Expected 401 with a challenge without a token, got %d", rr.Code)
+	}
+	if rr := adminRequest(a, "GET", "/tickers", "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with the wrong token, got %d", rr.Code)
+	}
+	if rr := adminRequest(a, "GET", "/tickers", "s3cret"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with the token, got %d", rr.Code)
+	}
+
+	a.token = ""
+	if rr := adminRequest(a, "GET", "/tickers", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 while the admin API is disabled, got %d", rr.Code)
+	}
+}
+
+func TestAdminTickersAndClients(t *testing.T) {
+	a, h := newTestAdmin(t)
+	c := newClient(h, nil, 2)
+	c.tickers["TSLA:NASDAQ"] = struct{}{}
+	c.send <- []byte("{}")
+	h.clients[c] = struct{}{}
+	h.store["TSLA:NASDAQ"] = &StockEntry{Ticker: "TSLA:NASDAQ", IsStock: true, StockData: &Stock_Key_Stats{Name: "Tesla Inc"}, Seq: 3}
+	h.store["NOPE:NASDAQ"] = &StockEntry{Ticker: "NOPE:NASDAQ", IsStock: true}
+	h.subscribers["TSLA:NASDAQ"] = map[*Client]struct{}{c: {}}
+	h.pins["alerts"] = map[string]struct{}{"TSLA:NASDAQ": {}}
+	h.scrapeFailed("TSLA:NASDAQ")
+	h.scrapeFailed("NOPE:NASDAQ")
+
+	var tickers []AdminTicker
+	json.Unmarshal(adminRequest(a, "GET", "/tickers", "s3cret").Body.Bytes(), &tickers)
+	if len(tickers) != 2 || tickers[0].Ticker != "NOPE:NASDAQ" || tickers[1].Ticker != "TSLA:NASDAQ" {
+		t.Fatalf("Expected both tickers, sorted, got %+v", tickers)
+	}
+	nope, tsla := tickers[0], tickers[1]
+	if nope.HasData || nope.ScrapeErrors != 1 || nope.FailuresInARow != 1 || nope.LastScrapeError == nil {
+		t.Errorf("Unexpected entry for the ticker without data: %+v", nope)
+	}
+	if !tsla.HasData || tsla.Type != "stock" || tsla.Subscribers != 1 || tsla.Seq != 3 ||
+		tsla.ScrapeErrors != 1 || tsla.FailuresInARow != 0 || len(tsla.PinnedBy) != 1 || tsla.PinnedBy[0] != "alerts" {
+		t.Errorf("Unexpected entry for TSLA:NASDAQ: %+v", tsla)
+	}
+
+	var clients []AdminClient
+	json.Unmarshal(adminRequest(a, "GET", "/clients", "s3cret").Body.Bytes(), &clients)
+	if len(clients) != 1 {
+		t.Fatalf("Expected one client, got %+v", clients)
+	}
+	if got := clients[0]; got.ID != c.id || got.Transport != "sse" || len(got.Tickers) != 1 ||
+		got.SendBuffered != 1 || got.SendBufferSize != h.cfg.WSClientSendBuffer {
+		t.Errorf("Unexpected client %+v", got)
+	}
+}
+
+func TestAdminDisconnectClient(t *testing.T) {
+	a, h := newTestAdmin(t)
+	conn := dialTestHub(t, h, subprotocolV2)
+	token := conn.readType(t, "session").Data.(map[string]interface{})["session"].(string)
+
+	clients := h.adminClients()
+	if len(clients) != 1 || clients[0].Transport != "websocket" || clients[0].Session != token[:8] {
+		t.Fatalf("Expected the WebSocket client, got %+v", clients)
+	}
+	if rr := adminRequest(a, "DELETE", "/clients/nope", "s3cret"); rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown client, got %d", rr.Code)
+	}
+	if rr := adminRequest(a, "DELETE", "/clients/"+clients[0].ID, "s3cret"); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rr.Code)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Fatalf("Expected a policy violation close, got %v", err)
+			}
+			break
+		}
+	}
+	h.mu.RLock()
+	_, resumable := h.sessions[token]
+	n := len(h.clients)
+	h.mu.RUnlock()
+	if resumable || n != 0 {
+		t.Fatalf("Expected the client and its session to be gone, got %d clients, session kept: %v", n, resumable)
+	}
+}
+
+func TestAdminPausePolling(t *testing.T) {
+	a, h := newTestAdmin(t)
+	var status PollingStatus
+	json.Unmarshal(adminRequest(a, "POST", "/polling/pause", "s3cret").Body.Bytes(), &status)
+	if !status.Paused || status.PausedAt == nil {
+		t.Fatalf("Expected polling to be paused, got %+v", status)
+	}
+
+	// On-demand scrapes are skipped too, but liveness holds.
+	h.scrapeNow(t.Context(), "TSLA:NASDAQ")
+	if n := len(h.sem); n != 0 {
+		t.Fatalf("Expected no scrape while paused, %d running", n)
+	}
+	h.lastPoll = time.Now().Add(-2 * h.cfg.HealthStallTimeout)
+	if st, ok := NewHealth(h, h.cfg).Status(false); !ok || !st.PollingPaused {
+		t.Fatalf("Expected a paused poll loop to be live, got %+v", st)
+	}
+
+	// Unknown tickers can't be refreshed.
+	if rr := adminRequest(a, "POST", "/tickers/TSLA:NASDAQ/refresh", "s3cret"); rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 refreshing an untracked ticker, got %d", rr.Code)
+	}
+
+	json.Unmarshal(adminRequest(a, "POST", "/polling/resume", "s3cret").Body.Bytes(), &status)
+	if status.Paused || status.PausedAt != nil {
+		t.Fatalf("Expected polling to be resumed, got %+v", status)
+	}
+}
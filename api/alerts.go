@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ---------------------------------------------------------------------------
+// Price alerts – rules evaluated on every ticker change
+// ---------------------------------------------------------------------------
+
+// Supported alert rule types.
+const (
+	alertPriceAbove  = "price_above"  // price >= threshold
+	alertPriceBelow  = "price_below"  // price <= threshold
+	alertChangeAbove = "change_above" // % change since previous close >= threshold
+	alertChangeBelow = "change_below" // % change since previous close <= threshold
+	alertYearHigh    = "year_high"    // price reaches the 52-week high
+	alertYearLow     = "year_low"     // price reaches the 52-week low
+	alertVolumeSpike = "volume_spike" // volume traded between polls >= threshold × its running average
+)
+
+var alertTypes = map[string]bool{
+	alertPriceAbove:  true,
+	alertPriceBelow:  true,
+	alertChangeAbove: true,
+	alertChangeBelow: true,
+	alertYearHigh:    true,
+	alertYearLow:     true,
+	alertVolumeSpike: true,
+}
+
+// AlertRule is a user-defined condition on one ticker.
+//
+// A rule fires when its condition becomes true, then disarms. It re-arms once
+// the value has moved back past the threshold by Hysteresis (in the
+// threshold's units) and fires again no sooner than CooldownSeconds after
+// the previous alert. CooldownSeconds defaults to the engine's cooldown when
+// omitted; 0 means none.
+type AlertRule struct {
+	ID              string    `json:"id"`
+	Ticker          string    `json:"ticker"`
+	Type            string    `json:"type"`
+	Threshold       float64   `json:"threshold"`
+	Hysteresis      float64   `json:"hysteresis"`
+	CooldownSeconds *int      `json:"cooldownSeconds"`
+	CreatedAt       time.Time `json:"createdAt"`
+
+	// Evaluation state, persisted so restarts don't re-fire alerts.
+	Armed     bool      `json:"armed"`
+	LastFired time.Time `json:"lastFired,omitempty"`
+}
+
+// AlertEvent is the payload of an "alert" ServerMessage.
+type AlertEvent struct {
+	RuleID    string    `json:"ruleId"`
+	Ticker    string    `json:"ticker"`
+	Type      string    `json:"type"`
+	Threshold float64   `json:"threshold"`
+	Value     float64   `json:"value"` // the observed value that crossed the threshold
+	Price     float64   `json:"price"`
+	Message   string    `json:"message"`
+	FiredAt   time.Time `json:"firedAt"`
+}
+
+// alertInputs are the values a rule is evaluated against.
+type alertInputs struct {
+	price         float64
+	changePercent float64
+	yearLow       float64
+	yearHigh      float64
+	hasYearRange  bool
+	volumeDelta   float64
+	volumeAvg     float64
+	hasVolume     bool
+}
+
+// evaluate reports the value the rule looks at, whether its condition
+// holds, and whether the value is far enough back to re-arm the rule.
+func (r *AlertRule) evaluate(in alertInputs) (value float64, hit, rearm, ok bool) {
+	switch r.Type {
+	case alertPriceAbove:
+		return in.price, in.price >= r.Threshold, in.price < r.Threshold-r.Hysteresis, true
+	case alertPriceBelow:
+		return in.price, in.price <= r.Threshold, in.price > r.Threshold+r.Hysteresis, true
+	case alertChangeAbove:
+		v := in.changePercent
+		return v, v >= r.Threshold, v < r.Threshold-r.Hysteresis, true
+	case alertChangeBelow:
+		v := in.changePercent
+		return v, v <= r.Threshold, v > r.Threshold+r.Hysteresis, true
+	case alertYearHigh:
+		if !in.hasYearRange {
+			return 0, false, false, false
+		}
+		return in.price, in.price >= in.yearHigh, in.price < in.yearHigh-r.Hysteresis, true
+	case alertYearLow:
+		if !in.hasYearRange {
+			return 0, false, false, false
+		}
+		return in.price, in.price <= in.yearLow, in.price > in.yearLow+r.Hysteresis, true
+	case alertVolumeSpike:
+		if !in.hasVolume || in.volumeAvg <= 0 {
+			return 0, false, false, false
+		}
+		ratio := in.volumeDelta / in.volumeAvg
+		return ratio, ratio >= r.Threshold, ratio < r.Threshold-r.Hysteresis, true
+	}
+	return 0, false, false, false
+}
+
+func (r *AlertRule) describe(value float64) string {
+	switch r.Type {
+	case alertPriceAbove:
+		return fmt.Sprintf("%s price %.2f is at or above %.2f", r.Ticker, value, r.Threshold)
+	case alertPriceBelow:
+		return fmt.Sprintf("%s price %.2f is at or below %.2f", r.Ticker, value, r.Threshold)
+	case alertChangeAbove:
+		return fmt.Sprintf("%s is up %.2f%% since previous close (threshold %.2f%%)", r.Ticker, value, r.Threshold)
+	case alertChangeBelow:
+		return fmt.Sprintf("%s is %.2f%% since previous close (threshold %.2f%%)", r.Ticker, value, r.Threshold)
+	case alertYearHigh:
+		return fmt.Sprintf("%s reached its 52-week high at %.2f", r.Ticker, value)
+	case alertYearLow:
+		return fmt.Sprintf("%s reached its 52-week low at %.2f", r.Ticker, value)
+	case alertVolumeSpike:
+		return fmt.Sprintf("%s volume spike: %.1fx the average", r.Ticker, value)
+	}
+	return r.Ticker + " alert"
+}
+
+// parseRange splits Google's "$214.25 - $498.82" style ranges into numbers.
+func parseRange(s string) (low, high float64, ok bool) {
+	parts := strings.SplitN(s, " - ", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	low, okLow := parsePrice(parts[0])
+	high, okHigh := parsePrice(parts[1])
+	return low, high, okLow && okHigh
+}
+
+// parsePrice parses a price string, ignoring thousands separators and any
+// leading currency symbol.
+func parsePrice(s string) (float64, bool) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", "")
+	s = strings.TrimLeftFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9') && r != '.' && r != '-'
+	})
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
+
+// ---------------------------------------------------------------------------
+// AlertEngine – rule storage and evaluation
+// ---------------------------------------------------------------------------
+
+var (
+	errAlertNotFound = errors.New("alert rule not found")
+	errInvalidAlert  = errors.New("invalid alert rule") // wrapped with the reason
+)
+
+// alertFile is the on-disk format of the alert rules.
+type alertFile struct {
+	Rules []*AlertRule `json:"rules"`
+}
+
+// volumeState tracks the running average of per-poll volume for a ticker.
+type volumeState struct {
+	last float64 // cumulative volume at the previous poll
+	avg  float64 // exponential moving average of per-poll deltas
+	n    int
+}
+
+// AlertEngine stores alert rules and evaluates them against quote changes.
+type AlertEngine struct {
+	mu              sync.Mutex
+	path            string
+	rules           map[string]*AlertRule
+	volumes         map[string]*volumeState
+	defaultCooldown time.Duration
+	listeners       []func(ev AlertEvent)
+	rulesChanged    func(tickers []string)
+
+	// dirty is set when evaluation changed a rule's state since the last
+	// save; Flush writes it out.
+	dirty bool
+}
+
+// NewAlertEngine loads rules from path. An empty path keeps rules in memory
+// only.
+func NewAlertEngine(path string, defaultCooldown time.Duration) (*AlertEngine, error) {
+	e := &AlertEngine{
+		path:            path,
+		rules:           make(map[string]*AlertRule),
+		volumes:         make(map[string]*volumeState),
+		defaultCooldown: defaultCooldown,
+	}
+	if path == "" {
+		return e, nil
+	}
+
+	var file alertFile
+	if _, err := readJSONFile(path, &file); err != nil {
+		return e, err
+	}
+	for _, r := range file.Rules {
+		if r != nil && r.ID != "" {
+			e.rules[r.ID] = r
+		}
+	}
+	slog.Info("loaded rules", "component", "alerts", "rules", len(e.rules))
+	return e, nil
+}
+
+// OnAlert registers fn to be called for every alert that fires.
+func (e *AlertEngine) OnAlert(fn func(ev AlertEvent)) {
+	e.mu.Lock()
+	e.listeners = append(e.listeners, fn)
+	e.mu.Unlock()
+}
+
+// List returns copies of all rules, optionally filtered by ticker, oldest
+// first.
+func (e *AlertEngine) List(ticker string) []AlertRule {
+	ticker = normalizeTicker(ticker)
+	e.mu.Lock()
+	out := make([]AlertRule, 0, len(e.rules))
+	for _, r := range e.rules {
+		if ticker == "" || r.Ticker == ticker {
+			out = append(out, *r)
+		}
+	}
+	e.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// Get returns a copy of the rule with the given id.
+func (e *AlertEngine) Get(id string) (AlertRule, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	r, ok := e.rules[id]
+	if !ok {
+		return AlertRule{}, false
+	}
+	return *r, true
+}
+
+// Tickers returns every ticker that has at least one rule.
+func (e *AlertEngine) Tickers() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	seen := make(map[string]struct{})
+	var out []string
+	for _, r := range e.rules {
+		if _, ok := seen[r.Ticker]; !ok {
+			seen[r.Ticker] = struct{}{}
+			out = append(out, r.Ticker)
+		}
+	}
+	return out
+}
+
+// Create validates and stores a new rule.
+func (e *AlertEngine) Create(r AlertRule) (AlertRule, error) {
+	r.Ticker = normalizeTicker(r.Ticker)
+	if r.Ticker == "" {
+		return AlertRule{}, fmt.Errorf("%w: ticker must not be empty", errInvalidAlert)
+	}
+	if !alertTypes[r.Type] {
+		return AlertRule{}, fmt.Errorf("%w: unknown alert type '%s'", errInvalidAlert, r.Type)
+	}
+	if r.Type == alertVolumeSpike && r.Threshold <= 0 {
+		return AlertRule{}, fmt.Errorf("%w: volume_spike needs a positive threshold (multiple of average volume)", errInvalidAlert)
+	}
+	if r.Hysteresis < 0 || (r.CooldownSeconds != nil && *r.CooldownSeconds < 0) {
+		return AlertRule{}, fmt.Errorf("%w: hysteresis and cooldownSeconds must not be negative", errInvalidAlert)
+	}
+	if r.CooldownSeconds == nil {
+		seconds := int(e.defaultCooldown / time.Second)
+		r.CooldownSeconds = &seconds
+	}
+	r.ID = newID()
+	r.CreatedAt = time.Now()
+	r.Armed = true
+	r.LastFired = time.Time{}
+
+	e.mu.Lock()
+	e.rules[r.ID] = &r
+	if err := e.saveLocked(); err != nil {
+		delete(e.rules, r.ID)
+		e.mu.Unlock()
+		return AlertRule{}, err
+	}
+	e.mu.Unlock()
+
+	e.notifyRulesChanged()
+	return r, nil
+}
+
+// Delete removes a rule.
+func (e *AlertEngine) Delete(id string) error {
+	e.mu.Lock()
+	cur, ok := e.rules[id]
+	if !ok {
+		e.mu.Unlock()
+		return errAlertNotFound
+	}
+	delete(e.rules, id)
+	if err := e.saveLocked(); err != nil {
+		e.rules[id] = cur
+		e.mu.Unlock()
+		return err
+	}
+	e.mu.Unlock()
+
+	e.notifyRulesChanged()
+	return nil
+}
+
+// Evaluate checks every rule for entry's ticker and returns the alerts that
+// fired. Listeners are notified of each one. Changed rule state is only
+// marked dirty, to be written by the next Flush.
+func (e *AlertEngine) Evaluate(entry StockEntry) []AlertEvent {
+	in, ok := e.inputs(entry)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	var fired []AlertEvent
+	e.mu.Lock()
+	dirty := false
+	for _, r := range e.rules {
+		if r.Ticker != entry.Ticker {
+			continue
+		}
+		value, hit, rearm, ok := r.evaluate(in)
+		if !ok {
+			continue
+		}
+		if !r.Armed {
+			if rearm {
+				r.Armed = true
+				dirty = true
+			}
+			continue
+		}
+		var cooldown time.Duration
+		if r.CooldownSeconds != nil {
+			cooldown = time.Duration(*r.CooldownSeconds) * time.Second
+		}
+		if !hit || now.Sub(r.LastFired) < cooldown {
+			continue
+		}
+
+		r.Armed = false
+		r.LastFired = now
+		dirty = true
+		fired = append(fired, AlertEvent{
+			RuleID:    r.ID,
+			Ticker:    r.Ticker,
+			Type:      r.Type,
+			Threshold: r.Threshold,
+			Value:     value,
+			Price:     in.price,
+			Message:   r.describe(value),
+			FiredAt:   now,
+		})
+	}
+	if dirty {
+		e.dirty = true
+	}
+	listeners := append([]func(AlertEvent){}, e.listeners...)
+	e.mu.Unlock()
+
+	for _, ev := range fired {
+		for _, fn := range listeners {
+			fn(ev)
+		}
+	}
+	return fired
+}
+
+// inputs extracts the values rules are evaluated against, updating the
+// ticker's running volume average along the way.
+func (e *AlertEngine) inputs(entry StockEntry) (alertInputs, bool) {
+	var in alertInputs
+	switch {
+	case entry.StockData != nil:
+		d := entry.StockData
+		in.price = float64(d.Price)
+		in.changePercent = float64(d.ChangePercent)
+		in.yearLow, in.yearHigh, in.hasYearRange = parseRange(d.YearRange)
+
+		if vol := parseVolume(d.Volume); vol > 0 {
+			e.mu.Lock()
+			vs, ok := e.volumes[entry.Ticker]
+			if !ok {
+				vs = &volumeState{last: vol}
+				e.volumes[entry.Ticker] = vs
+			} else {
+				delta := vol - vs.last
+				if delta < 0 {
+					delta = vol // new trading day
+				}
+				vs.last = vol
+				// The average excludes the current delta so a spike
+				// doesn't dilute its own baseline.
+				in.volumeDelta = delta
+				in.volumeAvg = vs.avg
+				in.hasVolume = vs.n >= 3
+				const alpha = 0.2
+				if vs.n == 0 {
+					vs.avg = delta
+				} else {
+					vs.avg = alpha*delta + (1-alpha)*vs.avg
+				}
+				vs.n++
+			}
+			e.mu.Unlock()
+		}
+	case entry.CryptoData != nil:
+		in.price = float64(entry.CryptoData.Price)
+		in.changePercent = float64(entry.CryptoData.ChangePercent)
+	default:
+		return in, false
+	}
+	return in, true
+}
+
+// Flush writes the rules to disk if evaluation changed them since the last
+// save.
+func (e *AlertEngine) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.dirty {
+		return nil
+	}
+	return e.saveLocked()
+}
+
+// saveLocked writes the rules to disk and clears dirty. Caller must hold
+// e.mu.
+func (e *AlertEngine) saveLocked() error {
+	if e.path == "" {
+		e.dirty = false
+		return nil
+	}
+	file := alertFile{Rules: make([]*AlertRule, 0, len(e.rules))}
+	for _, r := range e.rules {
+		file.Rules = append(file.Rules, r)
+	}
+	if err := writeJSONFile(e.path, file); err != nil {
+		slog.Error("save failed", "component", "alerts", "error", err)
+		return err
+	}
+	e.dirty = false
+	return nil
+}
+
+func (e *AlertEngine) notifyRulesChanged() {
+	if e.rulesChanged != nil {
+		e.rulesChanged(e.Tickers())
+	}
+}
+
+// ---------------------------------------------------------------------------
+// REST handlers
+// ---------------------------------------------------------------------------
+
+func (e *AlertEngine) getAlerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, e.List(r.URL.Query().Get("ticker")))
+}
+
+func (e *AlertEngine) createAlert(w http.ResponseWriter, r *http.Request) {
+	var req AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Expected JSON body with 'ticker', 'type', 'threshold' and optional 'hysteresis' and 'cooldownSeconds'.")
+		return
+	}
+
+	rule, err := e.Create(req)
+	if errors.Is(err, errInvalidAlert) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not save alert rules.")
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, rule)
+}
+
+func (e *AlertEngine) getAlert(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	rule, ok := e.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No alert rule found with id '%s'.", id))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, rule)
+}
+
+func (e *AlertEngine) deleteAlert(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := e.Delete(id)
+	if errors.Is(err, errAlertNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No alert rule found with id '%s'.", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not save alert rules.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ---------------------------------------------------------------------------
+// Hub integration
+// ---------------------------------------------------------------------------
+
+// UseAlerts evaluates the engine's rules on every ticker change, keeps every
+// ticker with a rule polled, and delivers fired alerts to the ticker's
+// WebSocket subscribers.
+func (h *Hub) UseAlerts(e *AlertEngine) {
+	h.alerts = e
+	e.rulesChanged = func(tickers []string) { h.Pin("alerts", tickers) }
+	h.Pin("alerts", e.Tickers())
+
+	e.OnAlert(func(ev AlertEvent) {
+		h.log.Info("alert fired", "rule", ev.RuleID, "ticker", ev.Ticker, "message", ev.Message)
+		h.broadcast(ev.Ticker, ServerMessage{
+			Type:      "alert",
+			Ticker:    ev.Ticker,
+			Data:      ev,
+			Timestamp: ev.FiredAt,
+		})
+	})
+
+	h.OnChange(func(entry StockEntry) {
+		e.Evaluate(entry)
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func stockEntry(ticker string, price float32) StockEntry {
+	return StockEntry{
+		Ticker:    ticker,
+		IsStock:   true,
+		StockData: &Stock_Key_Stats{Name: ticker, Price: price, YearRange: "$214.25 - $498.82"},
+	}
+}
+
+func TestAlertHysteresis(t *testing.T) {
+	e, _ := NewAlertEngine("", time.Minute)
+	oneSecond := 1
+	rule, err := e.Create(AlertRule{Ticker: "tsla:nasdaq", Type: alertPriceAbove, Threshold: 400, Hysteresis: 5, CooldownSeconds: &oneSecond})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	if fired := e.Evaluate(stockEntry("TSLA:NASDAQ", 395)); len(fired) != 0 {
+		t.Fatalf("Expected no alert below threshold, got %v", fired)
+	}
+	if fired := e.Evaluate(stockEntry("TSLA:NASDAQ", 401)); len(fired) != 1 || fired[0].RuleID != rule.ID {
+		t.Fatalf("Expected the rule to fire when crossing 400, got %v", fired)
+	}
+	if fired := e.Evaluate(stockEntry("TSLA:NASDAQ", 402)); len(fired) != 0 {
+		t.Fatal("Expected the rule not to re-fire while still above the threshold")
+	}
+
+	// Dipping inside the hysteresis band doesn't re-arm the rule.
+	e.Evaluate(stockEntry("TSLA:NASDAQ", 397))
+	if r, _ := e.Get(rule.ID); r.Armed {
+		t.Fatal("Expected the rule to stay disarmed inside the hysteresis band")
+	}
+	e.Evaluate(stockEntry("TSLA:NASDAQ", 394))
+	if r, _ := e.Get(rule.ID); !r.Armed {
+		t.Fatal("Expected the rule to re-arm once past the hysteresis band")
+	}
+
+	// Re-armed, but still cooling down.
+	if fired := e.Evaluate(stockEntry("TSLA:NASDAQ", 401)); len(fired) != 0 {
+		t.Fatal("Expected the cooldown to suppress the alert")
+	}
+}
+
+func TestAlertYearHighAndValidation(t *testing.T) {
+	e, _ := NewAlertEngine("", time.Minute)
+	e.Create(AlertRule{Ticker: "TSLA:NASDAQ", Type: alertYearHigh})
+
+	if fired := e.Evaluate(stockEntry("TSLA:NASDAQ", 450)); len(fired) != 0 {
+		t.Fatal("Expected no alert below the 52-week high")
+	}
+	if fired := e.Evaluate(stockEntry("TSLA:NASDAQ", 499)); len(fired) != 1 {
+		t.Fatal("Expected an alert at a new 52-week high")
+	}
+
+	if _, err := e.Create(AlertRule{Ticker: "TSLA:NASDAQ", Type: "moon"}); err == nil {
+		t.Fatal("Expected unknown alert types to be rejected")
+	}
+}
+
+func TestAlertVolumeSpike(t *testing.T) {
+	e, _ := NewAlertEngine("", time.Minute)
+	e.Create(AlertRule{Ticker: "TSLA:NASDAQ", Type: alertVolumeSpike, Threshold: 3})
+
+	volume := func(v string) StockEntry {
+		entry := stockEntry("TSLA:NASDAQ", 400)
+		entry.StockData.Volume = v
+		return entry
+	}
+
+	// Steady 1K per poll builds the baseline.
+	for _, v := range []string{"10K", "11K", "12K", "13K", "14K"} {
+		if fired := e.Evaluate(volume(v)); len(fired) != 0 {
+			t.Fatalf("Expected no alert for steady volume at %s", v)
+		}
+	}
+	if fired := e.Evaluate(volume("19K")); len(fired) != 1 {
+		t.Fatal("Expected an alert for a 5x volume jump")
+	}
+}
+
+func TestAlertStateFlushedLater(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.json")
+	e, _ := NewAlertEngine(path, time.Minute)
+	none := 0
+	rule, _ := e.Create(AlertRule{Ticker: "TSLA:NASDAQ", Type: alertPriceAbove, Threshold: 400, CooldownSeconds: &none})
+
+	e.Evaluate(stockEntry("TSLA:NASDAQ", 401))
+	if saved, _ := NewAlertEngine(path, time.Minute); !mustGet(t, saved, rule.ID).Armed {
+		t.Fatal("Expected evaluation not to write the rules")
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if saved, _ := NewAlertEngine(path, time.Minute); mustGet(t, saved, rule.ID).Armed {
+		t.Fatal("Expected Flush to write the disarmed rule")
+	}
+
+	// Without a cooldown, the rule fires again as soon as it re-arms.
+	e.Evaluate(stockEntry("TSLA:NASDAQ", 390))
+	if fired := e.Evaluate(stockEntry("TSLA:NASDAQ", 401)); len(fired) != 1 {
+		t.Fatalf("Expected a rule with a zero cooldown to fire again, got %v", fired)
+	}
+	if r, _ := e.Create(AlertRule{Ticker: "TSLA:NASDAQ", Type: alertPriceAbove, Threshold: 500}); *r.CooldownSeconds != 60 {
+		t.Fatalf("Expected an omitted cooldown to default to the engine's, got %d", *r.CooldownSeconds)
+	}
+}
+
+func TestCreateAlertStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.json")
+	e, _ := NewAlertEngine(path, time.Minute)
+	e.Create(AlertRule{Ticker: "TSLA:NASDAQ", Type: alertPriceAbove, Threshold: 400})
+	e.path = filepath.Join(path, "unwritable.json") // its directory is a file
+
+	for body, status := range map[string]int{
+		`{"ticker": "TSLA:NASDAQ", "type": "nope"}`:                        http.StatusBadRequest,
+		`{"ticker": "TSLA:NASDAQ", "type": "price_above", "threshold": 1}`: http.StatusInternalServerError,
+	} {
+		rr := httptest.NewRecorder()
+		e.createAlert(rr, httptest.NewRequest("POST", "/alerts", strings.NewReader(body)))
+		if rr.Code != status {
+			t.Errorf("%s: expected %d, got %d", body, status, rr.Code)
+		}
+	}
+}
+
+func mustGet(t *testing.T, e *AlertEngine, id string) AlertRule {
+	t.Helper()
+	r, ok := e.Get(id)
+	if !ok {
+		t.Fatalf("Rule %s not found", id)
+	}
+	return r
+}
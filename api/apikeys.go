@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httprate"
+)
+
+// ---------------------------------------------------------------------------
+// API keys – per-key quotas, subscription limits and allowed routes
+// ---------------------------------------------------------------------------
+
+// A request may carry an API key in the X-API-Key header, or for /ws and
+// /stream, whose browser clients can't set headers, in the api_key query
+// parameter. A keyed request is rate limited on its key's own quota instead
+// of its IP's. Without API_KEYS_REQUIRED, requests without a key are still
+// served, limited by IP as before. Keys are created, listed and revoked
+// through the admin API; only a hash of each key is stored.
+
+// APIKey is a key's settings. The key itself is only shown once, when it's
+// created.
+type APIKey struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"` // first characters of the key, to tell keys apart
+	Hash   string `json:"hash"`   // hex SHA-256 of the key
+
+	// RequestLimit is the key's requests per RATE_LIMIT_WINDOW; 0 uses
+	// RATE_LIMIT_REQUESTS.
+	RequestLimit int `json:"requestLimit"`
+	// MaxSubscriptions caps the distinct tickers subscribed to across all
+	// of the key's WebSocket and /stream clients; 0 is unlimited.
+	MaxSubscriptions int `json:"maxSubscriptions"`
+	// Routes are the path prefixes the key may use, e.g. "/stocks" or
+	// "/ws"; empty allows every route.
+	Routes []string `json:"routes,omitempty"`
+
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// APIKeyView is a key as the admin API lists it.
+type APIKeyView struct {
+	ID               string     `json:"id"`
+	Name             string     `json:"name"`
+	Prefix           string     `json:"prefix"`
+	RequestLimit     int        `json:"requestLimit"`
+	MaxSubscriptions int        `json:"maxSubscriptions"`
+	Routes           []string   `json:"routes,omitempty"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	Requests         uint64     `json:"requests"` // since the server started
+}
+
+// apiKeyFile is the on-disk format of the key store.
+type apiKeyFile struct {
+	Keys []*APIKey `json:"keys"`
+}
+
+var (
+	errAPIKeyNotFound = errors.New("API key not found")
+	errAPIKeyRevoked  = errors.New("API key already revoked")
+)
+
+// apiKeyPrefix starts every key, so a leaked one is easy to recognise.
+const apiKeyPrefix = "stonks_"
+
+// APIKeyStore keeps API keys in memory and writes every change through to a
+// JSON file.
+type APIKeyStore struct {
+	mu     sync.RWMutex
+	path   string
+	keys   map[string]*APIKey // by id
+	byHash map[string]*APIKey
+
+	// requests counts each key's requests since the server started, by id
+	requests map[string]*atomic.Uint64
+
+	// revoked is called with the id of a key after it's revoked
+	revoked func(id string)
+}
+
+// NewAPIKeyStore loads the store from path. An empty path keeps the store
+// in memory only.
+func NewAPIKeyStore(path string) (*APIKeyStore, error) {
+	s := &APIKeyStore{
+		path:     path,
+		keys:     make(map[string]*APIKey),
+		byHash:   make(map[string]*APIKey),
+		requests: make(map[string]*atomic.Uint64),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	var file apiKeyFile
+	if _, err := readJSONFile(path, &file); err != nil {
+		return s, err
+	}
+	for _, k := range file.Keys {
+		if k != nil && k.ID != "" && k.Hash != "" {
+			s.keys[k.ID] = k
+			s.byHash[k.Hash] = k
+			s.requests[k.ID] = new(atomic.Uint64)
+		}
+	}
+	slog.Info("loaded API keys", "component", "apikeys", "keys", len(s.keys))
+	return s, nil
+}
+
+// hashAPIKey returns the hex SHA-256 of key. Keys are random, so a fast
+// hash is enough.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create adds a key with spec's settings and returns it along with the key
+// itself, which isn't stored.
+func (s *APIKeyStore) Create(spec APIKey) (APIKeyView, string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return APIKeyView{}, "", err
+	}
+	secret := apiKeyPrefix + hex.EncodeToString(b)
+
+	k := &APIKey{
+		ID:               newID(),
+		Name:             strings.TrimSpace(spec.Name),
+		Prefix:           secret[:len(apiKeyPrefix)+6],
+		Hash:             hashAPIKey(secret),
+		RequestLimit:     spec.RequestLimit,
+		MaxSubscriptions: spec.MaxSubscriptions,
+		Routes:           spec.Routes,
+		CreatedAt:        time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+	s.byHash[k.Hash] = k
+	if err := s.saveLocked(); err != nil {
+		delete(s.keys, k.ID)
+		delete(s.byHash, k.Hash)
+		return APIKeyView{}, "", err
+	}
+	s.requests[k.ID] = new(atomic.Uint64)
+	return s.viewLocked(k), secret, nil
+}
+
+// List returns every key, revoked ones included, oldest first.
+func (s *APIKeyStore) List() []APIKeyView {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]APIKeyView, 0, len(s.keys))
+	for _, k := range s.keys {
+		out = append(out, s.viewLocked(k))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// Revoke stops key id from being accepted and disconnects its clients. The
+// key stays listed, marked revoked.
+func (s *APIKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	k, ok := s.keys[id]
+	if !ok {
+		s.mu.Unlock()
+		return errAPIKeyNotFound
+	}
+	if k.RevokedAt != nil {
+		s.mu.Unlock()
+		return errAPIKeyRevoked
+	}
+	now := time.Now().UTC()
+	k.RevokedAt = &now
+	if err := s.saveLocked(); err != nil {
+		k.RevokedAt = nil
+		s.mu.Unlock()
+		return err
+	}
+	revoked := s.revoked
+	s.mu.Unlock()
+
+	slog.Info("API key revoked", "component", "apikeys", "api_key", id)
+	if revoked != nil {
+		revoked(id)
+	}
+	return nil
+}
+
+// lookup returns the key whose hash matches secret, revoked or not.
+func (s *APIKeyStore) lookup(secret string) (*APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.byHash[hashAPIKey(secret)]
+	if !ok {
+		return nil, false
+	}
+	cp := *k
+	return &cp, true
+}
+
+func (s *APIKeyStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	file := apiKeyFile{Keys: make([]*APIKey, 0, len(s.keys))}
+	for _, k := range s.keys {
+		file.Keys = append(file.Keys, k)
+	}
+	if err := writeJSONFile(s.path, file); err != nil {
+		slog.Error("save failed", "component", "apikeys", "error", err)
+		return err
+	}
+	return nil
+}
+
+// viewLocked returns k without its hash. Caller must hold s.mu.
+func (s *APIKeyStore) viewLocked(k *APIKey) APIKeyView {
+	return APIKeyView{
+		ID:               k.ID,
+		Name:             k.Name,
+		Prefix:           k.Prefix,
+		RequestLimit:     k.RequestLimit,
+		MaxSubscriptions: k.MaxSubscriptions,
+		Routes:           k.Routes,
+		CreatedAt:        k.CreatedAt,
+		RevokedAt:        k.RevokedAt,
+		Requests:         s.requests[k.ID].Load(),
+	}
+}
+
+// allows reports whether the key may use path.
+func (k *APIKey) allows(path string) bool {
+	if len(k.Routes) == 0 {
+		return true
+	}
+	for _, prefix := range k.Routes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// keylessPaths never need an API key: health checks, and metrics scrapes,
+// the admin API and webhooks, which need their own token.
+var keylessPaths = []string{"/healthz", "/readyz", "/metrics", "/admin", "/webhooks"}
+
+func isKeylessPath(path string) bool {
+	for _, p := range keylessPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeyCtxKey struct{}
+
+// apiKeyFrom returns the API key the request ctx belongs to was made with.
+func apiKeyFrom(ctx context.Context) (*APIKey, bool) {
+	k, ok := ctx.Value(apiKeyCtxKey{}).(*APIKey)
+	return k, ok
+}
+
+// Authenticate checks the request's API key, if any, and puts it in the
+// request's context, with its quota for the rate limiter. It must be
+// installed before the rate limiter. If required is set, requests without a
+// key are rejected.
+func (s *APIKeyStore) Authenticate(required bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isKeylessPath(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			secret := r.Header.Get("X-API-Key")
+			if secret == "" && (r.URL.Path == "/ws" || r.URL.Path == "/stream") {
+				secret = r.URL.Query().Get("api_key")
+			}
+			if secret == "" {
+				if required {
+					writeError(w, http.StatusUnauthorized, "An API key is required. Send it in the X-API-Key header, or the api_key query parameter for /ws and /stream.")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			k, ok := s.lookup(secret)
+			if !ok || k.RevokedAt != nil {
+				writeError(w, http.StatusUnauthorized, "Invalid or revoked API key.")
+				return
+			}
+			if !k.allows(r.URL.Path) {
+				writeError(w, http.StatusForbidden, fmt.Sprintf("This API key can't be used for %s.", r.URL.Path))
+				return
+			}
+			s.mu.RLock()
+			s.requests[k.ID].Add(1)
+			s.mu.RUnlock()
+
+			ctx := context.WithValue(r.Context(), apiKeyCtxKey{}, k)
+			if k.RequestLimit > 0 {
+				ctx = httprate.WithRequestLimit(ctx, k.RequestLimit)
+			}
+			ctx = withLogger(ctx, loggerFrom(ctx).With("api_key", k.ID))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// rateLimitKey counts a keyed request toward its key's quota and any other
+// request toward its client IP's.
+func rateLimitKey(r *http.Request) (string, error) {
+	if k, ok := apiKeyFrom(r.Context()); ok {
+		return "key:" + k.ID, nil
+	}
+	return ipRateLimitKey(clientIP(r)), nil
+}
+
+// useAPIKey applies the limits of the API key the connection was opened
+// with, if any.
+func (c *Client) useAPIKey(ctx context.Context) {
+	if k, ok := apiKeyFrom(ctx); ok {
+		c.apiKey, c.maxSubscriptions = k.ID, k.MaxSubscriptions
+	}
+}
+
+// atSubscriptionLimit reports whether subscribing c to ticker would take
+// its API key past its subscription limit, which counts the distinct
+// tickers of all of the key's clients. Caller must hold h.mu.
+func (h *Hub) atSubscriptionLimit(c *Client, ticker string) bool {
+	if c.maxSubscriptions <= 0 {
+		return false
+	}
+	tickers := h.keyTickers(c.apiKey, nil)
+	c.mu.Lock()
+	for t := range c.tickers { // c may not be registered yet
+		tickers[t] = struct{}{}
+	}
+	c.mu.Unlock()
+	_, subscribed := tickers[ticker]
+	return !subscribed && len(tickers) >= c.maxSubscriptions
+}
+
+// keyTickers returns the tickers the clients of apiKey subscribe to,
+// leaving out except's. Caller must hold h.mu.
+func (h *Hub) keyTickers(apiKey string, except *Client) map[string]struct{} {
+	tickers := make(map[string]struct{})
+	for c := range h.clients {
+		if c == except || c.apiKey != apiKey {
+			continue
+		}
+		c.mu.Lock()
+		for t := range c.tickers {
+			tickers[t] = struct{}{}
+		}
+		c.mu.Unlock()
+	}
+	return tickers
+}
+
+// UseAPIKeys disconnects the clients of a key when it's revoked.
+func (h *Hub) UseAPIKeys(s *APIKeyStore) {
+	s.mu.Lock()
+	s.revoked = h.disconnectAPIKey
+	s.mu.Unlock()
+}
+
+// disconnectAPIKey drops every client connected with key id.
+func (h *Hub) disconnectAPIKey(id string) {
+	h.mu.RLock()
+	var ids []string
+	for c := range h.clients {
+		if c.apiKey == id {
+			ids = append(ids, c.id)
+		}
+	}
+	h.mu.RUnlock()
+	for _, cid := range ids {
+		h.disconnectClient(cid, "API key revoked")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// REST handlers, mounted under /admin
+// ---------------------------------------------------------------------------
+
+type apiKeyRequest struct {
+	Name             string   `json:"name"`
+	RequestLimit     int      `json:"requestLimit"`
+	MaxSubscriptions int      `json:"maxSubscriptions"`
+	Routes           []string `json:"routes"`
+}
+
+// apiKeyCreated is the response to creating a key: the only time the key
+// itself is shown.
+type apiKeyCreated struct {
+	APIKeyView
+	Key string `json:"key"`
+}
+
+func (s *APIKeyStore) getKeys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.List())
+}
+
+func (s *APIKeyStore) createKey(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		writeError(w, http.StatusBadRequest, "Expected JSON body with a 'name' and optional 'requestLimit', 'maxSubscriptions' and 'routes'.")
+		return
+	}
+	if req.RequestLimit < 0 || req.MaxSubscriptions < 0 {
+		writeError(w, http.StatusBadRequest, "'requestLimit' and 'maxSubscriptions' must not be negative.")
+		return
+	}
+	for _, route := range req.Routes {
+		if !strings.HasPrefix(route, "/") {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Route '%s' must be a path starting with '/'.", route))
+			return
+		}
+	}
+
+	view, secret, err := s.Create(APIKey{
+		Name:             req.Name,
+		RequestLimit:     req.RequestLimit,
+		MaxSubscriptions: req.MaxSubscriptions,
+		Routes:           req.Routes,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not save API key.")
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, apiKeyCreated{APIKeyView: view, Key: secret})
+}
+
+func (s *APIKeyStore) revokeKey(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	switch err := s.Revoke(id); {
+	case errors.Is(err, errAPIKeyNotFound):
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No API key found with id '%s'.", id))
+	case errors.Is(err, errAPIKeyRevoked):
+		writeError(w, http.StatusConflict, fmt.Sprintf("API key '%s' is already revoked.", id))
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "Could not save API keys.")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/httprate"
+	"github.com/gorilla/websocket"
+)
+
+// keyedRequest sends a GET for path through handler with the given API key.
+func keyedRequest(handler http.Handler, path, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAPIKeyStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+	s, err := NewAPIKeyStore(path)
+	if err != nil {
+		t.Fatalf("NewAPIKeyStore failed: %v", err)
+	}
+	view, secret, err := s.Create(APIKey{Name: " partner ", RequestLimit: 10, Routes: []string{"/stocks"}})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if !strings.HasPrefix(secret, apiKeyPrefix) || !strings.HasPrefix(secret, view.Prefix) || view.Name != "partner" {
+		t.Fatalf("Unexpected key %q for %+v", secret, view)
+	}
+
+	loaded, err := NewAPIKeyStore(path)
+	if err != nil {
+		t.Fatalf("Reloading failed: %v", err)
+	}
+	k, ok := loaded.lookup(secret)
+	if !ok || k.ID != view.ID || k.RequestLimit != 10 {
+		t.Fatalf("Expected the key to survive a restart, got %+v", k)
+	}
+	if _, ok := loaded.lookup(secret + "x"); ok {
+		t.Fatal("Expected a wrong key not to match")
+	}
+
+	if err := loaded.Revoke(view.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if err := loaded.Revoke(view.ID); err != errAPIKeyRevoked {
+		t.Fatalf("Expected errAPIKeyRevoked revoking twice, got %v", err)
+	}
+	if err := loaded.Revoke("nope"); err != errAPIKeyNotFound {
+		t.Fatalf("Expected errAPIKeyNotFound, got %v", err)
+	}
+	if keys := loaded.List(); len(keys) != 1 || keys[0].RevokedAt == nil {
+		t.Fatalf("Expected the revoked key to stay listed, got %+v", keys)
+	}
+}
+
+func TestAPIKeyAuthenticate(t *testing.T) {
+	s, _ := NewAPIKeyStore("")
+	_, stocksOnly, _ := s.Create(APIKey{Name: "stocks", Routes: []string{"/stocks"}})
+	revokedView, revoked, _ := s.Create(APIKey{Name: "revoked"})
+	s.Revoke(revokedView.ID)
+
+	var seen *APIKey
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = apiKeyFrom(r.Context())
+	})
+	optional, required := s.Authenticate(false)(ok), s.Authenticate(true)(ok)
+
+	if rr := keyedRequest(optional, "/stocks/TSLA:NASDAQ", ""); rr.Code != http.StatusOK || seen != nil {
+		t.Fatalf("Expected a keyless request to pass when keys are optional, got %d", rr.Code)
+	}
+	if rr := keyedRequest(required, "/stocks/TSLA:NASDAQ", ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a key when keys are required, got %d", rr.Code)
+	}
+	if rr := keyedRequest(required, "/healthz", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected health checks to need no key, got %d", rr.Code)
+	}
+	if rr := keyedRequest(required, "/stocks/TSLA:NASDAQ", stocksOnly); rr.Code != http.StatusOK || seen == nil || seen.Name != "stocks" {
+		t.Fatalf("Expected the key to be accepted and passed on, got %d", rr.Code)
+	}
+	if rr := keyedRequest(optional, "/crypto/BTC:USD", stocksOnly); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 outside the key's routes, got %d", rr.Code)
+	}
+	if rr := keyedRequest(optional, "/stocksearch", stocksOnly); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected route prefixes to match whole path segments, got %d", rr.Code)
+	}
+	if rr := keyedRequest(optional, "/stocks/TSLA:NASDAQ", revoked); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for a revoked key, got %d", rr.Code)
+	}
+
+	// The query parameter only counts for the streaming endpoints.
+	if rr := keyedRequest(required, "/stocks/TSLA:NASDAQ?api_key="+stocksOnly, ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected api_key to be ignored on REST routes, got %d", rr.Code)
+	}
+	if rr := keyedRequest(required, "/ws?api_key="+stocksOnly, ""); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected api_key to be read on /ws, got %d", rr.Code)
+	}
+	for _, k := range s.List() {
+		if k.Name == "stocks" && k.Requests != 1 {
+			t.Fatalf("Expected only the accepted request to be counted, got %d", k.Requests)
+		}
+	}
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	s, _ := NewAPIKeyStore("")
+	_, small, _ := s.Create(APIKey{Name: "small", RequestLimit: 1})
+	_, large, _ := s.Create(APIKey{Name: "large"})
+
+	handler := s.Authenticate(false)(httprate.Limit(3, time.Minute,
+		httprate.WithKeyFuncs(rateLimitKey))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+
+	if rr := keyedRequest(handler, "/", small); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the first request to pass, got %d", rr.Code)
+	}
+	if rr := keyedRequest(handler, "/", small); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the key's own limit of 1, got %d", rr.Code)
+	}
+	// Other keys and keyless requests from the same IP have their own quota.
+	for i := 0; i < 3; i++ {
+		if rr := keyedRequest(handler, "/", large); rr.Code != http.StatusOK {
+			t.Fatalf("Expected request %d with the default limit to pass, got %d", i+1, rr.Code)
+		}
+	}
+	if rr := keyedRequest(handler, "/", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the IP's quota to be untouched, got %d", rr.Code)
+	}
+}
+
+func TestAPIKeySubscriptionLimitAndRevoke(t *testing.T) {
+	h := newTestHub(t)
+	h.setPaused(true) // no scrapes
+	s, _ := NewAPIKeyStore("")
+	h.UseAPIKeys(s)
+	view, secret, _ := s.Create(APIKey{Name: "ws", MaxSubscriptions: 1})
+
+	go h.Run()
+	srv := httptest.NewServer(s.Authenticate(true)(http.HandlerFunc(h.ServeWs)))
+	t.Cleanup(srv.Close)
+	conn := dialTestURL(t, "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?api_key="+secret, subprotocolV2)
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "id": "s-1", "ticker": "TSLA:NASDAQ"})
+	conn.readType(t, "subscribed")
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "id": "s-2", "ticker": "AAPL:NASDAQ"})
+	if e := conn.readType(t, "error"); e.ID != "s-2" || e.Code != codeSubscriptionLimit {
+		t.Fatalf("Expected subscription_limit for s-2, got %+v", e)
+	}
+	// Subscribing again to a ticker it has is fine.
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "id": "s-3", "ticker": "TSLA:NASDAQ"})
+	if m := conn.readType(t, "subscribed"); m.ID != "s-3" {
+		t.Fatalf("Expected s-3 to be acknowledged, got %+v", m)
+	}
+
+	if err := s.Revoke(view.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Fatalf("Expected a policy violation close after revoking the key, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestSubscriptionLimitCountsAllOfAKeysClients(t *testing.T) {
+	h := newTestHub(t)
+	h.paused = true // no scrapes
+	keyed := func(key string, max int) *Client {
+		c := newClient(h, nil, 2)
+		c.apiKey, c.maxSubscriptions = key, max
+		h.clients[c] = struct{}{}
+		return c
+	}
+
+	a, b := keyed("k", 2), keyed("k", 2)
+	if !h.subscribe(a, "", "TSLA:NASDAQ") || !h.subscribe(b, "", "AAPL:NASDAQ") {
+		t.Fatal("Expected two tickers to fit the key's limit")
+	}
+	if h.subscribe(b, "", "MSFT:NASDAQ") {
+		t.Fatal("Expected a third ticker on another connection to go over the key's limit")
+	}
+	if !h.subscribe(a, "", "AAPL:NASDAQ") {
+		t.Fatal("Expected a ticker the key already has to be accepted")
+	}
+
+	// A resumed session only brings over what fits the new client's key.
+	old := keyed("other", 0)
+	h.subscribe(old, "", "MSFT:NASDAQ")
+	h.subscribe(old, "", "NFLX:NASDAQ")
+	c := keyed("j", 2)
+	h.subscribe(c, "", "TSLA:NASDAQ")
+	h.mu.Lock()
+	adopted := h.adopt(c, old)
+	_, kept := h.store["NFLX:NASDAQ"]
+	h.mu.Unlock()
+	if len(adopted) != 1 || adopted[0] != "MSFT:NASDAQ" || len(c.tickers) != 2 {
+		t.Fatalf("Expected only MSFT:NASDAQ to be adopted, got %v", adopted)
+	}
+	if kept {
+		t.Fatal("Expected the ticker left behind to be released")
+	}
+}
+
+func TestAdminAPIKeys(t *testing.T) {
+	a, _ := newTestAdmin(t)
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/keys", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rr := httptest.NewRecorder()
+		a.Routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := create(`{"name": "bad", "routes": ["stocks"]}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a route without a leading slash, got %d", rr.Code)
+	}
+	rr := create(`{"name": "partner", "requestLimit": 500, "maxSubscriptions": 20}`)
+	var created apiKeyCreated
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusCreated || created.Key == "" || created.MaxSubscriptions != 20 {
+		t.Fatalf("Expected the new key, got %d %s", rr.Code, rr.Body)
+	}
+
+	var keys []map[string]interface{}
+	json.Unmarshal(adminRequest(a, "GET", "/keys", "s3cret").Body.Bytes(), &keys)
+	if len(keys) != 1 || keys[0]["id"] != created.ID {
+		t.Fatalf("Expected the key to be listed, got %v", keys)
+	}
+	if _, leaked := keys[0]["hash"]; leaked {
+		t.Fatal("Expected the key's hash not to be listed")
+	}
+
+	if rr := adminRequest(a, "DELETE", "/keys/"+created.ID, "s3cret"); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rr.Code)
+	}
+	if rr := adminRequest(a, "DELETE", "/keys/"+created.ID, "s3cret"); rr.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 revoking twice, got %d", rr.Code)
+	}
+}
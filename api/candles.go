@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ---------------------------------------------------------------------------
+// OHLCV candles aggregated from polled ticks
+// ---------------------------------------------------------------------------
+
+// candleIntervals lists the supported aggregation intervals, smallest first.
+// Buckets are aligned to UTC (a "1d" candle spans 00:00–24:00 UTC).
+var candleIntervals = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+}
+
+// validCandleInterval reports whether name is one of candleIntervals.
+func validCandleInterval(name string) bool {
+	for _, iv := range candleIntervals {
+		if iv.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Candle is a single OHLCV bar. Volume is the traded volume that happened
+// within the bar, derived from the cumulative day volume Google reports.
+type Candle struct {
+	Start  time.Time `json:"start"`
+	Open   float32   `json:"open"`
+	High   float32   `json:"high"`
+	Low    float32   `json:"low"`
+	Close  float32   `json:"close"`
+	Volume float64   `json:"volume"`
+	Ticks  int       `json:"ticks"`
+}
+
+// CandleUpdate is the payload of a "candle" ServerMessage.
+type CandleUpdate struct {
+	Interval string `json:"interval"`
+	Closed   bool   `json:"closed"` // true once the bar's interval has elapsed
+	Candle   Candle `json:"candle"`
+}
+
+// candleRing is a fixed-capacity ring buffer of candles for one interval.
+// The last element is the currently forming candle.
+type candleRing struct {
+	interval time.Duration
+	buf      []Candle
+	head     int // index of the oldest candle
+	n        int // number of candles stored
+}
+
+func (r *candleRing) last() *Candle {
+	if r.n == 0 {
+		return nil
+	}
+	return &r.buf[(r.head+r.n-1)%len(r.buf)]
+}
+
+func (r *candleRing) push(c Candle) {
+	if r.n < len(r.buf) {
+		r.buf[(r.head+r.n)%len(r.buf)] = c
+		r.n++
+		return
+	}
+	// Full – overwrite the oldest.
+	r.buf[r.head] = c
+	r.head = (r.head + 1) % len(r.buf)
+}
+
+// snapshot returns the stored candles, oldest first.
+func (r *candleRing) snapshot() []Candle {
+	out := make([]Candle, r.n)
+	for i := 0; i < r.n; i++ {
+		out[i] = r.buf[(r.head+i)%len(r.buf)]
+	}
+	return out
+}
+
+// CandleSeries aggregates ticks for one ticker into every supported interval.
+type CandleSeries struct {
+	mu      sync.Mutex
+	rings   map[string]*candleRing
+	lastVol float64 // cumulative volume seen on the previous tick
+	seenVol bool
+}
+
+// NewCandleSeries creates a series keeping at most capacity candles per
+// interval.
+func NewCandleSeries(capacity int) *CandleSeries {
+	if capacity < 1 {
+		capacity = 1
+	}
+	s := &CandleSeries{rings: make(map[string]*candleRing, len(candleIntervals))}
+	for _, iv := range candleIntervals {
+		s.rings[iv.Name] = &candleRing{
+			interval: iv.Duration,
+			buf:      make([]Candle, capacity),
+		}
+	}
+	return s
+}
+
+// Add records a tick and returns the resulting updates: for every interval a
+// closed candle (if the tick started a new bucket) followed by the candle the
+// tick landed in. cumVolume is the cumulative day volume, or 0 if unknown.
+func (s *CandleSeries) Add(price float32, cumVolume float64, ts time.Time) []CandleUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Volume traded since the previous tick. A drop in the cumulative
+	// figure means the trading day rolled over, so count from zero.
+	var delta float64
+	if cumVolume > 0 {
+		if s.seenVol {
+			delta = cumVolume - s.lastVol
+			if delta < 0 {
+				delta = cumVolume
+			}
+		}
+		s.lastVol = cumVolume
+		s.seenVol = true
+	}
+
+	ts = ts.UTC()
+	updates := make([]CandleUpdate, 0, len(candleIntervals)+1)
+	for _, iv := range candleIntervals {
+		r := s.rings[iv.Name]
+		bucket := ts.Truncate(r.interval)
+		cur := r.last()
+
+		switch {
+		case cur != nil && bucket.Equal(cur.Start):
+			if price > cur.High {
+				cur.High = price
+			}
+			if price < cur.Low {
+				cur.Low = price
+			}
+			cur.Close = price
+			cur.Volume += delta
+			cur.Ticks++
+		case cur != nil && bucket.Before(cur.Start):
+			// Out-of-order tick; ignore it for this interval.
+			continue
+		default:
+			if cur != nil {
+				updates = append(updates, CandleUpdate{Interval: iv.Name, Closed: true, Candle: *cur})
+			}
+			r.push(Candle{
+				Start:  bucket,
+				Open:   price,
+				High:   price,
+				Low:    price,
+				Close:  price,
+				Volume: delta,
+				Ticks:  1,
+			})
+		}
+		updates = append(updates, CandleUpdate{Interval: iv.Name, Candle: *r.last()})
+	}
+	return updates
+}
+
+// Candles returns the stored candles for interval, oldest first. The last
+// candle may still be forming.
+func (s *CandleSeries) Candles(interval string) []Candle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rings[interval]
+	if !ok {
+		return nil
+	}
+	return r.snapshot()
+}
+
+// parseVolume converts Google's abbreviated volume strings ("60.08M",
+// "1,234", "2.1B") into a number. Unparseable input yields 0.
+func parseVolume(s string) float64 {
+	s = strings.TrimSpace(strings.ReplaceAll(s, ",", ""))
+	if s == "" {
+		return 0
+	}
+	mult := 1.0
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		mult = 1e3
+	case 'M', 'm':
+		mult = 1e6
+	case 'B', 'b':
+		mult = 1e9
+	case 'T', 't':
+		mult = 1e12
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return v * mult
+}
+
+// ---------------------------------------------------------------------------
+// Hub integration
+// ---------------------------------------------------------------------------
+
+// recordTick feeds a freshly scraped price into the ticker's candle series
+// and pushes the resulting updates to candle subscribers. It runs on every
+// successful scrape, not only when the quote changed, so candles keep closing
+// on schedule for quiet tickers.
+func (h *Hub) recordTick(ticker string, price float32, volume float64) {
+	h.mu.Lock()
+	if _, ok := h.store[ticker]; !ok {
+		h.mu.Unlock()
+		return // ticker was removed while we were scraping
+	}
+	series, ok := h.candles[ticker]
+	if !ok {
+		series = NewCandleSeries(h.cfg.CandleHistory)
+		h.candles[ticker] = series
+	}
+	h.mu.Unlock()
+
+	updates := series.Add(price, volume, time.Now())
+	h.broadcastCandles(ticker, updates)
+
+	closed := make(map[string]bool)
+	for _, u := range updates {
+		if u.Closed {
+			closed[u.Interval] = true
+		}
+	}
+	if len(closed) > 0 {
+		h.broadcastIndicators(ticker, series, closed)
+	}
+}
+
+// broadcastCandles sends each update to the subscribers of ticker that asked
+// for its interval.
+func (h *Hub) broadcastCandles(ticker string, updates []CandleUpdate) {
+	h.mu.RLock()
+	subs := h.subscribers[ticker]
+	clients := make([]*Client, 0, len(subs))
+	for c := range subs {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+
+	for _, c := range clients {
+		c.mu.Lock()
+		intervals := c.candles[ticker]
+		wanted := make([]CandleUpdate, 0, len(intervals))
+		for _, u := range updates {
+			if _, ok := intervals[u.Interval]; ok {
+				wanted = append(wanted, u)
+			}
+		}
+		c.mu.Unlock()
+
+		for _, u := range wanted {
+			h.sendToClient(c, ServerMessage{
+				Type:      "candle",
+				Ticker:    ticker,
+				Data:      u,
+				Timestamp: time.Now(),
+			})
+		}
+	}
+}
+
+// subscribeCandle subscribes the client to candle updates for one interval.
+// It implies a regular subscription to the ticker, since candles are only
+// built while the ticker is being polled.
+func (h *Hub) subscribeCandle(client *Client, reqID, ticker, interval string) {
+	ticker = strings.TrimSpace(strings.ToUpper(ticker))
+	if ticker == "" {
+		return
+	}
+	if !validCandleInterval(interval) {
+		h.replyError(client, reqID, codeInvalidInterval, ticker, "invalid candle interval: "+interval+". Use 1m, 5m, 15m, 1h or 1d")
+		return
+	}
+
+	client.mu.Lock()
+	_, subscribed := client.tickers[ticker]
+	client.mu.Unlock()
+	if !subscribed && !h.subscribe(client, reqID, ticker) {
+		return
+	}
+
+	client.mu.Lock()
+	if _, ok := client.candles[ticker]; !ok {
+		client.candles[ticker] = make(map[string]struct{})
+	}
+	client.candles[ticker][interval] = struct{}{}
+	client.mu.Unlock()
+
+	h.reply(client, reqID, ServerMessage{
+		Type:      "candle_subscribed",
+		Ticker:    ticker,
+		Data:      map[string]string{"interval": interval},
+		Timestamp: time.Now(),
+	})
+
+	// Send the forming candle right away if we have one.
+	h.mu.RLock()
+	series := h.candles[ticker]
+	h.mu.RUnlock()
+	if series != nil {
+		if candles := series.Candles(interval); len(candles) > 0 {
+			h.sendToClient(client, ServerMessage{
+				Type:      "candle",
+				Ticker:    ticker,
+				Data:      CandleUpdate{Interval: interval, Candle: candles[len(candles)-1]},
+				Timestamp: time.Now(),
+			})
+		}
+	}
+}
+
+// unsubscribeCandle stops candle updates for one interval. The quote
+// subscription itself is left untouched.
+func (h *Hub) unsubscribeCandle(client *Client, reqID, ticker, interval string) {
+	ticker = strings.TrimSpace(strings.ToUpper(ticker))
+	if ticker == "" {
+		return
+	}
+
+	client.mu.Lock()
+	if intervals, ok := client.candles[ticker]; ok {
+		delete(intervals, interval)
+		if len(intervals) == 0 {
+			delete(client.candles, ticker)
+		}
+	}
+	client.mu.Unlock()
+
+	h.reply(client, reqID, ServerMessage{
+		Type:      "candle_unsubscribed",
+		Ticker:    ticker,
+		Data:      map[string]string{"interval": interval},
+		Timestamp: time.Now(),
+	})
+}
+
+// ServeCandles is the HTTP handler for /stocks/{stock_query}/candles. Candles
+// exist only for tickers the hub is currently polling.
+func (h *Hub) ServeCandles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ticker := strings.ToUpper(chi.URLParam(r, "stock_query"))
+
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "1m"
+	}
+	if !validCandleInterval(interval) {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Invalid interval '%s'. Use 1m, 5m, 15m, 1h or 1d.", interval)))
+		return
+	}
+
+	h.mu.RLock()
+	series := h.candles[ticker]
+	h.mu.RUnlock()
+
+	var candles []Candle
+	if series != nil {
+		candles = series.Candles(interval)
+	}
+	if len(candles) == 0 {
+		w.WriteHeader(404)
+		w.Write([]byte(fmt.Sprintf("No candle data for '%s'. Candles are built while a ticker is subscribed over /ws.", ticker)))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, candles)
+}
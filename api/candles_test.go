@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCandleSeriesAggregation(t *testing.T) {
+	s := NewCandleSeries(10)
+	base := time.Date(2026, 2, 23, 12, 0, 0, 0, time.UTC)
+
+	s.Add(100, 1000, base)
+	s.Add(105, 1500, base.Add(10*time.Second))
+	s.Add(98, 1700, base.Add(20*time.Second))
+	updates := s.Add(101, 2000, base.Add(70*time.Second))
+
+	var closed *CandleUpdate
+	for i, u := range updates {
+		if u.Interval == "1m" && u.Closed {
+			closed = &updates[i]
+		}
+	}
+	if closed == nil {
+		t.Fatal("Expected the first 1m candle to close when a tick lands in the next minute")
+	}
+
+	c := closed.Candle
+	if c.Open != 100 || c.High != 105 || c.Low != 98 || c.Close != 98 {
+		t.Fatalf("Unexpected OHLC for closed candle: %+v", c)
+	}
+	if c.Volume != 700 {
+		t.Fatalf("Expected volume 700 in closed candle, got %v", c.Volume)
+	}
+
+	minute := s.Candles("1m")
+	if len(minute) != 2 {
+		t.Fatalf("Expected 2 one-minute candles, got %d", len(minute))
+	}
+	hour := s.Candles("1h")
+	if len(hour) != 1 || hour[0].Ticks != 4 || hour[0].Volume != 1000 {
+		t.Fatalf("Expected a single hourly candle with 4 ticks and volume 1000, got %+v", hour)
+	}
+}
+
+func TestCandleSeriesRingBuffer(t *testing.T) {
+	s := NewCandleSeries(3)
+	base := time.Date(2026, 2, 23, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 5; i++ {
+		s.Add(float32(i), 0, base.Add(time.Duration(i)*time.Minute))
+	}
+
+	candles := s.Candles("1m")
+	if len(candles) != 3 {
+		t.Fatalf("Expected ring buffer to hold 3 candles, got %d", len(candles))
+	}
+	if candles[0].Open != 2 || candles[2].Open != 4 {
+		t.Fatalf("Expected oldest candles to be overwritten, got %+v", candles)
+	}
+}
+
+func TestParseVolume(t *testing.T) {
+	cases := map[string]float64{
+		"60.08M": 60.08e6,
+		"1,234":  1234,
+		"2.5B":   2.5e9,
+		"":       0,
+		"n/a":    0,
+	}
+	for in, want := range cases {
+		if got := parseVolume(in); got != want {
+			t.Errorf("parseVolume(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Client IPs – the address of the client behind trusted reverse proxies
+// ---------------------------------------------------------------------------
+
+// Behind a reverse proxy every request comes from the proxy's address. When
+// a request arrives from one of the TRUSTED_PROXIES, its client IP is taken
+// from X-Forwarded-For instead: the rightmost address that isn't a trusted
+// proxy, since anything left of it could have been sent by the client. A
+// request without X-Forwarded-For falls back to X-Real-IP. Requests from
+// anywhere else use their peer address, whatever headers they carry. The
+// rate limiter, the request log and the per-IP connection limit all use the
+// resolved IP.
+
+// ClientIPs resolves client IPs, trusting the proxies in trusted.
+type ClientIPs struct {
+	trusted []netip.Prefix
+}
+
+// NewClientIPs parses cfg.TrustedProxies, a comma separated list of CIDRs
+// or single addresses.
+func NewClientIPs(cfg *Config) (*ClientIPs, error) {
+	c := &ClientIPs{}
+	for _, s := range strings.Split(cfg.TrustedProxies, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+			}
+			c.trusted = append(c.trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		c.trusted = append(c.trusted, prefix.Masked())
+	}
+	return c, nil
+}
+
+// trusts reports whether ip is a trusted proxy.
+func (c *ClientIPs) trusts(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range c.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses an address from a forwarding header or RemoteAddr, with or
+// without a port.
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// Resolve returns the IP of the client that sent r.
+func (c *ClientIPs) Resolve(r *http.Request) string {
+	peer, ok := parseIP(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !c.trusts(peer) {
+		return peer.String()
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip, ok := parseIP(hops[i])
+			if !ok {
+				// Garbage, so whoever added it can't be trusted either.
+				break
+			}
+			client = ip
+			if !c.trusts(ip) {
+				break
+			}
+		}
+		return client.String()
+	}
+	if ip, ok := parseIP(r.Header.Get("X-Real-IP")); ok {
+		return ip.String()
+	}
+	return peer.String()
+}
+
+type clientIPCtxKey struct{}
+
+// Middleware resolves each request's client IP and puts it in the request's
+// context. It must come before everything that uses clientIP.
+func (c *ClientIPs) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPCtxKey{}, c.Resolve(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the client IP resolved for r, or r's peer address if
+// the middleware didn't run.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPCtxKey{}).(string); ok {
+		return ip
+	}
+	if ip, ok := parseIP(r.RemoteAddr); ok {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// ipRateLimitKey is the rate limiter key for ip. IPv6 clients are limited
+// per /64, as they usually get a whole one.
+func ipRateLimitKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() {
+		return "ip:" + ip
+	}
+	return "ip:" + netip.PrefixFrom(addr, 64).Masked().String()
+}
+
+// connectionsFrom counts the connected WebSocket and /stream clients with
+// client IP ip. Detached sessions don't count.
+func (h *Hub) connectionsFrom(ip string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for c := range h.clients {
+		c.mu.Lock()
+		if c.remote == ip && !c.detached {
+			n++
+		}
+		c.mu.Unlock()
+	}
+	return n
+}
+
+// tooManyConnections answers r with 429 if its client IP already has
+// WSMaxConnectionsPerIP connections. The limit is checked before the new
+// connection registers, so a burst of connections may briefly exceed it.
+func (h *Hub) tooManyConnections(w http.ResponseWriter, r *http.Request) bool {
+	max := h.cfg.WSMaxConnectionsPerIP
+	if max <= 0 {
+		return false
+	}
+	ip := clientIP(r)
+	if h.connectionsFrom(ip) < max {
+		return false
+	}
+	loggerFrom(r.Context()).Warn("too many connections", "component", "hub", "client_ip", ip, "limit", max)
+	writeError(w, http.StatusTooManyRequests, fmt.Sprintf("Too many connections from %s, the limit is %d.", ip, max))
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientIPResolve(t *testing.T) {
+	ips, err := NewClientIPs(&Config{TrustedProxies: "172.16.0.0/12, 10.0.0.1, fd00::/8"})
+	if err != nil {
+		t.Fatalf("NewClientIPs failed: %v", err)
+	}
+
+	cases := []struct {
+		remote, xff, realIP, want string
+	}{
+		// Untrusted peers can't pick their IP.
+		{"203.0.113.9:4000", "198.51.100.1", "198.51.100.2", "203.0.113.9"},
+		// A trusted proxy's X-Forwarded-For is read right to left.
+		{"172.18.0.2:4000", "198.51.100.1", "", "198.51.100.1"},
+		{"172.18.0.2:4000", "6.6.6.6, 198.51.100.1", "", "198.51.100.1"},
+		{"172.18.0.2:4000", "198.51.100.1, 10.0.0.1", "", "198.51.100.1"},
+		// Every hop trusted: the leftmost is as close to the client as it gets.
+		{"172.18.0.2:4000", "10.0.0.1, 172.18.0.3", "", "10.0.0.1"},
+		// A garbled hop stops the walk at the last trusted one.
+		{"172.18.0.2:4000", "198.51.100.1, nonsense", "", "172.18.0.2"},
+		// X-Real-IP only without X-Forwarded-For.
+		{"172.18.0.2:4000", "", "198.51.100.7", "198.51.100.7"},
+		{"172.18.0.2:4000", "", "", "172.18.0.2"},
+		{"[fd00::1]:4000", "2001:db8::5", "", "2001:db8::5"},
+		{"[::ffff:10.0.0.1]:4000", "198.51.100.1", "", "198.51.100.1"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if got := ips.Resolve(req); got != tc.want {
+			t.Errorf("Resolve(%s, XFF %q, X-Real-IP %q) = %s, want %s", tc.remote, tc.xff, tc.realIP, got, tc.want)
+		}
+	}
+
+	if _, err := NewClientIPs(&Config{TrustedProxies: "10.0.0.0/33"}); err == nil {
+		t.Error("Expected an invalid CIDR to be rejected")
+	}
+}
+
+func TestClientIPRateLimitKey(t *testing.T) {
+	ips, _ := NewClientIPs(&Config{TrustedProxies: "172.16.0.0/12"})
+	var key string
+	handler := ips.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _ = rateLimitKey(r)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "172.18.0.2:4000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if key != "ip:198.51.100.1" {
+		t.Fatalf("Expected the forwarded client's IP as the key, got %q", key)
+	}
+
+	req.Header.Set("X-Forwarded-For", "2001:db8:1:2:3::9")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if key != "ip:2001:db8:1:2::/64" {
+		t.Fatalf("Expected IPv6 clients to share their /64, got %q", key)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.WSMaxConnectionsPerIP = 1
+	conn := dialTestHub(t, h, subprotocolV2)
+	conn.readType(t, "session") // registered
+
+	_, resp, err := websocket.DefaultDialer.Dial(conn.url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected a second connection from the same IP to get 429, got %v", err)
+	}
+
+	conn.Close()
+	h.cfg.WSMaxConnectionsPerIP = 2
+	dialTestURL(t, conn.url, subprotocolV2)
+}
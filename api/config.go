@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"time"
@@ -47,9 +47,168 @@ type Config struct {
 
 	// WSClientSendBuffer is the channel buffer size for outbound messages
 	// per connected client. If a client can't keep up and this buffer fills,
-	// messages are dropped rather than blocking the hub.
+	// messages are dropped rather than blocking the hub. Quote updates don't
+	// use it; they are conflated to the latest value per ticker instead.
 	WSClientSendBuffer int
 
+	// WSSlowClientTimeout is how long a client may stay behind (its send
+	// buffer full, or updates replaced before they could be written) before
+	// it is disconnected. 0 never disconnects slow clients.
+	WSSlowClientTimeout time.Duration
+
+	// WSSessionTTL is how long a dropped v2 connection's session can be
+	// resumed. 0 disables sessions.
+	WSSessionTTL time.Duration
+
+	// WSReplayBuffer is how many of a session's most recent messages are
+	// kept for replay on resume.
+	WSReplayBuffer int
+
+	// SSEHeartbeat is how often an idle /stream response gets a comment
+	// line, so proxies don't time it out.
+	SSEHeartbeat time.Duration
+
+	// WSCompressionLevel is the permessage-deflate level offered on /ws,
+	// from 1 (fastest) to 9 (smallest). 0 disables compression.
+	WSCompressionLevel int
+
+	// WSCompressionThreshold is the size in bytes below which frames are
+	// sent uncompressed; deflating a small quote costs more than it saves.
+	WSCompressionThreshold int
+
+	// TickerMaxFailures is how many scrapes in a row may find no data for a
+	// ticker that has never had any before it stops being polled.
+	TickerMaxFailures int
+
+	// NegativeCacheTTL is how long a dropped ticker is refused before it may
+	// be subscribed to again.
+	NegativeCacheTTL time.Duration
+
+	// WSMaxTickersPerMessage caps the "tickers" list of a single v2 client
+	// message.
+	WSMaxTickersPerMessage int
+
+	// WSMaxConnectionsPerIP caps the WebSocket and /stream connections from
+	// one client IP. 0 is unlimited.
+	WSMaxConnectionsPerIP int
+
+	// --------------- Candles ------------------------------------------------
+
+	// CandleHistory is the number of candles kept per ticker per interval
+	// (1m, 5m, 15m, 1h, 1d). Older candles are overwritten ring-buffer style.
+	CandleHistory int
+
+	// --------------- Persistence --------------------------------------------
+
+	// SnapshotPath is where the hub persists its last known quotes so a
+	// restart can serve them (marked stale) before the first poll completes.
+	// Set to an empty string to disable snapshots.
+	SnapshotPath string
+
+	// SnapshotInterval is how often the hub writes a snapshot while running.
+	// A final snapshot is always written on shutdown.
+	SnapshotInterval time.Duration
+
+	// SnapshotMaxAge bounds how old a remembered quote may be before it is
+	// discarded instead of being served as stale data.
+	SnapshotMaxAge time.Duration
+
+	// WarmCacheMax bounds how many untracked tickers the warm cache keeps.
+	// The least recently updated are evicted first. 0 means no limit.
+	WarmCacheMax int
+
+	// WSReconnectDelay is the reconnect hint sent to clients in the close
+	// frame when the server shuts down.
+	WSReconnectDelay time.Duration
+
+	// WatchlistPath is the JSON file backing server-side watchlists. Set to
+	// an empty string to keep watchlists in memory only.
+	WatchlistPath string
+
+	// PortfolioPath is the JSON file backing portfolios. Set to an empty
+	// string to keep portfolios in memory only.
+	PortfolioPath string
+
+	// AlertsPath is the JSON file backing price alert rules. Set to an empty
+	// string to keep rules in memory only.
+	AlertsPath string
+
+	// AlertCooldown is the default minimum time between two alerts from the
+	// same rule, used when a rule doesn't set its own cooldown.
+	AlertCooldown time.Duration
+
+	// AlertsFlushInterval is how often rule state changed by evaluation
+	// (armed, last fired) is written to AlertsPath. It is also written on
+	// shutdown.
+	AlertsFlushInterval time.Duration
+
+	// --------------- Webhooks -----------------------------------------------
+
+	// WebhooksPath is the JSON file backing webhook registrations and dead
+	// letters. Set to an empty string to keep them in memory only.
+	WebhooksPath string
+
+	// WebhookWorkers is the number of concurrent delivery workers.
+	WebhookWorkers int
+
+	// WebhookQueueSize is the number of deliveries that may wait for a worker
+	// before new ones are dead-lettered.
+	WebhookQueueSize int
+
+	// WebhookTimeout bounds a single delivery attempt.
+	WebhookTimeout time.Duration
+
+	// WebhookMaxAttempts is how many times a delivery is tried before it is
+	// moved to the dead-letter list.
+	WebhookMaxAttempts int
+
+	// WebhookRetryBase is the delay before the first retry; each further
+	// retry doubles it.
+	WebhookRetryBase time.Duration
+
+	// WebhookDeadLetterMax caps the dead-letter list; the oldest entries are
+	// dropped first.
+	WebhookDeadLetterMax int
+
+	// WebhookAllowPrivate lets webhooks target loopback, private and
+	// link-local addresses. Off by default, so registering a webhook can't
+	// be used to reach internal services.
+	WebhookAllowPrivate bool
+
+	// --------------- Shutdown -----------------------------------------------
+
+	// ShutdownTimeout bounds how long a graceful shutdown waits for in-flight
+	// HTTP requests, and then separately for the current poll cycle and the
+	// final snapshot, before exiting anyway.
+	ShutdownTimeout time.Duration
+
+	// --------------- Batch Quotes -------------------------------------------
+
+	// QuoteBatchMax is the most symbols accepted by one /quotes request.
+	QuoteBatchMax int
+
+	// QuoteBatchConcurrency bounds the scrapes a single /quotes request runs
+	// in parallel for symbols that aren't cached. Values below 1 mean 1.
+	QuoteBatchConcurrency int
+
+	// QuoteCacheTTL is how long a one-off scrape of an unpolled ticker is
+	// reused by later /quotes requests.
+	QuoteCacheTTL time.Duration
+
+	// QuoteBatchWeight is the number of symbols in a /quotes request that
+	// count as one request toward the rate limit.
+	QuoteBatchWeight int
+
+	// --------------- Currency Conversion ------------------------------------
+
+	// FXCacheTTL is how long a scraped exchange rate is reused before it is
+	// fetched again.
+	FXCacheTTL time.Duration
+
+	// FXNegativeCacheTTL is how long a currency pair whose first scrape
+	// found no rate is refused before it may be scraped again.
+	FXNegativeCacheTTL time.Duration
+
 	// --------------- Rate Limiting ------------------------------------------
 
 	// RateLimitRequests is the max number of HTTP requests per IP within
@@ -58,25 +217,153 @@ type Config struct {
 
 	// RateLimitWindow is the sliding window for the rate limiter.
 	RateLimitWindow time.Duration
+
+	// TrustedProxies is a comma separated list of CIDRs or addresses of
+	// reverse proxies whose X-Forwarded-For and X-Real-IP headers are
+	// believed, e.g. "172.16.0.0/12" for a Docker network. Empty trusts
+	// no one and uses each request's peer address.
+	TrustedProxies string
+
+	// --------------- Upstream -----------------------------------------------
+
+	// UpstreamRate is the budget of requests per minute to Google, shared
+	// by every scrape. 0 disables the budget.
+	UpstreamRate int
+
+	// UpstreamBurst is how many requests may go out at once before the
+	// budget starts spacing them.
+	UpstreamBurst int
+
+	// UpstreamBreakerThreshold is how many throttling responses in a row
+	// (429, 503 or a captcha page) open the circuit breaker.
+	UpstreamBreakerThreshold int
+
+	// UpstreamBackoffBase is how long the breaker stays open the first
+	// time. Each failed probe doubles it, up to UpstreamBackoffMax.
+	UpstreamBackoffBase time.Duration
+	UpstreamBackoffMax  time.Duration
+
+	// --------------- Health Checks ------------------------------------------
+
+	// CanaryTicker is scraped every CanaryInterval to tell whether scraping
+	// works, for /readyz. A CanaryInterval of 0 disables the canary.
+	CanaryTicker   string
+	CanaryInterval time.Duration
+
+	// CanaryMaxFailures is how many canary scrapes in a row may fail before
+	// /readyz reports the server as not ready.
+	CanaryMaxFailures int
+
+	// HealthStallTimeout is how long the poll loop may go without finishing
+	// a cycle before /healthz reports the server as not live.
+	HealthStallTimeout time.Duration
+
+	// --------------- HTTP Compression ---------------------------------------
+
+	// HTTPCompressionLevel is the brotli/gzip/deflate level for REST
+	// responses, negotiated with Accept-Encoding. 0 disables compression.
+	HTTPCompressionLevel int
+
+	// --------------- API Keys ---------------------------------------------
+
+	// APIKeysPath is the JSON file backing API keys. Set to an empty string
+	// to keep keys in memory only.
+	APIKeysPath string
+
+	// APIKeysRequired rejects requests without an API key. Health checks,
+	// /metrics and the admin API never need one; the latter two have their
+	// own tokens.
+	APIKeysRequired bool
+
+	// --------------- Admin ------------------------------------------------
+
+	// AdminToken is the bearer token for the /admin API. Empty disables it.
+	AdminToken string
+
+	// MetricsToken is the bearer token for /metrics. Empty falls back to
+	// AdminToken, and without either /metrics is disabled.
+	MetricsToken string
+
+	// --------------- Logging ------------------------------------------------
+
+	// LogLevel is the least severe level logged: debug, info, warn or error.
+	// Successful scrapes are only logged at debug.
+	LogLevel string
+
+	// LogFormat is "text" (logfmt-style key=value pairs) or "json".
+	LogFormat string
 }
 
 // LoadConfig reads environment variables and returns a Config with defaults
 // applied for any values that are missing or invalid.
 func LoadConfig() *Config {
 	cfg := &Config{
-		Port:               envStr("PORT", "8084"),
-		ScraperParallelism: envInt("SCRAPER_PARALLELISM", 4),
-		PollInterval:       envDuration("POLL_INTERVAL", 5*time.Second),
-		PollWorkers:        envInt("POLL_WORKERS", 10),
-		WSWriteBufferSize:  envInt("WS_WRITE_BUFFER_SIZE", 1024),
-		WSReadBufferSize:   envInt("WS_READ_BUFFER_SIZE", 1024),
-		WSClientSendBuffer: envInt("WS_CLIENT_SEND_BUFFER", 256),
-		RateLimitRequests:  envInt("RATE_LIMIT_REQUESTS", 30),
-		RateLimitWindow:    envDuration("RATE_LIMIT_WINDOW", 1*time.Minute),
+		Port:                     envStr("PORT", "8084"),
+		ScraperParallelism:       envInt("SCRAPER_PARALLELISM", 4),
+		PollInterval:             envDuration("POLL_INTERVAL", 5*time.Second),
+		PollWorkers:              envInt("POLL_WORKERS", 10),
+		WSWriteBufferSize:        envInt("WS_WRITE_BUFFER_SIZE", 1024),
+		WSReadBufferSize:         envInt("WS_READ_BUFFER_SIZE", 1024),
+		WSClientSendBuffer:       envInt("WS_CLIENT_SEND_BUFFER", 256),
+		WSMaxTickersPerMessage:   envInt("WS_MAX_TICKERS_PER_MESSAGE", 200),
+		WSMaxConnectionsPerIP:    envInt("WS_MAX_CONNECTIONS_PER_IP", 0),
+		WSSlowClientTimeout:      envDuration("WS_SLOW_CLIENT_TIMEOUT", 30*time.Second),
+		WSSessionTTL:             envDuration("WS_SESSION_TTL", 2*time.Minute),
+		WSReplayBuffer:           envInt("WS_REPLAY_BUFFER", 1000),
+		SSEHeartbeat:             envDuration("SSE_HEARTBEAT", 15*time.Second),
+		WSCompressionLevel:       envInt("WS_COMPRESSION_LEVEL", 1),
+		WSCompressionThreshold:   envInt("WS_COMPRESSION_THRESHOLD", 512),
+		TickerMaxFailures:        envInt("TICKER_MAX_FAILURES", 3),
+		NegativeCacheTTL:         envDuration("NEGATIVE_CACHE_TTL", 10*time.Minute),
+		WatchlistPath:            envPath("WATCHLIST_PATH", "data/watchlists.json"),
+		PortfolioPath:            envPath("PORTFOLIO_PATH", "data/portfolios.json"),
+		AlertsPath:               envPath("ALERTS_PATH", "data/alerts.json"),
+		AlertCooldown:            envDuration("ALERT_COOLDOWN", 5*time.Minute),
+		AlertsFlushInterval:      envDuration("ALERTS_FLUSH_INTERVAL", 30*time.Second),
+		WebhooksPath:             envPath("WEBHOOKS_PATH", "data/webhooks.json"),
+		WebhookWorkers:           envInt("WEBHOOK_WORKERS", 4),
+		WebhookQueueSize:         envInt("WEBHOOK_QUEUE_SIZE", 1024),
+		WebhookTimeout:           envDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookMaxAttempts:       envInt("WEBHOOK_MAX_ATTEMPTS", 6),
+		WebhookRetryBase:         envDuration("WEBHOOK_RETRY_BASE", 2*time.Second),
+		WebhookDeadLetterMax:     envInt("WEBHOOK_DEAD_LETTER_MAX", 500),
+		WebhookAllowPrivate:      envBool("WEBHOOK_ALLOW_PRIVATE", false),
+		WSReconnectDelay:         envDuration("WS_RECONNECT_DELAY", 5*time.Second),
+		ShutdownTimeout:          envDuration("SHUTDOWN_TIMEOUT", 15*time.Second),
+		CandleHistory:            envInt("CANDLE_HISTORY", 500),
+		SnapshotPath:             envPath("SNAPSHOT_PATH", "data/hub_snapshot.json"),
+		SnapshotInterval:         envDuration("SNAPSHOT_INTERVAL", 1*time.Minute),
+		SnapshotMaxAge:           envDuration("SNAPSHOT_MAX_AGE", 24*time.Hour),
+		WarmCacheMax:             envInt("WARM_CACHE_MAX", 1000),
+		QuoteBatchMax:            envInt("QUOTE_BATCH_MAX", 50),
+		QuoteBatchConcurrency:    envInt("QUOTE_BATCH_CONCURRENCY", 8),
+		QuoteCacheTTL:            envDuration("QUOTE_CACHE_TTL", 30*time.Second),
+		QuoteBatchWeight:         envInt("QUOTE_BATCH_WEIGHT", 10),
+		FXCacheTTL:               envDuration("FX_CACHE_TTL", 10*time.Minute),
+		FXNegativeCacheTTL:       envDuration("FX_NEGATIVE_CACHE_TTL", 10*time.Minute),
+		RateLimitRequests:        envInt("RATE_LIMIT_REQUESTS", 30),
+		RateLimitWindow:          envDuration("RATE_LIMIT_WINDOW", 1*time.Minute),
+		TrustedProxies:           envStr("TRUSTED_PROXIES", ""),
+		UpstreamRate:             envInt("UPSTREAM_RATE", 600),
+		UpstreamBurst:            envInt("UPSTREAM_BURST", 20),
+		UpstreamBreakerThreshold: envInt("UPSTREAM_BREAKER_THRESHOLD", 3),
+		UpstreamBackoffBase:      envDuration("UPSTREAM_BACKOFF_BASE", 30*time.Second),
+		UpstreamBackoffMax:       envDuration("UPSTREAM_BACKOFF_MAX", 15*time.Minute),
+		CanaryTicker:             envStr("CANARY_TICKER", "GOOGL:NASDAQ"),
+		CanaryInterval:           envDuration("CANARY_INTERVAL", 1*time.Minute),
+		CanaryMaxFailures:        envInt("CANARY_MAX_FAILURES", 3),
+		HealthStallTimeout:       envDuration("HEALTH_STALL_TIMEOUT", 2*time.Minute),
+		HTTPCompressionLevel:     envInt("HTTP_COMPRESSION_LEVEL", 5),
+		APIKeysPath:              envPath("API_KEYS_PATH", "data/apikeys.json"),
+		APIKeysRequired:          envBool("API_KEYS_REQUIRED", false),
+		AdminToken:               envStr("ADMIN_TOKEN", ""),
+		MetricsToken:             envStr("METRICS_TOKEN", ""),
+		LogLevel:                 envStr("LOG_LEVEL", "info"),
+		LogFormat:                envStr("LOG_FORMAT", "text"),
 	}
 
 	if cfg.Port == "" {
-		log.Fatal("PORT must be set")
+		fatal("PORT must be set")
 	}
 
 	return cfg
@@ -93,6 +380,15 @@ func envStr(key, fallback string) string {
 	return fallback
 }
 
+// envPath is envStr for file paths, except that a variable set to an
+// empty value returns "", which turns the file off.
+func envPath(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
 func envInt(key string, fallback int) int {
 	v := os.Getenv(key)
 	if v == "" {
@@ -100,12 +396,25 @@ func envInt(key string, fallback int) int {
 	}
 	n, err := strconv.Atoi(v)
 	if err != nil {
-		log.Printf("[config] invalid integer for %s=%q, using default %d", key, v, fallback)
+		slog.Warn("invalid integer, using default", "component", "config", "key", key, "value", v, "default", fallback)
 		return fallback
 	}
 	return n
 }
 
+func envBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Warn("invalid boolean, using default", "component", "config", "key", key, "value", v, "default", fallback)
+		return fallback
+	}
+	return b
+}
+
 func envDuration(key string, fallback time.Duration) time.Duration {
 	v := os.Getenv(key)
 	if v == "" {
@@ -113,7 +422,7 @@ func envDuration(key string, fallback time.Duration) time.Duration {
 	}
 	d, err := time.ParseDuration(v)
 	if err != nil {
-		log.Printf("[config] invalid duration for %s=%q, using default %s", key, v, fallback)
+		slog.Warn("invalid duration, using default", "component", "config", "key", key, "value", v, "default", fallback)
 		return fallback
 	}
 	return d
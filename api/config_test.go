@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEnvPathEmptyDisables(t *testing.T) {
+	t.Setenv("SNAPSHOT_PATH", "")
+	if cfg := LoadConfig(); cfg.SnapshotPath != "" {
+		t.Fatalf("Expected SNAPSHOT_PATH= to disable snapshots, got %q", cfg.SnapshotPath)
+	}
+	t.Setenv("SNAPSHOT_PATH", "/tmp/snap.json")
+	if cfg := LoadConfig(); cfg.SnapshotPath != "/tmp/snap.json" {
+		t.Fatalf("Expected the configured path, got %q", cfg.SnapshotPath)
+	}
+	os.Unsetenv("SNAPSHOT_PATH")
+	if cfg := LoadConfig(); cfg.SnapshotPath != "data/hub_snapshot.json" {
+		t.Fatalf("Expected the default path when unset, got %q", cfg.SnapshotPath)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ---------------------------------------------------------------------------
+// Update conflation, per-client rate limits and slow-client eviction
+// ---------------------------------------------------------------------------
+
+// Quote updates don't go through a client's send channel. Each client keeps
+// the latest undelivered update per ticker, and a newer update replaces an
+// older one, so a client that falls behind skips intermediate values but
+// never ends up with a stale price. Everything else (acks, candles, alerts,
+// ...) still uses the send channel.
+
+// maxUpdateInterval caps what a client may ask for with "set_rate".
+const maxUpdateInterval = time.Hour
+
+// queuedUpdate is a quote update waiting to be written to a client.
+type queuedUpdate struct {
+	payload []byte
+	full    []byte // full form of a delta payload, used if it gets conflated
+	seq     uint64
+}
+
+// queueUpdate puts msg, an update for msg.Ticker, in each client's
+// conflation buffer. For delta clients msg is the delta and full the
+// complete update; otherwise both are the same message. A pending update
+// that is replaced falls back to full, since the client never saw the
+// version the new delta was built on.
+func (h *Hub) queueUpdate(clients []*Client, msg, full ServerMessage) {
+	// Marshalled once per encoding in use, and shared by the clients.
+	encMsg := &encodedMessage{msg: msg}
+	encFull := encMsg
+	if msg.Type == "delta" {
+		encFull = &encodedMessage{msg: full}
+	}
+
+	now := time.Now()
+	for _, c := range clients {
+		payload, fullPayload := encMsg.payload(c.encoding), encFull.payload(c.encoding)
+		if payload == nil || fullPayload == nil {
+			continue
+		}
+		c.mu.Lock()
+		u := queuedUpdate{payload: payload, full: fullPayload, seq: msg.Seq}
+		old, pending := c.updates[msg.Ticker]
+		slow := false
+		switch {
+		case !pending:
+			c.updates[msg.Ticker] = u
+		case old.seq > u.seq:
+			// A newer update is already waiting.
+		default:
+			u.payload = u.full
+			c.updates[msg.Ticker] = u
+			h.conflated.Add(1)
+			// Held back by the client's own rate limit, or waiting for the
+			// client to resume, isn't falling behind.
+			if !c.detached && !now.Before(c.lastSent[msg.Ticker].Add(c.minInterval)) {
+				slow = h.markBehind(c, now)
+			}
+		}
+		c.mu.Unlock()
+
+		if slow {
+			h.evictSlowClient(c)
+			continue
+		}
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// takeUpdates removes and returns the updates that may be written now and
+// how long until the next held-back one may be; 0 if none are left. It also
+// clears the client's slow marker once nothing is waiting.
+func (c *Client) takeUpdates(now time.Time) ([][]byte, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.takeUpdatesLocked(now)
+}
+
+// takeUpdatesLocked is takeUpdates for callers holding c.mu.
+func (c *Client) takeUpdatesLocked(now time.Time) ([][]byte, time.Duration) {
+	var ready [][]byte
+	var next time.Duration
+	for ticker, u := range c.updates {
+		if wait := c.lastSent[ticker].Add(c.minInterval).Sub(now); wait > 0 {
+			if next == 0 || wait < next {
+				next = wait
+			}
+			continue
+		}
+		ready = append(ready, u.payload)
+		c.lastSent[ticker] = now
+		delete(c.updates, ticker)
+	}
+	if len(c.send) == 0 {
+		c.behindSince = time.Time{}
+	}
+	return ready, next
+}
+
+// markBehind records that c couldn't keep up at now and reports whether it
+// has been behind for longer than WSSlowClientTimeout. Caller must hold c.mu.
+func (h *Hub) markBehind(c *Client, now time.Time) bool {
+	if c.behindSince.IsZero() {
+		c.behindSince = now
+	}
+	return h.cfg.WSSlowClientTimeout > 0 && now.Sub(c.behindSince) > h.cfg.WSSlowClientTimeout
+}
+
+// evictSlowClient disconnects c with a "try again later" close frame. The
+// read pump then unregisters it as usual.
+func (h *Hub) evictSlowClient(c *Client) {
+	c.evictOnce.Do(func() {
+		h.evictions.Add(1)
+		c.log.Warn("disconnecting slow client", "behind_for_more_than", h.cfg.WSSlowClientTimeout)
+		close(c.evicted)
+		if c.conn == nil {
+			return
+		}
+		// WriteControl waits for the connection's writer, which may be
+		// stuck on this very client, so don't hold up the caller.
+		go func() {
+			msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "client too slow, updates were falling behind")
+			c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			c.conn.Close()
+		}()
+	})
+}
+
+// setRate handles "set_rate": at most one update per ticker every interval
+// for this client. "0" or an empty interval removes the limit.
+func (h *Hub) setRate(client *Client, reqID, interval string) {
+	var d time.Duration
+	if interval != "" {
+		var err error
+		if d, err = time.ParseDuration(interval); err != nil || d < 0 || d > maxUpdateInterval {
+			h.replyError(client, reqID, codeInvalidRate, "", fmt.Sprintf("invalid 'min_interval' %q, use a duration such as \"2s\", at most %s", interval, maxUpdateInterval))
+			return
+		}
+	}
+
+	client.mu.Lock()
+	client.minInterval = d
+	client.mu.Unlock()
+	select {
+	case client.wake <- struct{}{}: // limit may have been lowered
+	default:
+	}
+
+	h.reply(client, reqID, ServerMessage{
+		Type:      "rate_set",
+		Data:      map[string]string{"min_interval": d.String()},
+		Timestamp: time.Now(),
+	})
+}
+
+// ---------------------------------------------------------------------------
+// Stats
+// ---------------------------------------------------------------------------
+
+// HubStats are the WebSocket delivery counters, served at /ws/stats.
+type HubStats struct {
+	Clients             int    `json:"clients"`
+	Tickers             int    `json:"tickers"`
+	ConflatedUpdates    uint64 `json:"conflatedUpdates"`    // updates replaced before they were written
+	DroppedMessages     uint64 `json:"droppedMessages"`     // non-update messages dropped on a full send buffer
+	SlowClientEvictions uint64 `json:"slowClientEvictions"` // clients disconnected for falling behind
+}
+
+// Stats returns the current counters.
+func (h *Hub) Stats() HubStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return HubStats{
+		Clients:             len(h.clients),
+		Tickers:             len(h.store),
+		ConflatedUpdates:    h.conflated.Load(),
+		DroppedMessages:     h.dropped.Load(),
+		SlowClientEvictions: h.evictions.Load(),
+	}
+}
+
+// ServeStats is the handler for GET /ws/stats.
+func (h *Hub) ServeStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, h.Stats())
+}
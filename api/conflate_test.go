@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// takeUpdate removes and returns the client's pending update for ticker.
+func takeUpdate(t *testing.T, c *Client, ticker string) []byte {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u, ok := c.updates[ticker]
+	if !ok {
+		t.Fatalf("Expected a pending update for %s", ticker)
+	}
+	delete(c.updates, ticker)
+	return u.payload
+}
+
+func TestQueueUpdateConflates(t *testing.T) {
+	h := newTestHub(t)
+	c := newClient(h, nil, 2)
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		full := ServerMessage{Type: "stock_update", Ticker: "TSLA:NASDAQ", Seq: seq, Data: map[string]int{"price": int(seq)}}
+		delta := ServerMessage{Type: "delta", Ticker: "TSLA:NASDAQ", Seq: seq, Data: map[string]int{"price": int(seq)}}
+		h.queueUpdate([]*Client{c}, delta, full)
+	}
+	// An older update arriving late doesn't replace a newer one.
+	h.queueUpdate([]*Client{c}, ServerMessage{Type: "stock_update", Ticker: "TSLA:NASDAQ", Seq: 2}, ServerMessage{})
+
+	var msg ServerMessage
+	json.Unmarshal(takeUpdate(t, c, "TSLA:NASDAQ"), &msg)
+	if msg.Type != "stock_update" || msg.Seq != 3 {
+		t.Fatalf("Expected the latest update in full, got %+v", msg)
+	}
+	if got := h.Stats().ConflatedUpdates; got != 2 {
+		t.Fatalf("Expected 2 conflated updates, got %d", got)
+	}
+}
+
+func TestTakeUpdatesRespectsRate(t *testing.T) {
+	h := newTestHub(t)
+	c := newClient(h, nil, 2)
+	c.minInterval = 2 * time.Second
+
+	now := time.Now()
+	c.lastSent["TSLA:NASDAQ"] = now.Add(-time.Second)
+	h.queueUpdate([]*Client{c}, ServerMessage{Type: "stock_update", Ticker: "TSLA:NASDAQ", Seq: 1}, ServerMessage{})
+	h.queueUpdate([]*Client{c}, ServerMessage{Type: "crypto_update", Ticker: "BTC-USD", Seq: 1}, ServerMessage{})
+
+	ready, next := c.takeUpdates(now)
+	if len(ready) != 1 || next <= 0 || next > time.Second {
+		t.Fatalf("Expected BTC-USD now and TSLA:NASDAQ within a second, got %d ready, next in %s", len(ready), next)
+	}
+	if ready, next := c.takeUpdates(now.Add(time.Second)); len(ready) != 1 || next != 0 {
+		t.Fatalf("Expected TSLA:NASDAQ once its interval passed, got %d ready, next in %s", len(ready), next)
+	}
+}
+
+func TestSlowClientEvicted(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.WSSlowClientTimeout = 50 * time.Millisecond
+	c := newClient(h, nil, 2)
+	for len(c.send) < cap(c.send) {
+		c.send <- []byte("{}")
+	}
+
+	h.sendToClient(c, ServerMessage{Type: "alert"})
+	if h.Stats().SlowClientEvictions != 0 {
+		t.Fatal("Expected no eviction before the timeout")
+	}
+	time.Sleep(60 * time.Millisecond)
+	h.sendToClient(c, ServerMessage{Type: "alert"})
+	if stats := h.Stats(); stats.SlowClientEvictions != 1 || stats.DroppedMessages != 2 {
+		t.Fatalf("Expected the client to be evicted after 2 drops, got %+v", stats)
+	}
+}
+
+func TestProtocolSetRate(t *testing.T) {
+	h := newTestHub(t)
+	conn := dialTestHub(t, h, subprotocolV2)
+
+	conn.WriteJSON(map[string]interface{}{"action": "set_rate", "id": "r-1", "min_interval": "fast"})
+	if e := conn.readType(t, "error"); e.ID != "r-1" || e.Code != codeInvalidRate {
+		t.Fatalf("Expected invalid_rate for r-1, got %+v", e)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"action": "set_rate", "id": "r-2", "min_interval": "2s"})
+	if ack := conn.readType(t, "rate_set"); ack.ID != "r-2" || ack.Data.(map[string]interface{})["min_interval"] != "2s" {
+		t.Fatalf("Expected rate_set for r-2, got %+v", ack)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gocolly/colly/v2"
 )
@@ -22,8 +24,9 @@ type Crypto_News struct {
 	Thumbnail_Link string `json:"thumbnailLink,omitempty"`
 }
 
-func Get_Crypto_Data(collector *colly.Collector, crypto_name, crypto_currency string) *Crypto_Key_Stats {
-
+func Get_Crypto_Data(ctx context.Context, collector *colly.Collector, crypto_name, crypto_currency string) *Crypto_Key_Stats {
+	log := scrapeLogger(ctx, crypto_name+"-"+crypto_currency, "crypto")
+	start := time.Now()
 	url := "https://www.google.com/finance/quote/" + crypto_name + "-" + crypto_currency
 
 	var name string
@@ -62,6 +65,7 @@ func Get_Crypto_Data(collector *colly.Collector, crypto_name, crypto_currency st
 	collector.Visit(url)
 	collector.Wait()
 
+	logScrape(log, "crypto", name != "", start)
 	if name == "" {
 		return &Crypto_Key_Stats{}
 	}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"testing"
 )
 
 func TestGetCryptoData(t *testing.T) {
 	c := newTestCollector()
-	data := Get_Crypto_Data(c, "BTC", "USD")
+	data := Get_Crypto_Data(context.Background(), c, "BTC", "USD")
 
 	if data.Name == "" {
 		t.Fatal("Expected non-empty crypto name for BTC-USD")
@@ -24,7 +25,7 @@ func TestGetCryptoData(t *testing.T) {
 
 func TestGetCryptoDataInvalid(t *testing.T) {
 	c := newTestCollector()
-	data := Get_Crypto_Data(c, "FAKECOIN999", "ZZZZ")
+	data := Get_Crypto_Data(context.Background(), c, "FAKECOIN999", "ZZZZ")
 
 	if data.Name != "" {
 		t.Fatalf("Expected empty name for invalid crypto query, got: %s", data.Name)
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// Get_Currency_Rate scrapes the Google Finance page for a currency pair
+// (e.g. USD-EUR) and returns how many units of to one unit of from buys.
+// It returns 0 if the pair couldn't be scraped.
+func Get_Currency_Rate(collector *colly.Collector, from, to string) float64 {
+
+	url := "https://www.google.com/finance/quote/" + from + "-" + to
+
+	var rate float64
+
+	collector.OnHTML("div.YMlKec.fxKbKc", func(element *colly.HTMLElement) {
+		text := strings.ReplaceAll(element.Text, ",", "")
+		value, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err == nil {
+			rate = value
+		}
+	})
+
+	collector.Visit(url)
+	collector.Wait()
+
+	return rate
+}
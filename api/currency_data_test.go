@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetCurrencyRate(t *testing.T) {
+	c := newTestCollector()
+	rate := Get_Currency_Rate(c, "USD", "INR")
+
+	if rate == 0 {
+		t.Fatal("Expected non-zero rate for USD-INR")
+	}
+
+	t.Logf("USD-INR: %.4f", rate)
+}
+
+func TestGetCurrencyRateInvalid(t *testing.T) {
+	c := newTestCollector()
+	rate := Get_Currency_Rate(c, "ZZZ", "QQQ")
+
+	if rate != 0 {
+		t.Fatalf("Expected zero rate for invalid pair, got: %f", rate)
+	}
+}
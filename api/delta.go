@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Delta updates – only the fields that changed, with per-ticker sequencing
+// ---------------------------------------------------------------------------
+
+// Every change to a ticker bumps StockEntry.Seq, and every update, delta
+// and resync reply carries it. A delta client keeps the last full update it
+// saw and merges each "delta" into it. If a delta's seq isn't exactly one
+// more than the last one applied, updates were missed (a slow connection
+// drops messages) and the client should send "resync" for a fresh snapshot.
+
+// setDelta turns delta updates for ticker on or off for client.
+func (h *Hub) setDelta(client *Client, ticker string, on bool) {
+	ticker = strings.TrimSpace(strings.ToUpper(ticker))
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if on {
+		client.delta[ticker] = struct{}{}
+	} else {
+		delete(client.delta, ticker)
+	}
+}
+
+// deltaMessage turns full, the update for entry in currency, into a "delta"
+// holding only the fields that differ from prev. full is returned unchanged
+// when prev can't serve as a base: it had no data, isn't the immediately
+// preceding version, or either side failed to convert.
+func (h *Hub) deltaMessage(full ServerMessage, prev *StockEntry, currency string) ServerMessage {
+	if prev == nil || (prev.StockData == nil && prev.CryptoData == nil) || prev.Seq+1 != full.Seq || full.Error != "" {
+		return full
+	}
+	base := h.convertedMessage(prev, currency)
+	if base.Error != "" {
+		return full
+	}
+	fields, err := diffFields(base.Data, full.Data)
+	if err != nil {
+		return full
+	}
+	return ServerMessage{
+		Type:      "delta",
+		Ticker:    full.Ticker,
+		Data:      fields,
+		Stale:     full.Stale,
+		Seq:       full.Seq,
+		Timestamp: full.Timestamp,
+	}
+}
+
+// diffFields compares the JSON forms of two payloads and returns the
+// top-level fields of cur that differ from prev. Fields missing from cur are
+// reported as null. The result is empty, not nil, if nothing changed.
+func diffFields(prev, cur interface{}) (map[string]interface{}, error) {
+	before, err := jsonFields(prev)
+	if err != nil {
+		return nil, err
+	}
+	after, err := jsonFields(cur)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]interface{})
+	for k, v := range after {
+		if old, ok := before[k]; !ok || !reflect.DeepEqual(old, v) {
+			changed[k] = v
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changed[k] = nil
+		}
+	}
+	return changed, nil
+}
+
+func jsonFields(v interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// resync replies with the full current update for ticker, so a delta client
+// that detected a gap can start over from its seq.
+func (h *Hub) resync(client *Client, reqID, ticker string) {
+	ticker = strings.TrimSpace(strings.ToUpper(ticker))
+
+	client.mu.Lock()
+	_, subscribed := client.tickers[ticker]
+	currency := client.convert[ticker]
+	client.mu.Unlock()
+	if !subscribed {
+		h.replyError(client, reqID, codeNotSubscribed, ticker, "not subscribed to "+ticker)
+		return
+	}
+
+	h.mu.RLock()
+	var entry StockEntry
+	if e, ok := h.store[ticker]; ok {
+		entry = *e
+	}
+	h.mu.RUnlock()
+
+	if entry.StockData == nil && entry.CryptoData == nil {
+		// Nothing to send yet; the first update will be a full one.
+		h.replyError(client, reqID, codeUnavailable, ticker, "no data for "+ticker+" yet, the first update will be sent in full")
+		return
+	}
+	msg := h.convertedMessage(&entry, currency)
+	if client.protocol >= 2 {
+		msg.ID = reqID
+	}
+	// Queued like any update, so it replaces one that's still pending.
+	h.queueUpdate([]*Client{client}, msg, msg)
+}
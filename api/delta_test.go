@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiffFields(t *testing.T) {
+	prev := &Stock_Key_Stats{Name: "Tesla Inc", Price: 400, Change: 1, Volume: "10M"}
+	cur := &Stock_Key_Stats{Name: "Tesla Inc", Price: 401, Change: 2, Volume: "10M"}
+
+	fields, err := diffFields(prev, cur)
+	if err != nil {
+		t.Fatalf("diffFields failed: %v", err)
+	}
+	if len(fields) != 2 || fields["price"] != float64(401) || fields["change"] != float64(2) {
+		t.Fatalf("Expected only price and change, got %v", fields)
+	}
+
+	fields, _ = diffFields(map[string]interface{}{"a": 1, "b": 2}, map[string]interface{}{"a": 1})
+	if v, ok := fields["b"]; !ok || v != nil || len(fields) != 1 {
+		t.Fatalf("Expected a removed field to be null, got %v", fields)
+	}
+
+	if fields, _ := diffFields(cur, cur); fields == nil || len(fields) != 0 {
+		t.Fatalf("Expected an empty diff, got %v", fields)
+	}
+}
+
+func TestBroadcastEntryDelta(t *testing.T) {
+	h := newTestHub(t)
+	full := newClient(h, nil, 2)
+	delta := newClient(h, nil, 2)
+	delta.delta["TSLA:NASDAQ"] = struct{}{}
+	h.subscribers["TSLA:NASDAQ"] = map[*Client]struct{}{full: {}, delta: {}}
+
+	prev := &StockEntry{Ticker: "TSLA:NASDAQ", IsStock: true, Seq: 4, StockData: &Stock_Key_Stats{Name: "Tesla Inc", Price: 400}}
+	cur := &StockEntry{Ticker: "TSLA:NASDAQ", IsStock: true, Seq: 5, StockData: &Stock_Key_Stats{Name: "Tesla Inc", Price: 401}}
+	h.broadcastEntry(cur, prev)
+
+	var msg struct {
+		Type string                 `json:"type"`
+		Seq  uint64                 `json:"seq"`
+		Data map[string]interface{} `json:"data"`
+	}
+	json.Unmarshal(takeUpdate(t, full, "TSLA:NASDAQ"), &msg)
+	if msg.Type != "stock_update" || msg.Seq != 5 || msg.Data["stockName"] != "Tesla Inc" {
+		t.Fatalf("Expected a full update with seq 5, got %+v", msg)
+	}
+	msg.Data = nil
+	json.Unmarshal(takeUpdate(t, delta, "TSLA:NASDAQ"), &msg)
+	if msg.Type != "delta" || msg.Seq != 5 || len(msg.Data) != 1 || msg.Data["price"] != float64(401) {
+		t.Fatalf("Expected a price-only delta with seq 5, got %+v", msg)
+	}
+
+	// Without the preceding version as a base, delta clients get it in full.
+	prev.Seq = 2
+	h.broadcastEntry(cur, prev)
+	takeUpdate(t, full, "TSLA:NASDAQ")
+	msg.Data = nil
+	json.Unmarshal(takeUpdate(t, delta, "TSLA:NASDAQ"), &msg)
+	if msg.Type != "stock_update" || msg.Data["stockName"] != "Tesla Inc" {
+		t.Fatalf("Expected a full update after a gap, got %+v", msg)
+	}
+}
+
+func TestProtocolResync(t *testing.T) {
+	h := newTestHub(t)
+	conn := dialTestHub(t, h, subprotocolV2)
+
+	conn.WriteJSON(map[string]interface{}{"action": "resync", "id": "r-1", "ticker": "TSLA:NASDAQ"})
+	if e := conn.readType(t, "error"); e.ID != "r-1" || e.Code != codeNotSubscribed {
+		t.Fatalf("Expected not_subscribed for r-1, got %+v", e)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "ticker": "TSLA:NASDAQ", "delta": true})
+	conn.readType(t, "subscribed")
+
+	h.mu.Lock()
+	h.store["TSLA:NASDAQ"].StockData = &Stock_Key_Stats{Name: "Tesla Inc", Price: 400}
+	h.store["TSLA:NASDAQ"].Seq = 7
+	h.mu.Unlock()
+
+	conn.WriteJSON(map[string]interface{}{"action": "resync", "id": "r-2", "ticker": "TSLA:NASDAQ"})
+	update := conn.readType(t, "stock_update")
+	if update.ID != "r-2" || update.Seq != 7 || update.Data.(map[string]interface{})["price"] != float64(400) {
+		t.Fatalf("Expected a full update with seq 7 for r-2, got %+v", update)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"action": "list_subscriptions"})
+	list := conn.readType(t, "subscriptions")
+	if d := list.Data.(map[string]interface{})["delta"].([]interface{}); len(d) != 1 || d[0] != "TSLA:NASDAQ" {
+		t.Fatalf("Expected TSLA:NASDAQ in delta mode, got %+v", list.Data)
+	}
+}
+
+func TestSeqContinuesAfterRetrack(t *testing.T) {
+	h := newTestHub(t)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.store["TSLA:NASDAQ"] = &StockEntry{Ticker: "TSLA:NASDAQ", IsStock: true, Seq: 7, StockData: &Stock_Key_Stats{Price: 400}}
+	h.store["AAPL:NASDAQ"] = &StockEntry{Ticker: "AAPL:NASDAQ", IsStock: true, Seq: 3}
+	h.dropTicker("TSLA:NASDAQ")
+	h.dropTicker("AAPL:NASDAQ")
+
+	// AAPL had no data to keep warm, and TSLA's warm entry is gone.
+	delete(h.warm, "TSLA:NASDAQ")
+	for _, ticker := range []string{"TSLA:NASDAQ", "AAPL:NASDAQ"} {
+		entry, _ := h.trackTicker(ticker)
+		if entry.Seq < 7 {
+			t.Errorf("Expected %s to start from seq 7, got %d", ticker, entry.Seq)
+		}
+	}
+}
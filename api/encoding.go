@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ---------------------------------------------------------------------------
+// Message encodings – JSON text or MessagePack / CBOR binary frames
+// ---------------------------------------------------------------------------
+
+// A v2 client can ask for a binary encoding with the "stonks.v2.msgpack" or
+// "stonks.v2.cbor" subprotocol. The schema is the same as JSON: field names
+// come from the json tags, and omitted fields are omitted. Times are native
+// timestamps (the MessagePack timestamp extension, CBOR tag 1) instead of
+// RFC 3339 strings. Each message is its own binary frame; JSON messages
+// written together still share a text frame, one per line.
+
+// encoding is how a client's messages are serialized.
+type encoding int
+
+const (
+	encodingJSON encoding = iota
+	encodingMsgpack
+	encodingCBOR
+
+	numEncodings
+)
+
+func (e encoding) String() string {
+	switch e {
+	case encodingMsgpack:
+		return "MessagePack"
+	case encodingCBOR:
+		return "CBOR"
+	}
+	return "JSON"
+}
+
+// cborEnc writes times as CBOR epoch timestamps (tag 1).
+var cborEnc = func() cbor.EncMode {
+	em, err := cbor.EncOptions{Time: cbor.TimeUnixDynamic, TimeTag: cbor.EncTagRequired}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return em
+}()
+
+// marshal encodes v.
+func (e encoding) marshal(v interface{}) ([]byte, error) {
+	switch e {
+	case encodingMsgpack:
+		var buf bytes.Buffer
+		enc := msgpack.GetEncoder()
+		defer msgpack.PutEncoder(enc)
+		enc.Reset(&buf) // also clears the options below
+		enc.SetCustomStructTag("json")
+		enc.UseCompactInts(true)
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case encodingCBOR:
+		return cborEnc.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// unmarshal decodes data into v.
+func (e encoding) unmarshal(data []byte, v interface{}) error {
+	switch e {
+	case encodingMsgpack:
+		dec := msgpack.GetDecoder()
+		defer msgpack.PutDecoder(dec)
+		dec.Reset(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	case encodingCBOR:
+		return cbor.Unmarshal(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// stampSessionSeq is the stampSessionSeq function for messages in encoding e.
+func (e encoding) stampSessionSeq(payload []byte, seq uint64) []byte {
+	switch e {
+	case encodingMsgpack:
+		return stampMsgpack(payload, seq)
+	case encodingCBOR:
+		return stampCBOR(payload, seq)
+	}
+	return stampSessionSeq(payload, seq)
+}
+
+// stampMsgpack splices sessionSeq into a MessagePack map, growing its
+// header by one entry.
+func stampMsgpack(payload []byte, seq uint64) []byte {
+	var n, skip int
+	switch b := payload[0]; {
+	case b&0xf0 == 0x80: // fixmap
+		n, skip = int(b&0x0f), 1
+	case b == 0xde: // map 16
+		n, skip = int(payload[1])<<8|int(payload[2]), 3
+	default:
+		return payload // not a map; messages always are
+	}
+	value, _ := encodingMsgpack.marshal(seq)
+
+	b := make([]byte, 0, len(payload)+16+len(value))
+	if n+1 < 16 {
+		b = append(b, 0x80|byte(n+1))
+	} else {
+		b = append(b, 0xde, byte((n+1)>>8), byte(n+1))
+	}
+	b = append(b, 0xa0|byte(len("sessionSeq")))
+	b = append(b, "sessionSeq"...)
+	b = append(b, value...)
+	return append(b, payload[skip:]...)
+}
+
+// stampCBOR splices sessionSeq into a CBOR map, growing its header by one
+// entry.
+func stampCBOR(payload []byte, seq uint64) []byte {
+	var n, skip int
+	switch b := payload[0]; {
+	case b >= 0xa0 && b <= 0xb7: // map, length in the initial byte
+		n, skip = int(b-0xa0), 1
+	case b == 0xb8: // map, 1-byte length
+		n, skip = int(payload[1]), 2
+	default:
+		return payload // not a map; messages always are
+	}
+	value, _ := cborEnc.Marshal(seq)
+
+	b := make([]byte, 0, len(payload)+16+len(value))
+	if n+1 <= 23 {
+		b = append(b, 0xa0+byte(n+1))
+	} else {
+		b = append(b, 0xb8, byte(n+1))
+	}
+	b = append(b, 0x60|byte(len("sessionSeq")))
+	b = append(b, "sessionSeq"...)
+	b = append(b, value...)
+	return append(b, payload[skip:]...)
+}
+
+// encodedMessage encodes one message at most once per encoding, so a
+// broadcast costs one marshal per format rather than one per subscriber.
+type encodedMessage struct {
+	msg      ServerMessage
+	payloads [numEncodings][]byte
+	failed   [numEncodings]bool
+}
+
+// payload returns msg in encoding e, or nil if it can't be encoded.
+func (m *encodedMessage) payload(e encoding) []byte {
+	if m.payloads[e] == nil && !m.failed[e] {
+		p, err := e.marshal(m.msg)
+		if err != nil {
+			slog.Error("marshal error", "component", "hub", "encoding", e.String(), "error", err)
+			m.failed[e] = true
+			return nil
+		}
+		m.payloads[e] = p
+	}
+	return m.payloads[e]
+}
+
+// decodeClientMessage decodes a frame from c: text frames are always JSON,
+// binary frames use the client's encoding.
+func decodeClientMessage(c *Client, binary bool, raw []byte) (ClientMessage, error) {
+	var msg ClientMessage
+	e := encodingJSON
+	if binary {
+		e = c.encoding
+	}
+	if err := e.unmarshal(raw, &msg); err != nil {
+		return msg, fmt.Errorf("expected a %s object with 'action' and 'ticker' fields", e)
+	}
+	return msg, nil
+}
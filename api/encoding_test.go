@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func testUpdate() ServerMessage {
+	return ServerMessage{
+		Type:   "stock_update",
+		Ticker: "TSLA:NASDAQ",
+		Data: &Stock_Key_Stats{
+			Name:          "Tesla Inc",
+			Price:         398.41,
+			PreviousClose: 391.09,
+			DayRange:      "391.50 - 402.00",
+			MarketCap:     "1.27T USD",
+		},
+		Seq:       42,
+		Timestamp: time.Now(),
+	}
+}
+
+func TestEncodingsShareSchema(t *testing.T) {
+	want, err := encodingJSON.marshal(testUpdate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jsonFields map[string]interface{}
+	encodingJSON.unmarshal(want, &jsonFields)
+
+	for _, e := range []encoding{encodingMsgpack, encodingCBOR} {
+		payload, err := e.marshal(testUpdate())
+		if err != nil {
+			t.Fatalf("%s: %v", e, err)
+		}
+		var fields map[string]interface{}
+		if err := e.unmarshal(payload, &fields); err != nil {
+			t.Fatalf("%s: %v", e, err)
+		}
+		if len(fields) != len(jsonFields) {
+			t.Errorf("%s: got fields %v, want the JSON ones %v", e, fields, jsonFields)
+		}
+		for k := range jsonFields {
+			if _, ok := fields[k]; !ok {
+				t.Errorf("%s: missing field %q", e, k)
+			}
+		}
+		if len(payload) >= len(want) {
+			t.Errorf("%s: %d bytes, no smaller than JSON's %d", e, len(payload), len(want))
+		}
+	}
+}
+
+func TestStampSessionSeqBinary(t *testing.T) {
+	for _, e := range []encoding{encodingMsgpack, encodingCBOR} {
+		payload, _ := e.marshal(testUpdate())
+		var msg ServerMessage
+		if err := e.unmarshal(e.stampSessionSeq(payload, 300), &msg); err != nil {
+			t.Fatalf("%s: %v", e, err)
+		}
+		if msg.SessionSeq != 300 || msg.Type != "stock_update" || msg.Seq != 42 {
+			t.Errorf("%s: unexpected stamped message %+v", e, msg)
+		}
+
+		// The map header grows past its short form.
+		big := make(map[string]int)
+		for i := 0; i < 23; i++ {
+			big[fmt.Sprintf("f%02d", i)] = i
+		}
+		payload, _ = e.marshal(big)
+		var fields map[string]interface{}
+		if err := e.unmarshal(e.stampSessionSeq(payload, 7), &fields); err != nil || len(fields) != 24 {
+			t.Errorf("%s: expected 24 fields after stamping, got %d (%v)", e, len(fields), err)
+		}
+	}
+}
+
+// readBinary reads binary frames from conn until a message of type
+// msgType arrives.
+func readBinary(t *testing.T, conn *testConn, e encoding, msgType string) ServerMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		frameType, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Waiting for %q: %v", msgType, err)
+		}
+		if frameType != websocket.BinaryMessage {
+			t.Fatalf("Expected a binary frame, got type %d: %s", frameType, frame)
+		}
+		var msg ServerMessage
+		if err := e.unmarshal(frame, &msg); err != nil {
+			t.Fatalf("Decoding %s frame: %v", e, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestProtocolBinaryEncodings(t *testing.T) {
+	for sub, e := range map[string]encoding{subprotocolV2Msgpack: encodingMsgpack, subprotocolV2CBOR: encodingCBOR} {
+		t.Run(e.String(), func(t *testing.T) {
+			h := newTestHub(t)
+			conn := dialTestHub(t, h, sub, subprotocolV2)
+			if conn.Subprotocol() != sub {
+				t.Fatalf("Expected %s to be preferred, got %q", sub, conn.Subprotocol())
+			}
+			if s := readBinary(t, conn, e, "session"); s.SessionSeq != 1 {
+				t.Fatalf("Expected the session message first, got %+v", s)
+			}
+
+			frame, _ := e.marshal(ClientMessage{Action: "subscribe", ID: "s-1", Ticker: "TSLA:NASDAQ"})
+			conn.WriteMessage(websocket.BinaryMessage, frame)
+			if ack := readBinary(t, conn, e, "subscribed"); ack.ID != "s-1" || ack.Ticker != "TSLA:NASDAQ" || ack.SessionSeq != 2 {
+				t.Fatalf("Unexpected ack %+v", ack)
+			}
+
+			// JSON text frames are still understood.
+			conn.WriteJSON(map[string]interface{}{"action": "list_subscriptions", "id": "l-1"})
+			if list := readBinary(t, conn, e, "subscriptions"); list.ID != "l-1" {
+				t.Fatalf("Unexpected reply %+v", list)
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeUpdate(b *testing.B) {
+	msg := testUpdate()
+	for e := encodingJSON; e < numEncodings; e++ {
+		b.Run(e.String(), func(b *testing.B) {
+			payload, _ := e.marshal(msg)
+			b.ReportMetric(float64(len(payload)), "bytes/msg")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				e.marshal(msg)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeClientMessage(b *testing.B) {
+	msg := ClientMessage{Action: "subscribe", ID: "s-1", Tickers: []string{"TSLA:NASDAQ", "BTC-USD", ".DJI:INDEXDJX"}}
+	for e := encodingJSON; e < numEncodings; e++ {
+		b.Run(e.String(), func(b *testing.B) {
+			c := &Client{encoding: e}
+			raw, _ := e.marshal(msg)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				decodeClientMessage(c, e != encodingJSON, raw)
+			}
+		})
+	}
+}
+
+// BenchmarkQueueUpdate fans one update out to 500 subscribers of one
+// encoding; the message is marshalled once either way.
+func BenchmarkQueueUpdate(b *testing.B) {
+	h := NewHub(newOfflineCollector(), LoadConfig())
+	msg := testUpdate()
+	for e := encodingJSON; e < numEncodings; e++ {
+		b.Run(e.String(), func(b *testing.B) {
+			clients := make([]*Client, 500)
+			for i := range clients {
+				clients[i] = newClient(h, nil, 2)
+				clients[i].encoding = e
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				msg.Seq = uint64(i)
+				h.queueUpdate(clients, msg, msg)
+				for _, c := range clients {
+					c.takeUpdates(time.Now())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// ---------------------------------------------------------------------------
+// Currency conversion of quotes
+// ---------------------------------------------------------------------------
+
+// Conversion describes how a quote was converted. Original holds the
+// unconverted data as scraped.
+type Conversion struct {
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Rate     float64     `json:"rate"`
+	RateTime time.Time   `json:"rateTime"` // when the rate was scraped
+	Original interface{} `json:"original"`
+}
+
+// ConvertedStock is a stock quote with its prices in another currency.
+type ConvertedStock struct {
+	Stock_Key_Stats
+	Conversion *Conversion `json:"conversion"`
+}
+
+// ConvertedCrypto is a crypto quote with its prices in another currency.
+type ConvertedCrypto struct {
+	Crypto_Key_Stats
+	Conversion *Conversion `json:"conversion"`
+}
+
+var (
+	// errNoRate means no exchange rate could be scraped for a pair.
+	errNoRate = errors.New("no exchange rate available")
+	// errUnknownPair means Google has no rate for a pair that has never
+	// had one, most likely because one of the codes doesn't exist.
+	errUnknownPair = errors.New("no exchange rate found")
+)
+
+// fxRate is a cached exchange rate.
+type fxRate struct {
+	rate    float64
+	fetched time.Time
+}
+
+// fxCall is an in-flight rate fetch that concurrent callers wait on.
+type fxCall struct {
+	done chan struct{}
+	rate fxRate
+	ok   bool
+}
+
+// FXRates fetches exchange rates from Google Finance currency pages and
+// caches them for a TTL. Concurrent requests for the same pair share one
+// scrape. Pairs whose first scrape finds no rate are not scraped again
+// until failTTL has passed.
+type FXRates struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	failTTL  time.Duration
+	rates    map[string]fxRate    // "USD-EUR" -> rate
+	inflight map[string]*fxCall   // pairs being fetched
+	failed   map[string]time.Time // unknown pairs -> when they may be retried
+
+	// fetch scrapes one rate. Replaced in tests.
+	fetch func(from, to string) (float64, bool)
+}
+
+// NewFXRates creates a rate cache that scrapes with clones of c. Pairs
+// with no rate are refused for failTTL.
+func NewFXRates(c *colly.Collector, ttl, failTTL time.Duration) *FXRates {
+	return &FXRates{
+		ttl:      ttl,
+		failTTL:  failTTL,
+		rates:    make(map[string]fxRate),
+		inflight: make(map[string]*fxCall),
+		failed:   make(map[string]time.Time),
+		fetch: func(from, to string) (float64, bool) {
+			rate := Get_Currency_Rate(c.Clone(), from, to)
+			return rate, rate > 0
+		},
+	}
+}
+
+// validCurrency reports whether s looks like an ISO 4217 code.
+func validCurrency(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Rate returns how many units of to one unit of from is worth. Prices on
+// London quotes are in pence (GBX), which Google has no pair for, so they
+// go through GBP. An expired rate is still used if a fresh one can't be
+// scraped.
+func (fx *FXRates) Rate(from, to string) (float64, time.Time, error) {
+	return fx.lookup(from, to, true)
+}
+
+// CachedRate is Rate without waiting for a scrape. It returns the cached
+// rate, expired or not, and fetches a missing or expired one in the
+// background, so it fails until the pair's first rate has arrived.
+func (fx *FXRates) CachedRate(from, to string) (float64, time.Time, error) {
+	return fx.lookup(from, to, false)
+}
+
+// Unknown reports whether the pair is in the negative cache, i.e. its
+// first scrape found no rate less than failTTL ago.
+func (fx *FXRates) Unknown(from, to string) bool {
+	from, to, _ = fxPair(from, to)
+	if from == to {
+		return false
+	}
+	fx.mu.Lock()
+	defer fx.mu.Unlock()
+	return fx.unknownLocked(from + "-" + to)
+}
+
+func (fx *FXRates) unknownLocked(pair string) bool {
+	until, ok := fx.failed[pair]
+	return ok && time.Now().Before(until)
+}
+
+// fxPair maps pence to pounds, returning the pair Google quotes and the
+// factor its rate must be scaled by.
+func fxPair(from, to string) (string, string, float64) {
+	scale := 1.0
+	if from == "GBX" {
+		from, scale = "GBP", scale/100
+	}
+	if to == "GBX" {
+		to, scale = "GBP", scale*100
+	}
+	return from, to, scale
+}
+
+func (fx *FXRates) lookup(from, to string, wait bool) (float64, time.Time, error) {
+	if from == to {
+		return 1, time.Now(), nil
+	}
+	from, to, scale := fxPair(from, to)
+	if from == to {
+		return scale, time.Now(), nil
+	}
+
+	get := fx.rate
+	if !wait {
+		get = fx.cachedRate
+	}
+	r, err := get(from, to)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return r.rate * scale, r.fetched, nil
+}
+
+// cachedRate returns the cached rate for the pair and starts a refresh if
+// it's missing or expired. Unknown pairs are not fetched.
+func (fx *FXRates) cachedRate(from, to string) (fxRate, error) {
+	pair := from + "-" + to
+	fx.mu.Lock()
+	if fx.unknownLocked(pair) {
+		fx.mu.Unlock()
+		return fxRate{}, fmt.Errorf("%w for %s", errUnknownPair, pair)
+	}
+	cached, have := fx.rates[pair]
+	_, running := fx.inflight[pair]
+	fx.mu.Unlock()
+
+	if (!have || time.Since(cached.fetched) >= fx.ttl) && !running {
+		go fx.rate(from, to)
+	}
+	if !have {
+		return fxRate{}, fmt.Errorf("%w for %s yet", errNoRate, pair)
+	}
+	return cached, nil
+}
+
+func (fx *FXRates) rate(from, to string) (fxRate, error) {
+	pair := from + "-" + to
+
+	fx.mu.Lock()
+	if fx.unknownLocked(pair) {
+		fx.mu.Unlock()
+		return fxRate{}, fmt.Errorf("%w for %s", errUnknownPair, pair)
+	}
+	cached, have := fx.rates[pair]
+	if have && time.Since(cached.fetched) < fx.ttl {
+		fx.mu.Unlock()
+		return cached, nil
+	}
+	call, running := fx.inflight[pair]
+	if !running {
+		call = &fxCall{done: make(chan struct{})}
+		fx.inflight[pair] = call
+	}
+	fx.mu.Unlock()
+
+	if running {
+		<-call.done
+	} else {
+		rate, ok := fx.fetch(from, to)
+		call.rate, call.ok = fxRate{rate: rate, fetched: time.Now()}, ok
+
+		fx.mu.Lock()
+		if ok {
+			fx.rates[pair] = call.rate
+		} else if !have && fx.failTTL > 0 && !upstream.blocked() {
+			// A pair that has never had a rate most likely doesn't exist.
+			// While the upstream guard turns scrapes away that's unknown,
+			// so the pair is only refused after a real attempt.
+			now := time.Now()
+			for p, until := range fx.failed {
+				if !now.Before(until) {
+					delete(fx.failed, p)
+				}
+			}
+			fx.failed[pair] = now.Add(fx.failTTL)
+		}
+		delete(fx.inflight, pair)
+		fx.mu.Unlock()
+		close(call.done)
+	}
+
+	if call.ok {
+		return call.rate, nil
+	}
+	if have {
+		slog.Warn("could not refresh exchange rate, using cached rate", "component", "fx", "pair", pair, "fetched", cached.fetched)
+		return cached, nil
+	}
+	return fxRate{}, fmt.Errorf("%w for %s", errNoRate, pair)
+}
+
+// ConvertEntry returns the entry's data with prices converted to currency,
+// as a ConvertedStock or ConvertedCrypto. Percentages are unchanged, and
+// market cap is left as scraped.
+func (fx *FXRates) ConvertEntry(entry StockEntry, currency string) (interface{}, error) {
+	return fx.convertEntry(entry, currency, true)
+}
+
+// convertEntry is ConvertEntry. Unless wait is set, it only uses cached
+// rates, see CachedRate.
+func (fx *FXRates) convertEntry(entry StockEntry, currency string, wait bool) (interface{}, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if !validCurrency(currency) {
+		return nil, fmt.Errorf("invalid currency '%s', use a 3-letter code such as EUR", currency)
+	}
+	if entry.IsIndex {
+		return nil, errors.New("indexes are quoted in points and can't be converted")
+	}
+	from := quoteCurrency(entry.Ticker)
+	if from == "" {
+		return nil, fmt.Errorf("unknown quote currency for %s", entry.Ticker)
+	}
+
+	rate, at, err := fx.lookup(from, currency, wait)
+	if err != nil {
+		return nil, err
+	}
+	conv := &Conversion{From: from, To: currency, Rate: rate, RateTime: at}
+
+	switch {
+	case entry.StockData != nil:
+		conv.Original = entry.StockData
+		out := ConvertedStock{Stock_Key_Stats: *entry.StockData, Conversion: conv}
+		out.Price = float32(float64(out.Price) * rate)
+		out.PreviousClose = float32(float64(out.PreviousClose) * rate)
+		out.Change = float32(float64(out.Change) * rate)
+		out.DayRange = convertRange(out.DayRange, rate)
+		out.YearRange = convertRange(out.YearRange, rate)
+		return out, nil
+	case entry.CryptoData != nil:
+		conv.Original = entry.CryptoData
+		out := ConvertedCrypto{Crypto_Key_Stats: *entry.CryptoData, Conversion: conv}
+		out.Price = float32(float64(out.Price) * rate)
+		out.PreviousClose = float32(float64(out.PreviousClose) * rate)
+		out.Change = float32(float64(out.Change) * rate)
+		return out, nil
+	}
+	return nil, fmt.Errorf("no data for %s", entry.Ticker)
+}
+
+// convertRange converts a "$214.25 - $498.82" style range, dropping the
+// currency symbols. Ranges that don't parse are returned unchanged.
+func convertRange(s string, rate float64) string {
+	low, high, ok := parseRange(s)
+	if !ok {
+		return s
+	}
+	return fmt.Sprintf("%.2f - %.2f", low*rate, high*rate)
+}
+
+// ---------------------------------------------------------------------------
+// Hub integration
+// ---------------------------------------------------------------------------
+
+// UseFX enables the per-subscription "convert" option on WebSocket.
+func (h *Hub) UseFX(fx *FXRates) {
+	h.fx = fx
+}
+
+// setConversion records the currency a client wants ticker's updates in, or
+// clears it when currency is empty. It reports false (after telling the
+// client why) if the option can't be honoured.
+func (h *Hub) setConversion(client *Client, reqID, ticker, currency string) bool {
+	ticker = strings.TrimSpace(strings.ToUpper(ticker))
+	currency = strings.TrimSpace(strings.ToUpper(currency))
+
+	code, text := "", ""
+	switch {
+	case currency == "":
+	case h.fx == nil:
+		code, text = codeUnavailable, "currency conversion is not available"
+	case !validCurrency(currency):
+		code, text = codeInvalidCurrency, fmt.Sprintf("invalid currency '%s', use a 3-letter code such as EUR", currency)
+	case isIndexTicker(ticker):
+		code, text = codeInvalidCurrency, "indexes are quoted in points and can't be converted"
+	case quoteCurrency(ticker) == "":
+		code, text = codeInvalidCurrency, fmt.Sprintf("unknown quote currency for %s", ticker)
+	case h.fx.Unknown(quoteCurrency(ticker), currency):
+		code, text = codeInvalidCurrency, fmt.Sprintf("no exchange rate found for %s-%s", quoteCurrency(ticker), currency)
+	}
+	if code != "" {
+		h.replyError(client, reqID, code, ticker, text)
+		return false
+	}
+
+	client.mu.Lock()
+	if currency == "" {
+		delete(client.convert, ticker)
+	} else {
+		client.convert[ticker] = currency
+	}
+	client.mu.Unlock()
+
+	if currency != "" {
+		h.fx.CachedRate(quoteCurrency(ticker), currency) // fetch it ahead of the first update
+	}
+	return true
+}
+
+// convertedMessage returns the update message for entry in currency. If the
+// conversion fails the unconverted message is returned with the reason in
+// its Error field, so the client still gets the quote. It runs while
+// updates fan out, so it only uses cached rates and never scrapes.
+func (h *Hub) convertedMessage(entry *StockEntry, currency string) ServerMessage {
+	msg := entryMessage(entry)
+	if currency == "" || h.fx == nil {
+		return msg
+	}
+	data, err := h.fx.convertEntry(*entry, currency, false)
+	if err != nil {
+		msg.Error = "conversion to " + currency + " failed: " + err.Error()
+		return msg
+	}
+	msg.Data = data
+	return msg
+}
+
+// ---------------------------------------------------------------------------
+// REST helpers
+// ---------------------------------------------------------------------------
+
+// writeConverted handles the "convert" query parameter on the single-quote
+// endpoints. It writes the converted quote (or the conversion error) and
+// reports true, or reports false without writing if no conversion was asked
+// for. A conversion that can't be made, including to a pair Google has no
+// rate for, is a 400; a rate that couldn't be scraped is a 502, or a 503
+// while the upstream circuit breaker is open.
+func writeConverted(w http.ResponseWriter, r *http.Request, entry StockEntry) bool {
+	currency := r.URL.Query().Get("convert")
+	if currency == "" {
+		return false
+	}
+	data, err := fxRates.ConvertEntry(entry, currency)
+	if errors.Is(err, errNoRate) {
+		if !writeUpstreamUnavailable(w) {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("Could not convert '%s' to %s: %s.", entry.Ticker, strings.ToUpper(currency), err))
+		}
+		return true
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Could not convert '%s' to %s: %s.", entry.Ticker, strings.ToUpper(currency), err))
+		return true
+	}
+	writeJSON(w, r, http.StatusOK, data)
+	return true
+}
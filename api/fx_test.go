@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestFX(rates map[string]float64) (*FXRates, *atomic.Int32) {
+	fx := NewFXRates(nil, time.Minute, time.Minute)
+	var fetches atomic.Int32
+	fx.fetch = func(from, to string) (float64, bool) {
+		fetches.Add(1)
+		time.Sleep(10 * time.Millisecond) // let concurrent callers pile up
+		rate, ok := rates[from+"-"+to]
+		return rate, ok
+	}
+	return fx, &fetches
+}
+
+func TestFXRateCachesAndSharesFetches(t *testing.T) {
+	fx, fetches := newTestFX(map[string]float64{"USD-EUR": 0.92, "GBP-USD": 1.25})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rate, _, err := fx.Rate("USD", "EUR"); err != nil || rate != 0.92 {
+				t.Errorf("Expected 0.92, got %v (%v)", rate, err)
+			}
+		}()
+	}
+	wg.Wait()
+	fx.Rate("USD", "EUR")
+	if fetches.Load() != 1 {
+		t.Fatalf("Expected a single scrape for USD-EUR, got %d", fetches.Load())
+	}
+
+	// London quotes are in pence.
+	if rate, _, _ := fx.Rate("GBX", "USD"); rate != 0.0125 {
+		t.Fatalf("Expected GBX-USD 0.0125, got %v", rate)
+	}
+	if _, _, err := fx.Rate("USD", "XYZ"); err == nil {
+		t.Fatal("Expected an error for an unknown pair")
+	}
+}
+
+func TestFXConvertEntry(t *testing.T) {
+	fx, _ := newTestFX(map[string]float64{"USD-EUR": 0.5})
+	entry := StockEntry{
+		Ticker:    "TSLA:NASDAQ",
+		IsStock:   true,
+		StockData: &Stock_Key_Stats{Name: "Tesla Inc", Price: 400, PreviousClose: 380, Change: 20, ChangePercent: 5.26, DayRange: "$390.00 - $410.00"},
+	}
+
+	data, err := fx.ConvertEntry(entry, "eur")
+	if err != nil {
+		t.Fatalf("ConvertEntry failed: %v", err)
+	}
+	got := data.(ConvertedStock)
+	if got.Price != 200 || got.Change != 10 || got.ChangePercent != 5.26 || got.DayRange != "195.00 - 205.00" {
+		t.Fatalf("Unexpected conversion %+v", got.Stock_Key_Stats)
+	}
+	if got.Conversion.From != "USD" || got.Conversion.Rate != 0.5 || got.Conversion.Original.(*Stock_Key_Stats).Price != 400 {
+		t.Fatalf("Unexpected conversion details %+v", got.Conversion)
+	}
+
+	index := StockEntry{Ticker: "NDX:INDEXNASDAQ", IsStock: true, IsIndex: true, StockData: &Stock_Key_Stats{}}
+	if _, err := fx.ConvertEntry(index, "EUR"); err == nil {
+		t.Fatal("Expected indexes to be rejected")
+	}
+	if _, err := fx.ConvertEntry(entry, "euro"); err == nil {
+		t.Fatal("Expected an invalid currency code to be rejected")
+	}
+}
+
+func TestBroadcastEntryConvertsPerClient(t *testing.T) {
+	h := newTestHub(t)
+	fx, _ := newTestFX(map[string]float64{"USD-INR": 80})
+	h.UseFX(fx)
+
+	plain := newClient(h, nil, 2)
+	inr := newClient(h, nil, 2)
+	inr.convert["TSLA:NASDAQ"] = "INR"
+	h.subscribers["TSLA:NASDAQ"] = map[*Client]struct{}{plain: {}, inr: {}}
+
+	entry := &StockEntry{
+		Ticker:    "TSLA:NASDAQ",
+		IsStock:   true,
+		StockData: &Stock_Key_Stats{Name: "Tesla Inc", Price: 2},
+	}
+
+	type update struct {
+		Error string `json:"error"`
+		Data  struct {
+			Price      float32     `json:"price"`
+			Conversion *Conversion `json:"conversion"`
+		} `json:"data"`
+	}
+
+	// The rate isn't cached yet: the broadcast doesn't wait for it, it
+	// sends the quote unconverted and fetches the rate in the background.
+	h.broadcastEntry(entry, &StockEntry{})
+	var msg update
+	json.Unmarshal(takeUpdate(t, inr, "TSLA:NASDAQ"), &msg)
+	if msg.Data.Price != 2 || msg.Data.Conversion != nil || msg.Error == "" {
+		t.Fatalf("Expected the unconverted quote with an error, got %+v", msg)
+	}
+	takeUpdate(t, plain, "TSLA:NASDAQ")
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, _, err := fx.CachedRate("USD", "INR"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the rate to be fetched in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	h.broadcastEntry(entry, &StockEntry{})
+	msg = update{}
+	json.Unmarshal(takeUpdate(t, plain, "TSLA:NASDAQ"), &msg)
+	if msg.Data.Price != 2 || msg.Data.Conversion != nil {
+		t.Fatalf("Expected the unconverted quote, got %+v", msg.Data)
+	}
+	json.Unmarshal(takeUpdate(t, inr, "TSLA:NASDAQ"), &msg)
+	if msg.Data.Price != 160 || msg.Data.Conversion == nil || msg.Data.Conversion.To != "INR" {
+		t.Fatalf("Expected the quote in INR, got %+v", msg.Data)
+	}
+}
+
+func TestWriteConvertedStatus(t *testing.T) {
+	fx, _ := newTestFX(map[string]float64{"USD-EUR": 0.5})
+	prev := fxRates
+	fxRates = fx
+	t.Cleanup(func() { fxRates = prev })
+	entry := StockEntry{Ticker: "TSLA:NASDAQ", IsStock: true, StockData: &Stock_Key_Stats{Price: 2}}
+
+	for _, tc := range []struct {
+		convert string
+		status  int
+	}{
+		{"eur", http.StatusOK},
+		{"nope", http.StatusBadRequest},
+		{"jpy", http.StatusBadGateway}, // the rate can't be scraped
+		{"jpy", http.StatusBadRequest}, // known to have no rate now
+	} {
+		rr := httptest.NewRecorder()
+		writeConverted(rr, httptest.NewRequest("GET", "/stock/TSLA:NASDAQ?convert="+tc.convert, nil), entry)
+		if rr.Code != tc.status {
+			t.Errorf("convert=%s: expected %d, got %d: %s", tc.convert, tc.status, rr.Code, rr.Body)
+		}
+	}
+}
+
+func TestQuotesConvert(t *testing.T) {
+	h := newTestHub(t)
+	fx, _ := newTestFX(map[string]float64{"USD-EUR": 0.5})
+	h.UseFX(fx)
+	h.store["BTC-USD"] = &StockEntry{Ticker: "BTC-USD", CryptoData: &Crypto_Key_Stats{Name: "Bitcoin", Price: 100}}
+	h.store["NDX:INDEXNASDAQ"] = &StockEntry{Ticker: "NDX:INDEXNASDAQ", IsStock: true, IsIndex: true, StockData: &Stock_Key_Stats{Name: "Nasdaq-100"}}
+	q := NewQuoteBatcher(h, h.cfg)
+
+	rr := httptest.NewRecorder()
+	q.getQuotes(rr, httptest.NewRequest("GET", "/quotes?symbols=BTC-USD,NDX:INDEXNASDAQ&convert=eur", nil))
+
+	var resp struct {
+		Errors  int `json:"errors"`
+		Results []struct {
+			Data struct {
+				Price float32 `json:"price"`
+			} `json:"data"`
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v. Body: %s", err, rr.Body.String())
+	}
+	if resp.Results[0].Data.Price != 50 {
+		t.Fatalf("Expected BTC at 50 EUR, got %+v", resp.Results[0])
+	}
+	if resp.Errors != 1 || resp.Results[1].Error == "" {
+		t.Fatalf("Expected the index to fail conversion, got %+v", resp.Results[1])
+	}
+}
+
+func TestFXUnknownPairsAreNotRescraped(t *testing.T) {
+	h := newTestHub(t)
+	fx, fetches := newTestFX(map[string]float64{"USD-EUR": 0.5})
+	h.UseFX(fx)
+
+	// The first lookup can't tell a bad code from a failed scrape.
+	if _, _, err := fx.Rate("USD", "ZZZ"); !errors.Is(err, errNoRate) {
+		t.Fatalf("Expected errNoRate, got %v", err)
+	}
+	if !fx.Unknown("USD", "ZZZ") || fx.Unknown("USD", "EUR") {
+		t.Fatal("Expected only USD-ZZZ to be unknown")
+	}
+	for i := 0; i < 5; i++ {
+		if _, _, err := fx.CachedRate("USD", "ZZZ"); !errors.Is(err, errUnknownPair) {
+			t.Fatalf("Expected errUnknownPair, got %v", err)
+		}
+		if _, _, err := fx.Rate("USD", "ZZZ"); !errors.Is(err, errUnknownPair) {
+			t.Fatalf("Expected errUnknownPair, got %v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond) // no background scrape may be running
+	if fetches.Load() != 1 {
+		t.Fatalf("Expected a single scrape for USD-ZZZ, got %d", fetches.Load())
+	}
+
+	c := newClient(h, nil, 2)
+	if h.setConversion(c, "1", "TSLA:NASDAQ", "zzz") {
+		t.Fatal("Expected the convert option to be rejected")
+	}
+	if msgs := readSent(c); len(msgs) != 1 || msgs[0].Code != codeInvalidCurrency {
+		t.Fatalf("Expected a %s reply, got %+v", codeInvalidCurrency, msgs)
+	}
+	if _, ok := c.convert["TSLA:NASDAQ"]; ok {
+		t.Fatal("Expected no conversion to be recorded")
+	}
+
+	// Once the negative cache expires the pair is scraped again.
+	fx.mu.Lock()
+	fx.failed["USD-ZZZ"] = time.Now()
+	fx.mu.Unlock()
+	fx.Rate("USD", "ZZZ")
+	if fetches.Load() != 2 {
+		t.Fatalf("Expected USD-ZZZ to be scraped again, got %d scrapes", fetches.Load())
+	}
+}
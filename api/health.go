@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Health checks – liveness, readiness and the scraper canary
+// ---------------------------------------------------------------------------
+
+// A canary scrape of a known ticker runs every CanaryInterval, whether or
+// not anyone is subscribed, so readiness reflects whether Google Finance can
+// be scraped right now. /healthz only fails when the hub's poll loop has
+// stalled, which a restart fixes; /readyz also fails while the canary keeps
+// failing, which a restart doesn't.
+
+// Health runs the canary and serves /healthz and /readyz.
+type Health struct {
+	hub *Hub
+	cfg *Config
+	log *slog.Logger
+
+	mu          sync.Mutex
+	lastSuccess time.Time // last successful canary scrape, zero if none yet
+	failures    int       // consecutive failed canary scrapes
+
+	// fetch scrapes one ticker. Replaced in tests.
+	fetch func(ctx context.Context, ticker string) (StockEntry, bool)
+}
+
+// HealthStatus is the body of /healthz and /readyz.
+type HealthStatus struct {
+	Status               string         `json:"status"`            // "ok" or "unavailable"
+	Reasons              []string       `json:"reasons,omitempty"` // why it isn't ok
+	CanaryTicker         string         `json:"canaryTicker"`
+	LastSuccessfulScrape *time.Time     `json:"lastSuccessfulScrape"` // null until the canary first succeeds
+	ConsecutiveFailures  int            `json:"consecutiveFailures"`
+	Clients              int            `json:"clients"`
+	PollKeepingUp        bool           `json:"pollKeepingUp"`           // last cycle fit in the poll interval and one finished recently
+	PollingPaused        bool           `json:"pollingPaused,omitempty"` // paused through the admin API
+	LastPollCycle        time.Time      `json:"lastPollCycle"`
+	LastPollDuration     string         `json:"lastPollDuration"`
+	PollInterval         string         `json:"pollInterval"`
+	Upstream             UpstreamStatus `json:"upstream"` // the circuit breaker toward Google
+}
+
+// NewHealth creates the health checks for hub. Call Run to start the canary.
+func NewHealth(hub *Hub, cfg *Config) *Health {
+	return &Health{
+		hub: hub,
+		cfg: cfg,
+		log: slog.Default().With("component", "health"),
+		fetch: func(ctx context.Context, ticker string) (StockEntry, bool) {
+			return scrapeEntry(ctx, hub.collector.Clone(), ticker)
+		},
+	}
+}
+
+// Run scrapes the canary ticker right away and then every CanaryInterval,
+// until the hub shuts down. Should be called in a goroutine.
+func (hc *Health) Run() {
+	if hc.cfg.CanaryInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(hc.cfg.CanaryInterval)
+	defer ticker.Stop()
+	for {
+		hc.probe()
+		select {
+		case <-ticker.C:
+		case <-hc.hub.quit:
+			return
+		}
+	}
+}
+
+// probe runs one canary scrape and records the outcome. While the upstream
+// circuit breaker is open there's nothing to learn; scrapes it turns away
+// aren't counted as failures.
+func (hc *Health) probe() {
+	if hc.hub.upstream.backingOff() {
+		return
+	}
+	_, ok := hc.fetch(withLogger(context.Background(), hc.log), hc.cfg.CanaryTicker)
+	if !ok && hc.hub.upstream.blocked() {
+		return
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if ok {
+		if hc.failures > 0 {
+			hc.log.Info("canary recovered", "ticker", hc.cfg.CanaryTicker, "failures", hc.failures)
+		}
+		hc.lastSuccess = time.Now()
+		hc.failures = 0
+		return
+	}
+	hc.failures++
+	hc.log.Warn("canary scrape failed", "ticker", hc.cfg.CanaryTicker, "failures", hc.failures)
+}
+
+// Status reports the current state, checked for liveness or, if readiness
+// is set, for readiness. It reports false along with the reasons if the
+// check fails.
+func (hc *Health) Status(readiness bool) (HealthStatus, bool) {
+	now := time.Now()
+	hub, cfg := hc.hub, hc.cfg
+
+	hub.mu.RLock()
+	lastPoll, pollTook, clients, paused := hub.lastPoll, hub.pollTook, len(hub.clients), hub.paused
+	hub.mu.RUnlock()
+	hc.mu.Lock()
+	lastSuccess, failures := hc.lastSuccess, hc.failures
+	hc.mu.Unlock()
+
+	status := HealthStatus{
+		Status:              "ok",
+		CanaryTicker:        cfg.CanaryTicker,
+		ConsecutiveFailures: failures,
+		Clients:             clients,
+		PollKeepingUp:       pollTook <= cfg.PollInterval && now.Sub(lastPoll) < 3*cfg.PollInterval,
+		PollingPaused:       paused,
+		LastPollCycle:       lastPoll,
+		LastPollDuration:    pollTook.String(),
+		PollInterval:        cfg.PollInterval.String(),
+		Upstream:            hub.upstream.Status(),
+	}
+	if !lastSuccess.IsZero() {
+		status.LastSuccessfulScrape = &lastSuccess
+	}
+
+	// Liveness: a stuck poll loop needs a restart. A paused one doesn't,
+	// and neither does one waiting for the upstream circuit breaker.
+	if !paused && !hub.upstream.blocked() && now.Sub(lastPoll) > cfg.HealthStallTimeout {
+		status.Reasons = append(status.Reasons, "poll loop stalled, no cycle finished for more than "+cfg.HealthStallTimeout.String())
+	}
+	if readiness {
+		select {
+		case <-hub.quit:
+			status.Reasons = append(status.Reasons, "shutting down")
+		default:
+		}
+		if cfg.CanaryInterval > 0 {
+			switch {
+			case failures >= cfg.CanaryMaxFailures:
+				status.Reasons = append(status.Reasons, fmt.Sprintf("canary scrape of %s failed %d times in a row", cfg.CanaryTicker, failures))
+			case lastSuccess.IsZero():
+				status.Reasons = append(status.Reasons, "canary scrape of "+cfg.CanaryTicker+" hasn't succeeded yet")
+			}
+		}
+	}
+	if len(status.Reasons) > 0 {
+		status.Status = "unavailable"
+		return status, false
+	}
+	return status, true
+}
+
+// ServeHealthz is the handler for GET /healthz (liveness).
+func (hc *Health) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	hc.write(w, r, false)
+}
+
+// ServeReadyz is the handler for GET /readyz (readiness).
+func (hc *Health) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	hc.write(w, r, true)
+}
+
+func (hc *Health) write(w http.ResponseWriter, r *http.Request, readiness bool) {
+	w.Header().Set("Cache-Control", "no-store")
+	status, ok := hc.Status(readiness)
+	if !ok {
+		writeJSON(w, r, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, status)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestHealth(t *testing.T) (*Health, *bool) {
+	t.Helper()
+	h := newTestHub(t)
+	h.lastPoll, h.pollTook = time.Now(), time.Second
+	hc := NewHealth(h, h.cfg)
+	up := true
+	hc.fetch = func(_ context.Context, ticker string) (StockEntry, bool) { return StockEntry{Ticker: ticker}, up }
+	return hc, &up
+}
+
+func getHealth(t *testing.T, handler http.HandlerFunc) (int, HealthStatus) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/", nil))
+	var status HealthStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Invalid body %q: %v", rr.Body.String(), err)
+	}
+	return rr.Code, status
+}
+
+func TestReadyzFollowsCanary(t *testing.T) {
+	hc, up := newTestHealth(t)
+	hc.cfg.CanaryMaxFailures = 2
+
+	if code, status := getHealth(t, hc.ServeReadyz); code != http.StatusServiceUnavailable || len(status.Reasons) != 1 {
+		t.Fatalf("Expected not ready before the first canary, got %d %+v", code, status)
+	}
+
+	hc.probe()
+	code, status := getHealth(t, hc.ServeReadyz)
+	if code != http.StatusOK || status.Status != "ok" || status.LastSuccessfulScrape == nil || !status.PollKeepingUp {
+		t.Fatalf("Expected ready after a good canary, got %d %+v", code, status)
+	}
+
+	*up = false
+	hc.probe()
+	if code, _ := getHealth(t, hc.ServeReadyz); code != http.StatusOK {
+		t.Fatal("Expected one failed canary to be tolerated")
+	}
+	hc.probe()
+	if code, status := getHealth(t, hc.ServeReadyz); code != http.StatusServiceUnavailable || status.ConsecutiveFailures != 2 {
+		t.Fatalf("Expected not ready after 2 failures, got %d %+v", code, status)
+	}
+	if code, _ := getHealth(t, hc.ServeHealthz); code != http.StatusOK {
+		t.Fatal("Expected a failing canary not to affect liveness")
+	}
+
+	*up = true
+	hc.probe()
+	if code, status := getHealth(t, hc.ServeReadyz); code != http.StatusOK || status.ConsecutiveFailures != 0 {
+		t.Fatalf("Expected the canary to recover, got %d %+v", code, status)
+	}
+}
+
+func TestHealthzPollLoop(t *testing.T) {
+	hc, _ := newTestHealth(t)
+	hc.probe()
+	h := hc.hub
+
+	h.pollTook = 2 * h.cfg.PollInterval
+	if code, status := getHealth(t, hc.ServeHealthz); code != http.StatusOK || status.PollKeepingUp {
+		t.Fatalf("Expected a slow poll cycle to be reported but live, got %d %+v", code, status)
+	}
+
+	h.lastPoll = time.Now().Add(-2 * h.cfg.HealthStallTimeout)
+	if code, _ := getHealth(t, hc.ServeHealthz); code != http.StatusServiceUnavailable {
+		t.Fatal("Expected a stalled poll loop to fail liveness")
+	}
+	if code, _ := getHealth(t, hc.ServeReadyz); code != http.StatusServiceUnavailable {
+		t.Fatal("Expected a stalled poll loop to fail readiness")
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gocolly/colly/v2"
@@ -18,17 +20,36 @@ import (
 
 // ClientMessage is what the client sends to subscribe/unsubscribe.
 type ClientMessage struct {
-	Action string `json:"action"` // "subscribe" or "unsubscribe"
-	Ticker string `json:"ticker"` // e.g. "TSLA:NASDAQ" (stock) or "BTC-USD" (crypto)
+	Action    string         `json:"action"`              // one of clientActions
+	ID        string         `json:"id,omitempty"`        // echoed in acks and errors (v2 only)
+	Ticker    string         `json:"ticker"`              // e.g. "TSLA:NASDAQ" (stock) or "BTC-USD" (crypto)
+	Tickers   []string       `json:"tickers,omitempty"`   // several tickers at once (v2 only)
+	Interval  string         `json:"interval,omitempty"`  // candle interval, e.g. "1m" (candle and indicator actions only)
+	Watchlist string         `json:"watchlist,omitempty"` // watchlist id (watchlist actions only)
+	Portfolio string         `json:"portfolio,omitempty"` // portfolio id (portfolio actions only)
+	Indicator *IndicatorSpec `json:"indicator,omitempty"` // indicator and parameters (indicator actions only)
+	Resume    *ResumeRequest `json:"resume,omitempty"`    // session to take over (resume only)
+	Convert   string         `json:"convert,omitempty"`   // currency to convert prices to, e.g. "EUR" (subscribe only)
+	Delta     bool           `json:"delta,omitempty"`     // send only changed fields after the first update (subscribe only)
+
+	MinInterval string `json:"min_interval,omitempty"` // least time between updates per ticker, e.g. "2s" (set_rate only)
 }
 
 // ServerMessage is what the server pushes to clients.
 type ServerMessage struct {
-	Type      string      `json:"type"`   // "stock_update", "index_update", "crypto_update", "error", "subscribed", "unsubscribed"
-	Ticker    string      `json:"ticker"` // the ticker key
+	Type      string      `json:"type"`         // "stock_update", "index_update", "crypto_update", "delta", "candle", "error", "subscribed", "unsubscribed"
+	ID        string      `json:"id,omitempty"` // id of the client message this replies to (v2 only)
+	Ticker    string      `json:"ticker"`       // the ticker key
 	Data      interface{} `json:"data,omitempty"`
+	Stale     bool        `json:"stale,omitempty"` // data restored from a snapshot, not yet refreshed
+	Seq       uint64      `json:"seq,omitempty"`   // per-ticker sequence number of updates and deltas
 	Error     string      `json:"error,omitempty"`
+	Code      string      `json:"code,omitempty"` // machine-readable error code (v2 only)
 	Timestamp time.Time   `json:"timestamp"`
+
+	// SessionSeq numbers the messages of a v2 connection. It is spliced in
+	// when the message is written, see stampSessionSeq.
+	SessionSeq uint64 `json:"sessionSeq,omitempty"`
 }
 
 // ---------------------------------------------------------------------------
@@ -43,6 +64,14 @@ type StockEntry struct {
 	StockData   *Stock_Key_Stats  `json:"stockData,omitempty"`
 	CryptoData  *Crypto_Key_Stats `json:"cryptoData,omitempty"`
 	LastUpdated time.Time         `json:"lastUpdated"`
+	Stale       bool              `json:"stale,omitempty"` // true until the first scrape after a restore
+	Seq         uint64            `json:"seq,omitempty"`   // incremented on every change
+
+	// failures counts scrapes in a row that found no data; scrapeErrors
+	// counts every failed scrape and lastScrapeError is when the latest was
+	failures        int
+	scrapeErrors    int
+	lastScrapeError time.Time
 }
 
 // ---------------------------------------------------------------------------
@@ -57,9 +86,36 @@ type Hub struct {
 	// store maps ticker -> latest entry  (e.g. "TSLA:NASDAQ" or "BTC-USD")
 	store map[string]*StockEntry
 
+	// warm holds last known entries for tickers that are not currently
+	// tracked (restored from a snapshot or recently unsubscribed). They seed
+	// the store as stale data when the ticker is subscribed again.
+	warm map[string]*StockEntry
+
+	// retiredSeq is the highest Seq of any ticker dropped so far. Tickers
+	// tracked again start from it, so a ticker's Seq never goes back and
+	// clients never mistake a new update for one they already have.
+	retiredSeq uint64
+
+	// candles maps ticker -> OHLCV aggregation of its polled ticks
+	candles map[string]*CandleSeries
+
 	// subscribers maps ticker -> set of clients interested in it
 	subscribers map[string]map[*Client]struct{}
 
+	// pins maps owner -> tickers kept polled on behalf of server-side
+	// features (portfolios, alerts, ...) regardless of client subscriptions
+	pins map[string]map[string]struct{}
+
+	// failed is the negative cache: tickers dropped for never returning
+	// data, and when they may be tracked again
+	failed map[string]time.Time
+
+	// sessions maps token -> resumable session of a v2 client
+	sessions map[string]*session
+
+	// changeHooks run after every ticker change, see OnChange
+	changeHooks []func(entry StockEntry)
+
 	// clients is the set of all connected clients
 	clients map[*Client]struct{}
 
@@ -73,12 +129,65 @@ type Hub struct {
 	// cfg holds all tunable parameters
 	cfg *Config
 
+	// log is the hub's logger; pollCycles numbers poll cycles for it
+	log        *slog.Logger
+	pollCycles uint64
+
+	// paused stops the poll loop and on-demand scrapes, set through the
+	// admin API. Guarded by mu.
+	paused   bool
+	pausedAt time.Time
+
 	// sem is a semaphore that bounds the number of concurrent scrapes
 	// during a poll cycle. Capacity = cfg.PollWorkers.
 	sem chan struct{}
 
 	// upgrader for WebSocket connections, configured from cfg
 	upgrader websocket.Upgrader
+
+	// quit is closed to stop the Run loop; done is closed once it returns.
+	quit     chan struct{}
+	done     chan struct{}
+	quitOnce sync.Once
+
+	// lastPoll is when the last poll cycle finished (or Run started) and
+	// pollTook how long it took; read by the health checks. Guarded by mu.
+	lastPoll time.Time
+	pollTook time.Duration
+
+	// streamsDone is closed by CloseStreams to end /stream responses
+	streamsDone chan struct{}
+	streamsOnce sync.Once
+
+	// watchlists backs subscribe_watchlist; nil when not configured
+	watchlists *WatchlistStore
+
+	// portfolios backs subscribe_portfolio; nil when not configured
+	portfolios *PortfolioStore
+
+	// alerts' evaluation state is flushed periodically and on shutdown;
+	// nil when not configured
+	alerts *AlertEngine
+
+	// fx converts updates for clients that subscribed with "convert"; nil
+	// when not configured
+	fx *FXRates
+
+	// upstream's circuit breaker pauses polling while it's open; nil when
+	// not configured
+	upstream *Upstream
+
+	// scrapes tracks on-demand scrapes started outside the poll cycle
+	// (e.g. on subscribe) so shutdown can wait for them. scrapesMu is held
+	// while closing quit and while adding to scrapes, so no scrape starts
+	// once Shutdown waits.
+	scrapes   sync.WaitGroup
+	scrapesMu sync.Mutex
+
+	// delivery counters, see Stats
+	conflated atomic.Uint64
+	dropped   atomic.Uint64
+	evictions atomic.Uint64
 }
 
 // Client represents a single WebSocket connection.
@@ -87,9 +196,112 @@ type Client struct {
 	conn *websocket.Conn
 	send chan []byte
 
-	// tickers this client is subscribed to
+	// id identifies the client in the admin API; remote and requestID are
+	// the address and request ID of the request that opened it
+	id          string
+	remote      string
+	requestID   string
+	connectedAt time.Time
+
+	// apiKey is the id of the API key the client connected with, if any;
+	// maxSubscriptions is that key's ticker limit, 0 for none
+	apiKey           string
+	maxSubscriptions int
+
+	// protocol is the negotiated protocol version (1 or 2)
+	protocol int
+	encoding encoding // JSON, or a binary encoding negotiated by subprotocol
+
+	// tickers this client is subscribed to; direct holds those it
+	// subscribed to itself rather than only through a watchlist
 	mu      sync.Mutex
 	tickers map[string]struct{}
+	direct  map[string]struct{}
+
+	// candle intervals this client is subscribed to, per ticker
+	candles map[string]map[string]struct{}
+
+	// indicators this client streams, per ticker, keyed by IndicatorSpec.key
+	indicators map[string]map[string]clientIndicator
+
+	// convert maps ticker -> currency this client wants its prices in
+	convert map[string]string
+
+	// delta holds the tickers this client gets delta updates for
+	delta map[string]struct{}
+
+	// ids of the watchlists and portfolios this client follows
+	watchlists map[string]struct{}
+	portfolios map[string]struct{}
+
+	// updates holds the latest undelivered quote update per ticker, see
+	// queueUpdate; wake tells the write pump there is something in it
+	updates map[string]queuedUpdate
+	wake    chan struct{}
+
+	// minInterval is the least time between two updates for one ticker, set
+	// with "set_rate"; lastSent is when each ticker's last update went out
+	minInterval time.Duration
+	lastSent    map[string]time.Time
+
+	// log carries the ID of the request that opened the connection, so
+	// every log line about the client can be tied back to it
+	log *slog.Logger
+
+	// behindSince is when the client started falling behind, zero while it
+	// keeps up
+	behindSince time.Time
+	evictOnce   sync.Once
+	evicted     chan struct{} // closed on eviction, ends an SSE stream
+
+	// session makes a v2 client resumable; nil for v1. A detached client
+	// has lost its connection but keeps its subscriptions until the session
+	// is resumed or expires. closed is set once send is closed.
+	session  *session
+	detached bool
+	closed   bool
+
+	// closeMsg is the close frame written once send is closed, empty for
+	// none in particular
+	closeMsg []byte
+
+	// replay holds missed messages to write first after a resume
+	replay [][]byte
+}
+
+// newClient creates a client for conn speaking the given protocol version.
+func newClient(h *Hub, conn *websocket.Conn, protocol int) *Client {
+	return &Client{
+		hub:         h,
+		conn:        conn,
+		send:        make(chan []byte, h.cfg.WSClientSendBuffer),
+		id:          newID(),
+		connectedAt: time.Now(),
+		protocol:    protocol,
+		tickers:     make(map[string]struct{}),
+		direct:      make(map[string]struct{}),
+		candles:     make(map[string]map[string]struct{}),
+		indicators:  make(map[string]map[string]clientIndicator),
+		convert:     make(map[string]string),
+		delta:       make(map[string]struct{}),
+		watchlists:  make(map[string]struct{}),
+		portfolios:  make(map[string]struct{}),
+		updates:     make(map[string]queuedUpdate),
+		wake:        make(chan struct{}, 1),
+		lastSent:    make(map[string]time.Time),
+		evicted:     make(chan struct{}),
+		log:         h.log,
+	}
+}
+
+// logContext returns a context carrying the client's logger, with the id of
+// the client message being handled if it has one.
+func (c *Client) logContext(reqID string) context.Context {
+	l := c.log
+	if reqID != "" {
+		l = l.With("msg_id", reqID)
+	}
+	return withLogger(context.Background(), l)
 }
 
 // ---------------------------------------------------------------------------
@@ -100,49 +312,161 @@ type Client struct {
 func NewHub(collector *colly.Collector, cfg *Config) *Hub {
 	return &Hub{
 		store:        make(map[string]*StockEntry),
+		warm:         make(map[string]*StockEntry),
+		candles:      make(map[string]*CandleSeries),
 		subscribers:  make(map[string]map[*Client]struct{}),
+		pins:         make(map[string]map[string]struct{}),
+		failed:       make(map[string]time.Time),
+		sessions:     make(map[string]*session),
 		clients:      make(map[*Client]struct{}),
 		registerCh:   make(chan *Client),
 		unregisterCh: make(chan *Client),
 		collector:    collector,
 		cfg:          cfg,
+		log:          slog.Default().With("component", "hub"),
 		sem:          make(chan struct{}, cfg.PollWorkers),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+		streamsDone:  make(chan struct{}),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  cfg.WSReadBufferSize,
 			WriteBufferSize: cfg.WSWriteBufferSize,
 			CheckOrigin: func(r *http.Request) bool {
 				return true // allow all origins, matching existing CORS policy
 			},
+			Subprotocols:      []string{subprotocolV2Msgpack, subprotocolV2CBOR, subprotocolV2, subprotocolV1},
+			EnableCompression: cfg.WSCompressionLevel > 0,
 		},
 	}
 }
 
 // Run starts the hub's main loop. Should be called in a goroutine.
+// It returns after Shutdown is called and the current poll cycle finishes.
 func (h *Hub) Run() {
+	defer close(h.done)
+
 	pollTicker := time.NewTicker(h.cfg.PollInterval)
 	defer pollTicker.Stop()
 
-	log.Printf("[hub] started – poll every %s, %d workers", h.cfg.PollInterval, h.cfg.PollWorkers)
+	// A nil channel never fires, so snapshots are simply skipped when
+	// persistence is disabled.
+	var snapshotC <-chan time.Time
+	if h.cfg.SnapshotPath != "" && h.cfg.SnapshotInterval > 0 {
+		snapshotTicker := time.NewTicker(h.cfg.SnapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshotC = snapshotTicker.C
+	}
+	var alertsC <-chan time.Time
+	if h.alerts != nil && h.cfg.AlertsFlushInterval > 0 {
+		alertsTicker := time.NewTicker(h.cfg.AlertsFlushInterval)
+		defer alertsTicker.Stop()
+		alertsC = alertsTicker.C
+	}
+
+	h.mu.Lock()
+	h.lastPoll = time.Now()
+	h.mu.Unlock()
+	h.log.Info("started", "poll_interval", h.cfg.PollInterval, "poll_workers", h.cfg.PollWorkers)
 
 	for {
 		select {
 		case client := <-h.registerCh:
 			h.mu.Lock()
 			h.clients[client] = struct{}{}
+			n := len(h.clients)
 			h.mu.Unlock()
-			log.Printf("[hub] client connected (%d total)", len(h.clients))
+			client.log.Info("client connected", "clients", n)
 
 		case client := <-h.unregisterCh:
 			h.removeClient(client)
-			log.Printf("[hub] client disconnected (%d total)", len(h.clients))
+			h.mu.RLock()
+			n := len(h.clients)
+			h.mu.RUnlock()
+			client.log.Info("client disconnected", "clients", n)
 
 		case <-pollTicker.C:
-			h.pollAll()
+			if !h.pollingPaused() && !h.upstream.backingOff() {
+				h.pollAll()
+			}
+
+		case <-snapshotC:
+			if err := h.SaveSnapshot(); err != nil {
+				h.log.Error("snapshot failed", "error", err)
+			}
+
+		case <-alertsC:
+			h.alerts.Flush()
+
+		case <-h.quit:
+			h.log.Info("stopped")
+			return
 		}
 	}
 }
 
+// Shutdown stops the hub gracefully. It tells every WebSocket client to go
+// away with a reconnect hint, waits for the in-flight poll cycle (bounded by
+// ctx), writes a final snapshot and the alerts' state, and closes the
+// remaining connections.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.scrapesMu.Lock()
+	h.quitOnce.Do(func() { close(h.quit) })
+	h.scrapesMu.Unlock()
+
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		if c.conn != nil { // SSE streams end on quit
+			clients = append(clients, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	// WriteControl may run concurrently with the write pump.
+	reason := fmt.Sprintf("server restarting, reconnect in %s", h.cfg.WSReconnectDelay)
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	deadline := time.Now().Add(writeWait)
+	for _, c := range clients {
+		c.conn.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+	}
+	h.log.Info("sent going-away", "clients", len(clients))
+
+	// Wait for the poll cycle and any on-demand scrapes to finish.
+	idle := make(chan struct{})
+	go func() {
+		<-h.done
+		h.scrapes.Wait()
+		close(idle)
+	}()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+		h.log.Warn("gave up waiting for poll cycle", "error", err)
+	}
+
+	if serr := h.SaveSnapshot(); serr != nil {
+		h.log.Error("snapshot failed", "error", serr)
+		if err == nil {
+			err = serr
+		}
+	}
+	if h.alerts != nil {
+		if aerr := h.alerts.Flush(); aerr != nil && err == nil {
+			err = aerr
+		}
+	}
+
+	for _, c := range clients {
+		c.conn.Close()
+	}
+	return err
+}
+
 // removeClient unregisters a client from all subscriptions and closes it.
+// Clients with a session are detached instead, so they can be resumed.
 func (h *Hub) removeClient(client *Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -150,7 +474,15 @@ func (h *Hub) removeClient(client *Client) {
 	if _, ok := h.clients[client]; !ok {
 		return
 	}
+	if h.detachClient(client) {
+		return
+	}
+	h.forgetClient(client)
+}
 
+// forgetClient drops client's subscriptions and closes it. Caller must hold
+// h.mu.
+func (h *Hub) forgetClient(client *Client) {
 	client.mu.Lock()
 	tickers := make([]string, 0, len(client.tickers))
 	for t := range client.tickers {
@@ -163,28 +495,79 @@ func (h *Hub) removeClient(client *Client) {
 			delete(subs, client)
 			// If no subscribers left, remove the ticker from polling entirely.
 			if len(subs) == 0 {
-				delete(h.subscribers, t)
-				delete(h.store, t)
-				log.Printf("[hub] ticker %s removed (no subscribers)", t)
+				h.releaseTicker(t)
 			}
 		}
 	}
 
 	delete(h.clients, client)
-	close(client.send)
+	client.mu.Lock()
+	if !client.closed {
+		client.closed = true
+		close(client.send)
+	}
+	client.mu.Unlock()
+}
+
+// releaseTicker stops tracking a ticker once nothing needs it any more:
+// no client subscribes to it and no owner has pinned it.
+// Caller must hold h.mu.
+func (h *Hub) releaseTicker(ticker string) {
+	if len(h.subscribers[ticker]) > 0 {
+		return
+	}
+	for _, tickers := range h.pins {
+		if _, ok := tickers[ticker]; ok {
+			delete(h.subscribers, ticker)
+			return
+		}
+	}
+	h.dropTicker(ticker)
+}
+
+// dropTicker stops tracking a ticker that has no subscribers left. Its last
+// known data is kept in the warm cache. Caller must hold h.mu.
+func (h *Hub) dropTicker(ticker string) {
+	if entry, ok := h.store[ticker]; ok {
+		h.retiredSeq = max(h.retiredSeq, entry.Seq)
+		if entry.StockData != nil || entry.CryptoData != nil {
+			h.rememberWarm(entry)
+		}
+	}
+	delete(h.subscribers, ticker)
+	delete(h.store, ticker)
+	delete(h.candles, ticker)
+	h.log.Info("ticker removed, no subscribers", "ticker", ticker)
 }
 
 // ---------------------------------------------------------------------------
 // Subscription management
 // ---------------------------------------------------------------------------
 
-func (h *Hub) subscribe(client *Client, ticker string) {
+// subscribe adds client to ticker's subscribers and reports whether it did.
+// Malformed tickers and tickers in the negative cache are refused with an
+// error reply.
+func (h *Hub) subscribe(client *Client, reqID, ticker string) bool {
+	return h.addSubscription(client, reqID, ticker, true)
+}
+
+// addSubscription is subscribe; direct is false when the subscription comes
+// from a watchlist, so that unfollowing the watchlist may drop it again.
+func (h *Hub) addSubscription(client *Client, reqID, ticker string, direct bool) bool {
 	ticker = strings.TrimSpace(strings.ToUpper(ticker))
 	if ticker == "" {
-		return
+		return false
+	}
+	if h.rejectTicker(client, reqID, ticker) {
+		return false
 	}
 
 	h.mu.Lock()
+	if h.atSubscriptionLimit(client, ticker) {
+		h.mu.Unlock()
+		h.replyError(client, reqID, codeSubscriptionLimit, ticker, fmt.Sprintf("subscription limit reached, this API key allows %d tickers across its connections", client.maxSubscriptions))
+		return false
+	}
 
 	// Ensure subscriber set exists.
 	if _, ok := h.subscribers[ticker]; !ok {
@@ -192,45 +575,157 @@ func (h *Hub) subscribe(client *Client, ticker string) {
 	}
 	h.subscribers[ticker][client] = struct{}{}
 
-	// Ensure store entry exists (will be populated on next poll).
-	if _, ok := h.store[ticker]; !ok {
-		h.store[ticker] = &StockEntry{
-			Ticker:  ticker,
-			IsStock: isStockTicker(ticker),
-			IsIndex: isIndexTicker(ticker),
-		}
-		log.Printf("[hub] new ticker tracked: %s", ticker)
-	}
-
-	entry := h.store[ticker]
+	tracked, _ := h.trackTicker(ticker)
+	entry := *tracked
 	h.mu.Unlock()
 
 	client.mu.Lock()
 	client.tickers[ticker] = struct{}{}
+	if direct {
+		client.direct[ticker] = struct{}{}
+	}
 	client.mu.Unlock()
 
 	// Acknowledge subscription.
-	h.sendToClient(client, ServerMessage{
+	h.reply(client, reqID, ServerMessage{
 		Type:      "subscribed",
 		Ticker:    ticker,
 		Timestamp: time.Now(),
 	})
 
-	// If we already have data, send it immediately.
+	// If we already have data, send it immediately. If scrapes have found
+	// none so far, say so, as the other subscribers were told.
 	if entry.StockData != nil || entry.CryptoData != nil {
-		h.sendEntryToClient(client, entry)
+		h.sendEntryToClient(client, &entry)
+	} else if entry.failures > 0 {
+		h.sendToClient(client, notFoundMessage(ticker, time.Now()))
 	}
 
 	// Do an immediate fetch for this ticker so the client doesn't wait for
-	// the next poll cycle. Respects the semaphore.
+	// the next poll cycle.
+	h.scrapeNow(client.logContext(reqID), ticker)
+	return true
+}
+
+// trackTicker ensures a store entry exists for ticker (it will be populated
+// on the next poll) and reports whether it was newly added. New entries are
+// seeded with warm data, if any, so clients see the last known values
+// straight away. Caller must hold h.mu.
+func (h *Hub) trackTicker(ticker string) (*StockEntry, bool) {
+	if entry, ok := h.store[ticker]; ok {
+		return entry, false
+	}
+
+	if warm, ok := h.warm[ticker]; ok {
+		seeded := *warm
+		seeded.Stale = true
+		seeded.Seq = max(seeded.Seq, h.retiredSeq)
+		h.store[ticker] = &seeded
+		delete(h.warm, ticker)
+	} else {
+		h.store[ticker] = &StockEntry{
+			Ticker:  ticker,
+			IsStock: isStockTicker(ticker),
+			IsIndex: isIndexTicker(ticker),
+			Seq:     h.retiredSeq,
+		}
+	}
+	h.log.Info("new ticker tracked", "ticker", ticker)
+	return h.store[ticker], true
+}
+
+// scrapeNow polls a single ticker outside the regular poll cycle, logging
+// to ctx's logger, unless polling is paused or the upstream circuit breaker
+// is open. Respects the semaphore.
+func (h *Hub) scrapeNow(ctx context.Context, ticker string) {
+	if h.pollingPaused() || h.upstream.backingOff() {
+		return
+	}
+	h.forceScrape(ctx, ticker)
+}
+
+// forceScrape is scrapeNow, paused or not. Nothing is scraped once the hub
+// is shutting down.
+func (h *Hub) forceScrape(ctx context.Context, ticker string) {
+	h.scrapesMu.Lock()
+	defer h.scrapesMu.Unlock()
+	select {
+	case <-h.quit:
+		return
+	default:
+	}
+	h.scrapes.Add(1)
 	go func() {
-		h.sem <- struct{}{} // acquire
+		defer h.scrapes.Done()
+		h.acquireWorker()
 		defer func() { <-h.sem }()
-		h.pollTicker(ticker)
+		h.pollTicker(ctx, ticker)
 	}()
 }
 
-func (h *Hub) unsubscribe(client *Client, ticker string) {
+// Pin keeps tickers polled on behalf of a server-side owner (e.g.
+// "portfolios") even when no client subscribes to them. Each call replaces
+// the owner's previous set; pinning nothing releases them all.
+func (h *Hub) Pin(owner string, tickers []string) {
+	set := make(map[string]struct{}, len(tickers))
+	for _, t := range tickers {
+		if t = strings.TrimSpace(strings.ToUpper(t)); t != "" {
+			set[t] = struct{}{}
+		}
+	}
+
+	h.mu.Lock()
+	old := h.pins[owner]
+	if len(set) == 0 {
+		delete(h.pins, owner)
+	} else {
+		h.pins[owner] = set
+	}
+
+	var added []string
+	for t := range set {
+		if _, bad := h.negativeCached(t); bad {
+			continue
+		}
+		if _, isNew := h.trackTicker(t); isNew {
+			added = append(added, t)
+		}
+	}
+	for t := range old {
+		if _, kept := set[t]; !kept {
+			h.releaseTicker(t)
+		}
+	}
+	h.mu.Unlock()
+
+	ctx := withLogger(context.Background(), h.log.With("pin", owner))
+	for _, t := range added {
+		h.scrapeNow(ctx, t)
+	}
+}
+
+// OnChange registers fn to run after every change to a tracked ticker, with
+// a copy of the updated entry. Hooks must be registered before Run.
+func (h *Hub) OnChange(fn func(entry StockEntry)) {
+	h.changeHooks = append(h.changeHooks, fn)
+}
+
+// Lookup returns a copy of the latest entry for ticker, falling back to the
+// warm cache for tickers that are no longer tracked.
+func (h *Hub) Lookup(ticker string) (StockEntry, bool) {
+	ticker = strings.TrimSpace(strings.ToUpper(ticker))
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if entry, ok := h.store[ticker]; ok && (entry.StockData != nil || entry.CryptoData != nil) {
+		return *entry, true
+	}
+	if entry, ok := h.warm[ticker]; ok {
+		return *entry, true
+	}
+	return StockEntry{}, false
+}
+
+func (h *Hub) unsubscribe(client *Client, reqID, ticker string) {
 	ticker = strings.TrimSpace(strings.ToUpper(ticker))
 	if ticker == "" {
 		return
@@ -240,24 +735,34 @@ func (h *Hub) unsubscribe(client *Client, ticker string) {
 	if subs, ok := h.subscribers[ticker]; ok {
 		delete(subs, client)
 		if len(subs) == 0 {
-			delete(h.subscribers, ticker)
-			delete(h.store, ticker)
-			log.Printf("[hub] ticker %s removed (no subscribers)", ticker)
+			h.releaseTicker(ticker)
 		}
 	}
 	h.mu.Unlock()
 
-	client.mu.Lock()
-	delete(client.tickers, ticker)
-	client.mu.Unlock()
+	client.forgetTicker(ticker)
 
-	h.sendToClient(client, ServerMessage{
+	h.reply(client, reqID, ServerMessage{
 		Type:      "unsubscribed",
 		Ticker:    ticker,
 		Timestamp: time.Now(),
 	})
 }
 
+// forgetTicker clears everything the client holds for ticker.
+func (c *Client) forgetTicker(ticker string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tickers, ticker)
+	delete(c.direct, ticker)
+	delete(c.candles, ticker)
+	delete(c.indicators, ticker)
+	delete(c.convert, ticker)
+	delete(c.delta, ticker)
+	delete(c.updates, ticker)
+	delete(c.lastSent, ticker)
+}
+
 // isStockTicker distinguishes stocks/indexes (TSLA:NASDAQ) from crypto (BTC-USD).
 // Stocks and indexes use ":" as separator, crypto uses "-".
 func isStockTicker(ticker string) bool {
@@ -281,6 +786,10 @@ func isIndexTicker(ticker string) bool {
 // pollAll iterates all tracked tickers and refreshes data using a bounded
 // worker pool. At most cfg.PollWorkers scrapes run concurrently.
 func (h *Hub) pollAll() {
+	h.pollCycles++
+	l := h.log.With("poll_cycle", h.pollCycles)
+	ctx := withLogger(context.Background(), l)
+
 	h.mu.RLock()
 	tickers := make([]string, 0, len(h.store))
 	for t := range h.store {
@@ -288,6 +797,20 @@ func (h *Hub) pollAll() {
 	}
 	h.mu.RUnlock()
 
+	start := time.Now()
+	defer func() {
+		took := time.Since(start)
+		metrics.observePoll(took, h.cfg.PollInterval)
+		h.mu.Lock()
+		h.lastPoll, h.pollTook = time.Now(), took
+		h.mu.Unlock()
+		if took > h.cfg.PollInterval {
+			l.Warn("poll cycle overran the poll interval", "tickers", len(tickers), "duration", took, "poll_interval", h.cfg.PollInterval)
+		} else {
+			l.Debug("poll cycle", "tickers", len(tickers), "duration", took)
+		}
+	}()
+
 	if len(tickers) == 0 {
 		return
 	}
@@ -295,28 +818,54 @@ func (h *Hub) pollAll() {
 	var wg sync.WaitGroup
 	for _, t := range tickers {
 		wg.Add(1)
-		h.sem <- struct{}{} // acquire a slot (blocks if pool is full)
+		h.acquireWorker() // blocks if the pool is full
 		go func(ticker string) {
 			defer wg.Done()
 			defer func() { <-h.sem }() // release
-			h.pollTicker(ticker)
+			h.pollTicker(ctx, ticker)
 		}(t)
 	}
 	wg.Wait()
 }
 
+// acquireWorker takes a slot in the poll worker pool, recording how long it
+// had to wait for one. Release it with <-h.sem.
+func (h *Hub) acquireWorker() {
+	start := time.Now()
+	h.sem <- struct{}{}
+	metrics.workerWait.Add(time.Since(start).Seconds())
+}
+
+// acquireWorkerContext is acquireWorker, giving up when ctx is done. It
+// reports whether it got a slot.
+func (h *Hub) acquireWorkerContext(ctx context.Context) bool {
+	start := time.Now()
+	defer func() { metrics.workerWait.Add(time.Since(start).Seconds()) }()
+	select {
+	case h.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // pollTicker fetches fresh data for a single ticker, compares with stored
-// data, and broadcasts to subscribers if anything changed.
-func (h *Hub) pollTicker(ticker string) {
+// data, and broadcasts to subscribers if anything changed. The scrape logs
+// to ctx's logger.
+func (h *Hub) pollTicker(ctx context.Context, ticker string) {
 	// Create a fresh collector clone for each scrape to avoid callback
 	// accumulation on the shared collector.
 	c := h.collector.Clone()
 
 	if isStockTicker(ticker) {
-		newData := Get_Stock_Data(c, ticker)
+		newData := Get_Stock_Data(ctx, c, ticker)
 		if newData.Name == "" {
-			return // scrape failed or invalid ticker
+			if !h.upstream.blocked() {
+				h.scrapeFailed(ticker) // scrape failed or invalid ticker
+			}
+			return
 		}
+		h.recordTick(ticker, newData.Price, parseVolume(newData.Volume))
 
 		h.mu.Lock()
 		entry, ok := h.store[ticker]
@@ -325,27 +874,37 @@ func (h *Hub) pollTicker(ticker string) {
 			return // ticker was removed while we were scraping
 		}
 
-		changed := entry.StockData == nil || *entry.StockData != *newData
+		entry.failures = 0
+		prev := *entry
+		changed := entry.StockData == nil || entry.Stale || *entry.StockData != *newData
 		if changed {
+			entry.Seq++
+			entry.Stale = false
 			entry.StockData = newData
 			entry.IsStock = true
 			entry.IsIndex = isIndexTicker(ticker)
 			entry.LastUpdated = time.Now()
 		}
+		snapshot := *entry
 		h.mu.Unlock()
 
 		if changed {
-			h.broadcastEntry(ticker, entry)
+			h.broadcastEntry(&snapshot, &prev)
+			h.runChangeHooks(snapshot)
 		}
 	} else {
 		parts := strings.SplitN(ticker, "-", 2)
 		if len(parts) != 2 {
 			return
 		}
-		newData := Get_Crypto_Data(c, parts[0], parts[1])
+		newData := Get_Crypto_Data(ctx, c, parts[0], parts[1])
 		if newData.Name == "" {
+			if !h.upstream.blocked() {
+				h.scrapeFailed(ticker)
+			}
 			return
 		}
+		h.recordTick(ticker, newData.Price, 0)
 
 		h.mu.Lock()
 		entry, ok := h.store[ticker]
@@ -354,16 +913,22 @@ func (h *Hub) pollTicker(ticker string) {
 			return
 		}
 
-		changed := entry.CryptoData == nil || *entry.CryptoData != *newData
+		entry.failures = 0
+		prev := *entry
+		changed := entry.CryptoData == nil || entry.Stale || *entry.CryptoData != *newData
 		if changed {
+			entry.Seq++
+			entry.Stale = false
 			entry.CryptoData = newData
 			entry.IsStock = false
 			entry.LastUpdated = time.Now()
 		}
+		snapshot := *entry
 		h.mu.Unlock()
 
 		if changed {
-			h.broadcastEntry(ticker, entry)
+			h.broadcastEntry(&snapshot, &prev)
+			h.runChangeHooks(snapshot)
 		}
 	}
 }
@@ -372,7 +937,39 @@ func (h *Hub) pollTicker(ticker string) {
 // Broadcasting
 // ---------------------------------------------------------------------------
 
-func (h *Hub) broadcastEntry(ticker string, entry *StockEntry) {
+// broadcastEntry sends entry's update to the ticker's subscribers; prev is
+// the entry as it was before this change. Clients that subscribed with a
+// "convert" currency get a converted copy, and delta clients get only the
+// fields that changed since prev. Each message is built once per group.
+func (h *Hub) broadcastEntry(entry, prev *StockEntry) {
+	type group struct {
+		currency string
+		delta    bool
+	}
+
+	h.mu.RLock()
+	groups := make(map[group][]*Client)
+	for c := range h.subscribers[entry.Ticker] {
+		c.mu.Lock()
+		g := group{currency: c.convert[entry.Ticker]}
+		_, g.delta = c.delta[entry.Ticker]
+		c.mu.Unlock()
+		groups[g] = append(groups[g], c)
+	}
+	h.mu.RUnlock()
+
+	for g, clients := range groups {
+		full := h.convertedMessage(entry, g.currency)
+		msg := full
+		if g.delta {
+			msg = h.deltaMessage(full, prev, g.currency)
+		}
+		h.queueUpdate(clients, msg, full)
+	}
+}
+
+// entryMessage builds the stock/index/crypto update message for an entry.
+func entryMessage(entry *StockEntry) ServerMessage {
 	msgType := "stock_update"
 	var data interface{} = entry.StockData
 	if entry.IsIndex {
@@ -382,19 +979,19 @@ func (h *Hub) broadcastEntry(ticker string, entry *StockEntry) {
 		data = entry.CryptoData
 	}
 
-	msg := ServerMessage{
+	return ServerMessage{
 		Type:      msgType,
-		Ticker:    ticker,
+		Ticker:    entry.Ticker,
 		Data:      data,
+		Stale:     entry.Stale,
+		Seq:       entry.Seq,
 		Timestamp: entry.LastUpdated,
 	}
+}
 
-	payload, err := json.Marshal(msg)
-	if err != nil {
-		log.Printf("[hub] marshal error: %v", err)
-		return
-	}
-
+// broadcast sends msg to every client subscribed to ticker. The message is
+// marshalled once and shared across subscribers.
+func (h *Hub) broadcast(ticker string, msg ServerMessage) {
 	h.mu.RLock()
 	subs := h.subscribers[ticker]
 	clients := make([]*Client, 0, len(subs))
@@ -403,43 +1000,67 @@ func (h *Hub) broadcastEntry(ticker string, entry *StockEntry) {
 	}
 	h.mu.RUnlock()
 
+	h.fanOut(clients, msg)
+}
+
+// fanOut marshals msg once per encoding and queues it for each client.
+func (h *Hub) fanOut(clients []*Client, msg ServerMessage) {
+	enc := encodedMessage{msg: msg}
 	for _, c := range clients {
-		select {
-		case c.send <- payload:
-		default:
-			// Client buffer full – drop message rather than blocking the hub.
-			log.Printf("[hub] dropping message for slow client")
+		if payload := enc.payload(c.encoding); payload != nil {
+			h.trySend(c, payload)
 		}
 	}
 }
 
-func (h *Hub) sendEntryToClient(client *Client, entry *StockEntry) {
-	msgType := "stock_update"
-	var data interface{} = entry.StockData
-	if entry.IsIndex {
-		msgType = "index_update"
-	} else if !entry.IsStock {
-		msgType = "crypto_update"
-		data = entry.CryptoData
+// trySend queues payload on the client's send channel. If the buffer is full
+// the message is dropped rather than blocking the hub, and a client that
+// stays that way is evicted.
+func (h *Hub) trySend(c *Client, payload []byte) {
+	c.mu.Lock()
+	switch {
+	case c.detached:
+		c.session.record(payload)
+		c.mu.Unlock()
+		return
+	case c.closed:
+		c.mu.Unlock()
+		return
+	}
+	select {
+	case c.send <- payload:
+		c.mu.Unlock()
+		return
+	default:
 	}
+	h.dropped.Add(1)
+	slow := h.markBehind(c, time.Now())
+	c.mu.Unlock()
+	if slow {
+		h.evictSlowClient(c)
+	}
+}
 
-	h.sendToClient(client, ServerMessage{
-		Type:      msgType,
-		Ticker:    entry.Ticker,
-		Data:      data,
-		Timestamp: entry.LastUpdated,
-	})
+func (h *Hub) runChangeHooks(entry StockEntry) {
+	for _, fn := range h.changeHooks {
+		fn(entry)
+	}
+}
+
+func (h *Hub) sendEntryToClient(client *Client, entry *StockEntry) {
+	client.mu.Lock()
+	currency := client.convert[entry.Ticker]
+	client.mu.Unlock()
+	msg := h.convertedMessage(entry, currency)
+	h.queueUpdate([]*Client{client}, msg, msg)
 }
 
 func (h *Hub) sendToClient(client *Client, msg ServerMessage) {
-	payload, err := json.Marshal(msg)
+	payload, err := client.encoding.marshal(msg)
 	if err != nil {
 		return
 	}
-	select {
-	case client.send <- payload:
-	default:
-	}
+	h.trySend(client, payload)
 }
 
 // ---------------------------------------------------------------------------
@@ -448,20 +1069,37 @@ func (h *Hub) sendToClient(client *Client, msg ServerMessage) {
 
 // ServeWs is the HTTP handler that upgrades to WebSocket.
 func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request) {
+	if h.tooManyConnections(w, r) {
+		return
+	}
+	l := loggerFrom(r.Context()).With("component", "ws")
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("[ws] upgrade error: %v", err)
+		l.Warn("upgrade error", "error", err)
 		return
 	}
 
-	client := &Client{
-		hub:     h,
-		conn:    conn,
-		send:    make(chan []byte, h.cfg.WSClientSendBuffer),
-		tickers: make(map[string]struct{}),
+	if h.cfg.WSCompressionLevel > 0 {
+		if err := conn.SetCompressionLevel(h.cfg.WSCompressionLevel); err != nil {
+			l.Warn("could not set compression level", "level", h.cfg.WSCompressionLevel, "error", err)
+		}
 	}
 
-	h.registerCh <- client
+	client := newClient(h, conn, protocolVersion(conn.Subprotocol()))
+	client.encoding = subprotocolEncoding(conn.Subprotocol())
+	client.remote, client.requestID = clientIP(r), requestIDFrom(r.Context())
+	client.useAPIKey(r.Context())
+	client.log = l.With("client", client.id, "subprotocol", conn.Subprotocol())
+
+	select {
+	case h.registerCh <- client:
+	case <-h.quit:
+		// Shutting down; don't accept new clients.
+		conn.Close()
+		return
+	}
+	h.startSession(client)
+	h.sendUpstreamStatus(client)
 
 	go client.writePump()
 	go client.readPump()
@@ -475,15 +1113,21 @@ const (
 	writeWait  = 10 * time.Second
 	pongWait   = 60 * time.Second
 	pingPeriod = (pongWait * 9) / 10
+
+	// maxMessageSize leaves room for v2 batch subscribes.
+	maxMessageSize = 64 << 10
 )
 
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregisterCh <- c
+		select {
+		case c.hub.unregisterCh <- c:
+		case <-c.hub.quit:
+		}
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(4096)
+	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -491,78 +1135,148 @@ func (c *Client) readPump() {
 	})
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		frameType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
-				log.Printf("[ws] read error: %v", err)
+				c.log.Warn("read error", "error", err)
 			}
 			break
 		}
 
-		var msg ClientMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			c.hub.sendToClient(c, ServerMessage{
-				Type:      "error",
-				Error:     "invalid message format, expected JSON with 'action' and 'ticker' fields",
-				Timestamp: time.Now(),
-			})
-			continue
-		}
-
-		switch msg.Action {
-		case "subscribe":
-			c.hub.subscribe(c, msg.Ticker)
-		case "unsubscribe":
-			c.hub.unsubscribe(c, msg.Ticker)
-		default:
-			c.hub.sendToClient(c, ServerMessage{
-				Type:      "error",
-				Error:     "unknown action: " + msg.Action + ". Use 'subscribe' or 'unsubscribe'",
-				Timestamp: time.Now(),
-			})
-		}
+		c.hub.handleMessage(c, frameType == websocket.BinaryMessage, message)
 	}
 }
 
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
+	// flush fires when an update held back by the client's rate limit may
+	// be sent.
+	flush := time.NewTimer(time.Hour)
+	flush.Stop()
 	defer func() {
 		ticker.Stop()
+		flush.Stop()
 		c.conn.Close()
 	}()
 
 	for {
+		var message []byte
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case msg, ok := <-c.send:
 			if !ok {
 				// Hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.mu.Lock()
+				closeMsg := c.closeMsg
+				c.mu.Unlock()
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.conn.WriteMessage(websocket.CloseMessage, closeMsg)
 				return
 			}
+			message = msg
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Drain queued messages into the same write.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte("\n"))
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
-				return
-			}
+		case <-c.wake:
+		case <-flush.C:
 
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+			continue
+		}
+
+		next, ok := c.write(message)
+		if !ok {
+			return
+		}
+		if next > 0 {
+			flush.Reset(next)
+		}
+	}
+}
+
+// write sends everything collect returns: JSON as a single text frame,
+// binary encodings one frame per message. It returns how long until the next
+// held-back update is due, and false if the connection failed.
+func (c *Client) write(message []byte) (time.Duration, bool) {
+	msgs, next, ok := c.collect(message)
+	if !ok {
+		return 0, false
+	}
+	if len(msgs) == 0 {
+		return next, true
+	}
+
+	// Compression only applies if the client negotiated permessage-deflate.
+	threshold := c.hub.cfg.WSCompressionThreshold
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if c.encoding != encodingJSON {
+		for _, msg := range msgs {
+			c.conn.EnableWriteCompression(len(msg) >= threshold)
+			if err := c.conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return 0, false
+			}
 		}
+		return next, true
+	}
+	size := len(msgs) - 1 // newlines
+	for _, msg := range msgs {
+		size += len(msg)
+	}
+	c.conn.EnableWriteCompression(size >= threshold)
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return 0, false
+	}
+	for i, msg := range msgs {
+		if i > 0 {
+			w.Write([]byte("\n"))
+		}
+		w.Write(msg)
+	}
+	if err := w.Close(); err != nil {
+		return 0, false
+	}
+	return next, true
+}
+
+// collect takes what is ready to be written to c, in order: messages
+// replayed after a resume, message (if any), the rest of the send channel
+// and the quote updates that are due. Acks go out before the updates they
+// precede. Messages are stamped and recorded if c has a session. It returns
+// how long until the next held-back update is due, and false if c has been
+// detached.
+func (c *Client) collect(message []byte) ([][]byte, time.Duration, bool) {
+	c.mu.Lock()
+	s, msgs := c.session, c.replay
+	c.replay = nil
+	if c.detached {
+		c.mu.Unlock()
+		if message != nil {
+			s.record(message) // taken off send just before the detach
+		}
+		return nil, 0, false
+	}
+	updates, next := c.takeUpdatesLocked(time.Now())
+	c.mu.Unlock()
+
+	// Replayed messages are already stamped and recorded.
+	add := func(payload []byte) {
+		if s != nil {
+			payload = s.record(payload)
+		}
+		msgs = append(msgs, payload)
+	}
+	if message != nil {
+		add(message)
+	}
+	for n := len(c.send); n > 0; n-- {
+		if msg, ok := <-c.send; ok {
+			add(msg)
+		}
+	}
+	for _, u := range updates {
+		add(u)
 	}
+	return msgs, next, true
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHubShutdown(t *testing.T) {
+	h := newTestHub(t)
+	h.store["TSLA:NASDAQ"] = &StockEntry{
+		Ticker:      "TSLA:NASDAQ",
+		StockData:   &Stock_Key_Stats{Name: "Tesla Inc", Price: 398.41},
+		LastUpdated: time.Now(),
+	}
+	go h.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	select {
+	case <-h.done:
+	default:
+		t.Fatal("Expected Run to have returned after Shutdown")
+	}
+	if _, err := os.Stat(h.cfg.SnapshotPath); err != nil {
+		t.Fatalf("Expected a snapshot to be flushed on shutdown: %v", err)
+	}
+
+	h.forceScrape(context.Background(), "TSLA:NASDAQ")
+	if n := len(h.sem); n != 0 {
+		t.Fatalf("Expected no scrape to start after Shutdown, %d running", n)
+	}
+}
+
+func TestHubPinKeepsTickersTracked(t *testing.T) {
+	h := newTestHub(t)
+
+	h.Pin("portfolios", []string{"tsla:nasdaq", "BTC-USD"})
+	if _, ok := h.store["TSLA:NASDAQ"]; !ok {
+		t.Fatal("Expected pinned ticker to be tracked")
+	}
+
+	// Pinning a smaller set releases the tickers no longer needed.
+	h.Pin("portfolios", []string{"BTC-USD"})
+	h.mu.RLock()
+	_, tsla := h.store["TSLA:NASDAQ"]
+	_, btc := h.store["BTC-USD"]
+	h.mu.RUnlock()
+	if tsla || !btc {
+		t.Fatalf("Expected only BTC-USD to stay tracked (tsla=%v btc=%v)", tsla, btc)
+	}
+
+	h.Pin("portfolios", nil)
+	h.scrapes.Wait()
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.store) != 0 {
+		t.Fatalf("Expected all tickers released, got %d", len(h.store))
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/milindmadhukar/stonksapi/indicators"
+)
+
+// ---------------------------------------------------------------------------
+// Technical indicators over the candle series
+// ---------------------------------------------------------------------------
+
+// IndicatorSpec names an indicator and its parameters. Zero values are
+// replaced with the usual defaults by normalize.
+type IndicatorSpec struct {
+	Name   string  `json:"name"`             // "sma", "ema", "rsi", "macd" or "bollinger"
+	Period int     `json:"period,omitempty"` // sma, ema, rsi, bollinger
+	Fast   int     `json:"fast,omitempty"`   // macd
+	Slow   int     `json:"slow,omitempty"`   // macd
+	Signal int     `json:"signal,omitempty"` // macd
+	StdDev float64 `json:"stddev,omitempty"` // bollinger band width
+}
+
+// normalize lower-cases the name, fills in defaults and validates the
+// parameters.
+func (s *IndicatorSpec) normalize() error {
+	s.Name = strings.ToLower(strings.TrimSpace(s.Name))
+	switch s.Name {
+	case "sma", "ema", "bollinger":
+		if s.Period == 0 {
+			s.Period = 20
+		}
+		if s.Name == "bollinger" && s.StdDev == 0 {
+			s.StdDev = 2
+		}
+	case "rsi":
+		if s.Period == 0 {
+			s.Period = 14
+		}
+	case "macd":
+		if s.Fast == 0 {
+			s.Fast = 12
+		}
+		if s.Slow == 0 {
+			s.Slow = 26
+		}
+		if s.Signal == 0 {
+			s.Signal = 9
+		}
+		if s.Fast < 1 || s.Slow < 1 || s.Signal < 1 || s.Fast >= s.Slow {
+			return fmt.Errorf("invalid macd parameters fast=%d slow=%d signal=%d, fast must be shorter than slow", s.Fast, s.Slow, s.Signal)
+		}
+		return nil
+	case "":
+		return fmt.Errorf("missing indicator name. Use sma, ema, rsi, macd or bollinger")
+	default:
+		return fmt.Errorf("unknown indicator '%s'. Use sma, ema, rsi, macd or bollinger", s.Name)
+	}
+	if s.Period < 1 || s.Period > 1000 {
+		return fmt.Errorf("invalid period %d, must be between 1 and 1000", s.Period)
+	}
+	if s.StdDev < 0 {
+		return fmt.Errorf("invalid stddev %g, must be positive", s.StdDev)
+	}
+	return nil
+}
+
+// warmup is the number of candles the indicator needs before every one of
+// its values is defined.
+func (s IndicatorSpec) warmup() int {
+	switch s.Name {
+	case "macd":
+		return s.Slow + s.Signal - 1
+	case "rsi":
+		return s.Period + 1 // period changes
+	default:
+		return s.Period
+	}
+}
+
+// checkCoverage rejects an indicator that needs more candles than the
+// candle series keeps, as it would never warm up.
+func (h *Hub) checkCoverage(spec IndicatorSpec) error {
+	if n := spec.warmup(); n > h.cfg.CandleHistory {
+		return fmt.Errorf("%s needs %d candles to warm up, but only %d are kept per interval (CANDLE_HISTORY)", spec.Name, n, h.cfg.CandleHistory)
+	}
+	return nil
+}
+
+// key identifies the indicator on one interval, e.g. "rsi(14)@1m".
+func (s IndicatorSpec) key(interval string) string {
+	var params string
+	switch s.Name {
+	case "macd":
+		params = fmt.Sprintf("%d,%d,%d", s.Fast, s.Slow, s.Signal)
+	case "bollinger":
+		params = fmt.Sprintf("%d,%g", s.Period, s.StdDev)
+	default:
+		params = strconv.Itoa(s.Period)
+	}
+	return fmt.Sprintf("%s(%s)@%s", s.Name, params, interval)
+}
+
+// IndicatorPoint is the indicator's value at the close of one candle. Values
+// holds "value" for single-line indicators, "macd", "signal" and "histogram"
+// for MACD, and "middle", "upper" and "lower" for Bollinger bands.
+type IndicatorPoint struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// IndicatorUpdate is the payload of an "indicator" ServerMessage.
+type IndicatorUpdate struct {
+	Key       string         `json:"key"`
+	Interval  string         `json:"interval"`
+	Indicator IndicatorSpec  `json:"indicator"`
+	Closed    bool           `json:"closed"` // false for the value on the forming candle
+	Point     IndicatorPoint `json:"point"`
+}
+
+// computeIndicator evaluates spec over the closes of candles. Points are
+// returned oldest first and start once the indicator has warmed up; the last
+// point belongs to the candle that is still forming.
+func computeIndicator(spec IndicatorSpec, candles []Candle) ([]IndicatorPoint, error) {
+	closes := make([]float64, len(candles))
+	for i, c := range candles {
+		closes[i] = float64(c.Close)
+	}
+
+	lines := map[string][]float64{}
+	switch spec.Name {
+	case "sma", "ema", "rsi":
+		fn := map[string]func([]float64, int) ([]float64, error){
+			"sma": indicators.SMA,
+			"ema": indicators.EMA,
+			"rsi": indicators.RSI,
+		}[spec.Name]
+		out, err := fn(closes, spec.Period)
+		if err != nil {
+			return nil, err
+		}
+		lines["value"] = out
+	case "macd":
+		res, err := indicators.MACD(closes, spec.Fast, spec.Slow, spec.Signal)
+		if err != nil {
+			return nil, err
+		}
+		lines["macd"], lines["signal"], lines["histogram"] = res.MACD, res.Signal, res.Histogram
+	case "bollinger":
+		res, err := indicators.Bollinger(closes, spec.Period, spec.StdDev)
+		if err != nil {
+			return nil, err
+		}
+		lines["middle"], lines["upper"], lines["lower"] = res.Middle, res.Upper, res.Lower
+	default:
+		return nil, fmt.Errorf("unknown indicator '%s'", spec.Name)
+	}
+
+	points := make([]IndicatorPoint, 0, len(candles))
+	for i, c := range candles {
+		values := make(map[string]float64, len(lines))
+		for name, line := range lines {
+			if !math.IsNaN(line[i]) {
+				values[name] = line[i]
+			}
+		}
+		if len(values) == 0 {
+			continue // still warming up
+		}
+		points = append(points, IndicatorPoint{Time: c.Start, Values: values})
+	}
+	return points, nil
+}
+
+// indicatorSpecFromQuery reads an IndicatorSpec from URL query parameters.
+func indicatorSpecFromQuery(r *http.Request) (IndicatorSpec, error) {
+	q := r.URL.Query()
+	spec := IndicatorSpec{Name: q.Get("name")}
+
+	ints := map[string]*int{"period": &spec.Period, "fast": &spec.Fast, "slow": &spec.Slow, "signal": &spec.Signal}
+	for name, dst := range ints {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return spec, fmt.Errorf("invalid %s '%s', expected an integer", name, v)
+			}
+			*dst = n
+		}
+	}
+	if v := q.Get("stddev"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return spec, fmt.Errorf("invalid stddev '%s', expected a number", v)
+		}
+		spec.StdDev = f
+	}
+	return spec, spec.normalize()
+}
+
+// ServeIndicators is the HTTP handler for /stocks/{stock_query}/indicators.
+// Like candles, indicators exist only for tickers the hub is polling.
+func (h *Hub) ServeIndicators(w http.ResponseWriter, r *http.Request) {
+	ticker := strings.ToUpper(chi.URLParam(r, "stock_query"))
+
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "1m"
+	}
+	if !validCandleInterval(interval) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid interval '%s'. Use 1m, 5m, 15m, 1h or 1d.", interval))
+		return
+	}
+	spec, err := indicatorSpecFromQuery(r)
+	if err == nil {
+		err = h.checkCoverage(spec)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error()+".")
+		return
+	}
+
+	h.mu.RLock()
+	series := h.candles[ticker]
+	h.mu.RUnlock()
+
+	var candles []Candle
+	if series != nil {
+		candles = series.Candles(interval)
+	}
+	if len(candles) == 0 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No candle data for '%s'. Indicators are computed from candles, which are built while a ticker is being polled.", ticker))
+		return
+	}
+
+	points, err := computeIndicator(spec, candles)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"ticker":    ticker,
+		"interval":  interval,
+		"key":       spec.key(interval),
+		"indicator": spec,
+		"candles":   len(candles),
+		"warmup":    spec.warmup(),
+		"points":    points,
+	})
+}
+
+// ---------------------------------------------------------------------------
+// WebSocket streaming
+// ---------------------------------------------------------------------------
+
+// clientIndicator is one indicator a client streams for a ticker.
+type clientIndicator struct {
+	interval string
+	spec     IndicatorSpec
+}
+
+// latestIndicator returns the indicator's value on the forming candle, or
+// with closed on the last closed one, if it has warmed up.
+func latestIndicator(series *CandleSeries, interval string, spec IndicatorSpec, closed bool) (IndicatorPoint, bool) {
+	if series == nil {
+		return IndicatorPoint{}, false
+	}
+	candles := series.Candles(interval)
+	if closed && len(candles) > 0 {
+		candles = candles[:len(candles)-1]
+	}
+	points, err := computeIndicator(spec, candles)
+	if err != nil || len(points) == 0 {
+		return IndicatorPoint{}, false
+	}
+	return points[len(points)-1], true
+}
+
+// broadcastIndicators pushes the value at the candle that just closed of
+// every indicator on one of the closed intervals that the subscribers of
+// ticker stream. Indicators are only computed when one of their candles
+// closes, not on every tick, and each distinct indicator once however many
+// clients follow it.
+func (h *Hub) broadcastIndicators(ticker string, series *CandleSeries, closed map[string]bool) {
+	h.mu.RLock()
+	subs := h.subscribers[ticker]
+	clients := make([]*Client, 0, len(subs))
+	for c := range subs {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+
+	type result struct {
+		point IndicatorPoint
+		ok    bool
+	}
+	computed := make(map[string]result)
+
+	for _, c := range clients {
+		c.mu.Lock()
+		wanted := make(map[string]clientIndicator, len(c.indicators[ticker]))
+		for key, ind := range c.indicators[ticker] {
+			if closed[ind.interval] {
+				wanted[key] = ind
+			}
+		}
+		c.mu.Unlock()
+
+		for key, ind := range wanted {
+			res, seen := computed[key]
+			if !seen {
+				res.point, res.ok = latestIndicator(series, ind.interval, ind.spec, true)
+				computed[key] = res
+			}
+			if !res.ok {
+				continue
+			}
+			h.sendToClient(c, ServerMessage{
+				Type:      "indicator",
+				Ticker:    ticker,
+				Data:      IndicatorUpdate{Key: key, Interval: ind.interval, Indicator: ind.spec, Closed: true, Point: res.point},
+				Timestamp: time.Now(),
+			})
+		}
+	}
+}
+
+// subscribeIndicator starts streaming an indicator for ticker. Like
+// subscribeCandle it implies a regular subscription to the ticker.
+func (h *Hub) subscribeIndicator(client *Client, reqID, ticker, interval string, spec *IndicatorSpec) {
+	ticker = strings.TrimSpace(strings.ToUpper(ticker))
+	if ticker == "" {
+		return
+	}
+	if interval == "" {
+		interval = "1m"
+	}
+	if spec == nil {
+		h.replyError(client, reqID, codeInvalidIndicator, ticker, `missing 'indicator' object, e.g. {"name": "rsi", "period": 14}`)
+		return
+	}
+	if !validCandleInterval(interval) {
+		h.replyError(client, reqID, codeInvalidInterval, ticker, "invalid candle interval: "+interval+". Use 1m, 5m, 15m, 1h or 1d")
+		return
+	}
+	err := spec.normalize()
+	if err == nil {
+		err = h.checkCoverage(*spec)
+	}
+	if err != nil {
+		h.replyError(client, reqID, codeInvalidIndicator, ticker, err.Error())
+		return
+	}
+
+	client.mu.Lock()
+	_, subscribed := client.tickers[ticker]
+	client.mu.Unlock()
+	if !subscribed && !h.subscribe(client, reqID, ticker) {
+		return
+	}
+
+	key := spec.key(interval)
+	client.mu.Lock()
+	if _, ok := client.indicators[ticker]; !ok {
+		client.indicators[ticker] = make(map[string]clientIndicator)
+	}
+	client.indicators[ticker][key] = clientIndicator{interval: interval, spec: *spec}
+	client.mu.Unlock()
+
+	h.reply(client, reqID, ServerMessage{
+		Type:      "indicator_subscribed",
+		Ticker:    ticker,
+		Data:      map[string]interface{}{"key": key, "interval": interval, "indicator": spec, "warmup": spec.warmup()},
+		Timestamp: time.Now(),
+	})
+
+	// Send the current value right away if there is enough history.
+	h.mu.RLock()
+	series := h.candles[ticker]
+	h.mu.RUnlock()
+	if point, ok := latestIndicator(series, interval, *spec, false); ok {
+		h.sendToClient(client, ServerMessage{
+			Type:      "indicator",
+			Ticker:    ticker,
+			Data:      IndicatorUpdate{Key: key, Interval: interval, Indicator: *spec, Point: point},
+			Timestamp: time.Now(),
+		})
+	}
+}
+
+// unsubscribeIndicator stops streaming one indicator. The quote subscription
+// itself is left untouched.
+func (h *Hub) unsubscribeIndicator(client *Client, reqID, ticker, interval string, spec *IndicatorSpec) {
+	ticker = strings.TrimSpace(strings.ToUpper(ticker))
+	if ticker == "" || spec == nil {
+		return
+	}
+	if interval == "" {
+		interval = "1m"
+	}
+	if err := spec.normalize(); err != nil {
+		return
+	}
+	key := spec.key(interval)
+
+	client.mu.Lock()
+	if subs, ok := client.indicators[ticker]; ok {
+		delete(subs, key)
+		if len(subs) == 0 {
+			delete(client.indicators, ticker)
+		}
+	}
+	client.mu.Unlock()
+
+	h.reply(client, reqID, ServerMessage{
+		Type:      "indicator_unsubscribed",
+		Ticker:    ticker,
+		Data:      map[string]string{"key": key},
+		Timestamp: time.Now(),
+	})
+}
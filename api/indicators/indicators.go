@@ -0,0 +1,191 @@
+// Package indicators implements common technical indicators over a price
+// series.
+//
+// Every function takes values oldest first and returns slices of the same
+// length, so out[i] lines up with values[i]. Positions before an indicator
+// has enough data (its warm-up period) hold NaN.
+package indicators
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrInvalidPeriod is returned when a period is less than 1, or when a
+// MACD's fast period is not shorter than its slow period.
+var ErrInvalidPeriod = errors.New("indicators: invalid period")
+
+// SMA returns the simple moving average over period values.
+func SMA(values []float64, period int) ([]float64, error) {
+	if period < 1 {
+		return nil, ErrInvalidPeriod
+	}
+	out := nanSlice(len(values))
+	var sum float64
+	for i, v := range values {
+		sum += v
+		if i >= period {
+			sum -= values[i-period]
+		}
+		if i >= period-1 {
+			out[i] = sum / float64(period)
+		}
+	}
+	return out, nil
+}
+
+// EMA returns the exponential moving average with smoothing 2/(period+1),
+// seeded with the SMA of the first period values.
+func EMA(values []float64, period int) ([]float64, error) {
+	if period < 1 {
+		return nil, ErrInvalidPeriod
+	}
+	out := nanSlice(len(values))
+	ema(values, period, out)
+	return out, nil
+}
+
+// ema writes the EMA of values into out, skipping leading NaNs in values so
+// it can be chained onto another indicator's output.
+func ema(values []float64, period int, out []float64) {
+	start := 0
+	for start < len(values) && math.IsNaN(values[start]) {
+		start++
+	}
+	if len(values)-start < period {
+		return
+	}
+
+	var sum float64
+	for _, v := range values[start : start+period] {
+		sum += v
+	}
+	prev := sum / float64(period)
+	out[start+period-1] = prev
+
+	k := 2 / float64(period+1)
+	for i := start + period; i < len(values); i++ {
+		prev = values[i]*k + prev*(1-k)
+		out[i] = prev
+	}
+}
+
+// RSI returns the relative strength index using Wilder's smoothing. The
+// first value is available once period price changes have been seen, i.e.
+// at index period.
+func RSI(values []float64, period int) ([]float64, error) {
+	if period < 1 {
+		return nil, ErrInvalidPeriod
+	}
+	out := nanSlice(len(values))
+	if len(values) <= period {
+		return out, nil
+	}
+
+	var avgGain, avgLoss float64
+	for i := 1; i <= period; i++ {
+		gain, loss := change(values[i-1], values[i])
+		avgGain += gain
+		avgLoss += loss
+	}
+	avgGain /= float64(period)
+	avgLoss /= float64(period)
+	out[period] = rsi(avgGain, avgLoss)
+
+	for i := period + 1; i < len(values); i++ {
+		gain, loss := change(values[i-1], values[i])
+		avgGain = (avgGain*float64(period-1) + gain) / float64(period)
+		avgLoss = (avgLoss*float64(period-1) + loss) / float64(period)
+		out[i] = rsi(avgGain, avgLoss)
+	}
+	return out, nil
+}
+
+func change(prev, cur float64) (gain, loss float64) {
+	d := cur - prev
+	if d > 0 {
+		return d, 0
+	}
+	return 0, -d
+}
+
+func rsi(avgGain, avgLoss float64) float64 {
+	if avgLoss == 0 {
+		if avgGain == 0 {
+			return 50 // flat series
+		}
+		return 100
+	}
+	return 100 - 100/(1+avgGain/avgLoss)
+}
+
+// MACDResult holds the three MACD lines.
+type MACDResult struct {
+	MACD      []float64 // fast EMA - slow EMA
+	Signal    []float64 // EMA of MACD over the signal period
+	Histogram []float64 // MACD - Signal
+}
+
+// MACD returns the moving average convergence/divergence of values. The
+// usual parameters are 12, 26 and 9.
+func MACD(values []float64, fast, slow, signal int) (MACDResult, error) {
+	if fast < 1 || slow < 1 || signal < 1 || fast >= slow {
+		return MACDResult{}, ErrInvalidPeriod
+	}
+	fastEMA, _ := EMA(values, fast)
+	slowEMA, _ := EMA(values, slow)
+
+	res := MACDResult{
+		MACD:      nanSlice(len(values)),
+		Signal:    nanSlice(len(values)),
+		Histogram: nanSlice(len(values)),
+	}
+	for i := range values {
+		res.MACD[i] = fastEMA[i] - slowEMA[i] // NaN until the slow EMA starts
+	}
+	ema(res.MACD, signal, res.Signal)
+	for i := range values {
+		res.Histogram[i] = res.MACD[i] - res.Signal[i]
+	}
+	return res, nil
+}
+
+// BollingerResult holds the three Bollinger bands.
+type BollingerResult struct {
+	Middle []float64 // SMA
+	Upper  []float64 // Middle + k standard deviations
+	Lower  []float64 // Middle - k standard deviations
+}
+
+// Bollinger returns Bollinger bands k population standard deviations
+// around the period SMA. The usual parameters are 20 and 2.
+func Bollinger(values []float64, period int, k float64) (BollingerResult, error) {
+	middle, err := SMA(values, period)
+	if err != nil {
+		return BollingerResult{}, err
+	}
+	res := BollingerResult{
+		Middle: middle,
+		Upper:  nanSlice(len(values)),
+		Lower:  nanSlice(len(values)),
+	}
+	for i := period - 1; i < len(values); i++ {
+		var variance float64
+		for _, v := range values[i-period+1 : i+1] {
+			d := v - middle[i]
+			variance += d * d
+		}
+		sd := math.Sqrt(variance / float64(period))
+		res.Upper[i] = middle[i] + k*sd
+		res.Lower[i] = middle[i] - k*sd
+	}
+	return res, nil
+}
+
+func nanSlice(n int) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = math.NaN()
+	}
+	return out
+}
@@ -0,0 +1,90 @@
+package indicators
+
+import (
+	"math"
+	"testing"
+)
+
+func approx(t *testing.T, name string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-6 {
+		t.Fatalf("%s: got %.8f, want %.8f", name, got, want)
+	}
+}
+
+func TestSMA(t *testing.T) {
+	out, err := SMA([]float64{1, 2, 3, 4, 5}, 3)
+	if err != nil {
+		t.Fatalf("SMA failed: %v", err)
+	}
+	if !math.IsNaN(out[0]) || !math.IsNaN(out[1]) {
+		t.Fatalf("Expected NaN during warm-up, got %v", out[:2])
+	}
+	approx(t, "out[2]", out[2], 2)
+	approx(t, "out[4]", out[4], 4)
+
+	if _, err := SMA(nil, 0); err != ErrInvalidPeriod {
+		t.Fatalf("Expected ErrInvalidPeriod, got %v", err)
+	}
+}
+
+func TestEMA(t *testing.T) {
+	out, _ := EMA([]float64{2, 4, 6, 8}, 3)
+	approx(t, "seed", out[2], 4)           // SMA of 2, 4, 6
+	approx(t, "next", out[3], 8*0.5+4*0.5) // k = 2/(3+1)
+}
+
+func TestRSI(t *testing.T) {
+	// Wilder's original worked example (14-period).
+	closes := []float64{
+		44.34, 44.09, 44.15, 43.61, 44.33, 44.83, 45.10, 45.42,
+		45.84, 46.08, 45.89, 46.03, 45.61, 46.28, 46.28, 46.00,
+	}
+	out, _ := RSI(closes, 14)
+	if !math.IsNaN(out[13]) {
+		t.Fatalf("Expected NaN before index 14, got %v", out[13])
+	}
+	if math.Abs(out[14]-70.46) > 0.01 || math.Abs(out[15]-66.25) > 0.01 {
+		t.Fatalf("Expected RSI ~70.46 then ~66.25, got %.2f and %.2f", out[14], out[15])
+	}
+
+	flat, _ := RSI([]float64{1, 1, 1}, 2)
+	approx(t, "flat", flat[2], 50)
+	up, _ := RSI([]float64{1, 2, 3}, 2)
+	approx(t, "rising", up[2], 100)
+}
+
+func TestMACD(t *testing.T) {
+	values := make([]float64, 40)
+	for i := range values {
+		values[i] = float64(i)
+	}
+	res, err := MACD(values, 3, 6, 4)
+	if err != nil {
+		t.Fatalf("MACD failed: %v", err)
+	}
+	if !math.IsNaN(res.MACD[4]) || math.IsNaN(res.MACD[5]) {
+		t.Fatal("Expected MACD to start once the slow EMA is available")
+	}
+	if !math.IsNaN(res.Signal[7]) || math.IsNaN(res.Signal[8]) {
+		t.Fatal("Expected the signal line to start signal-1 values after MACD")
+	}
+	// On a straight line both EMAs lag by (period-1)/2, so MACD settles at
+	// (6-1)/2 - (3-1)/2 = 1.5 and the histogram at 0.
+	approx(t, "macd", res.MACD[39], 1.5)
+	approx(t, "histogram", res.Histogram[39], 0)
+
+	if _, err := MACD(values, 26, 12, 9); err != ErrInvalidPeriod {
+		t.Fatalf("Expected fast >= slow to be rejected, got %v", err)
+	}
+}
+
+func TestBollinger(t *testing.T) {
+	res, _ := Bollinger([]float64{2, 4, 4, 4, 5, 5, 7, 9}, 8, 2)
+	approx(t, "middle", res.Middle[7], 5)
+	approx(t, "upper", res.Upper[7], 9) // population stddev is 2
+	approx(t, "lower", res.Lower[7], 1)
+	if !math.IsNaN(res.Upper[6]) {
+		t.Fatal("Expected NaN during warm-up")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestIndicatorSpecNormalize(t *testing.T) {
+	spec := IndicatorSpec{Name: " MACD "}
+	if err := spec.normalize(); err != nil {
+		t.Fatalf("normalize failed: %v", err)
+	}
+	if spec.Fast != 12 || spec.Slow != 26 || spec.Signal != 9 {
+		t.Fatalf("Expected MACD defaults 12/26/9, got %+v", spec)
+	}
+	if got := spec.key("1d"); got != "macd(12,26,9)@1d" {
+		t.Fatalf("Unexpected key %q", got)
+	}
+
+	for _, bad := range []IndicatorSpec{{Name: "vwap"}, {Name: "rsi", Period: -1}, {Name: "macd", Fast: 30, Slow: 10}} {
+		if err := bad.normalize(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestComputeIndicatorSkipsWarmup(t *testing.T) {
+	start := time.Date(2026, 2, 23, 12, 0, 0, 0, time.UTC)
+	candles := make([]Candle, 5)
+	for i := range candles {
+		candles[i] = Candle{Start: start.Add(time.Duration(i) * time.Minute), Close: float32(i + 1)}
+	}
+
+	points, err := computeIndicator(IndicatorSpec{Name: "sma", Period: 3}, candles)
+	if err != nil {
+		t.Fatalf("computeIndicator failed: %v", err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("Expected 3 points after a 3-candle warm-up, got %d", len(points))
+	}
+	if !points[0].Time.Equal(candles[2].Start) || points[0].Values["value"] != 2 {
+		t.Fatalf("Unexpected first point %+v", points[0])
+	}
+}
+
+func TestServeIndicators(t *testing.T) {
+	h := newTestHub(t)
+	series := NewCandleSeries(100)
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		series.Add(float32(100+i), 0, now.Add(time.Duration(i-30)*time.Minute))
+	}
+	h.candles["TSLA:NASDAQ"] = series
+
+	r := chi.NewRouter()
+	r.Get("/stocks/{stock_query}/indicators", h.ServeIndicators)
+
+	req := httptest.NewRequest("GET", "/stocks/tsla:nasdaq/indicators?name=rsi&period=14&interval=1m", nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Body: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		Key    string           `json:"key"`
+		Points []IndicatorPoint `json:"points"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if resp.Key != "rsi(14)@1m" || len(resp.Points) != 16 {
+		t.Fatalf("Expected 16 rsi(14)@1m points, got %q with %d points", resp.Key, len(resp.Points))
+	}
+	if v := resp.Points[len(resp.Points)-1].Values["value"]; v != 100 {
+		t.Fatalf("Expected RSI 100 on a steadily rising series, got %v", v)
+	}
+
+	for path, want := range map[string]int{
+		"/stocks/TSLA:NASDAQ/indicators?name=foo":                http.StatusBadRequest,
+		"/stocks/TSLA:NASDAQ/indicators?name=rsi&interval=2m":    http.StatusBadRequest,
+		"/stocks/AAPL:NASDAQ/indicators?name=rsi&interval=1m":    http.StatusNotFound,
+		"/stocks/TSLA:NASDAQ/indicators?name=macd&fast=x":        http.StatusBadRequest,
+		"/stocks/TSLA:NASDAQ/indicators?name=bollinger&stddev=3": http.StatusOK,
+	} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != want {
+			t.Fatalf("%s: expected %d, got %d", path, want, rr.Code)
+		}
+	}
+}
+
+func TestIndicatorsStreamOnClose(t *testing.T) {
+	h := newTestHub(t)
+	series := NewCandleSeries(100)
+	start := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	for i := 0; i < 30; i++ {
+		series.Add(float32(100+i), 0, start.Add(time.Duration(i)*time.Minute))
+	}
+	c := newClient(h, nil, 2)
+	h.subscribers["TSLA:NASDAQ"] = map[*Client]struct{}{c: {}}
+	spec := IndicatorSpec{Name: "sma", Period: 3}
+	c.indicators["TSLA:NASDAQ"] = map[string]clientIndicator{spec.key("1m"): {interval: "1m", spec: spec}}
+
+	h.broadcastIndicators("TSLA:NASDAQ", series, map[string]bool{"5m": true})
+	if msgs := readSent(c); len(msgs) != 0 {
+		t.Fatalf("Expected nothing while no 1m candle closed, got %+v", msgs)
+	}
+
+	h.broadcastIndicators("TSLA:NASDAQ", series, map[string]bool{"1m": true})
+	msgs := readSent(c)
+	if len(msgs) != 1 || msgs[0].Type != "indicator" {
+		t.Fatalf("Expected one indicator update, got %+v", msgs)
+	}
+	data, _ := json.Marshal(msgs[0].Data)
+	var u IndicatorUpdate
+	json.Unmarshal(data, &u)
+	if !u.Closed || !u.Point.Time.Equal(start.Add(28*time.Minute)) || u.Point.Values["value"] != 127 {
+		t.Fatalf("Expected the value at the candle that closed, got %+v", u)
+	}
+}
+
+func TestIndicatorCoverage(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.CandleHistory = 30
+	r := chi.NewRouter()
+	r.Get("/stocks/{stock_query}/indicators", h.ServeIndicators)
+
+	for path, want := range map[string]int{
+		"/stocks/TSLA:NASDAQ/indicators?name=rsi&period=29":  http.StatusNotFound, // fits, but no candles yet
+		"/stocks/TSLA:NASDAQ/indicators?name=rsi&period=30":  http.StatusBadRequest,
+		"/stocks/TSLA:NASDAQ/indicators?name=macd&signal=10": http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != want {
+			t.Errorf("%s: expected %d, got %d (%s)", path, want, rr.Code, rr.Body)
+		}
+	}
+}
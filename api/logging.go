@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// ---------------------------------------------------------------------------
+// Logging – log/slog with request and scrape correlation IDs
+// ---------------------------------------------------------------------------
+
+// Every HTTP request gets a request ID, taken from its X-Request-ID header
+// or generated, and echoed back in the response. A logger carrying it rides
+// in the request's context into the handlers, the scrapers and, for
+// WebSocket and event stream clients, every hub log line about the client.
+// Each scrape gets its own scrape ID, logged along with whatever triggered
+// it: a request, a client's subscribe or a poll cycle.
+
+// NewLogger creates a logger writing to w in cfg.LogFormat ("text" or
+// "json") at cfg.LogLevel.
+func NewLogger(cfg *Config, w io.Writer) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		slog.Warn("invalid LOG_LEVEL, using info", "component", "config", "value", cfg.LogLevel)
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if strings.EqualFold(cfg.LogFormat, "json") {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type (
+	logCtxKey       struct{}
+	requestIDCtxKey struct{}
+)
+
+// withLogger returns a copy of ctx carrying l.
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, logCtxKey{}, l)
+}
+
+// loggerFrom returns the logger carried by ctx, or the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(logCtxKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// requestIDFrom returns the ID of the request ctx belongs to, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return id
+}
+
+// maxRequestIDLen bounds client-supplied request IDs.
+const maxRequestIDLen = 64
+
+// validRequestID accepts client-supplied IDs made of letters, digits and
+// "-_.:/", so they can't break a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("-_.:/", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RequestLogger assigns each request its ID, puts a logger carrying it in
+// the request's context and logs the request once it's done. Server errors
+// are logged at error level.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		l := slog.Default().With("request_id", id)
+
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ctx := context.WithValue(withLogger(r.Context(), l), requestIDCtxKey{}, id)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		code := ww.Status()
+		if code == 0 {
+			// Nothing written, or the connection was hijacked.
+			code = http.StatusOK
+			if r.Header.Get("Upgrade") != "" {
+				code = http.StatusSwitchingProtocols
+			}
+		}
+		level := slog.LevelInfo
+		if code >= 500 {
+			level = slog.LevelError
+		}
+		l.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", code,
+			"bytes", ww.BytesWritten(),
+			"duration", time.Since(start),
+			"client_ip", clientIP(r),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
+// scrapeIDs numbers scrapes for the lifetime of the process.
+var scrapeIDs atomic.Uint64
+
+// scrapeLogger returns the logger for a new scrape of ticker: ctx's logger
+// with a fresh scrape ID.
+func scrapeLogger(ctx context.Context, ticker, assetClass string) *slog.Logger {
+	return loggerFrom(ctx).With("scrape_id", scrapeIDs.Add(1), "ticker", ticker, "asset_class", assetClass)
+}
+
+// logScrape logs a finished scrape with its duration and outcome, and
+// records it in the metrics. Successful scrapes are logged at debug level,
+// so the poll loop doesn't flood the log.
+func logScrape(l *slog.Logger, assetClass string, ok bool, start time.Time) {
+	metrics.observeScrape(assetClass, ok, start)
+	if ok {
+		l.Debug("scrape", "outcome", "success", "duration", time.Since(start))
+		return
+	}
+	l.Warn("scrape", "outcome", "failure", "duration", time.Since(start))
+}
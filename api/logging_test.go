@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs makes the default logger write JSON to a buffer for the rest
+// of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(NewLogger(&Config{LogLevel: "debug", LogFormat: "json"}, &buf))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+// logLines decodes the JSON log lines in buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("Log line isn't JSON: %q", line)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&Config{LogLevel: "warn", LogFormat: "text"}, &buf)
+	l.Info("hidden")
+	l.Warn("shown", "ticker", "TSLA:NASDAQ")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "msg=shown ticker=TSLA:NASDAQ") {
+		t.Fatalf("Expected only the warning in text format, got %q", out)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	buf := captureLogs(t)
+	var seen string
+	h := RequestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loggerFrom(r.Context()).Info("handling")
+		seen = requestIDFrom(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	// A usable incoming ID is kept.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/stocks/TSLA:NASDAQ", nil)
+	req.Header.Set("X-Request-ID", "trace-42")
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); got != "trace-42" || seen != got {
+		t.Fatalf("Expected the request ID to be echoed, got %q", got)
+	}
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("Expected the handler's line and the request line, got %v", lines)
+	}
+	for _, line := range lines {
+		if line["request_id"] != "trace-42" {
+			t.Errorf("Expected request_id trace-42 on %v", line)
+		}
+	}
+	if done := lines[1]; done["msg"] != "request" || done["status"] != float64(http.StatusTeapot) || done["path"] != "/stocks/TSLA:NASDAQ" {
+		t.Errorf("Unexpected request line %v", done)
+	}
+
+	// Anything else gets a generated one.
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-ID", "bad id\nwith=newline")
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); !validRequestID(got) || got == req.Header.Get("X-Request-ID") {
+		t.Fatalf("Expected a generated request ID, got %q", got)
+	}
+}
+
+func TestScrapeLogCorrelation(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&Config{LogLevel: "debug", LogFormat: "json"}, &buf)
+	ctx := withLogger(context.Background(), l.With("request_id", "r-1"))
+
+	first := scrapeLogger(ctx, "TSLA:NASDAQ", "stock")
+	logScrape(first, "stock", true, time.Now())
+	logScrape(scrapeLogger(ctx, "BTC-USD", "crypto"), "crypto", false, time.Now())
+
+	lines := logLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("Expected two scrape lines, got %v", lines)
+	}
+	ok, failed := lines[0], lines[1]
+	if ok["level"] != "DEBUG" || ok["outcome"] != "success" || ok["ticker"] != "TSLA:NASDAQ" || ok["asset_class"] != "stock" {
+		t.Errorf("Unexpected success line %v", ok)
+	}
+	if failed["level"] != "WARN" || failed["outcome"] != "failure" || failed["ticker"] != "BTC-USD" {
+		t.Errorf("Unexpected failure line %v", failed)
+	}
+	for _, line := range lines {
+		if line["request_id"] != "r-1" {
+			t.Errorf("Expected the request ID on %v", line)
+		}
+		if _, ok := line["duration"]; !ok {
+			t.Errorf("Expected a duration on %v", line)
+		}
+	}
+	if ok["scrape_id"] == failed["scrape_id"] {
+		t.Errorf("Expected distinct scrape IDs, both got %v", ok["scrape_id"])
+	}
+}
+
+func TestClientLogContext(t *testing.T) {
+	var buf bytes.Buffer
+	h := newTestHub(t)
+	c := newClient(h, nil, 2)
+	c.log = NewLogger(&Config{LogLevel: "info", LogFormat: "json"}, &buf).With("request_id", "ws-1")
+
+	loggerFrom(c.logContext("s-1")).Info("scrape")
+	line := logLines(t, &buf)[0]
+	if line["request_id"] != "ws-1" || line["msg_id"] != "s-1" {
+		t.Fatalf("Expected the connection's request ID and the message id, got %v", line)
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
+	"github.com/andybalholm/brotli"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
@@ -17,6 +24,9 @@ import (
 // Global initialization of Colly collector.
 var collector *colly.Collector
 
+// Global FX rate cache, shared by the REST handlers and the hub.
+var fxRates *FXRates
+
 func main() {
 	// Loading the env file.
 	godotenv.Load(".env")
@@ -24,6 +34,10 @@ func main() {
 	// Load configuration from environment.
 	cfg := LoadConfig()
 
+	// Structured logging. Anything still using the log package goes through
+	// it too, at info level.
+	slog.SetDefault(NewLogger(cfg, os.Stderr))
+
 	// Declaring the colly collector and setting its configurations.
 	collector = colly.NewCollector(
 		colly.AllowedDomains("google.com", "www.google.com"),
@@ -37,23 +51,59 @@ func main() {
 		Parallelism: cfg.ScraperParallelism,
 	})
 
+	// Every request to Google spends the upstream budget and passes the
+	// circuit breaker. Clones share the transport.
+	upstream = NewUpstream(cfg, http.DefaultTransport)
+	collector.WithTransport(upstream)
+	metrics.RegisterUpstream(upstream)
+
+	fxRates = NewFXRates(collector, cfg.FXCacheTTL, cfg.FXNegativeCacheTTL)
+
 	// Initialing the chi router.
 	r := chi.NewRouter()
 
-	// Adding the logger middleware to generate logs.
-	r.Use(middleware.Logger)
+	// Client IPs, read from X-Forwarded-For behind trusted proxies.
+	clientIPs, err := NewClientIPs(cfg)
+	if err != nil {
+		fatal("invalid TRUSTED_PROXIES", "error", err)
+	}
+	r.Use(clientIPs.Middleware)
+
+	// Request IDs and request logs.
+	r.Use(RequestLogger)
+
+	// Request metrics, per route pattern.
+	r.Use(metrics.Middleware)
 
 	// Adding the CORS middleware.
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Request-ID", "X-API-Key"},
+		ExposedHeaders:   []string{"X-Request-ID"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
-	// Adding HTTP rate limit on IP.
-	r.Use(httprate.LimitByIP(cfg.RateLimitRequests, cfg.RateLimitWindow))
+	// API keys, with their own rate limits and route restrictions.
+	keys, err := NewAPIKeyStore(cfg.APIKeysPath)
+	if err != nil {
+		fatal("could not load API keys", "error", err)
+	}
+	r.Use(keys.Authenticate(cfg.APIKeysRequired))
+
+	// Adding HTTP rate limit per API key, or on client IP for requests
+	// without one. Batch quote requests are weighted by their number of symbols.
+	r.Use(weighQuoteBatches(cfg.QuoteBatchWeight))
+	r.Use(httprate.Limit(cfg.RateLimitRequests, cfg.RateLimitWindow,
+		httprate.WithKeyFuncs(rateLimitKey),
+		httprate.WithLimitHandler(metrics.rateLimitExceeded)))
+
+	// Compressing JSON and text responses. Event streams and WebSocket
+	// upgrades pass through untouched.
+	if cfg.HTTPCompressionLevel > 0 {
+		r.Use(newCompressor(cfg.HTTPCompressionLevel).Handler)
+	}
 
 	// Homepage
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -74,32 +124,183 @@ func main() {
 
 	// WebSocket hub for live updates.
 	hub := NewHub(collector, cfg)
+	hub.UseFX(fxRates)
+	hub.UseAPIKeys(keys)
+	hub.UseUpstream(upstream)
+	lastKnown = hub.Lookup
+	if err := hub.LoadSnapshot(); err != nil {
+		slog.Warn("could not restore hub snapshot", "error", err)
+	}
+
+	// Server-side watchlists.
+	watchlists, err := NewWatchlistStore(cfg.WatchlistPath)
+	if err != nil {
+		fatal("could not load watchlists", "error", err)
+	}
+	hub.UseWatchlists(watchlists)
+
+	// Portfolios, priced from the hub's quotes.
+	portfolios, err := NewPortfolioStore(cfg.PortfolioPath, hub.Lookup)
+	if err != nil {
+		fatal("could not load portfolios", "error", err)
+	}
+	hub.UsePortfolios(portfolios)
+
+	// Price alerts, evaluated whenever a ticker changes.
+	alerts, err := NewAlertEngine(cfg.AlertsPath, cfg.AlertCooldown)
+	if err != nil {
+		fatal("could not load alert rules", "error", err)
+	}
+	hub.UseAlerts(alerts)
+
+	// Outbound webhooks for quote changes and fired alerts.
+	webhooks, err := NewWebhookDispatcher(cfg)
+	if err != nil {
+		fatal("could not load webhooks", "error", err)
+	}
+	hub.UseWebhooks(webhooks, alerts)
+
 	go hub.Run()
+	metrics.RegisterHub(hub)
+
+	// Liveness and readiness, backed by a canary scrape
+	health := NewHealth(hub, cfg)
+	go health.Run()
+
+	// Health checks
+	r.Get("/healthz", health.ServeHealthz)
+	r.Get("/readyz", health.ServeReadyz)
+	// Prometheus metrics, behind METRICS_TOKEN or ADMIN_TOKEN
+	r.Handle("/metrics", metrics.Protected(cfg))
+
+	// Admin API for inspecting and controlling the hub
+	admin := NewAdmin(hub, keys, cfg)
+	r.Mount("/admin", admin.Routes())
 
 	// WebSocket endpoint
 	r.Get("/ws", hub.ServeWs)
+	// WebSocket delivery counters
+	r.Get("/ws/stats", hub.ServeStats)
+	// Server-Sent Events stream of the same updates
+	r.Get("/stream", hub.ServeStream)
+	// Stock Candles (aggregated from hub polling)
+	r.Get("/stocks/{stock_query}/candles", hub.ServeCandles)
+	// Technical indicators (computed from the candles)
+	r.Get("/stocks/{stock_query}/indicators", hub.ServeIndicators)
+
+	// Watchlists
+	r.Get("/watchlists", watchlists.getWatchlists)
+	r.Post("/watchlists", watchlists.createWatchlist)
+	r.Get("/watchlists/{id}", watchlists.getWatchlist)
+	r.Put("/watchlists/{id}", watchlists.updateWatchlist)
+	r.Delete("/watchlists/{id}", watchlists.deleteWatchlist)
+	r.Get("/watchlists/{id}/tickers", watchlists.getWatchlistTickers)
+	r.Post("/watchlists/{id}/tickers", watchlists.addWatchlistTicker)
+	r.Put("/watchlists/{id}/tickers", watchlists.setWatchlistTickers)
+	r.Delete("/watchlists/{id}/tickers/{ticker}", watchlists.removeWatchlistTicker)
+
+	// Portfolios
+	r.Get("/portfolios", portfolios.getPortfolios)
+	r.Post("/portfolios", portfolios.createPortfolio)
+	r.Get("/portfolios/{id}", portfolios.getPortfolio)
+	r.Delete("/portfolios/{id}", portfolios.deletePortfolio)
+	r.Post("/portfolios/{id}/lots", portfolios.addLot)
+	r.Delete("/portfolios/{id}/lots/{lot_id}", portfolios.removeLot)
+
+	// Batch quotes
+	quotes := NewQuoteBatcher(hub, cfg)
+	r.Get("/quotes", quotes.getQuotes)
+	r.Post("/quotes", quotes.getQuotes)
+
+	// Alerts
+	r.Get("/alerts", alerts.getAlerts)
+	r.Post("/alerts", alerts.createAlert)
+	r.Get("/alerts/{id}", alerts.getAlert)
+	r.Delete("/alerts/{id}", alerts.deleteAlert)
+
+	// Webhooks make the server send requests, so they need the admin token
+	r.Group(func(r chi.Router) {
+		r.Use(admin.Authenticate)
+		r.Get("/webhooks", webhooks.getWebhooks)
+		r.Post("/webhooks", webhooks.createWebhook)
+		r.Get("/webhooks/dead-letters", webhooks.getDeadLetters)
+		r.Post("/webhooks/dead-letters/{id}/replay", webhooks.replayDeadLetter)
+		r.Get("/webhooks/{id}", webhooks.getWebhook)
+		r.Delete("/webhooks/{id}", webhooks.deleteWebhook)
+	})
+
+	slog.Info("starting the server", "port", cfg.Port, "poll_workers", cfg.PollWorkers,
+		"poll_interval", cfg.PollInterval, "scraper_parallelism", cfg.ScraperParallelism)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", cfg.Port),
+		Handler: r,
+	}
+	// Streams never finish on their own, so end them before Shutdown waits.
+	srv.RegisterOnShutdown(hub.CloseStreams)
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("server error", "error", err)
+		}
+	}()
+
+	// Block until SIGINT/SIGTERM, then shut down gracefully.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+
+	slog.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+	httpCtx, cancelHTTP := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelHTTP()
+
+	// Stop accepting connections and let in-flight REST requests finish.
+	// Hijacked WebSocket connections are not tracked by the server.
+	if err := srv.Shutdown(httpCtx); err != nil {
+		slog.Error("HTTP shutdown", "error", err)
+	}
 
-	log.Printf("Starting the server on port %s (poll_workers=%d, poll_interval=%s, scraper_parallelism=%d)",
-		cfg.Port, cfg.PollWorkers, cfg.PollInterval, cfg.ScraperParallelism)
+	// The hub gets its own timeout, so slow REST requests can't use up the
+	// time for the poll cycle and the final snapshot.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
 
-	http.ListenAndServe(fmt.Sprintf(":%s", cfg.Port), r)
+	// Close WebSockets, wait for the poll cycle and flush the snapshot.
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		slog.Error("hub shutdown", "error", err)
+	}
+
+	// Park undelivered webhook events in the dead-letter list.
+	if err := webhooks.Stop(shutdownCtx); err != nil {
+		slog.Error("webhook shutdown", "error", err)
+	}
+
+	slog.Info("shutdown complete")
 }
 
 func getStockStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	stock_data := Get_Stock_Data(collector, chi.URLParam(r, "stock_query"))
+	stock_data := Get_Stock_Data(r.Context(), collector, chi.URLParam(r, "stock_query"))
 
 	// Returning a 404 if the stock data doesn't have a name.
 	if stock_data.Name == "" {
+		if writeLastKnown(w, r, normalizeTicker(chi.URLParam(r, "stock_query"))) {
+			return
+		}
 		w.WriteHeader(404)
 		w.Write([]byte(fmt.Sprintf("No stock data found for the query '%s'.", chi.URLParam(r, "stock_query"))))
 		return
 
 	}
 
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "    ")
-	enc.Encode(*stock_data)
+	// Converting the prices if asked to.
+	ticker := normalizeTicker(chi.URLParam(r, "stock_query"))
+	if writeConverted(w, r, StockEntry{Ticker: ticker, IsStock: true, IsIndex: isIndexTicker(ticker), StockData: stock_data}) {
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, *stock_data)
 }
 
 func getStockNews(w http.ResponseWriter, r *http.Request) {
@@ -108,29 +309,37 @@ func getStockNews(w http.ResponseWriter, r *http.Request) {
 
 	// Returning a 404 if no stock news are found.
 	if len(*stock_news) == 0 {
+		if writeUpstreamUnavailable(w) {
+			return
+		}
 		w.WriteHeader(404)
 		w.Write([]byte(fmt.Sprintf("No news found for '%s'.", chi.URLParam(r, "stock_query"))))
 		return
 	}
 
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "    ")
-	enc.Encode(*stock_news)
+	writeJSON(w, r, http.StatusOK, *stock_news)
 }
 
 func getCryptoData(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	crypto_data := Get_Crypto_Data(collector, chi.URLParam(r, "crypto_name"), chi.URLParam(r, "crypto_currency"))
+	crypto_data := Get_Crypto_Data(r.Context(), collector, chi.URLParam(r, "crypto_name"), chi.URLParam(r, "crypto_currency"))
 
 	if crypto_data.Name == "" {
+		if writeLastKnown(w, r, normalizeTicker(chi.URLParam(r, "crypto_name")+"-"+chi.URLParam(r, "crypto_currency"))) {
+			return
+		}
 		w.WriteHeader(404)
 		w.Write([]byte(fmt.Sprintf("No crypto data found for the query '%s:%s'", chi.URLParam(r, "crypto_name"), chi.URLParam(r, "crypto_currency"))))
 		return
 	}
 
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "    ")
-	enc.Encode(*crypto_data)
+	// Converting the prices if asked to.
+	ticker := normalizeTicker(chi.URLParam(r, "crypto_name") + "-" + chi.URLParam(r, "crypto_currency"))
+	if writeConverted(w, r, StockEntry{Ticker: ticker, CryptoData: crypto_data}) {
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, *crypto_data)
 }
 
 func searchStocks(w http.ResponseWriter, r *http.Request) {
@@ -138,29 +347,37 @@ func searchStocks(w http.ResponseWriter, r *http.Request) {
 	results := Search_Stocks(collector, chi.URLParam(r, "query"))
 
 	if len(*results) == 0 {
+		if writeUpstreamUnavailable(w) {
+			return
+		}
 		w.WriteHeader(404)
 		w.Write([]byte(fmt.Sprintf("No results found for '%s'.", chi.URLParam(r, "query"))))
 		return
 	}
 
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "    ")
-	enc.Encode(*results)
+	writeJSON(w, r, http.StatusOK, *results)
 }
 
 func getIndexData(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	index_data := Get_Stock_Data(collector, chi.URLParam(r, "index_query"))
+	index_data := Get_Stock_Data(r.Context(), collector, chi.URLParam(r, "index_query"))
 
 	if index_data.Name == "" {
+		if writeLastKnown(w, r, normalizeTicker(chi.URLParam(r, "index_query"))) {
+			return
+		}
 		w.WriteHeader(404)
 		w.Write([]byte(fmt.Sprintf("No index data found for the query '%s'.", chi.URLParam(r, "index_query"))))
 		return
 	}
 
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "    ")
-	enc.Encode(*index_data)
+	// Indexes can't be converted; this reports why if asked to.
+	ticker := normalizeTicker(chi.URLParam(r, "index_query"))
+	if writeConverted(w, r, StockEntry{Ticker: ticker, IsStock: true, IsIndex: true, StockData: index_data}) {
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, *index_data)
 }
 
 func getCryptoNews(w http.ResponseWriter, r *http.Request) {
@@ -169,12 +386,42 @@ func getCryptoNews(w http.ResponseWriter, r *http.Request) {
 
 	// Returning a 404 if no stock news are found.
 	if len(*crypto_news) == 0 {
+		if writeUpstreamUnavailable(w) {
+			return
+		}
 		w.WriteHeader(404)
 		w.Write([]byte(fmt.Sprintf("No news found for the query '%s:%s'", chi.URLParam(r, "crypto_name"), chi.URLParam(r, "crypto_currency"))))
 		return
 	}
 
+	writeJSON(w, r, http.StatusOK, *crypto_news)
+}
+
+// writeJSON writes v as a JSON response with the given status, indented
+// with 4 spaces if the request asks for ?pretty=1.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	enc := json.NewEncoder(w)
-	enc.SetIndent("", "    ")
-	enc.Encode(*crypto_news)
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		enc.SetIndent("", "    ")
+	}
+	enc.Encode(v)
+}
+
+// newCompressor negotiates brotli, gzip or deflate from Accept-Encoding,
+// preferring brotli.
+func newCompressor(level int) *middleware.Compressor {
+	c := middleware.NewCompressor(level, "application/json", "text/plain")
+	c.SetEncoder("br", func(w io.Writer, level int) io.Writer {
+		return brotli.NewWriterLevel(w, level)
+	})
+	return c
+}
+
+// writeError writes a plain-text error message with the given status.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(msg))
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httprate"
@@ -194,3 +198,59 @@ func TestInvalidIndexEndpoint(t *testing.T) {
 		t.Fatalf("Expected status 404 for invalid index, got %d", rr.Code)
 	}
 }
+
+func TestWriteJSONPretty(t *testing.T) {
+	for query, want := range map[string]string{
+		"/":           "{\"a\":1}\n",
+		"/?pretty=1":  "{\n    \"a\": 1\n}\n",
+		"/?pretty=no": "{\"a\":1}\n",
+	} {
+		rr := httptest.NewRecorder()
+		writeJSON(rr, httptest.NewRequest("GET", query, nil), http.StatusOK, map[string]int{"a": 1})
+		if rr.Body.String() != want {
+			t.Errorf("%s: got %q, want %q", query, rr.Body.String(), want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(newCompressor(5).Handler)
+	r.Get("/json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, strings.Repeat("stonks ", 100))
+	})
+	r.Get("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {}\n\n"))
+	})
+
+	for accept, want := range map[string]string{"br, gzip": "br", "gzip, deflate": "gzip", "": ""} {
+		req := httptest.NewRequest("GET", "/json", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if got := rr.Header().Get("Content-Encoding"); got != want {
+			t.Fatalf("Accept-Encoding %q: got Content-Encoding %q, want %q", accept, got, want)
+		}
+
+		var body io.Reader = rr.Body
+		switch want {
+		case "br":
+			body = brotli.NewReader(rr.Body)
+		case "gzip":
+			body, _ = gzip.NewReader(rr.Body)
+		}
+		var s string
+		if err := json.NewDecoder(body).Decode(&s); err != nil || len(s) != 700 {
+			t.Fatalf("Accept-Encoding %q: could not decode the response: %v", accept, err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != "data: {}\n\n" {
+		t.Fatal("Expected event streams not to be compressed")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ---------------------------------------------------------------------------
+// Prometheus metrics, served at /metrics
+// ---------------------------------------------------------------------------
+
+// metrics is shared by the scrapers, the hub and the HTTP middleware, like
+// the global collector. The hub's gauges are read when /metrics is scraped,
+// see hubCollector.
+var metrics = NewMetrics()
+
+// Metrics holds the instruments and the registry they're served from.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	scrapeDuration   *prometheus.HistogramVec // asset_class, outcome
+	pollDuration     prometheus.Histogram
+	pollOverruns     prometheus.Counter
+	workerWait       prometheus.Counter
+	rateLimited      prometheus.Counter
+	upstreamRequests *prometheus.CounterVec // outcome
+	upstreamWait     prometheus.Counter
+	httpRequests     *prometheus.CounterVec   // method, route, code
+	httpDuration     *prometheus.HistogramVec // method, route
+}
+
+// NewMetrics creates the instruments in a new registry, along with the Go
+// runtime and process collectors.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		scrapeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "stonks_scrape_duration_seconds",
+			Help:    "Time taken by Google Finance scrapes, by asset class (stock, index, crypto) and outcome (success, failure).",
+			Buckets: []float64{.1, .25, .5, 1, 2, 4, 8, 16, 32},
+		}, []string{"asset_class", "outcome"}),
+		pollDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "stonks_poll_cycle_duration_seconds",
+			Help:    "Time taken by a hub poll cycle to scrape every tracked ticker.",
+			Buckets: []float64{.25, .5, 1, 2, 4, 8, 16, 32, 64},
+		}),
+		pollOverruns: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stonks_poll_cycle_overruns_total",
+			Help: "Poll cycles that took longer than the poll interval.",
+		}),
+		workerWait: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stonks_poll_worker_wait_seconds_total",
+			Help: "Time scrapes spent waiting for a free poll worker.",
+		}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stonks_http_rate_limited_total",
+			Help: "HTTP requests rejected by the per-IP or per-API-key rate limit.",
+		}),
+		upstreamRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stonks_upstream_requests_total",
+			Help: "Requests to Google by outcome: ok, throttled (429, 503 or captcha), error (no response) or rejected (circuit breaker open).",
+		}, []string{"outcome"}),
+		upstreamWait: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stonks_upstream_wait_seconds_total",
+			Help: "Time requests to Google spent waiting for the upstream rate budget.",
+		}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "stonks_http_requests_total",
+			Help: "HTTP requests by method, route pattern and status code.",
+		}, []string{"method", "route", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "stonks_http_request_duration_seconds",
+			Help:    "HTTP request latency by method and route pattern. WebSocket and event stream connections aren't included.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.scrapeDuration, m.pollDuration, m.pollOverruns, m.workerWait,
+		m.rateLimited, m.upstreamRequests, m.upstreamWait, m.httpRequests, m.httpDuration,
+	)
+	return m
+}
+
+// RegisterHub exports the hub's clients, subscriptions, poll workers and
+// delivery counters.
+func (m *Metrics) RegisterHub(h *Hub) {
+	m.registry.MustRegister(&hubCollector{hub: h})
+}
+
+// RegisterUpstream exports the state of u's circuit breaker.
+func (m *Metrics) RegisterUpstream(u *Upstream) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "stonks_upstream_breaker_state",
+		Help: "State of the circuit breaker toward Google: 0 closed, 1 open, 2 half-open.",
+	}, u.stateValue))
+}
+
+// observeScrape records a scrape of the given asset class that started at
+// start.
+func (m *Metrics) observeScrape(assetClass string, ok bool, start time.Time) {
+	outcome := "success"
+	if !ok {
+		outcome = "failure"
+	}
+	m.scrapeDuration.WithLabelValues(assetClass, outcome).Observe(time.Since(start).Seconds())
+}
+
+// observePoll records a poll cycle that took d.
+func (m *Metrics) observePoll(d, interval time.Duration) {
+	m.pollDuration.Observe(d.Seconds())
+	if d > interval {
+		m.pollOverruns.Inc()
+	}
+}
+
+// stockAssetClass tells stocks from indexes for stonks_scrape_duration_seconds.
+func stockAssetClass(query string) string {
+	if isIndexTicker(normalizeTicker(query)) {
+		return "index"
+	}
+	return "stock"
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Protected is Handler behind cfg.MetricsToken, or cfg.AdminToken if that
+// isn't set. Without either it's disabled.
+func (m *Metrics) Protected(cfg *Config) http.Handler {
+	token := cfg.MetricsToken
+	if token == "" {
+		token = cfg.AdminToken
+	}
+	return requireBearer(token, "metrics", "Metrics are disabled. Set METRICS_TOKEN or ADMIN_TOKEN to enable them.")(m.Handler())
+}
+
+// Middleware counts requests and times them by route pattern, so
+// /stocks/{stock_query} is one series rather than one per ticker. Requests
+// that never reached a route (404s, rate-limited requests) have route
+// "none".
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "none"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		code := ww.Status()
+		if code == 0 {
+			// Nothing written, or the connection was hijacked.
+			code = http.StatusOK
+			if r.Header.Get("Upgrade") != "" {
+				code = http.StatusSwitchingProtocols
+			}
+		}
+		m.httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(code)).Inc()
+
+		// A connection's lifetime isn't a latency.
+		if code != http.StatusSwitchingProtocols && ww.Header().Get("Content-Type") != "text/event-stream" {
+			m.httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+		}
+	})
+}
+
+// rateLimitExceeded is the rate limiter's response, counted.
+func (m *Metrics) rateLimitExceeded(w http.ResponseWriter, r *http.Request) {
+	m.rateLimited.Inc()
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// hubCollector reads the hub's state when /metrics is scraped.
+type hubCollector struct {
+	hub *Hub
+}
+
+var (
+	descClients = prometheus.NewDesc("stonks_ws_clients",
+		"Connected WebSocket and event stream clients, including detached sessions.", nil, nil)
+	descTickers = prometheus.NewDesc("stonks_tracked_tickers",
+		"Tickers the hub polls.", nil, nil)
+	descSubscriptions = prometheus.NewDesc("stonks_ticker_subscribers",
+		"Clients subscribed to each ticker.", []string{"ticker"}, nil)
+	descWorkersBusy = prometheus.NewDesc("stonks_poll_workers_busy",
+		"Poll workers currently scraping. Saturated when equal to stonks_poll_workers.", nil, nil)
+	descWorkers = prometheus.NewDesc("stonks_poll_workers",
+		"Size of the poll worker pool (POLL_WORKERS).", nil, nil)
+	descDropped = prometheus.NewDesc("stonks_ws_dropped_messages_total",
+		"Non-update messages dropped on a full client send buffer.", nil, nil)
+	descConflated = prometheus.NewDesc("stonks_ws_conflated_updates_total",
+		"Quote updates replaced by a newer one before they were written.", nil, nil)
+	descEvictions = prometheus.NewDesc("stonks_ws_slow_client_evictions_total",
+		"Clients disconnected for falling behind.", nil, nil)
+)
+
+func (c *hubCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{descClients, descTickers, descSubscriptions, descWorkersBusy, descWorkers, descDropped, descConflated, descEvictions} {
+		ch <- d
+	}
+}
+
+func (c *hubCollector) Collect(ch chan<- prometheus.Metric) {
+	h := c.hub
+	stats := h.Stats()
+	ch <- prometheus.MustNewConstMetric(descClients, prometheus.GaugeValue, float64(stats.Clients))
+	ch <- prometheus.MustNewConstMetric(descTickers, prometheus.GaugeValue, float64(stats.Tickers))
+	ch <- prometheus.MustNewConstMetric(descWorkersBusy, prometheus.GaugeValue, float64(len(h.sem)))
+	ch <- prometheus.MustNewConstMetric(descWorkers, prometheus.GaugeValue, float64(cap(h.sem)))
+	ch <- prometheus.MustNewConstMetric(descDropped, prometheus.CounterValue, float64(stats.DroppedMessages))
+	ch <- prometheus.MustNewConstMetric(descConflated, prometheus.CounterValue, float64(stats.ConflatedUpdates))
+	ch <- prometheus.MustNewConstMetric(descEvictions, prometheus.CounterValue, float64(stats.SlowClientEvictions))
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ticker, subs := range h.subscribers {
+		ch <- prometheus.MustNewConstMetric(descSubscriptions, prometheus.GaugeValue, float64(len(subs)), ticker)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httprate"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// scrapeMetrics returns m's /metrics output.
+func scrapeMetrics(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from /metrics, got %d", rr.Code)
+	}
+	return rr.Body.String()
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	m := NewMetrics()
+	r := chi.NewRouter()
+	r.Use(m.Middleware)
+	r.Use(httprate.Limit(2, time.Minute, httprate.WithLimitHandler(m.rateLimitExceeded)))
+	r.Get("/stocks/{stock_query}", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "nope")
+	})
+
+	for _, path := range []string{"/stocks/TSLA:NASDAQ", "/stocks/AAPL:NASDAQ", "/stocks/GOOGL:NASDAQ"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if n := testutil.ToFloat64(m.httpRequests.WithLabelValues("GET", "/stocks/{stock_query}", "404")); n != 2 {
+		t.Fatalf("Expected 2 requests counted under the route pattern, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.httpRequests.WithLabelValues("GET", "none", "429")); n != 1 {
+		t.Fatalf("Expected the rate-limited request under route none, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.rateLimited); n != 1 {
+		t.Fatalf("Expected 1 rate-limit rejection, got %v", n)
+	}
+}
+
+func TestMetricsHubCollector(t *testing.T) {
+	m := NewMetrics()
+	h := newTestHub(t)
+	m.RegisterHub(h)
+	a, b := newClient(h, nil, 2), newClient(h, nil, 2)
+	h.clients[a], h.clients[b] = struct{}{}, struct{}{}
+	h.store["TSLA:NASDAQ"] = &StockEntry{Ticker: "TSLA:NASDAQ"}
+	h.subscribers["TSLA:NASDAQ"] = map[*Client]struct{}{a: {}, b: {}}
+	h.dropped.Add(3)
+
+	m.observePoll(2*h.cfg.PollInterval, h.cfg.PollInterval)
+	m.observeScrape("crypto", false, time.Now())
+
+	out := scrapeMetrics(t, m)
+	for _, want := range []string{
+		"stonks_ws_clients 2",
+		"stonks_tracked_tickers 1",
+		`stonks_ticker_subscribers{ticker="TSLA:NASDAQ"} 2`,
+		"stonks_ws_dropped_messages_total 3",
+		fmt.Sprintf("stonks_poll_workers %d", cap(h.sem)),
+		"stonks_poll_cycle_overruns_total 1",
+		`stonks_scrape_duration_seconds_count{asset_class="crypto",outcome="failure"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in /metrics", want)
+		}
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	m := NewMetrics()
+	scrape := func(cfg *Config, auth string) int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		m.Protected(cfg).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := scrape(&Config{}, ""); code != http.StatusNotFound {
+		t.Errorf("Expected /metrics to be disabled without a token, got %d", code)
+	}
+	cfg := &Config{AdminToken: "admin"}
+	if code := scrape(cfg, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", code)
+	}
+	if code := scrape(cfg, "admin"); code != http.StatusOK {
+		t.Errorf("Expected the admin token to be accepted, got %d", code)
+	}
+	cfg.MetricsToken = "prom"
+	if code := scrape(cfg, "admin"); code != http.StatusUnauthorized {
+		t.Errorf("Expected only METRICS_TOKEN to be accepted once set, got %d", code)
+	}
+	if code := scrape(cfg, "prom"); code != http.StatusOK {
+		t.Errorf("Expected METRICS_TOKEN to be accepted, got %d", code)
+	}
+}
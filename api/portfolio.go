@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ---------------------------------------------------------------------------
+// Portfolios – holdings, lots and live P&L from hub quotes
+// ---------------------------------------------------------------------------
+
+// Lot is a single purchase of a holding.
+type Lot struct {
+	ID       string     `json:"id"`
+	Quantity float64    `json:"quantity"`
+	Price    float64    `json:"price"` // cost per unit, in the holding's currency
+	Date     *time.Time `json:"date,omitempty"`
+}
+
+// Holding groups the lots of one ticker inside a portfolio.
+type Holding struct {
+	Ticker   string `json:"ticker"`
+	Currency string `json:"currency"`
+	Lots     []Lot  `json:"lots"`
+}
+
+// Portfolio is a named set of holdings.
+type Portfolio struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Holdings  []Holding `json:"holdings"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// HoldingValuation is a holding priced with the hub's latest quote.
+type HoldingValuation struct {
+	Ticker          string  `json:"ticker"`
+	Currency        string  `json:"currency"`
+	Quantity        float64 `json:"quantity"`
+	CostBasis       float64 `json:"costBasis"`
+	AverageCost     float64 `json:"averageCost"`
+	Priced          bool    `json:"priced"` // false until the hub has a quote for the ticker
+	Stale           bool    `json:"stale,omitempty"`
+	Price           float64 `json:"price"`
+	PreviousClose   float64 `json:"previousClose"`
+	MarketValue     float64 `json:"marketValue"`
+	DayPnL          float64 `json:"dayPnl"`
+	TotalPnL        float64 `json:"totalPnl"`
+	TotalPnLPercent float64 `json:"totalPnlPercent"`
+	Lots            []Lot   `json:"lots"`
+}
+
+// PortfolioTotals sums the priced holdings of one currency.
+type PortfolioTotals struct {
+	MarketValue     float64 `json:"marketValue"`
+	CostBasis       float64 `json:"costBasis"`
+	DayPnL          float64 `json:"dayPnl"`
+	TotalPnL        float64 `json:"totalPnl"`
+	TotalPnLPercent float64 `json:"totalPnlPercent"`
+}
+
+// PortfolioValuation is the payload of GET /portfolios/{id} and of the
+// "portfolio_update" WebSocket message. Totals are grouped by currency since
+// holdings in different currencies can't be summed directly.
+type PortfolioValuation struct {
+	ID       string                     `json:"id"`
+	Name     string                     `json:"name"`
+	Holdings []HoldingValuation         `json:"holdings"`
+	Totals   map[string]PortfolioTotals `json:"totals"`
+	AsOf     time.Time                  `json:"asOf"`
+}
+
+// QuoteLookup returns the latest known entry for a ticker.
+type QuoteLookup func(ticker string) (StockEntry, bool)
+
+// valuePortfolio prices every holding of p using lookup.
+func valuePortfolio(p Portfolio, lookup QuoteLookup) PortfolioValuation {
+	v := PortfolioValuation{
+		ID:       p.ID,
+		Name:     p.Name,
+		Holdings: make([]HoldingValuation, 0, len(p.Holdings)),
+		Totals:   make(map[string]PortfolioTotals),
+		AsOf:     time.Now(),
+	}
+
+	for _, h := range p.Holdings {
+		hv := HoldingValuation{
+			Ticker:   h.Ticker,
+			Currency: h.Currency,
+			Lots:     h.Lots,
+		}
+		for _, lot := range h.Lots {
+			hv.Quantity += lot.Quantity
+			hv.CostBasis += lot.Quantity * lot.Price
+		}
+		if hv.Quantity != 0 {
+			hv.AverageCost = hv.CostBasis / hv.Quantity
+		}
+
+		entry, found := lookup(h.Ticker)
+		if price, prevClose, ok := entryPrice(entry); found && ok {
+			hv.Priced = true
+			hv.Stale = entry.Stale
+			hv.Price = price
+			hv.PreviousClose = prevClose
+			hv.MarketValue = hv.Quantity * price
+			hv.DayPnL = hv.Quantity * (price - prevClose)
+			hv.TotalPnL = hv.MarketValue - hv.CostBasis
+			if hv.CostBasis != 0 {
+				hv.TotalPnLPercent = hv.TotalPnL / hv.CostBasis * 100
+			}
+
+			t := v.Totals[h.Currency]
+			t.MarketValue += hv.MarketValue
+			t.CostBasis += hv.CostBasis
+			t.DayPnL += hv.DayPnL
+			t.TotalPnL += hv.TotalPnL
+			v.Totals[h.Currency] = t
+		}
+		v.Holdings = append(v.Holdings, hv)
+	}
+
+	for cur, t := range v.Totals {
+		if t.CostBasis != 0 {
+			t.TotalPnLPercent = t.TotalPnL / t.CostBasis * 100
+			v.Totals[cur] = t
+		}
+	}
+	return v
+}
+
+// entryPrice extracts the price and previous close from an entry.
+func entryPrice(entry StockEntry) (price, prevClose float64, ok bool) {
+	switch {
+	case entry.StockData != nil:
+		return float64(entry.StockData.Price), float64(entry.StockData.PreviousClose), true
+	case entry.CryptoData != nil:
+		return float64(entry.CryptoData.Price), float64(entry.CryptoData.PreviousClose), true
+	}
+	return 0, 0, false
+}
+
+// exchangeCurrencies maps common Google Finance exchange codes to the
+// currency their quotes are in.
+var exchangeCurrencies = map[string]string{
+	"NASDAQ":       "USD",
+	"NYSE":         "USD",
+	"NYSEARCA":     "USD",
+	"NYSEAMERICAN": "USD",
+	"OTCMKTS":      "USD",
+	"NSE":          "INR",
+	"BOM":          "INR",
+	"LON":          "GBX",
+	"ETR":          "EUR",
+	"FRA":          "EUR",
+	"EPA":          "EUR",
+	"AMS":          "EUR",
+	"TYO":          "JPY",
+	"HKG":          "HKD",
+	"TSE":          "CAD",
+	"ASX":          "AUD",
+}
+
+// quoteCurrency guesses the currency a ticker is quoted in: the quote
+// currency for crypto pairs, or the exchange's currency for stocks.
+// It returns "" when unknown.
+func quoteCurrency(ticker string) string {
+	ticker = normalizeTicker(ticker)
+	if !isStockTicker(ticker) {
+		if parts := strings.SplitN(ticker, "-", 2); len(parts) == 2 {
+			return parts[1]
+		}
+		return ""
+	}
+	parts := strings.SplitN(ticker, ":", 2)
+	return exchangeCurrencies[parts[1]]
+}
+
+// ---------------------------------------------------------------------------
+// PortfolioStore
+// ---------------------------------------------------------------------------
+
+var (
+	errPortfolioNotFound = errors.New("portfolio not found")
+	errLotNotFound       = errors.New("lot not found")
+	errEmptyPortfolio    = errors.New("portfolio name must not be empty")
+	errInvalidLot        = errors.New("invalid lot") // wrapped with the reason
+)
+
+// PortfolioChangeFunc is called after a portfolio is created, edited or
+// deleted, with the portfolio's latest state.
+type PortfolioChangeFunc func(p Portfolio, deleted bool)
+
+// portfolioFile is the on-disk format of the portfolio store.
+type portfolioFile struct {
+	Portfolios []*Portfolio `json:"portfolios"`
+}
+
+// PortfolioStore keeps portfolios in memory and writes every change through
+// to a JSON file.
+type PortfolioStore struct {
+	mu        sync.RWMutex
+	path      string
+	items     map[string]*Portfolio
+	lookup    QuoteLookup
+	listeners []PortfolioChangeFunc
+}
+
+// NewPortfolioStore loads the store from path, pricing holdings with lookup.
+// An empty path keeps the store in memory only.
+func NewPortfolioStore(path string, lookup QuoteLookup) (*PortfolioStore, error) {
+	s := &PortfolioStore{
+		path:   path,
+		items:  make(map[string]*Portfolio),
+		lookup: lookup,
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	var file portfolioFile
+	if _, err := readJSONFile(path, &file); err != nil {
+		return s, err
+	}
+	for _, p := range file.Portfolios {
+		if p != nil && p.ID != "" {
+			s.items[p.ID] = p
+		}
+	}
+	slog.Info("loaded portfolios", "component", "portfolios", "portfolios", len(s.items))
+	return s, nil
+}
+
+// OnChange registers fn to be called after every change.
+func (s *PortfolioStore) OnChange(fn PortfolioChangeFunc) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, fn)
+	s.mu.Unlock()
+}
+
+// List returns copies of all portfolios, oldest first.
+func (s *PortfolioStore) List() []Portfolio {
+	s.mu.RLock()
+	out := make([]Portfolio, 0, len(s.items))
+	for _, p := range s.items {
+		out = append(out, copyPortfolio(p))
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// Get returns a copy of the portfolio with the given id.
+func (s *PortfolioStore) Get(id string) (Portfolio, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.items[id]
+	if !ok {
+		return Portfolio{}, false
+	}
+	return copyPortfolio(p), true
+}
+
+// Value prices the portfolio with the given id.
+func (s *PortfolioStore) Value(id string) (PortfolioValuation, bool) {
+	p, ok := s.Get(id)
+	if !ok {
+		return PortfolioValuation{}, false
+	}
+	return valuePortfolio(p, s.lookup), true
+}
+
+// Tickers returns every ticker held in any portfolio.
+func (s *PortfolioStore) Tickers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := make(map[string]struct{})
+	var out []string
+	for _, p := range s.items {
+		for _, h := range p.Holdings {
+			if _, ok := seen[h.Ticker]; !ok {
+				seen[h.Ticker] = struct{}{}
+				out = append(out, h.Ticker)
+			}
+		}
+	}
+	return out
+}
+
+// Create adds an empty portfolio.
+func (s *PortfolioStore) Create(name string) (Portfolio, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Portfolio{}, errEmptyPortfolio
+	}
+
+	now := time.Now()
+	p := &Portfolio{
+		ID:        newID(),
+		Name:      name,
+		Holdings:  []Holding{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	s.mu.Lock()
+	s.items[p.ID] = p
+	if err := s.saveLocked(); err != nil {
+		delete(s.items, p.ID)
+		s.mu.Unlock()
+		return Portfolio{}, err
+	}
+	out := copyPortfolio(p)
+	s.mu.Unlock()
+
+	s.notify(out, false)
+	return out, nil
+}
+
+// Update applies fn to a copy of the portfolio and stores the result. A
+// failed update or save leaves the stored portfolio untouched.
+func (s *PortfolioStore) Update(id string, fn func(p *Portfolio) error) (Portfolio, error) {
+	s.mu.Lock()
+	cur, ok := s.items[id]
+	if !ok {
+		s.mu.Unlock()
+		return Portfolio{}, errPortfolioNotFound
+	}
+
+	next := copyPortfolio(cur)
+	if err := fn(&next); err != nil {
+		s.mu.Unlock()
+		return Portfolio{}, err
+	}
+	next.UpdatedAt = time.Now()
+	stored := copyPortfolio(&next)
+	s.items[id] = &stored
+	if err := s.saveLocked(); err != nil {
+		s.items[id] = cur
+		s.mu.Unlock()
+		return Portfolio{}, err
+	}
+	s.mu.Unlock()
+
+	s.notify(next, false)
+	return next, nil
+}
+
+// Delete removes the portfolio with the given id.
+func (s *PortfolioStore) Delete(id string) error {
+	s.mu.Lock()
+	cur, ok := s.items[id]
+	if !ok {
+		s.mu.Unlock()
+		return errPortfolioNotFound
+	}
+	delete(s.items, id)
+	if err := s.saveLocked(); err != nil {
+		s.items[id] = cur
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+
+	s.notify(*cur, true)
+	return nil
+}
+
+// AddLot records a purchase, creating the holding if needed.
+func (s *PortfolioStore) AddLot(id, ticker, currency string, lot Lot) (Portfolio, error) {
+	ticker = normalizeTicker(ticker)
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if ticker == "" {
+		return Portfolio{}, fmt.Errorf("%w: ticker must not be empty", errInvalidLot)
+	}
+	if lot.Quantity <= 0 || lot.Price < 0 {
+		return Portfolio{}, fmt.Errorf("%w: quantity must be positive and price must not be negative", errInvalidLot)
+	}
+	if currency == "" {
+		currency = quoteCurrency(ticker)
+	}
+	if currency == "" {
+		return Portfolio{}, fmt.Errorf("%w: could not infer the currency of %s, please pass 'currency'", errInvalidLot, ticker)
+	}
+	lot.ID = newID()
+
+	return s.Update(id, func(p *Portfolio) error {
+		for i := range p.Holdings {
+			h := &p.Holdings[i]
+			if h.Ticker != ticker {
+				continue
+			}
+			if h.Currency != currency {
+				return fmt.Errorf("%s is held in %s, not %s", ticker, h.Currency, currency)
+			}
+			h.Lots = append(h.Lots, lot)
+			return nil
+		}
+		p.Holdings = append(p.Holdings, Holding{Ticker: ticker, Currency: currency, Lots: []Lot{lot}})
+		return nil
+	})
+}
+
+// RemoveLot deletes a lot, dropping the holding once it has no lots left.
+func (s *PortfolioStore) RemoveLot(id, lotID string) (Portfolio, error) {
+	return s.Update(id, func(p *Portfolio) error {
+		for i := range p.Holdings {
+			lots := p.Holdings[i].Lots
+			for j := range lots {
+				if lots[j].ID != lotID {
+					continue
+				}
+				p.Holdings[i].Lots = append(lots[:j], lots[j+1:]...)
+				if len(p.Holdings[i].Lots) == 0 {
+					p.Holdings = append(p.Holdings[:i], p.Holdings[i+1:]...)
+				}
+				return nil
+			}
+		}
+		return errLotNotFound
+	})
+}
+
+// saveLocked writes the store to disk. Caller must hold s.mu.
+func (s *PortfolioStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	file := portfolioFile{Portfolios: make([]*Portfolio, 0, len(s.items))}
+	for _, p := range s.items {
+		file.Portfolios = append(file.Portfolios, p)
+	}
+	if err := writeJSONFile(s.path, file); err != nil {
+		slog.Error("save failed", "component", "portfolios", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PortfolioStore) notify(p Portfolio, deleted bool) {
+	s.mu.RLock()
+	listeners := append([]PortfolioChangeFunc(nil), s.listeners...)
+	s.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(p, deleted)
+	}
+}
+
+func copyPortfolio(p *Portfolio) Portfolio {
+	out := *p
+	out.Holdings = make([]Holding, len(p.Holdings))
+	for i, h := range p.Holdings {
+		h.Lots = append([]Lot(nil), h.Lots...)
+		out.Holdings[i] = h
+	}
+	return out
+}
+
+// ---------------------------------------------------------------------------
+// REST handlers
+// ---------------------------------------------------------------------------
+
+type lotRequest struct {
+	Ticker   string     `json:"ticker"`
+	Currency string     `json:"currency"`
+	Quantity float64    `json:"quantity"`
+	Price    float64    `json:"price"`
+	Date     *time.Time `json:"date"`
+}
+
+func (s *PortfolioStore) getPortfolios(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.List())
+}
+
+func (s *PortfolioStore) createPortfolio(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Expected JSON body with a 'name'.")
+		return
+	}
+
+	p, err := s.Create(req.Name)
+	if errors.Is(err, errEmptyPortfolio) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not save portfolio.")
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, p)
+}
+
+// getPortfolio returns the portfolio priced with the latest quotes.
+func (s *PortfolioStore) getPortfolio(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	v, ok := s.Value(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No portfolio found with id '%s'.", id))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, v)
+}
+
+func (s *PortfolioStore) deletePortfolio(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := s.Delete(id)
+	if errors.Is(err, errPortfolioNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No portfolio found with id '%s'.", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not save portfolios.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *PortfolioStore) addLot(w http.ResponseWriter, r *http.Request) {
+	var req lotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Expected JSON body with 'ticker', 'quantity', 'price' and optional 'currency' and 'date'.")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	_, err := s.AddLot(id, req.Ticker, req.Currency, Lot{Quantity: req.Quantity, Price: req.Price, Date: req.Date})
+	s.respondValuation(w, r, id, err, http.StatusCreated)
+}
+
+func (s *PortfolioStore) removeLot(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	_, err := s.RemoveLot(id, chi.URLParam(r, "lot_id"))
+	s.respondValuation(w, r, id, err, http.StatusOK)
+}
+
+// respondValuation writes the priced portfolio after an edit, or the edit's
+// error.
+func (s *PortfolioStore) respondValuation(w http.ResponseWriter, r *http.Request, id string, err error, status int) {
+	switch {
+	case errors.Is(err, errPortfolioNotFound):
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No portfolio found with id '%s'.", id))
+	case errors.Is(err, errLotNotFound):
+		writeError(w, http.StatusNotFound, "No such lot in this portfolio.")
+	case errors.Is(err, errInvalidLot):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "Could not save portfolio.")
+	default:
+		v, _ := s.Value(id)
+		writeJSON(w, r, status, v)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Hub integration – live portfolio updates
+// ---------------------------------------------------------------------------
+
+// UsePortfolios keeps every held ticker polled and pushes a
+// "portfolio_update" to followers whenever a holding's quote changes or the
+// portfolio is edited.
+func (h *Hub) UsePortfolios(ps *PortfolioStore) {
+	h.portfolios = ps
+	h.Pin("portfolios", ps.Tickers())
+
+	ps.OnChange(func(p Portfolio, deleted bool) {
+		h.Pin("portfolios", ps.Tickers())
+		if deleted {
+			h.sendToPortfolioFollowers(p.ID, ServerMessage{
+				Type:      "portfolio_deleted",
+				Data:      map[string]string{"id": p.ID},
+				Timestamp: time.Now(),
+			})
+			return
+		}
+		h.pushPortfolio(p.ID)
+	})
+
+	h.OnChange(func(entry StockEntry) {
+		for _, p := range ps.List() {
+			for _, holding := range p.Holdings {
+				if holding.Ticker == entry.Ticker {
+					h.pushPortfolio(p.ID)
+					break
+				}
+			}
+		}
+	})
+}
+
+// pushPortfolio sends the current valuation to the portfolio's followers.
+func (h *Hub) pushPortfolio(id string) {
+	followers := h.portfolioFollowers(id)
+	if len(followers) == 0 {
+		return
+	}
+	v, ok := h.portfolios.Value(id)
+	if !ok {
+		return
+	}
+	msg := ServerMessage{
+		Type:      "portfolio_update",
+		Data:      v,
+		Timestamp: v.AsOf,
+	}
+	for _, c := range followers {
+		h.sendToClient(c, msg)
+	}
+}
+
+func (h *Hub) portfolioFollowers(id string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var out []*Client
+	for c := range h.clients {
+		c.mu.Lock()
+		if _, ok := c.portfolios[id]; ok {
+			out = append(out, c)
+		}
+		c.mu.Unlock()
+	}
+	return out
+}
+
+func (h *Hub) sendToPortfolioFollowers(id string, msg ServerMessage) {
+	for _, c := range h.portfolioFollowers(id) {
+		h.sendToClient(c, msg)
+	}
+}
+
+func (h *Hub) subscribePortfolio(client *Client, reqID, id string) {
+	if h.portfolios == nil {
+		h.replyError(client, reqID, codeUnavailable, "", "portfolios are not available")
+		return
+	}
+	v, ok := h.portfolios.Value(id)
+	if !ok {
+		h.replyError(client, reqID, codeNotFound, "", "portfolio not found: "+id)
+		return
+	}
+
+	client.mu.Lock()
+	client.portfolios[id] = struct{}{}
+	client.mu.Unlock()
+
+	h.reply(client, reqID, ServerMessage{
+		Type:      "portfolio_update",
+		Data:      v,
+		Timestamp: v.AsOf,
+	})
+}
+
+func (h *Hub) unsubscribePortfolio(client *Client, reqID, id string) {
+	client.mu.Lock()
+	delete(client.portfolios, id)
+	client.mu.Unlock()
+
+	h.reply(client, reqID, ServerMessage{
+		Type:      "portfolio_unsubscribed",
+		Data:      map[string]string{"id": id},
+		Timestamp: time.Now(),
+	})
+}
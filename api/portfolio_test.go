@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestValuePortfolio(t *testing.T) {
+	s, _ := NewPortfolioStore("", func(ticker string) (StockEntry, bool) {
+		switch ticker {
+		case "TSLA:NASDAQ":
+			return StockEntry{Ticker: ticker, StockData: &Stock_Key_Stats{Price: 400, PreviousClose: 410}}, true
+		case "BTC-USD":
+			return StockEntry{Ticker: ticker, CryptoData: &Crypto_Key_Stats{Price: 60000, PreviousClose: 59000}}, true
+		}
+		return StockEntry{}, false
+	})
+
+	p, _ := s.Create("Main")
+	s.AddLot(p.ID, "tsla:nasdaq", "", Lot{Quantity: 10, Price: 300})
+	s.AddLot(p.ID, "TSLA:NASDAQ", "USD", Lot{Quantity: 10, Price: 350})
+	s.AddLot(p.ID, "BTC-USD", "", Lot{Quantity: 0.5, Price: 50000})
+	s.AddLot(p.ID, "RELIANCE:NSE", "", Lot{Quantity: 5, Price: 2500})
+
+	v, ok := s.Value(p.ID)
+	if !ok {
+		t.Fatal("Expected portfolio valuation")
+	}
+	if len(v.Holdings) != 3 {
+		t.Fatalf("Expected 3 holdings, got %d", len(v.Holdings))
+	}
+
+	tsla := v.Holdings[0]
+	if tsla.Quantity != 20 || tsla.CostBasis != 6500 || tsla.MarketValue != 8000 {
+		t.Fatalf("Unexpected TSLA valuation: %+v", tsla)
+	}
+	if tsla.DayPnL != -200 || tsla.TotalPnL != 1500 {
+		t.Fatalf("Unexpected TSLA P&L: day=%v total=%v", tsla.DayPnL, tsla.TotalPnL)
+	}
+
+	if v.Holdings[2].Priced || v.Holdings[2].Currency != "INR" {
+		t.Fatalf("Expected unpriced INR holding for RELIANCE:NSE, got %+v", v.Holdings[2])
+	}
+
+	usd := v.Totals["USD"]
+	if usd.MarketValue != 38000 || usd.TotalPnL != 6500 {
+		t.Fatalf("Unexpected USD totals: %+v", usd)
+	}
+	if math.Abs(usd.TotalPnLPercent-6500.0/31500*100) > 1e-9 {
+		t.Fatalf("Unexpected USD total P&L percent: %v", usd.TotalPnLPercent)
+	}
+}
+
+func TestPortfolioLots(t *testing.T) {
+	s, _ := NewPortfolioStore("", func(string) (StockEntry, bool) { return StockEntry{}, false })
+	p, _ := s.Create("Main")
+
+	if _, err := s.AddLot(p.ID, "TSLA:NASDAQ", "", Lot{Quantity: 0, Price: 300}); err == nil {
+		t.Fatal("Expected a zero-quantity lot to be rejected")
+	}
+	if _, err := s.AddLot(p.ID, "FOO:UNKNOWN", "", Lot{Quantity: 1, Price: 1}); err == nil {
+		t.Fatal("Expected an error when the currency can't be inferred")
+	}
+
+	p, _ = s.AddLot(p.ID, "TSLA:NASDAQ", "", Lot{Quantity: 1, Price: 300})
+	if _, err := s.AddLot(p.ID, "TSLA:NASDAQ", "EUR", Lot{Quantity: 1, Price: 300}); err == nil {
+		t.Fatal("Expected a currency mismatch to be rejected")
+	}
+
+	lotID := p.Holdings[0].Lots[0].ID
+	p, err := s.RemoveLot(p.ID, lotID)
+	if err != nil {
+		t.Fatalf("RemoveLot failed: %v", err)
+	}
+	if len(p.Holdings) != 0 {
+		t.Fatalf("Expected the holding to be dropped with its last lot, got %+v", p.Holdings)
+	}
+	if got := s.Tickers(); len(got) != 0 {
+		t.Fatalf("Expected no held tickers, got %v", got)
+	}
+}
+
+func TestPortfolioStoreRollsBackFailedSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "portfolios.json")
+	s, _ := NewPortfolioStore(path, func(string) (StockEntry, bool) { return StockEntry{}, false })
+	p, _ := s.Create("Main")
+	notified := 0
+	s.OnChange(func(Portfolio, bool) { notified++ })
+
+	s.path = filepath.Join(path, "unwritable.json") // its directory is a file
+	if _, err := s.Create("Other"); err == nil {
+		t.Fatal("Expected Create to fail")
+	}
+	if _, err := s.AddLot(p.ID, "TSLA:NASDAQ", "", Lot{Quantity: 1, Price: 300}); err == nil {
+		t.Fatal("Expected AddLot to fail")
+	}
+	if err := s.Delete(p.ID); err == nil {
+		t.Fatal("Expected Delete to fail")
+	}
+
+	if list := s.List(); len(list) != 1 || len(list[0].Holdings) != 0 || notified != 0 {
+		t.Fatalf("Expected failed saves to change nothing, got %+v after %d notifications", list, notified)
+	}
+}
+
+func TestPortfolioHandlerStatuses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "portfolios.json")
+	s, _ := NewPortfolioStore(path, func(string) (StockEntry, bool) { return StockEntry{}, false })
+	p, _ := s.Create("Main")
+	r := chi.NewRouter()
+	r.Post("/portfolios", s.createPortfolio)
+	r.Post("/portfolios/{id}/lots", s.addLot)
+	post := func(url, body string) int {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		return rr.Code
+	}
+
+	s.path = filepath.Join(path, "unwritable.json") // its directory is a file
+	for _, tc := range []struct {
+		url, body string
+		status    int
+	}{
+		{"/portfolios", `{"name": " "}`, http.StatusBadRequest},
+		{"/portfolios", `{"name": "Other"}`, http.StatusInternalServerError},
+		{"/portfolios/" + p.ID + "/lots", `{"ticker": "TSLA:NASDAQ", "quantity": 0, "price": 1}`, http.StatusBadRequest},
+		{"/portfolios/" + p.ID + "/lots", `{"ticker": "TSLA:NASDAQ", "quantity": 1, "price": 1}`, http.StatusInternalServerError},
+	} {
+		if got := post(tc.url, tc.body); got != tc.status {
+			t.Errorf("POST %s %s: expected %d, got %d", tc.url, tc.body, tc.status, got)
+		}
+	}
+}
+
+func TestLotDateOmittedWhenUnset(t *testing.T) {
+	out, _ := json.Marshal(Lot{ID: "l1", Quantity: 1, Price: 300})
+	if strings.Contains(string(out), "date") {
+		t.Fatalf("Expected no date for a lot without one, got %s", out)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// WebSocket protocol versions, request handling and error codes
+// ---------------------------------------------------------------------------
+
+// Subprotocols offered in Sec-WebSocket-Protocol, most preferred first.
+// Clients that don't ask for one speak v1.
+const (
+	subprotocolV2Msgpack = "stonks.v2.msgpack"
+	subprotocolV2CBOR    = "stonks.v2.cbor"
+	subprotocolV2        = "stonks.v2"
+	subprotocolV1        = "stonks.v1"
+)
+
+// protocolVersion maps a negotiated subprotocol to its version number.
+func protocolVersion(subprotocol string) int {
+	switch subprotocol {
+	case subprotocolV2, subprotocolV2Msgpack, subprotocolV2CBOR:
+		return 2
+	}
+	return 1
+}
+
+// subprotocolEncoding maps a negotiated subprotocol to its message encoding.
+func subprotocolEncoding(subprotocol string) encoding {
+	switch subprotocol {
+	case subprotocolV2Msgpack:
+		return encodingMsgpack
+	case subprotocolV2CBOR:
+		return encodingCBOR
+	}
+	return encodingJSON
+}
+
+// Error codes sent in ServerMessage.Code to v2 clients.
+const (
+	codeInvalidMessage    = "invalid_message"    // not JSON, or the wrong shape
+	codeUnknownAction     = "unknown_action"     // action isn't one of clientActions
+	codeMissingTicker     = "missing_ticker"     // no ticker or tickers given
+	codeInvalidTicker     = "invalid_ticker"     // not SYMBOL:EXCHANGE or NAME-CURRENCY
+	codeTooManyTickers    = "too_many_tickers"   // more than WSMaxTickersPerMessage
+	codeInvalidInterval   = "invalid_interval"   // not a candle interval
+	codeInvalidIndicator  = "invalid_indicator"  // missing or bad indicator spec
+	codeInvalidCurrency   = "invalid_currency"   // convert can't be honoured
+	codeNotFound          = "not_found"          // unknown watchlist or portfolio, or a ticker without data
+	codeNotSubscribed     = "not_subscribed"     // resync of a ticker the client doesn't follow
+	codeInvalidRate       = "invalid_rate"       // set_rate interval isn't a valid duration
+	codeUnavailable       = "unavailable"        // feature not configured, or no data yet
+	codeSubscriptionLimit = "subscription_limit" // the API key's MaxSubscriptions is reached
+)
+
+// clientActions lists every action, in the order they're documented.
+var clientActions = []string{
+	"subscribe", "unsubscribe",
+	"subscribe_candle", "unsubscribe_candle",
+	"subscribe_indicator", "unsubscribe_indicator",
+	"subscribe_watchlist", "unsubscribe_watchlist",
+	"subscribe_portfolio", "unsubscribe_portfolio",
+	"resync",
+	"set_rate",
+	"resume",
+	"list_subscriptions",
+}
+
+// v2Actions are the actions v1 clients don't have.
+var v2Actions = map[string]bool{"resume": true, "list_subscriptions": true}
+
+// reply sends an acknowledgement or error for the client message with
+// request id reqID. v1 clients never see ids or error codes.
+func (h *Hub) reply(client *Client, reqID string, msg ServerMessage) {
+	if client.protocol >= 2 {
+		msg.ID = reqID
+	} else {
+		msg.Code = ""
+	}
+	h.sendToClient(client, msg)
+}
+
+// replyError sends an "error" reply with a machine-readable code.
+func (h *Hub) replyError(client *Client, reqID, code, ticker, text string) {
+	h.reply(client, reqID, ServerMessage{
+		Type:      "error",
+		Ticker:    ticker,
+		Code:      code,
+		Error:     text,
+		Timestamp: time.Now(),
+	})
+}
+
+// handleMessage decodes and dispatches one client message, JSON in a text
+// frame or the client's encoding in a binary one. Ticker actions
+// accept a single "ticker" and, on v2, a "tickers" list; each ticker is
+// acknowledged separately with the message's id.
+func (h *Hub) handleMessage(c *Client, binary bool, raw []byte) {
+	msg, err := decodeClientMessage(c, binary, raw)
+	if err != nil {
+		h.replyError(c, "", codeInvalidMessage, "", "invalid message format, "+err.Error())
+		return
+	}
+	if c.protocol < 2 {
+		msg.ID, msg.Tickers = "", nil
+	}
+
+	tickers := msg.Tickers
+	if msg.Ticker != "" {
+		tickers = append([]string{msg.Ticker}, tickers...)
+	}
+	if len(tickers) > h.cfg.WSMaxTickersPerMessage {
+		h.replyError(c, msg.ID, codeTooManyTickers, "", fmt.Sprintf("too many tickers (%d), the limit is %d per message", len(tickers), h.cfg.WSMaxTickersPerMessage))
+		return
+	}
+
+	switch msg.Action {
+	case "subscribe_watchlist":
+		h.subscribeWatchlist(c, msg.ID, msg.Watchlist)
+		return
+	case "unsubscribe_watchlist":
+		h.unsubscribeWatchlist(c, msg.ID, msg.Watchlist)
+		return
+	case "subscribe_portfolio":
+		h.subscribePortfolio(c, msg.ID, msg.Portfolio)
+		return
+	case "unsubscribe_portfolio":
+		h.unsubscribePortfolio(c, msg.ID, msg.Portfolio)
+		return
+	case "set_rate":
+		h.setRate(c, msg.ID, msg.MinInterval)
+		return
+	case "resume":
+		if c.protocol >= 2 {
+			h.resume(c, msg.ID, msg.Resume)
+			return
+		}
+	case "list_subscriptions":
+		if c.protocol >= 2 {
+			h.listSubscriptions(c, msg.ID)
+			return
+		}
+	}
+
+	var handle func(ticker string)
+	switch msg.Action {
+	case "subscribe":
+		handle = func(t string) {
+			if h.setConversion(c, msg.ID, t, msg.Convert) {
+				h.setDelta(c, t, msg.Delta)
+				h.subscribe(c, msg.ID, t)
+			}
+		}
+	case "unsubscribe":
+		handle = func(t string) { h.unsubscribe(c, msg.ID, t) }
+	case "resync":
+		handle = func(t string) { h.resync(c, msg.ID, t) }
+	case "subscribe_candle":
+		handle = func(t string) { h.subscribeCandle(c, msg.ID, t, msg.Interval) }
+	case "unsubscribe_candle":
+		handle = func(t string) { h.unsubscribeCandle(c, msg.ID, t, msg.Interval) }
+	case "subscribe_indicator":
+		handle = func(t string) {
+			var spec *IndicatorSpec
+			if msg.Indicator != nil {
+				copied := *msg.Indicator // normalized per ticker
+				spec = &copied
+			}
+			h.subscribeIndicator(c, msg.ID, t, msg.Interval, spec)
+		}
+	case "unsubscribe_indicator":
+		handle = func(t string) {
+			var spec *IndicatorSpec
+			if msg.Indicator != nil {
+				copied := *msg.Indicator
+				spec = &copied
+			}
+			h.unsubscribeIndicator(c, msg.ID, t, msg.Interval, spec)
+		}
+	default:
+		actions := clientActions
+		if c.protocol < 2 {
+			actions = nil
+			for _, a := range clientActions {
+				if !v2Actions[a] {
+					actions = append(actions, a)
+				}
+			}
+		}
+		h.replyError(c, msg.ID, codeUnknownAction, "", "unknown action: "+msg.Action+". Use '"+strings.Join(actions, "', '")+"'")
+		return
+	}
+
+	valid := 0
+	for _, t := range tickers {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		valid++
+		handle(t)
+	}
+	// v1 ignores messages without a ticker, as it always has.
+	if valid == 0 && c.protocol >= 2 {
+		h.replyError(c, msg.ID, codeMissingTicker, "", "missing 'ticker' or 'tickers'")
+	}
+}
+
+// subscriptionList is the payload of a "subscriptions" message.
+type subscriptionList struct {
+	Tickers     []string            `json:"tickers"`
+	Candles     map[string][]string `json:"candles,omitempty"`      // ticker -> intervals
+	Indicators  map[string][]string `json:"indicators,omitempty"`   // ticker -> indicator keys
+	Convert     map[string]string   `json:"convert,omitempty"`      // ticker -> currency
+	Delta       []string            `json:"delta,omitempty"`        // tickers in delta mode
+	MinInterval string              `json:"min_interval,omitempty"` // set with set_rate
+	Watchlists  []string            `json:"watchlists,omitempty"`
+	Portfolios  []string            `json:"portfolios,omitempty"`
+}
+
+// listSubscriptions replies with everything the client is subscribed to.
+func (h *Hub) listSubscriptions(c *Client, reqID string) {
+	c.mu.Lock()
+	list := subscriptionList{
+		Tickers:    sortedKeys(c.tickers),
+		Candles:    make(map[string][]string, len(c.candles)),
+		Indicators: make(map[string][]string, len(c.indicators)),
+		Convert:    make(map[string]string, len(c.convert)),
+		Delta:      sortedKeys(c.delta),
+		Watchlists: sortedKeys(c.watchlists),
+		Portfolios: sortedKeys(c.portfolios),
+	}
+	for t, intervals := range c.candles {
+		list.Candles[t] = sortedKeys(intervals)
+	}
+	for t, inds := range c.indicators {
+		for key := range inds {
+			list.Indicators[t] = append(list.Indicators[t], key)
+		}
+		sort.Strings(list.Indicators[t])
+	}
+	for t, currency := range c.convert {
+		list.Convert[t] = currency
+	}
+	if c.minInterval > 0 {
+		list.MinInterval = c.minInterval.String()
+	}
+	c.mu.Unlock()
+
+	h.reply(c, reqID, ServerMessage{
+		Type:      "subscriptions",
+		Data:      list,
+		Timestamp: time.Now(),
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
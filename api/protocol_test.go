@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testConn is a WebSocket client that splits the newline-joined frames
+// written by writePump back into single messages.
+type testConn struct {
+	*websocket.Conn
+	url     string
+	pending []ServerMessage
+}
+
+// dialTestHub runs h behind a test server and connects a WebSocket client
+// offering the given subprotocols.
+func dialTestHub(t *testing.T, h *Hub, subprotocols ...string) *testConn {
+	t.Helper()
+	go h.Run()
+	srv := httptest.NewServer(http.HandlerFunc(h.ServeWs))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		h.Shutdown(ctx)
+		srv.Close()
+	})
+
+	return dialTestURL(t, "ws"+strings.TrimPrefix(srv.URL, "http"), subprotocols...)
+}
+
+// dialTestURL connects another WebSocket client to a test server.
+func dialTestURL(t *testing.T, url string, subprotocols ...string) *testConn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, url: url}
+}
+
+// readType reads messages until one of type msgType arrives.
+func (c *testConn) readType(t *testing.T, msgType string) ServerMessage {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		for len(c.pending) > 0 {
+			msg := c.pending[0]
+			c.pending = c.pending[1:]
+			if msg.Type == msgType {
+				return msg
+			}
+		}
+		_, frame, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("Waiting for %q: %v", msgType, err)
+		}
+		for _, line := range bytes.Split(frame, []byte("\n")) {
+			var msg ServerMessage
+			if err := json.Unmarshal(line, &msg); err != nil {
+				t.Fatalf("Bad message %q: %v", line, err)
+			}
+			c.pending = append(c.pending, msg)
+		}
+	}
+}
+
+func TestProtocolV2BatchSubscribe(t *testing.T) {
+	h := newTestHub(t)
+	conn := dialTestHub(t, h, subprotocolV2)
+	if conn.Subprotocol() != subprotocolV2 {
+		t.Fatalf("Expected %s to be negotiated, got %q", subprotocolV2, conn.Subprotocol())
+	}
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "id": "req-1", "tickers": []string{"TSLA:NASDAQ", "btc-usd"}})
+	for _, want := range []string{"TSLA:NASDAQ", "BTC-USD"} {
+		ack := conn.readType(t, "subscribed")
+		if ack.ID != "req-1" || ack.Ticker != want {
+			t.Fatalf("Expected ack for %s with id req-1, got %+v", want, ack)
+		}
+	}
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe_candle", "id": "req-2", "ticker": "TSLA:NASDAQ", "interval": "2m"})
+	if e := conn.readType(t, "error"); e.ID != "req-2" || e.Code != codeInvalidInterval {
+		t.Fatalf("Expected invalid_interval error for req-2, got %+v", e)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "id": "req-3"})
+	if e := conn.readType(t, "error"); e.ID != "req-3" || e.Code != codeMissingTicker {
+		t.Fatalf("Expected missing_ticker error for req-3, got %+v", e)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"action": "list_subscriptions", "id": "req-4"})
+	list := conn.readType(t, "subscriptions")
+	tickers := list.Data.(map[string]interface{})["tickers"].([]interface{})
+	if list.ID != "req-4" || len(tickers) != 2 || tickers[0] != "BTC-USD" {
+		t.Fatalf("Unexpected subscription list %+v", list)
+	}
+}
+
+func TestProtocolV1Compatibility(t *testing.T) {
+	h := newTestHub(t)
+	conn := dialTestHub(t, h)
+	if conn.Subprotocol() != "" {
+		t.Fatalf("Expected no subprotocol, got %q", conn.Subprotocol())
+	}
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "id": "ignored", "ticker": "TSLA:NASDAQ"})
+	if ack := conn.readType(t, "subscribed"); ack.ID != "" {
+		t.Fatalf("Expected v1 acks without an id, got %+v", ack)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"action": "list_subscriptions"})
+	if e := conn.readType(t, "error"); e.Code != "" || !strings.HasPrefix(e.Error, "unknown action") {
+		t.Fatalf("Expected a v1 unknown action error, got %+v", e)
+	}
+}
+
+func TestProtocolCompression(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.WSCompressionThreshold = 0
+	url := dialTestHub(t, h, subprotocolV2).url
+
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolV2}, EnableCompression: true}
+	ws, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("Expected permessage-deflate to be negotiated, got %q", ext)
+	}
+
+	conn := &testConn{Conn: ws, url: url}
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "id": "c", "tickers": []string{"TSLA:NASDAQ", "BTC-USD"}})
+	for i := 0; i < 2; i++ {
+		if ack := conn.readType(t, "subscribed"); ack.ID != "c" {
+			t.Fatalf("Unexpected ack %+v", ack)
+		}
+	}
+}
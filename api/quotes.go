@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/httprate"
+	"github.com/gocolly/colly/v2"
+)
+
+// ---------------------------------------------------------------------------
+// Batch quotes – many tickers in one request
+// ---------------------------------------------------------------------------
+
+// QuoteResult is one symbol's outcome in a batch response. Exactly one of
+// Data and Error is set.
+type QuoteResult struct {
+	Symbol      string      `json:"symbol"`
+	Type        string      `json:"type,omitempty"` // "stock", "index" or "crypto"
+	Data        interface{} `json:"data,omitempty"`
+	Cached      bool        `json:"cached"` // served without a fresh scrape
+	Stale       bool        `json:"stale,omitempty"`
+	LastUpdated time.Time   `json:"lastUpdated,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// QuoteBatcher answers /quotes from the hub's cache, scraping only the
+// symbols it has no fresh data for.
+type QuoteBatcher struct {
+	hub         *Hub
+	fx          *FXRates
+	maxSymbols  int
+	concurrency int
+	cacheTTL    time.Duration
+
+	// fetch scrapes one ticker. Replaced in tests.
+	fetch func(ctx context.Context, ticker string) (StockEntry, bool)
+}
+
+// NewQuoteBatcher creates a batcher backed by hub's cache and collector.
+// Its scrapes take a slot in the hub's worker pool, like polls do.
+func NewQuoteBatcher(hub *Hub, cfg *Config) *QuoteBatcher {
+	return &QuoteBatcher{
+		hub:         hub,
+		fx:          hub.fx,
+		maxSymbols:  cfg.QuoteBatchMax,
+		concurrency: max(cfg.QuoteBatchConcurrency, 1),
+		cacheTTL:    cfg.QuoteCacheTTL,
+		fetch: func(ctx context.Context, ticker string) (StockEntry, bool) {
+			if !hub.acquireWorkerContext(ctx) {
+				return StockEntry{Ticker: ticker}, false
+			}
+			defer func() { <-hub.sem }()
+			return scrapeEntry(ctx, hub.collector.Clone(), ticker)
+		},
+	}
+}
+
+// Quotes returns one result per symbol, in the order given. Cached values
+// are used when the hub polls the ticker or scraped it within cacheTTL; the
+// rest are scraped with at most concurrency requests in flight, logging to
+// ctx's logger. While the upstream circuit breaker is open nothing is
+// scraped: the last known values are served, marked stale, however old. If
+// convert is set, prices are converted to that currency; a symbol that
+// can't be converted gets an error.
+func (q *QuoteBatcher) Quotes(ctx context.Context, symbols []string, convert string) []QuoteResult {
+	results := make([]QuoteResult, len(symbols))
+	blocked := q.hub.upstream.blocked()
+	sem := make(chan struct{}, q.concurrency)
+	var wg sync.WaitGroup
+
+	for i, symbol := range symbols {
+		results[i].Symbol = symbol
+		if !isStockTicker(symbol) && !strings.Contains(symbol, "-") {
+			results[i].Error = "invalid symbol, use SYMBOL:EXCHANGE for stocks and indexes or NAME-CURRENCY for crypto"
+			continue
+		}
+		if q.hub.knownBad(symbol) {
+			results[i].Error = "no data found"
+			continue
+		}
+		if entry, ok := q.hub.cachedQuote(symbol, q.cacheTTL); ok {
+			results[i].fill(entry, true)
+			results[i].Stale = results[i].Stale || blocked
+			continue
+		}
+		if blocked {
+			if entry, ok := q.hub.Lookup(symbol); ok {
+				results[i].fill(entry, true)
+				results[i].Stale = true
+			} else {
+				results[i].Error = "Google Finance is throttling requests and there is no cached data"
+			}
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(res *QuoteResult) {
+			defer func() { <-sem; wg.Done() }()
+
+			entry, ok := q.fetch(ctx, res.Symbol)
+			if !ok {
+				res.Error = "no data found"
+				return
+			}
+			q.hub.rememberQuote(entry)
+			res.fill(entry, false)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	if convert != "" {
+		for i := range results {
+			q.convert(&results[i], convert)
+		}
+	}
+	return results
+}
+
+// convert replaces a result's data with its converted form. Exchange rates
+// are cached, so a batch fetches each currency pair once.
+func (q *QuoteBatcher) convert(res *QuoteResult, currency string) {
+	if res.Error != "" {
+		return
+	}
+	if q.fx == nil {
+		res.Data, res.Error = nil, "currency conversion is not available"
+		return
+	}
+	entry := StockEntry{Ticker: res.Symbol, IsStock: res.Type != "crypto", IsIndex: res.Type == "index"}
+	switch data := res.Data.(type) {
+	case *Stock_Key_Stats:
+		entry.StockData = data
+	case *Crypto_Key_Stats:
+		entry.CryptoData = data
+	}
+	converted, err := q.fx.ConvertEntry(entry, currency)
+	if err != nil {
+		res.Data, res.Error = nil, "conversion failed: "+err.Error()
+		return
+	}
+	res.Data = converted
+}
+
+func (res *QuoteResult) fill(entry StockEntry, cached bool) {
+	res.Cached = cached
+	res.Stale = entry.Stale
+	res.LastUpdated = entry.LastUpdated
+	switch {
+	case entry.IsIndex:
+		res.Type, res.Data = "index", entry.StockData
+	case entry.IsStock:
+		res.Type, res.Data = "stock", entry.StockData
+	default:
+		res.Type, res.Data = "crypto", entry.CryptoData
+	}
+}
+
+// scrapeEntry scrapes ticker once with c, outside of the hub's polling.
+func scrapeEntry(ctx context.Context, c *colly.Collector, ticker string) (StockEntry, bool) {
+	entry := StockEntry{Ticker: ticker, LastUpdated: time.Now()}
+	if isStockTicker(ticker) {
+		data := Get_Stock_Data(ctx, c, ticker)
+		if data.Name == "" {
+			return entry, false
+		}
+		entry.StockData, entry.IsStock, entry.IsIndex = data, true, isIndexTicker(ticker)
+		return entry, true
+	}
+
+	parts := strings.SplitN(ticker, "-", 2)
+	if len(parts) != 2 {
+		return entry, false
+	}
+	data := Get_Crypto_Data(ctx, c, parts[0], parts[1])
+	if data.Name == "" {
+		return entry, false
+	}
+	entry.CryptoData = data
+	return entry, true
+}
+
+// cachedQuote returns the hub's data for ticker if it can be served without
+// scraping: the ticker is being polled, or it was scraped within ttl.
+func (h *Hub) cachedQuote(ticker string, ttl time.Duration) (StockEntry, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if entry, ok := h.store[ticker]; ok && !entry.Stale && (entry.StockData != nil || entry.CryptoData != nil) {
+		return *entry, true
+	}
+	if entry, ok := h.warm[ticker]; ok && !entry.Stale && time.Since(entry.LastUpdated) < ttl {
+		return *entry, true
+	}
+	return StockEntry{}, false
+}
+
+// rememberQuote keeps a one-off scrape in the warm cache so repeated batch
+// requests within the cache TTL don't scrape again. Polled tickers are left
+// alone; the poll loop owns their entries.
+func (h *Hub) rememberQuote(entry StockEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, tracked := h.store[entry.Ticker]; !tracked {
+		h.rememberWarm(&entry)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// REST handlers
+// ---------------------------------------------------------------------------
+
+// quoteBodyLimit caps the POST /quotes body.
+const quoteBodyLimit = 64 << 10
+
+// quoteRequest is the parsed form of a /quotes request.
+type quoteRequest struct {
+	Symbols []string `json:"symbols"`
+	Convert string   `json:"convert"`
+}
+
+// parseQuoteRequest reads ?symbols=A,B&convert=EUR or a JSON body
+// {"symbols": ["A", "B"], "convert": "EUR"}. A POST body is buffered and
+// restored so it can be read again by the handler after the rate-limit
+// middleware.
+func parseQuoteRequest(r *http.Request) (quoteRequest, error) {
+	req := quoteRequest{Convert: r.URL.Query().Get("convert")}
+	if r.Method != http.MethodPost {
+		req.Symbols = normalizeTickers(strings.Split(r.URL.Query().Get("symbols"), ","))
+		return req, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, quoteBodyLimit))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return req, err
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, err
+	}
+	req.Symbols = normalizeTickers(req.Symbols)
+	return req, nil
+}
+
+// weighQuoteBatches makes a /quotes request count as one request per
+// symbolsPerUnit symbols (rounded up) toward the rate limit of the request's
+// API key or IP. It must be installed before the rate limiter.
+func weighQuoteBatches(symbolsPerUnit int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/quotes" && symbolsPerUnit > 0 {
+				if req, err := parseQuoteRequest(r); err == nil && len(req.Symbols) > symbolsPerUnit {
+					weight := (len(req.Symbols) + symbolsPerUnit - 1) / symbolsPerUnit
+					r = r.WithContext(httprate.WithIncrement(r.Context(), weight))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// getQuotes is the handler for GET and POST /quotes.
+func (q *QuoteBatcher) getQuotes(w http.ResponseWriter, r *http.Request) {
+	req, err := parseQuoteRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Expected JSON body with a 'symbols' array and optional 'convert' currency.")
+		return
+	}
+	symbols := req.Symbols
+	if len(symbols) == 0 {
+		writeError(w, http.StatusBadRequest, "No symbols given. Use ?symbols=TSLA:NASDAQ,BTC-USD or a JSON body with 'symbols'.")
+		return
+	}
+	if len(symbols) > q.maxSymbols {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Too many symbols (%d), the limit is %d per request.", len(symbols), q.maxSymbols))
+		return
+	}
+
+	convert := strings.ToUpper(strings.TrimSpace(req.Convert))
+	if convert != "" && !validCurrency(convert) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid currency '%s'. Use a 3-letter code such as EUR.", req.Convert))
+		return
+	}
+
+	results := q.Quotes(r.Context(), symbols, convert)
+	failed := 0
+	for _, res := range results {
+		if res.Error != "" {
+			failed++
+		}
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"count":   len(results),
+		"errors":  failed,
+		"results": results,
+	})
+}
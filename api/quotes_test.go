@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/httprate"
+)
+
+func TestQuoteBatcherUsesCache(t *testing.T) {
+	h := newTestHub(t)
+	h.store["TSLA:NASDAQ"] = &StockEntry{
+		Ticker:      "TSLA:NASDAQ",
+		IsStock:     true,
+		StockData:   &Stock_Key_Stats{Name: "Tesla Inc", Price: 398.41},
+		LastUpdated: time.Now().Add(-time.Hour), // polled, so still fresh
+	}
+
+	q := NewQuoteBatcher(h, h.cfg)
+	var fetches atomic.Int32
+	q.fetch = func(_ context.Context, ticker string) (StockEntry, bool) {
+		fetches.Add(1)
+		if ticker == "NOPE:NASDAQ" {
+			return StockEntry{}, false
+		}
+		return StockEntry{Ticker: ticker, CryptoData: &Crypto_Key_Stats{Name: "Bitcoin"}, LastUpdated: time.Now()}, true
+	}
+
+	results := q.Quotes(context.Background(), []string{"TSLA:NASDAQ", "BTC-USD", "NOPE:NASDAQ", "garbage"}, "")
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+	if !results[0].Cached || results[0].Type != "stock" {
+		t.Fatalf("Expected TSLA from the hub cache, got %+v", results[0])
+	}
+	if results[1].Cached || results[1].Type != "crypto" || results[1].Error != "" {
+		t.Fatalf("Expected BTC to be scraped, got %+v", results[1])
+	}
+	if results[2].Error == "" || results[3].Error == "" {
+		t.Fatalf("Expected per-symbol errors, got %+v and %+v", results[2], results[3])
+	}
+	if fetches.Load() != 2 {
+		t.Fatalf("Expected 2 scrapes, got %d", fetches.Load())
+	}
+
+	// A second batch reuses the one-off scrape.
+	results = q.Quotes(context.Background(), []string{"BTC-USD"}, "")
+	if !results[0].Cached || fetches.Load() != 2 {
+		t.Fatalf("Expected BTC to be served from cache, got %+v after %d scrapes", results[0], fetches.Load())
+	}
+}
+
+func TestQuoteBatcherTakesHubWorkers(t *testing.T) {
+	h := newTestHub(t)
+	q := NewQuoteBatcher(h, h.cfg)
+	for i := 0; i < cap(h.sem); i++ {
+		h.sem <- struct{}{} // every worker busy polling
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	results := q.Quotes(ctx, []string{"BTC-USD"}, "")
+	if results[0].Error == "" || len(h.sem) != cap(h.sem) {
+		t.Fatalf("Expected the scrape to wait for a worker and give up, got %+v", results[0])
+	}
+}
+
+func TestQuoteBatcherClampsConcurrency(t *testing.T) {
+	h := newTestHub(t)
+	for _, n := range []int{0, -1} {
+		cfg := *h.cfg
+		cfg.QuoteBatchConcurrency = n
+		q := NewQuoteBatcher(h, &cfg)
+		q.fetch = func(_ context.Context, ticker string) (StockEntry, bool) {
+			return StockEntry{Ticker: ticker, CryptoData: &Crypto_Key_Stats{Name: "Bitcoin"}}, true
+		}
+		done := make(chan []QuoteResult, 1)
+		go func() { done <- q.Quotes(context.Background(), []string{"BTC-USD", "ETH-USD"}, "") }()
+		select {
+		case results := <-done:
+			if results[0].Error != "" || results[1].Error != "" {
+				t.Fatalf("QUOTE_BATCH_CONCURRENCY=%d: unexpected errors %+v", n, results)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("QUOTE_BATCH_CONCURRENCY=%d: Quotes hung", n)
+		}
+	}
+}
+
+func TestQuotesEndpoint(t *testing.T) {
+	h := newTestHub(t)
+	h.store["BTC-USD"] = &StockEntry{Ticker: "BTC-USD", CryptoData: &Crypto_Key_Stats{Name: "Bitcoin"}}
+	q := NewQuoteBatcher(h, h.cfg)
+	q.maxSymbols = 3
+
+	r := chi.NewRouter()
+	r.Get("/quotes", q.getQuotes)
+	r.Post("/quotes", q.getQuotes)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/quotes", strings.NewReader(`{"symbols":["btc-usd","BTC-USD"]}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Body: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Count   int           `json:"count"`
+		Results []QuoteResult `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if resp.Count != 1 || resp.Results[0].Symbol != "BTC-USD" {
+		t.Fatalf("Expected one de-duplicated result, got %+v", resp)
+	}
+
+	for path, want := range map[string]int{
+		"/quotes":                         http.StatusBadRequest,
+		"/quotes?symbols=A:B,C:D,E:F,G:H": http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != want {
+			t.Fatalf("%s: expected %d, got %d", path, want, rr.Code)
+		}
+	}
+}
+
+func TestWeighQuoteBatches(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(weighQuoteBatches(10))
+	r.Use(httprate.LimitByIP(3, time.Minute))
+	r.Get("/quotes", func(w http.ResponseWriter, r *http.Request) {})
+
+	symbols := make([]string, 25)
+	for i := range symbols {
+		symbols[i] = fmt.Sprintf("T%d:X", i)
+	}
+	path := "/quotes?symbols=" + strings.Join(symbols, ",") // weight 3
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the first batch to pass, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/quotes?symbols=T:X", nil))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the batch to use up the limit, got %d", rr.Code)
+	}
+}
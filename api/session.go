@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Resumable sessions – v2 clients can reconnect without losing anything
+// ---------------------------------------------------------------------------
+
+// Every v2 connection gets a session. Each message written to it is stamped
+// with a "sessionSeq" and kept in a bounded replay buffer. When the
+// connection drops, the session stays subscribed for WSSessionTTL: quote
+// updates keep being conflated into it and other messages go to the replay
+// buffer. A new connection that sends "resume" with the session token and
+// the last sessionSeq it saw takes the session over and gets everything it
+// missed.
+
+// ResumeRequest is the "resume" field of a resume action.
+type ResumeRequest struct {
+	Session string `json:"session"`
+	LastSeq uint64 `json:"lastSeq"`
+}
+
+// session is the resumable state of one v2 connection.
+type session struct {
+	token string
+	enc   encoding // of the recorded messages
+
+	mu      sync.Mutex
+	client  *Client     // the connection that owns the session
+	nextSeq uint64      // sessionSeq of the last message recorded
+	ring    [][]byte    // stamped messages, ring[(start+i)%len] is the i-th oldest
+	start   int         // index of the oldest message in ring
+	n       int         // number of messages in ring
+	expiry  *time.Timer // drops the session once detached for too long
+}
+
+func newSession(c *Client, size int) (*session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s := &session{token: hex.EncodeToString(b), client: c, ring: make([][]byte, size)}
+	if c != nil {
+		s.enc = c.encoding
+	}
+	return s, nil
+}
+
+// record stamps payload with the next sessionSeq, keeps it in the replay
+// buffer and returns the stamped message.
+func (s *session) record(payload []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextSeq++
+	stamped := s.enc.stampSessionSeq(payload, s.nextSeq)
+	if len(s.ring) == 0 {
+		return stamped
+	}
+	if s.n < len(s.ring) {
+		s.ring[(s.start+s.n)%len(s.ring)] = stamped
+		s.n++
+	} else {
+		s.ring[s.start] = stamped
+		s.start = (s.start + 1) % len(s.ring)
+	}
+	return stamped
+}
+
+// since returns the recorded messages after lastSeq, oldest first. It
+// reports false if some of them have already been overwritten, or lastSeq
+// is from the future.
+func (s *session) since(lastSeq uint64) ([][]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lastSeq > s.nextSeq {
+		return nil, false
+	}
+	missed := int(s.nextSeq - lastSeq)
+	if missed > s.n {
+		return nil, false
+	}
+	out := make([][]byte, 0, missed)
+	for i := s.n - missed; i < s.n; i++ {
+		out = append(out, s.ring[(s.start+i)%len(s.ring)])
+	}
+	return out, true
+}
+
+// stampSessionSeq adds "sessionSeq" as the first field of a JSON object.
+// Messages are marshalled once for all their recipients, so the per-client
+// number is spliced in rather than marshalled.
+func stampSessionSeq(payload []byte, seq uint64) []byte {
+	b := make([]byte, 0, len(payload)+24)
+	b = append(b, `{"sessionSeq":`...)
+	b = strconv.AppendUint(b, seq, 10)
+	if len(payload) > 2 {
+		b = append(b, ',')
+	}
+	return append(b, payload[1:]...)
+}
+
+// startSession gives a new v2 client its session and tells it the token.
+// Without a token the client still works, it just can't resume.
+func (h *Hub) startSession(c *Client) {
+	if c.protocol < 2 || h.cfg.WSSessionTTL <= 0 {
+		return
+	}
+	s, err := newSession(c, h.cfg.WSReplayBuffer)
+	if err != nil {
+		c.log.Error("could not start session", "error", err)
+		return
+	}
+
+	h.mu.Lock()
+	h.sessions[s.token] = s
+	h.mu.Unlock()
+	c.mu.Lock()
+	c.session = s
+	c.mu.Unlock()
+
+	h.sendToClient(c, ServerMessage{
+		Type: "session",
+		Data: map[string]interface{}{
+			"session": s.token,
+			"ttl":     h.cfg.WSSessionTTL.String(),
+			"buffer":  h.cfg.WSReplayBuffer,
+		},
+		Timestamp: time.Now(),
+	})
+}
+
+// detachClient keeps a disconnected client's session alive instead of
+// removing the client, and reports whether it did. The client stays
+// subscribed: its pending and future messages go to the replay buffer and
+// quote updates are conflated as usual, until the session is resumed or
+// expires.
+func (h *Hub) detachClient(c *Client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.session
+	if s == nil {
+		return false
+	}
+	if c.detached {
+		return true
+	}
+	c.detached = true
+	c.closed = true
+	for len(c.send) > 0 {
+		s.record(<-c.send)
+	}
+	close(c.send)
+
+	s.mu.Lock()
+	s.expiry = time.AfterFunc(h.cfg.WSSessionTTL, func() { h.expireSession(s) })
+	s.mu.Unlock()
+	c.log.Info("session detached", "session", s.token[:8], "resumable_for", h.cfg.WSSessionTTL)
+	return true
+}
+
+// expireSession drops a session that wasn't resumed in time, along with its
+// detached client's subscriptions.
+func (h *Hub) expireSession(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s.mu.Lock()
+	c := s.client
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	detached := c.detached
+	c.mu.Unlock()
+	if !detached || h.sessions[s.token] != s {
+		return // resumed in the meantime
+	}
+	delete(h.sessions, s.token)
+	h.forgetClient(c)
+	c.log.Info("session expired", "session", s.token[:8])
+}
+
+// resume hands the session identified by req to client: the session's
+// subscriptions move over, and the messages after req.LastSeq are written
+// before anything new. If those messages are no longer buffered the client
+// gets "resync_required", followed by the current quote of each ticker.
+// Sessions of other API keys are treated as unknown.
+func (h *Hub) resume(client *Client, reqID string, req *ResumeRequest) {
+	if req == nil || req.Session == "" {
+		h.replyError(client, reqID, codeInvalidMessage, "", "missing 'resume' with 'session' and 'lastSeq'")
+		return
+	}
+
+	h.mu.Lock()
+	s, ok := h.sessions[req.Session]
+	client.mu.Lock()
+	own := client.session
+	client.mu.Unlock()
+	var old *Client
+	if ok {
+		s.mu.Lock()
+		old = s.client
+		s.mu.Unlock()
+	}
+	// A session only belongs to the API key it was made with, so another
+	// key can't take over its subscriptions. It looks like any unknown one.
+	if !ok || s == own || old.apiKey != client.apiKey {
+		h.mu.Unlock()
+		h.reply(client, reqID, ServerMessage{
+			Type:      "resync_required",
+			Error:     "unknown or expired session, subscribe again",
+			Timestamp: time.Now(),
+		})
+		return
+	}
+
+	// The old connection may not have noticed it's gone yet. Detaching it
+	// starts an expiry timer, so stop that after.
+	h.detachClient(old)
+	if old.conn != nil {
+		old.conn.Close()
+	}
+	s.mu.Lock()
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.mu.Unlock()
+
+	// Buffered messages can't be replayed in another encoding.
+	missed, complete := s.since(req.LastSeq)
+	if s.enc != client.encoding {
+		missed, complete = nil, false
+	}
+	tickers := h.adopt(client, old)
+	if own != nil {
+		delete(h.sessions, own.token)
+	}
+
+	client.mu.Lock()
+	client.session = s
+	if complete {
+		client.replay = missed
+	}
+	client.mu.Unlock()
+	s.mu.Lock()
+	s.client = client
+	s.expiry = nil
+	if s.enc != client.encoding {
+		s.enc = client.encoding
+		s.start, s.n = 0, 0
+		clear(s.ring)
+	}
+	s.mu.Unlock()
+
+	var entries []StockEntry
+	if !complete {
+		for _, t := range tickers {
+			if e, ok := h.store[t]; ok && (e.StockData != nil || e.CryptoData != nil) {
+				entries = append(entries, *e)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	client.log.Info("session resumed", "session", s.token[:8], "replayed", len(missed))
+	if !complete {
+		h.reply(client, reqID, ServerMessage{
+			Type:      "resync_required",
+			Data:      map[string]interface{}{"session": s.token, "tickers": tickers},
+			Error:     "missed messages are no longer buffered, current quotes follow",
+			Timestamp: time.Now(),
+		})
+		for i := range entries {
+			h.sendEntryToClient(client, &entries[i])
+		}
+		return
+	}
+	h.reply(client, reqID, ServerMessage{
+		Type:      "resumed",
+		Data:      map[string]interface{}{"session": s.token, "replayed": len(missed), "tickers": tickers},
+		Timestamp: time.Now(),
+	})
+	select {
+	case client.wake <- struct{}{}:
+	default:
+	}
+}
+
+// adopt moves everything old is subscribed to over to client and removes
+// old from the hub. Tickers that would take client's API key past its
+// subscription limit are dropped instead. It returns the tickers that
+// moved. Caller must hold h.mu.
+func (h *Hub) adopt(client, old *Client) []string {
+	var keyed map[string]struct{}
+	if client.maxSubscriptions > 0 {
+		keyed = h.keyTickers(client.apiKey, old)
+	}
+
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if keyed != nil {
+		for t := range client.tickers { // client may not be registered yet
+			keyed[t] = struct{}{}
+		}
+	}
+	held := make([]string, 0, len(old.tickers))
+	for t := range old.tickers {
+		held = append(held, t)
+	}
+	sort.Strings(held)
+
+	var tickers []string
+	for _, t := range held {
+		subs, ok := h.subscribers[t]
+		if !ok {
+			continue // dropped while detached
+		}
+		delete(subs, old)
+		if keyed != nil {
+			if _, ok := keyed[t]; !ok && len(keyed) >= client.maxSubscriptions {
+				h.releaseTicker(t)
+				continue
+			}
+			keyed[t] = struct{}{}
+		}
+		subs[client] = struct{}{}
+		client.tickers[t] = struct{}{}
+		tickers = append(tickers, t)
+	}
+	adopted := func(t string) bool {
+		_, ok := client.tickers[t]
+		return ok
+	}
+	for t := range old.direct {
+		if adopted(t) {
+			client.direct[t] = struct{}{}
+		}
+	}
+	for t, intervals := range old.candles {
+		if adopted(t) {
+			client.candles[t] = intervals
+		}
+	}
+	for t, inds := range old.indicators {
+		if adopted(t) {
+			client.indicators[t] = inds
+		}
+	}
+	for t, currency := range old.convert {
+		if adopted(t) {
+			client.convert[t] = currency
+		}
+	}
+	for t := range old.delta {
+		if adopted(t) {
+			client.delta[t] = struct{}{}
+		}
+	}
+	for id := range old.watchlists {
+		client.watchlists[id] = struct{}{}
+	}
+	for id := range old.portfolios {
+		client.portfolios[id] = struct{}{}
+	}
+	if old.encoding == client.encoding { // otherwise resume sends the current quotes
+		for t, u := range old.updates {
+			if cur, ok := client.updates[t]; adopted(t) && (!ok || cur.seq < u.seq) {
+				client.updates[t] = u
+			}
+		}
+	}
+	for t, sent := range old.lastSent {
+		client.lastSent[t] = sent
+	}
+	client.minInterval = old.minInterval
+
+	old.tickers = make(map[string]struct{})
+	old.direct = make(map[string]struct{})
+	old.updates = make(map[string]queuedUpdate)
+	delete(h.clients, old)
+	return tickers
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionReplayBuffer(t *testing.T) {
+	if got := string(stampSessionSeq([]byte(`{"type":"alert"}`), 7)); got != `{"sessionSeq":7,"type":"alert"}` {
+		t.Fatalf("Unexpected stamp %s", got)
+	}
+
+	s, err := newSession(nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		s.record([]byte(`{}`))
+	}
+	missed, ok := s.since(3)
+	if !ok || len(missed) != 2 || string(missed[0]) != `{"sessionSeq":4}` {
+		t.Fatalf("Expected messages 4 and 5, got %q (%v)", missed, ok)
+	}
+	if missed, ok := s.since(5); !ok || len(missed) != 0 {
+		t.Fatalf("Expected nothing missed, got %q (%v)", missed, ok)
+	}
+	if _, ok := s.since(1); ok {
+		t.Fatal("Expected message 2 to have rolled over")
+	}
+	if _, ok := s.since(9); ok {
+		t.Fatal("Expected a lastSeq from the future to be rejected")
+	}
+}
+
+// waitDetached waits for the hub to notice a dropped connection.
+func waitDetached(t *testing.T, h *Hub, token string) *Client {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.RLock()
+		s := h.sessions[token]
+		h.mu.RUnlock()
+		s.mu.Lock()
+		c := s.client
+		s.mu.Unlock()
+		c.mu.Lock()
+		detached := c.detached
+		c.mu.Unlock()
+		if detached {
+			return c
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Session was never detached")
+	return nil
+}
+
+func TestProtocolResumeSession(t *testing.T) {
+	h := newTestHub(t)
+	conn := dialTestHub(t, h, subprotocolV2)
+	token := conn.readType(t, "session").Data.(map[string]interface{})["session"].(string)
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "ticker": "TSLA:NASDAQ"})
+	lastSeq := conn.readType(t, "subscribed").SessionSeq
+	conn.Close()
+	old := waitDetached(t, h, token)
+
+	// Missed while disconnected: an alert and a quote change.
+	h.sendToClient(old, ServerMessage{Type: "alert", Ticker: "TSLA:NASDAQ"})
+	entry := &StockEntry{Ticker: "TSLA:NASDAQ", IsStock: true, Seq: 1, StockData: &Stock_Key_Stats{Name: "Tesla Inc", Price: 400}}
+	h.broadcastEntry(entry, &StockEntry{})
+
+	again := dialTestURL(t, conn.url, subprotocolV2)
+	again.readType(t, "session")
+	again.WriteJSON(map[string]interface{}{"action": "resume", "id": "re", "resume": map[string]interface{}{"session": token, "lastSeq": lastSeq}})
+
+	if alert := again.readType(t, "alert"); alert.SessionSeq <= lastSeq {
+		t.Fatalf("Expected the alert to be replayed after %d, got %+v", lastSeq, alert)
+	}
+	// The offline test scrape may add a subscription_error to the replay.
+	if ack := again.readType(t, "resumed"); ack.ID != "re" || ack.Data.(map[string]interface{})["replayed"].(float64) < 1 {
+		t.Fatalf("Expected resumed with the replayed messages, got %+v", ack)
+	}
+	if update := again.readType(t, "stock_update"); update.Seq != 1 {
+		t.Fatalf("Expected the missed quote, got %+v", update)
+	}
+
+	h.mu.RLock()
+	_, subscribed := h.subscribers["TSLA:NASDAQ"][old]
+	h.mu.RUnlock()
+	if subscribed {
+		t.Fatal("Expected the old client to be unsubscribed")
+	}
+	again.WriteJSON(map[string]interface{}{"action": "list_subscriptions"})
+	if list := again.readType(t, "subscriptions"); len(list.Data.(map[string]interface{})["tickers"].([]interface{})) != 1 {
+		t.Fatalf("Expected TSLA:NASDAQ to be restored, got %+v", list.Data)
+	}
+}
+
+func TestProtocolResumeRolledOver(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.WSReplayBuffer = 2
+	conn := dialTestHub(t, h, subprotocolV2)
+	token := conn.readType(t, "session").Data.(map[string]interface{})["session"].(string)
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "ticker": "TSLA:NASDAQ"})
+	lastSeq := conn.readType(t, "subscribed").SessionSeq
+	conn.Close()
+	old := waitDetached(t, h, token)
+	for i := 0; i < 3; i++ {
+		h.sendToClient(old, ServerMessage{Type: "alert", Ticker: "TSLA:NASDAQ"})
+	}
+	h.mu.Lock()
+	h.store["TSLA:NASDAQ"].StockData = &Stock_Key_Stats{Name: "Tesla Inc", Price: 400}
+	h.mu.Unlock()
+
+	again := dialTestURL(t, conn.url, subprotocolV2)
+	again.WriteJSON(map[string]interface{}{"action": "resume", "resume": map[string]interface{}{"session": token, "lastSeq": lastSeq}})
+	if r := again.readType(t, "resync_required"); r.Error == "" {
+		t.Fatalf("Expected resync_required with a reason, got %+v", r)
+	}
+	if update := again.readType(t, "stock_update"); update.Ticker != "TSLA:NASDAQ" {
+		t.Fatalf("Expected the current quote, got %+v", update)
+	}
+
+	again.WriteJSON(map[string]interface{}{"action": "resume", "resume": map[string]interface{}{"session": "nope"}})
+	if r := again.readType(t, "resync_required"); r.Data != nil {
+		t.Fatalf("Expected an unknown session to restore nothing, got %+v", r)
+	}
+}
+
+func TestProtocolResumeRequiresSameAPIKey(t *testing.T) {
+	h := newTestHub(t)
+	conn := dialTestHub(t, h, subprotocolV2)
+	token := conn.readType(t, "session").Data.(map[string]interface{})["session"].(string)
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "ticker": "TSLA:NASDAQ"})
+	lastSeq := conn.readType(t, "subscribed").SessionSeq
+	conn.Close()
+	old := waitDetached(t, h, token)
+	h.mu.Lock()
+	old.apiKey = "other"
+	h.mu.Unlock()
+
+	again := dialTestURL(t, conn.url, subprotocolV2)
+	again.readType(t, "session")
+	again.WriteJSON(map[string]interface{}{"action": "resume", "resume": map[string]interface{}{"session": token, "lastSeq": lastSeq}})
+	if r := again.readType(t, "resync_required"); r.Data != nil {
+		t.Fatalf("Expected another key's session to restore nothing, got %+v", r)
+	}
+
+	h.mu.RLock()
+	s := h.sessions[token]
+	_, subscribed := h.subscribers["TSLA:NASDAQ"][old]
+	h.mu.RUnlock()
+	if s == nil || !subscribed {
+		t.Fatal("Expected the session to be left with its own client")
+	}
+	s.mu.Lock()
+	owner := s.client
+	s.mu.Unlock()
+	if owner != old {
+		t.Fatal("Expected the session not to be taken over")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Hub snapshot – warm restarts across redeploys
+// ---------------------------------------------------------------------------
+
+// snapshotVersion is bumped whenever the on-disk format changes
+// incompatibly. Snapshots with a different version are ignored.
+const snapshotVersion = 1
+
+// hubSnapshot is the on-disk representation of the hub's last known data.
+type hubSnapshot struct {
+	Version int           `json:"version"`
+	SavedAt time.Time     `json:"savedAt"`
+	Entries []*StockEntry `json:"entries"`
+}
+
+// SaveSnapshot writes the store and warm cache to cfg.SnapshotPath.
+// It is a no-op when persistence is disabled.
+func (h *Hub) SaveSnapshot() error {
+	if h.cfg.SnapshotPath == "" {
+		return nil
+	}
+
+	h.mu.Lock()
+	h.pruneWarm()
+	snap := hubSnapshot{
+		Version: snapshotVersion,
+		SavedAt: time.Now(),
+		Entries: make([]*StockEntry, 0, len(h.store)+len(h.warm)),
+	}
+	for _, entry := range h.store {
+		if entry.StockData != nil || entry.CryptoData != nil {
+			e := *entry
+			snap.Entries = append(snap.Entries, &e)
+		}
+	}
+	for _, entry := range h.warm {
+		e := *entry
+		snap.Entries = append(snap.Entries, &e)
+	}
+	h.mu.Unlock()
+
+	if err := writeJSONFile(h.cfg.SnapshotPath, snap); err != nil {
+		return err
+	}
+
+	h.log.Debug("snapshot saved", "entries", len(snap.Entries))
+	return nil
+}
+
+// LoadSnapshot restores entries from cfg.SnapshotPath into the warm cache.
+// Restored data is served as stale until the ticker is scraped again.
+// A missing snapshot is not an error.
+func (h *Hub) LoadSnapshot() error {
+	if h.cfg.SnapshotPath == "" {
+		return nil
+	}
+
+	var snap hubSnapshot
+	found, err := readJSONFile(h.cfg.SnapshotPath, &snap)
+	if err != nil || !found {
+		return err
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	h.mu.Lock()
+	for _, entry := range snap.Entries {
+		if entry == nil || entry.Ticker == "" {
+			continue
+		}
+		entry.Stale = true
+		h.warm[entry.Ticker] = entry
+	}
+	h.pruneWarm()
+	restored := len(h.warm)
+	h.mu.Unlock()
+
+	h.log.Info("snapshot restored", "entries", restored, "saved_at", snap.SavedAt)
+	return nil
+}
+
+// rememberWarm keeps entry in the warm cache, evicting to stay within
+// cfg.WarmCacheMax. Caller must hold h.mu.
+func (h *Hub) rememberWarm(entry *StockEntry) {
+	h.warm[entry.Ticker] = entry
+	if max := h.cfg.WarmCacheMax; max > 0 && len(h.warm) > max {
+		h.pruneWarm()
+	}
+}
+
+// pruneWarm evicts warm entries older than cfg.SnapshotMaxAge, then the
+// least recently updated ones until at most cfg.WarmCacheMax are left.
+// Caller must hold h.mu.
+func (h *Hub) pruneWarm() {
+	if h.cfg.SnapshotMaxAge > 0 {
+		cutoff := time.Now().Add(-h.cfg.SnapshotMaxAge)
+		for ticker, entry := range h.warm {
+			if entry.LastUpdated.Before(cutoff) {
+				delete(h.warm, ticker)
+			}
+		}
+	}
+
+	max := h.cfg.WarmCacheMax
+	if max <= 0 || len(h.warm) <= max {
+		return
+	}
+	entries := make([]*StockEntry, 0, len(h.warm))
+	for _, entry := range h.warm {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUpdated.Before(entries[j].LastUpdated)
+	})
+	for _, entry := range entries[:len(entries)-max] {
+		delete(h.warm, entry.Ticker)
+	}
+}
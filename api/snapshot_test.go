@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// offlineTransport fails every request, so hub tests never reach Google.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("offline")
+}
+
+// newOfflineCollector is newTestCollector without network access.
+func newOfflineCollector() *colly.Collector {
+	c := newTestCollector()
+	c.WithTransport(offlineTransport{})
+	return c
+}
+
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	cfg := LoadConfig()
+	cfg.SnapshotPath = filepath.Join(t.TempDir(), "snapshot.json")
+	return NewHub(newOfflineCollector(), cfg)
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	h := newTestHub(t)
+	h.store["TSLA:NASDAQ"] = &StockEntry{
+		Ticker:      "TSLA:NASDAQ",
+		IsStock:     true,
+		StockData:   &Stock_Key_Stats{Name: "Tesla Inc", Price: 398.41},
+		LastUpdated: time.Now(),
+	}
+	h.store["ETH-USD"] = &StockEntry{Ticker: "ETH-USD"} // never scraped, not persisted
+	h.warm["BTC-USD"] = &StockEntry{
+		Ticker:      "BTC-USD",
+		CryptoData:  &Crypto_Key_Stats{Name: "Bitcoin", Price: 65412.06},
+		LastUpdated: time.Now(),
+	}
+	h.warm["OLD:NSE"] = &StockEntry{
+		Ticker:      "OLD:NSE",
+		StockData:   &Stock_Key_Stats{Name: "Old"},
+		LastUpdated: time.Now().Add(-48 * time.Hour),
+	}
+
+	if err := h.SaveSnapshot(); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	restored := NewHub(nil, h.cfg)
+	if err := restored.LoadSnapshot(); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+
+	if len(restored.warm) != 2 {
+		t.Fatalf("Expected 2 restored entries, got %d", len(restored.warm))
+	}
+	tsla := restored.warm["TSLA:NASDAQ"]
+	if tsla == nil || !tsla.Stale || tsla.StockData.Price != 398.41 {
+		t.Fatalf("Expected stale TSLA entry with its last price, got %+v", tsla)
+	}
+	if _, ok := restored.warm["OLD:NSE"]; ok {
+		t.Fatal("Expected entries older than SnapshotMaxAge to be dropped")
+	}
+}
+
+func TestWarmCacheBounded(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.WarmCacheMax = 2
+	now := time.Now()
+	for i, ticker := range []string{"A:NSE", "B:NSE", "C:NSE"} {
+		h.rememberWarm(&StockEntry{Ticker: ticker, LastUpdated: now.Add(time.Duration(i) * time.Minute)})
+	}
+	if _, ok := h.warm["A:NSE"]; ok || len(h.warm) != 2 {
+		t.Fatalf("Expected the least recently updated entry to be evicted, got %v", h.warm)
+	}
+
+	// Entries past SnapshotMaxAge go first, whatever their number.
+	h.rememberWarm(&StockEntry{Ticker: "OLD:NSE", LastUpdated: now.Add(-48 * time.Hour)})
+	h.rememberWarm(&StockEntry{Ticker: "D:NSE", LastUpdated: now.Add(3 * time.Minute)})
+	if _, ok := h.warm["OLD:NSE"]; ok || len(h.warm) != 2 || h.warm["C:NSE"] == nil || h.warm["D:NSE"] == nil {
+		t.Fatalf("Expected C and D to be kept, got %v", h.warm)
+	}
+}
+
+func TestLoadSnapshotMissingFile(t *testing.T) {
+	h := newTestHub(t)
+	if err := h.LoadSnapshot(); err != nil {
+		t.Fatalf("Expected a missing snapshot to be ignored, got: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Server-Sent Events – the WebSocket stream over plain HTTP
+// ---------------------------------------------------------------------------
+
+// A /stream request is a hub client like any WebSocket connection, speaking
+// protocol v2 without the ability to send messages: it subscribes to the
+// tickers in the query string and receives the same ServerMessages, one
+// per event. Its session makes Last-Event-ID work: event ids are
+// "<session>:<sessionSeq>", and a reconnect with the last one resumes the
+// session as the "resume" action does.
+
+// ServeStream is the handler for GET /stream?tickers=A,B.
+func (h *Hub) ServeStream(w http.ResponseWriter, r *http.Request) {
+	tickers := normalizeTickers(strings.Split(r.URL.Query().Get("tickers"), ","))
+	lastID := r.Header.Get("Last-Event-ID")
+	if len(tickers) == 0 && lastID == "" {
+		writeError(w, http.StatusBadRequest, "No tickers given. Use ?tickers=TSLA:NASDAQ,BTC-USD.")
+		return
+	}
+	if len(tickers) > h.cfg.WSMaxTickersPerMessage {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Too many tickers (%d), the limit is %d per stream.", len(tickers), h.cfg.WSMaxTickersPerMessage))
+		return
+	}
+	if h.tooManyConnections(w, r) {
+		return
+	}
+
+	l := loggerFrom(r.Context()).With("component", "sse")
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", h.cfg.WSReconnectDelay.Milliseconds())
+	if err := rc.Flush(); err != nil {
+		l.Warn("streaming not supported", "error", err)
+		return
+	}
+
+	client := newClient(h, nil, 2)
+	client.remote, client.requestID = clientIP(r), requestIDFrom(r.Context())
+	client.useAPIKey(r.Context())
+	client.log = l.With("client", client.id)
+	select {
+	case h.registerCh <- client:
+	case <-h.quit:
+		return
+	}
+	defer func() {
+		select {
+		case h.unregisterCh <- client:
+		case <-h.quit:
+		}
+	}()
+
+	h.startSession(client)
+	h.sendUpstreamStatus(client)
+	if token, seq, ok := parseEventID(lastID); ok {
+		h.resume(client, "", &ResumeRequest{Session: token, LastSeq: seq})
+	}
+	for _, t := range tickers {
+		client.mu.Lock()
+		_, subscribed := client.tickers[t]
+		client.mu.Unlock()
+		if !subscribed {
+			h.subscribe(client, "", t)
+		}
+	}
+
+	var heartbeat <-chan time.Time // nil never fires: heartbeats disabled
+	if h.cfg.SSEHeartbeat > 0 {
+		t := time.NewTicker(h.cfg.SSEHeartbeat)
+		defer t.Stop()
+		heartbeat = t.C
+	}
+	flush := time.NewTimer(time.Hour)
+	flush.Stop()
+	defer flush.Stop()
+
+	for {
+		var message []byte
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.evicted:
+			return
+		case <-h.quit:
+			return
+		case <-h.streamsDone:
+			return
+
+		case <-heartbeat:
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			continue
+
+		case msg, ok := <-client.send:
+			if !ok {
+				return
+			}
+			message = msg
+		case <-client.wake:
+		case <-flush.C:
+		}
+
+		msgs, next, ok := client.collect(message)
+		if !ok {
+			return
+		}
+		if len(msgs) > 0 {
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			for _, msg := range msgs {
+				if err := writeEvent(w, client.session, msg); err != nil {
+					return
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+		if next > 0 {
+			flush.Reset(next)
+		}
+	}
+}
+
+// CloseStreams ends every /stream response. The HTTP server waits for
+// handlers to return before it shuts down, and streams never do on their
+// own.
+func (h *Hub) CloseStreams() {
+	h.streamsOnce.Do(func() { close(h.streamsDone) })
+}
+
+// writeEvent writes one message as an SSE event, with an id if the client
+// has a session.
+func writeEvent(w io.Writer, s *session, msg []byte) error {
+	var b bytes.Buffer
+	if s != nil {
+		if seq, ok := sessionSeqOf(msg); ok {
+			fmt.Fprintf(&b, "id: %s:%d\n", s.token, seq)
+		}
+	}
+	b.WriteString("data: ")
+	b.Write(msg)
+	b.WriteString("\n\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// sessionSeqOf reads the sessionSeq that stampSessionSeq put in front of a
+// message.
+func sessionSeqOf(msg []byte) (uint64, bool) {
+	const prefix = `{"sessionSeq":`
+	if !bytes.HasPrefix(msg, []byte(prefix)) {
+		return 0, false
+	}
+	rest := msg[len(prefix):]
+	end := bytes.IndexAny(rest, ",}")
+	if end < 0 {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(string(rest[:end]), 10, 64)
+	return seq, err == nil
+}
+
+// parseEventID splits a Last-Event-ID of the form "<session>:<sessionSeq>".
+func parseEventID(id string) (string, uint64, bool) {
+	token, seq, ok := strings.Cut(id, ":")
+	if !ok || token == "" {
+		return "", 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return token, n, err == nil
+}
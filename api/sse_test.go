@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one event read off a /stream response; comment is set for
+// comment lines such as heartbeats.
+type sseEvent struct {
+	id      string
+	data    ServerMessage
+	comment string
+}
+
+// startTestStreams runs h behind a test server and returns the /stream URL.
+func startTestStreams(t *testing.T, h *Hub) string {
+	t.Helper()
+	go h.Run()
+	srv := httptest.NewServer(http.HandlerFunc(h.ServeStream))
+	t.Cleanup(func() {
+		h.CloseStreams()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		h.Shutdown(ctx)
+		srv.Close()
+	})
+	return srv.URL + "/stream"
+}
+
+// dialTestStream opens a stream and returns its response, its events and a
+// function that disconnects it.
+func dialTestStream(t *testing.T, url, lastID string) (*http.Response, <-chan sseEvent, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+
+	events := make(chan sseEvent, 64)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		var ev sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, ": "):
+				events <- sseEvent{comment: strings.TrimPrefix(line, ": ")}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.data)
+			case line == "" && ev.data.Type != "":
+				events <- ev
+				ev = sseEvent{}
+			}
+		}
+	}()
+	return resp, events, cancel
+}
+
+// nextEvent waits for the next event of type msgType, or the next comment
+// if msgType is empty.
+func nextEvent(t *testing.T, events <-chan sseEvent, msgType string) sseEvent {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("Stream ended waiting for %q", msgType)
+			}
+			if (msgType == "" && ev.comment != "") || (msgType != "" && ev.data.Type == msgType) {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %q", msgType)
+		}
+	}
+}
+
+func TestServeStreamRequiresTickers(t *testing.T) {
+	h := newTestHub(t)
+	rec := httptest.NewRecorder()
+	h.ServeStream(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without tickers, got %d", rec.Code)
+	}
+}
+
+func TestServeStreamEvents(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.SSEHeartbeat = 50 * time.Millisecond
+	h.store["TSLA:NASDAQ"] = &StockEntry{Ticker: "TSLA:NASDAQ", IsStock: true, StockData: &Stock_Key_Stats{Name: "Tesla Inc", Price: 398}}
+
+	resp, events, _ := dialTestStream(t, startTestStreams(t, h)+"?tickers=tsla:nasdaq", "")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+	session := nextEvent(t, events, "session")
+	token := session.data.Data.(map[string]interface{})["session"].(string)
+	if session.id != token+":1" {
+		t.Fatalf("Expected event id %s:1, got %q", token, session.id)
+	}
+	if update := nextEvent(t, events, "stock_update"); update.data.Ticker != "TSLA:NASDAQ" {
+		t.Fatalf("Expected the current TSLA:NASDAQ quote, got %+v", update.data)
+	}
+	if hb := nextEvent(t, events, ""); hb.comment != "heartbeat" {
+		t.Fatalf("Expected a heartbeat comment, got %+v", hb)
+	}
+}
+
+func TestServeStreamLastEventID(t *testing.T) {
+	h := newTestHub(t)
+	url := startTestStreams(t, h)
+	_, events, disconnect := dialTestStream(t, url+"?tickers=TSLA:NASDAQ", "")
+	sub := nextEvent(t, events, "subscribed")
+	token, _, _ := strings.Cut(sub.id, ":")
+	disconnect()
+
+	// Missed while disconnected.
+	old := waitDetached(t, h, token)
+	h.sendToClient(old, ServerMessage{Type: "alert", Ticker: "TSLA:NASDAQ"})
+
+	_, again, _ := dialTestStream(t, url, sub.id)
+	alert := nextEvent(t, again, "alert")
+	if id, _, _ := strings.Cut(alert.id, ":"); id != token {
+		t.Fatalf("Expected the alert to be replayed on session %s, got id %q", token, alert.id)
+	}
+	if ack := nextEvent(t, again, "resumed"); ack.data.Data.(map[string]interface{})["session"] != token {
+		t.Fatalf("Expected the session to be resumed, got %+v", ack.data)
+	}
+}
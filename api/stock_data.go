@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gocolly/colly/v2"
 )
@@ -28,8 +30,10 @@ type Stock_News struct {
 	Thumbnail_Link string `json:"thumbnailLink,omitempty"`
 }
 
-func Get_Stock_Data(collector *colly.Collector, stock_query string) *Stock_Key_Stats {
-
+func Get_Stock_Data(ctx context.Context, collector *colly.Collector, stock_query string) *Stock_Key_Stats {
+	assetClass := stockAssetClass(stock_query)
+	log := scrapeLogger(ctx, stock_query, assetClass)
+	start := time.Now()
 	url := "https://www.google.com/finance/quote/" + stock_query
 
 	var name string
@@ -91,6 +95,7 @@ func Get_Stock_Data(collector *colly.Collector, stock_query string) *Stock_Key_S
 	collector.Visit(url)
 	collector.Wait()
 
+	logScrape(log, assetClass, name != "", start)
 	if name == "" {
 		return &Stock_Key_Stats{}
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 
 	"github.com/gocolly/colly/v2"
@@ -20,7 +21,7 @@ func newTestCollector() *colly.Collector {
 
 func TestGetStockData(t *testing.T) {
 	c := newTestCollector()
-	data := Get_Stock_Data(c, "TSLA:NASDAQ")
+	data := Get_Stock_Data(context.Background(), c, "TSLA:NASDAQ")
 
 	if data.Name == "" {
 		t.Fatal("Expected non-empty stock name for TSLA:NASDAQ")
@@ -46,7 +47,7 @@ func TestGetStockData(t *testing.T) {
 
 func TestGetStockDataInvalid(t *testing.T) {
 	c := newTestCollector()
-	data := Get_Stock_Data(c, "INVALIDTICKER12345:FAKEXCHANGE")
+	data := Get_Stock_Data(context.Background(), c, "INVALIDTICKER12345:FAKEXCHANGE")
 
 	if data.Name != "" {
 		t.Fatalf("Expected empty name for invalid query, got: %s", data.Name)
@@ -55,7 +56,7 @@ func TestGetStockDataInvalid(t *testing.T) {
 
 func TestGetStockDataINR(t *testing.T) {
 	c := newTestCollector()
-	data := Get_Stock_Data(c, "PAYTM:NSE")
+	data := Get_Stock_Data(context.Background(), c, "PAYTM:NSE")
 
 	if data.Name == "" {
 		t.Fatal("Expected non-empty stock name for PAYTM:NSE")
@@ -91,7 +92,7 @@ func TestGetStockNews(t *testing.T) {
 
 func TestGetIndexDataNifty(t *testing.T) {
 	c := newTestCollector()
-	data := Get_Stock_Data(c, "NIFTY_50:INDEXNSE")
+	data := Get_Stock_Data(context.Background(), c, "NIFTY_50:INDEXNSE")
 
 	if data.Name == "" {
 		t.Fatal("Expected non-empty name for NIFTY_50:INDEXNSE")
@@ -116,7 +117,7 @@ func TestGetIndexDataNifty(t *testing.T) {
 
 func TestGetIndexDataNDX(t *testing.T) {
 	c := newTestCollector()
-	data := Get_Stock_Data(c, "NDX:INDEXNASDAQ")
+	data := Get_Stock_Data(context.Background(), c, "NDX:INDEXNASDAQ")
 
 	if data.Name == "" {
 		t.Fatal("Expected non-empty name for NDX:INDEXNASDAQ")
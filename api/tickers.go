@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Ticker validation and pruning of tickers that never return data
+// ---------------------------------------------------------------------------
+
+// validTicker reports whether ticker has the shape of a stock or index
+// (SYMBOL:EXCHANGE) or a crypto pair (NAME-CURRENCY). It doesn't say the
+// ticker exists; only a scrape can tell that.
+func validTicker(ticker string) bool {
+	if ticker == "" || strings.ContainsAny(ticker, " \t/?#%") {
+		return false
+	}
+	if isStockTicker(ticker) {
+		symbol, exchange, _ := strings.Cut(ticker, ":")
+		return symbol != "" && exchange != "" && !strings.Contains(exchange, ":")
+	}
+	name, currency, ok := strings.Cut(ticker, "-")
+	return ok && name != "" && validCurrency(currency)
+}
+
+// negativeCached reports whether ticker recently failed too often to be
+// tracked again, and until when. Caller must hold h.mu (read or write).
+func (h *Hub) negativeCached(ticker string) (time.Time, bool) {
+	until, ok := h.failed[ticker]
+	if !ok || !time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// knownBad reports whether ticker is in the negative cache.
+func (h *Hub) knownBad(ticker string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, bad := h.negativeCached(ticker)
+	return bad
+}
+
+// scrapeFailed counts a scrape of ticker that found no data. A ticker that
+// has never had data tells its subscribers on the first failure, and after
+// TickerMaxFailures failures in a row it is dropped, its subscribers are
+// unsubscribed, it is unpinned and it goes into the negative cache for
+// NegativeCacheTTL. Tickers with data keep their last value; they are more
+// likely to be suffering a scraping hiccup than to have disappeared.
+func (h *Hub) scrapeFailed(ticker string) {
+	h.mu.Lock()
+	entry, ok := h.store[ticker]
+	if ok {
+		entry.scrapeErrors++
+		entry.lastScrapeError = time.Now()
+	}
+	if !ok || entry.StockData != nil || entry.CryptoData != nil {
+		h.mu.Unlock()
+		return
+	}
+	entry.failures++
+	first := entry.failures == 1
+	pruned := entry.failures >= h.cfg.TickerMaxFailures
+
+	subs := make([]*Client, 0, len(h.subscribers[ticker]))
+	for c := range h.subscribers[ticker] {
+		subs = append(subs, c)
+	}
+	if pruned {
+		now := time.Now()
+		for t, until := range h.failed {
+			if !now.Before(until) {
+				delete(h.failed, t)
+			}
+		}
+		h.failed[ticker] = now.Add(h.cfg.NegativeCacheTTL)
+		h.retiredSeq = max(h.retiredSeq, entry.Seq)
+		for owner, pinned := range h.pins {
+			delete(pinned, ticker)
+			if len(pinned) == 0 {
+				delete(h.pins, owner)
+			}
+		}
+		delete(h.subscribers, ticker)
+		delete(h.store, ticker)
+		delete(h.candles, ticker)
+		h.log.Warn("ticker dropped, no data", "ticker", ticker, "scrapes", entry.failures)
+	}
+	h.mu.Unlock()
+
+	now := time.Now()
+	for _, c := range subs {
+		if first {
+			h.sendToClient(c, notFoundMessage(ticker, now))
+		}
+		if pruned {
+			c.forgetTicker(ticker)
+			h.sendToClient(c, ServerMessage{
+				Type:      "unsubscribed",
+				Ticker:    ticker,
+				Error:     fmt.Sprintf("no data for %s after %d attempts", ticker, h.cfg.TickerMaxFailures),
+				Timestamp: now,
+			})
+		}
+	}
+}
+
+// notFoundMessage tells a subscriber that ticker's scrapes have found no
+// data so far.
+func notFoundMessage(ticker string, now time.Time) ServerMessage {
+	return ServerMessage{
+		Type:      "subscription_error",
+		Ticker:    ticker,
+		Code:      codeNotFound,
+		Error:     "no data found for " + ticker + ", check the symbol and exchange",
+		Timestamp: now,
+	}
+}
+
+// rejectTicker replies to a subscription the hub won't track: a malformed
+// ticker or one in the negative cache. It reports false if ticker is fine.
+func (h *Hub) rejectTicker(client *Client, reqID, ticker string) bool {
+	if !validTicker(ticker) {
+		h.replyError(client, reqID, codeInvalidTicker, ticker, "invalid ticker '"+ticker+"', use SYMBOL:EXCHANGE for stocks and indexes or NAME-CURRENCY for crypto")
+		return true
+	}
+
+	h.mu.RLock()
+	until, bad := h.negativeCached(ticker)
+	h.mu.RUnlock()
+	if !bad {
+		return false
+	}
+	h.reply(client, reqID, ServerMessage{
+		Type:      "subscription_error",
+		Ticker:    ticker,
+		Code:      codeNotFound,
+		Error:     fmt.Sprintf("no data found for %s, retry after %s", ticker, until.UTC().Format(time.RFC3339)),
+		Timestamp: time.Now(),
+	})
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidTicker(t *testing.T) {
+	for ticker, want := range map[string]bool{
+		"TSLA:NASDAQ":       true,
+		".DJI:INDEXDJX":     true,
+		"NIFTY_50:INDEXNSE": true,
+		"BTC-USD":           true,
+		"FOO:BAR":           true, // well-formed; only a scrape tells it doesn't exist
+		"TSLA":              false,
+		":NASDAQ":           false,
+		"TSLA:":             false,
+		"A:B:C":             false,
+		"BTC-":              false,
+		"BTC-DOLLARS":       false,
+		"TSLA NASDAQ":       false,
+		"../TSLA:NASDAQ":    false,
+	} {
+		if got := validTicker(ticker); got != want {
+			t.Errorf("validTicker(%q) = %v, want %v", ticker, got, want)
+		}
+	}
+}
+
+// readSent decodes the messages queued on c's send channel.
+func readSent(c *Client) []ServerMessage {
+	var msgs []ServerMessage
+	for len(c.send) > 0 {
+		var msg ServerMessage
+		json.Unmarshal(<-c.send, &msg)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestScrapeFailedPrunesDeadTickers(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.TickerMaxFailures = 2
+	c := newClient(h, nil, 2)
+	h.store["FOO:BAR"] = &StockEntry{Ticker: "FOO:BAR", IsStock: true}
+	h.subscribers["FOO:BAR"] = map[*Client]struct{}{c: {}}
+	c.tickers["FOO:BAR"] = struct{}{}
+
+	h.scrapeFailed("FOO:BAR")
+	if msgs := readSent(c); len(msgs) != 1 || msgs[0].Type != "subscription_error" || msgs[0].Code != codeNotFound {
+		t.Fatalf("Expected a subscription_error after the first failure, got %+v", msgs)
+	}
+
+	h.scrapeFailed("FOO:BAR")
+	if msgs := readSent(c); len(msgs) != 1 || msgs[0].Type != "unsubscribed" || msgs[0].Error == "" {
+		t.Fatalf("Expected an unsubscribed with a reason, got %+v", msgs)
+	}
+	if _, tracked := h.store["FOO:BAR"]; tracked || len(c.tickers) != 0 || !h.knownBad("FOO:BAR") {
+		t.Fatal("Expected FOO:BAR to be dropped and negative-cached")
+	}
+
+	if h.subscribe(c, "again", "foo:bar") {
+		t.Fatal("Expected a negative-cached ticker to be refused")
+	}
+	if msgs := readSent(c); len(msgs) != 1 || msgs[0].Type != "subscription_error" || msgs[0].ID != "again" {
+		t.Fatalf("Expected a subscription_error reply, got %+v", msgs)
+	}
+}
+
+func TestScrapeFailedLateSubscriberAndPins(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.TickerMaxFailures = 2
+	h.paused = true // no scrapes of our own
+	h.Pin("alerts", []string{"FOO:BAR", "TSLA:NASDAQ"})
+	h.Pin("webhooks", []string{"FOO:BAR"})
+
+	h.scrapeFailed("FOO:BAR")
+	late := newClient(h, nil, 2)
+	if !h.subscribe(late, "", "FOO:BAR") {
+		t.Fatal("Expected the subscription to be accepted")
+	}
+	msgs := readSent(late)
+	if len(msgs) != 2 || msgs[0].Type != "subscribed" || msgs[1].Type != "subscription_error" || msgs[1].Code != codeNotFound {
+		t.Fatalf("Expected a late subscriber to be told there is no data, got %+v", msgs)
+	}
+
+	h.scrapeFailed("FOO:BAR")
+	if _, ok := h.pins["alerts"]["FOO:BAR"]; ok {
+		t.Fatal("Expected a dropped ticker to be unpinned")
+	}
+	if _, ok := h.pins["alerts"]["TSLA:NASDAQ"]; !ok {
+		t.Fatal("Expected other pins to be kept")
+	}
+	if _, ok := h.pins["webhooks"]; ok {
+		t.Fatal("Expected an owner with nothing left pinned to be removed")
+	}
+}
+
+func TestScrapeFailedKeepsTickersWithData(t *testing.T) {
+	h := newTestHub(t)
+	h.cfg.TickerMaxFailures = 1
+	h.store["TSLA:NASDAQ"] = &StockEntry{Ticker: "TSLA:NASDAQ", IsStock: true, StockData: &Stock_Key_Stats{Name: "Tesla Inc"}}
+
+	h.scrapeFailed("TSLA:NASDAQ")
+	if _, tracked := h.store["TSLA:NASDAQ"]; !tracked || h.knownBad("TSLA:NASDAQ") {
+		t.Fatal("Expected a ticker with data to survive failed scrapes")
+	}
+}
+
+func TestProtocolInvalidTicker(t *testing.T) {
+	h := newTestHub(t)
+	conn := dialTestHub(t, h, subprotocolV2)
+
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "id": "s-1", "ticker": "TSLA"})
+	if e := conn.readType(t, "error"); e.ID != "s-1" || e.Code != codeInvalidTicker || e.Ticker != "TSLA" {
+		t.Fatalf("Expected invalid_ticker for s-1, got %+v", e)
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _, tracked := h.store["TSLA"]; tracked {
+		t.Fatal("Expected an invalid ticker not to be tracked")
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Upstream protection – rate budget, throttle detection and circuit breaker
+// ---------------------------------------------------------------------------
+
+// Every request to Google goes through the collector's transport, an
+// Upstream. It spends a global budget of UPSTREAM_RATE requests per minute,
+// bursting to UPSTREAM_BURST; a request over budget waits for its turn, or
+// fails straight away if that's more than a poll interval off.
+// Responses showing that Google is throttling us (429, 503, or a redirect
+// to its /sorry/ captcha page) count toward a circuit breaker. After
+// UPSTREAM_BREAKER_THRESHOLD of them in a row it opens: requests fail
+// without reaching Google, the hub stops polling and clients keep the last
+// known quotes. Once the backoff has passed, the next request is let
+// through as a probe. If it isn't throttled the breaker closes; if it is,
+// the breaker opens again for twice as long, up to UPSTREAM_BACKOFF_MAX.
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen // backoff over, a probe may go through
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+var (
+	errUpstreamOpen      = errors.New("upstream circuit breaker is open")
+	errUpstreamThrottled = errors.New("upstream redirected to a captcha page")
+	errUpstreamBusy      = errors.New("upstream rate budget exhausted")
+)
+
+// UpstreamStatus is the circuit breaker's state, as health checks and
+// clients see it.
+type UpstreamStatus struct {
+	State           string     `json:"state"`             // "closed", "open" or "half_open"
+	Since           time.Time  `json:"since"`             // when it entered the state
+	RetryAt         *time.Time `json:"retryAt,omitempty"` // while open, when a probe is let through
+	Trips           int        `json:"trips,omitempty"`   // times opened since it last closed
+	ThrottledInARow int        `json:"throttledInARow,omitempty"`
+	ThrottledTotal  uint64     `json:"throttledTotal"` // throttling responses since the server started
+}
+
+// Upstream is the http.RoundTripper guarding requests to Google.
+type Upstream struct {
+	base        http.RoundTripper
+	log         *slog.Logger
+	threshold   int
+	backoffBase time.Duration
+	backoffMax  time.Duration
+
+	// The token bucket. tokens goes negative while requests wait their turn.
+	bucketMu sync.Mutex
+	rate     float64 // tokens per second, 0 for no limit
+	burst    float64
+	tokens   float64
+	refilled time.Time
+	maxWait  time.Duration // longest a request may wait for its turn, 0 for no limit
+
+	mu        sync.Mutex
+	state     breakerState
+	since     time.Time
+	retryAt   time.Time
+	trips     int
+	inARow    int
+	throttled uint64
+	probing   bool // a half-open probe is in flight
+
+	// notifyMu keeps state change notifications in order.
+	notifyMu sync.Mutex
+	onChange func(UpstreamStatus)
+}
+
+// NewUpstream creates the guard for requests sent through base.
+func NewUpstream(cfg *Config, base http.RoundTripper) *Upstream {
+	threshold := cfg.UpstreamBreakerThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	now := time.Now()
+	return &Upstream{
+		base:        base,
+		log:         slog.Default().With("component", "upstream"),
+		threshold:   threshold,
+		backoffBase: cfg.UpstreamBackoffBase,
+		backoffMax:  cfg.UpstreamBackoffMax,
+		rate:        float64(cfg.UpstreamRate) / 60,
+		burst:       float64(max(cfg.UpstreamBurst, 1)),
+		tokens:      float64(max(cfg.UpstreamBurst, 1)),
+		refilled:    now,
+		maxWait:     cfg.PollInterval,
+		since:       now,
+	}
+}
+
+// RoundTrip sends req if the breaker and the rate budget allow it, and
+// records whether Google throttled it.
+func (u *Upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasPrefix(req.URL.Path, "/sorry/") {
+		// A redirect to the captcha page, already counted. Don't fetch it.
+		return nil, errUpstreamThrottled
+	}
+	probe, err := u.allow()
+	if err != nil {
+		metrics.upstreamRequests.WithLabelValues("rejected").Inc()
+		return nil, err
+	}
+	if err := u.wait(req.Context()); err != nil {
+		if errors.Is(err, errUpstreamBusy) {
+			metrics.upstreamRequests.WithLabelValues("busy").Inc()
+		}
+		u.endProbe(probe)
+		return nil, err
+	}
+
+	resp, err := u.base.RoundTrip(req)
+	if err != nil {
+		// Says nothing about throttling.
+		metrics.upstreamRequests.WithLabelValues("error").Inc()
+		u.endProbe(probe)
+		return nil, err
+	}
+	throttled := isThrottled(resp)
+	if throttled {
+		metrics.upstreamRequests.WithLabelValues("throttled").Inc()
+		u.log.Warn("throttled by upstream", "url", req.URL.Redacted(), "status", resp.StatusCode)
+	} else {
+		metrics.upstreamRequests.WithLabelValues("ok").Inc()
+	}
+	u.record(probe, throttled, retryAfter(resp))
+	return resp, nil
+}
+
+// isThrottled reports whether resp shows Google throttling us.
+func isThrottled(resp *http.Response) bool {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		return true
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		return strings.Contains(resp.Header.Get("Location"), "/sorry/")
+	}
+	return false
+}
+
+// retryAfter returns resp's Retry-After in seconds as a duration, or 0.
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// wait takes a token from the bucket, waiting until it's due. Tokens are
+// handed out in the order they're asked for. If the token is due more than
+// maxWait from now it isn't taken and errUpstreamBusy is returned, so a
+// backlog can't build up faster than the poll loop gets through it.
+func (u *Upstream) wait(ctx context.Context) error {
+	if u.rate <= 0 {
+		return nil
+	}
+	u.bucketMu.Lock()
+	now := time.Now()
+	u.tokens = min(u.burst, u.tokens+now.Sub(u.refilled).Seconds()*u.rate)
+	u.refilled = now
+	deficit := 1 - u.tokens
+	d := time.Duration(deficit / u.rate * float64(time.Second))
+	if u.maxWait > 0 && d > u.maxWait {
+		u.bucketMu.Unlock()
+		return errUpstreamBusy
+	}
+	u.tokens--
+	u.bucketMu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+
+	metrics.upstreamWait.Add(d.Seconds())
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		u.bucketMu.Lock()
+		u.tokens++ // give the reservation back
+		u.bucketMu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// allow reports whether a request may go out, and whether it's the
+// half-open probe.
+func (u *Upstream) allow() (probe bool, err error) {
+	u.mu.Lock()
+	switch u.state {
+	case breakerOpen:
+		if time.Now().Before(u.retryAt) {
+			u.mu.Unlock()
+			return false, errUpstreamOpen
+		}
+		u.state, u.since, u.probing = breakerHalfOpen, time.Now(), true
+		u.unlockAndNotify(true)
+		return true, nil
+	case breakerHalfOpen:
+		if u.probing {
+			u.mu.Unlock()
+			return false, errUpstreamOpen
+		}
+		u.probing = true
+		u.mu.Unlock()
+		return true, nil
+	}
+	u.mu.Unlock()
+	return false, nil
+}
+
+// endProbe lets another request probe if the probe never got an answer.
+func (u *Upstream) endProbe(probe bool) {
+	if !probe {
+		return
+	}
+	u.mu.Lock()
+	u.probing = false
+	u.mu.Unlock()
+}
+
+// record updates the breaker with a response. Only the probe closes it:
+// responses to requests sent before it opened say nothing about now.
+func (u *Upstream) record(probe, throttled bool, retry time.Duration) {
+	u.mu.Lock()
+	if probe {
+		u.probing = false
+	}
+	if !throttled {
+		changed := probe && u.state == breakerHalfOpen
+		if changed {
+			u.log.Info("circuit breaker closed", "trips", u.trips)
+			u.state, u.since, u.retryAt, u.trips = breakerClosed, time.Now(), time.Time{}, 0
+		}
+		if changed || u.state == breakerClosed {
+			u.inARow = 0
+		}
+		u.unlockAndNotify(changed)
+		return
+	}
+
+	u.throttled++
+	u.inARow++
+	changed := (probe && u.state == breakerHalfOpen) || (u.state == breakerClosed && u.inARow >= u.threshold)
+	if changed {
+		u.openLocked(retry)
+	}
+	u.unlockAndNotify(changed)
+}
+
+// openLocked opens the breaker, backing off for twice as long as last time
+// or for the response's Retry-After, whichever is longer, up to backoffMax.
+// Caller must hold u.mu.
+func (u *Upstream) openLocked(retry time.Duration) {
+	u.trips++
+	backoff := u.backoffBase
+	for i := 1; i < u.trips && backoff < u.backoffMax; i++ {
+		backoff *= 2
+	}
+	backoff = min(max(backoff, retry), u.backoffMax)
+	now := time.Now()
+	u.state, u.since, u.retryAt = breakerOpen, now, now.Add(backoff)
+	u.log.Warn("circuit breaker opened", "backoff", backoff, "trips", u.trips, "throttled_in_a_row", u.inARow)
+}
+
+// unlockAndNotify unlocks u.mu and, if the state changed, tells onChange.
+func (u *Upstream) unlockAndNotify(changed bool) {
+	if !changed {
+		u.mu.Unlock()
+		return
+	}
+	status := u.statusLocked()
+	u.notifyMu.Lock()
+	defer u.notifyMu.Unlock()
+	u.mu.Unlock()
+	if u.onChange != nil {
+		u.onChange(status)
+	}
+}
+
+// OnChange sets the function told about every change of the breaker's
+// state.
+func (u *Upstream) OnChange(fn func(UpstreamStatus)) {
+	u.notifyMu.Lock()
+	defer u.notifyMu.Unlock()
+	u.onChange = fn
+}
+
+// Status reports the breaker's state. A nil Upstream is always closed.
+func (u *Upstream) Status() UpstreamStatus {
+	if u == nil {
+		return UpstreamStatus{State: breakerClosed.String()}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.statusLocked()
+}
+
+func (u *Upstream) statusLocked() UpstreamStatus {
+	s := UpstreamStatus{
+		State:           u.state.String(),
+		Since:           u.since,
+		Trips:           u.trips,
+		ThrottledInARow: u.inARow,
+		ThrottledTotal:  u.throttled,
+	}
+	if u.state == breakerOpen {
+		retryAt := u.retryAt
+		s.RetryAt = &retryAt
+	}
+	return s
+}
+
+// blocked reports whether the breaker isn't closed or the rate budget is
+// turning requests away, so failed scrapes are its doing rather than the
+// ticker's.
+func (u *Upstream) blocked() bool {
+	if u == nil {
+		return false
+	}
+	u.mu.Lock()
+	closed := u.state == breakerClosed
+	u.mu.Unlock()
+	return !closed || u.busyFor() > 0
+}
+
+// busyFor returns how long until the rate budget stops turning requests
+// away, or 0 if it isn't.
+func (u *Upstream) busyFor() time.Duration {
+	if u == nil || u.rate <= 0 || u.maxWait <= 0 {
+		return 0
+	}
+	u.bucketMu.Lock()
+	tokens := min(u.burst, u.tokens+time.Since(u.refilled).Seconds()*u.rate)
+	u.bucketMu.Unlock()
+	d := time.Duration((1 - tokens) / u.rate * float64(time.Second))
+	return max(d-u.maxWait, 0)
+}
+
+// backingOff reports whether the breaker is open and its backoff isn't
+// over, so there's no point in scraping.
+func (u *Upstream) backingOff() bool {
+	if u == nil {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.state == breakerOpen && time.Now().Before(u.retryAt)
+}
+
+// stateValue is the breaker's state for stonks_upstream_breaker_state.
+func (u *Upstream) stateValue() float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return float64(u.state)
+}
+
+// upstream guards every request the global collector makes.
+var upstream *Upstream
+
+// lastKnown looks up the hub's last known data for a ticker, for REST
+// requests that can't be scraped. Nil until the hub is running.
+var lastKnown func(ticker string) (StockEntry, bool)
+
+// writeUpstreamUnavailable answers a request whose scrape failed with 503
+// while the upstream is blocked, and reports whether it did.
+func writeUpstreamUnavailable(w http.ResponseWriter) bool {
+	if !upstream.blocked() {
+		return false
+	}
+	var wait time.Duration
+	if s := upstream.Status(); s.RetryAt != nil {
+		wait = time.Until(*s.RetryAt)
+	} else {
+		wait = upstream.busyFor()
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+	}
+	writeError(w, http.StatusServiceUnavailable, "Google Finance is throttling requests. Try again later.")
+	return true
+}
+
+// writeLastKnown answers a quote request whose scrape failed while the
+// upstream is blocked with the ticker's last known data, marked stale with
+// a Warning header, or with 503 if there is none. It reports whether it
+// wrote a response.
+func writeLastKnown(w http.ResponseWriter, r *http.Request, ticker string) bool {
+	if !upstream.blocked() {
+		return false
+	}
+	entry, ok := StockEntry{}, false
+	if lastKnown != nil {
+		entry, ok = lastKnown(ticker)
+	}
+	if !ok || (entry.StockData == nil && entry.CryptoData == nil) {
+		return writeUpstreamUnavailable(w)
+	}
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	if writeConverted(w, r, entry) {
+		return true
+	}
+	if entry.CryptoData != nil {
+		writeJSON(w, r, http.StatusOK, *entry.CryptoData)
+	} else {
+		writeJSON(w, r, http.StatusOK, *entry.StockData)
+	}
+	return true
+}
+
+// ---------------------------------------------------------------------------
+// Hub integration
+// ---------------------------------------------------------------------------
+
+// UseUpstream makes the hub pause polling while u's breaker is open and
+// tell clients about its state.
+func (h *Hub) UseUpstream(u *Upstream) {
+	h.upstream = u
+	u.OnChange(h.broadcastUpstream)
+}
+
+// upstreamMessage is the "upstream" message for status s.
+func upstreamMessage(s UpstreamStatus) ServerMessage {
+	return ServerMessage{Type: "upstream", Data: s, Timestamp: time.Now()}
+}
+
+// broadcastUpstream tells every client the breaker's new state.
+func (h *Hub) broadcastUpstream(s UpstreamStatus) {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+
+	msg := upstreamMessage(s)
+	for _, c := range clients {
+		h.sendToClient(c, msg)
+	}
+}
+
+// sendUpstreamStatus tells a new client the breaker's state, unless it's
+// closed.
+func (h *Hub) sendUpstreamStatus(c *Client) {
+	if s := h.upstream.Status(); s.State != breakerClosed.String() {
+		h.sendToClient(c, upstreamMessage(s))
+	}
+}
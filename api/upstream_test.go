@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestUpstream guards requests to a test server answering with the
+// status in code, and counts the requests that reach it.
+func newTestUpstream(t *testing.T, cfg *Config) (*Upstream, *http.Client, string, *atomic.Int32, *atomic.Int32) {
+	t.Helper()
+	var code, hits atomic.Int32
+	code.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/captcha":
+			http.Redirect(w, r, "/sorry/index?continue=/finance", http.StatusFound)
+		case "/sorry/index":
+			t.Error("Expected the captcha page not to be fetched")
+		default:
+			w.WriteHeader(int(code.Load()))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	u := NewUpstream(cfg, http.DefaultTransport)
+	return u, &http.Client{Transport: u}, srv.URL, &code, &hits
+}
+
+func TestUpstreamBreaker(t *testing.T) {
+	u, client, url, code, hits := newTestUpstream(t, &Config{
+		UpstreamBreakerThreshold: 2,
+		UpstreamBackoffBase:      50 * time.Millisecond,
+		UpstreamBackoffMax:       time.Second,
+	})
+	var mu sync.Mutex
+	var states []string
+	u.OnChange(func(s UpstreamStatus) {
+		mu.Lock()
+		states = append(states, s.State)
+		mu.Unlock()
+	})
+
+	code.Store(http.StatusTooManyRequests)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get(url); err != nil {
+			t.Fatalf("Expected the throttled response to be returned, got %v", err)
+		}
+	}
+	s := u.Status()
+	if s.State != "open" || s.RetryAt == nil || s.ThrottledTotal != 2 {
+		t.Fatalf("Expected the breaker to open after 2 throttled responses, got %+v", s)
+	}
+	if _, err := client.Get(url); !errors.Is(err, errUpstreamOpen) || hits.Load() != 2 {
+		t.Fatalf("Expected requests to be turned away while open, got %v after %d hits", err, hits.Load())
+	}
+
+	// A throttled probe opens it again for twice as long.
+	time.Sleep(time.Until(*s.RetryAt))
+	client.Get(url)
+	s = u.Status()
+	if s.State != "open" || s.Trips != 2 || s.RetryAt.Sub(s.Since) != 100*time.Millisecond {
+		t.Fatalf("Expected a second trip with a 100ms backoff, got %+v", s)
+	}
+
+	// A good probe closes it.
+	code.Store(http.StatusOK)
+	time.Sleep(time.Until(*s.RetryAt))
+	if resp, err := client.Get(url); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the probe to go through, got %v", err)
+	}
+	if s = u.Status(); s.State != "closed" || s.Trips != 0 || s.ThrottledInARow != 0 {
+		t.Fatalf("Expected the breaker to close, got %+v", s)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"open", "half_open", "open", "half_open", "closed"}
+	if len(states) != len(want) {
+		t.Fatalf("Expected state changes %v, got %v", want, states)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("Expected state changes %v, got %v", want, states)
+		}
+	}
+}
+
+func TestUpstreamCaptchaAndRetryAfter(t *testing.T) {
+	u, client, url, _, hits := newTestUpstream(t, &Config{
+		UpstreamBreakerThreshold: 1,
+		UpstreamBackoffBase:      time.Second,
+		UpstreamBackoffMax:       time.Minute,
+	})
+	if _, err := client.Get(url + "/captcha"); err == nil {
+		t.Fatal("Expected following a redirect to the captcha page to fail")
+	}
+	s := u.Status()
+	if s.State != "open" || s.ThrottledTotal != 1 || hits.Load() != 1 {
+		t.Fatalf("Expected the captcha redirect to open the breaker, got %+v after %d hits", s, hits.Load())
+	}
+
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"120"}}}
+	if !isThrottled(resp) || retryAfter(resp) != 2*time.Minute {
+		t.Fatalf("Expected a 503 to be throttling with its Retry-After, got %v", retryAfter(resp))
+	}
+	u.mu.Lock()
+	u.openLocked(retryAfter(resp))
+	backoff := u.retryAt.Sub(u.since)
+	u.mu.Unlock()
+	if backoff != time.Minute {
+		t.Fatalf("Expected Retry-After to be capped at the max backoff, got %v", backoff)
+	}
+}
+
+func TestUpstreamRateBudget(t *testing.T) {
+	u, client, url, _, _ := newTestUpstream(t, &Config{UpstreamRate: 1200, UpstreamBurst: 1}) // one per 50ms
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get(url); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+	if took := time.Since(start); took < 90*time.Millisecond {
+		t.Fatalf("Expected 3 requests to be spaced 50ms apart, took %v", took)
+	}
+
+	// A request giving up on its turn hands it back.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := u.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancelled wait, got %v", err)
+	}
+}
+
+func TestUpstreamFailsFastWhenBusy(t *testing.T) {
+	u := NewUpstream(&Config{UpstreamRate: 60, UpstreamBurst: 1, PollInterval: 100 * time.Millisecond}, http.DefaultTransport) // one a second
+	if err := u.wait(context.Background()); err != nil {
+		t.Fatalf("Expected the burst to go straight out, got %v", err)
+	}
+	if err := u.wait(context.Background()); !errors.Is(err, errUpstreamBusy) {
+		t.Fatalf("Expected a wait longer than the poll interval to fail, got %v", err)
+	}
+	if d := u.busyFor(); d <= 0 || d > time.Second || !u.blocked() {
+		t.Fatalf("Expected the upstream to be blocked for under a second, got %v", d)
+	}
+}
+
+func TestWriteLastKnown(t *testing.T) {
+	u := NewUpstream(&Config{}, http.DefaultTransport)
+	u.state, u.retryAt = breakerOpen, time.Now().Add(time.Minute)
+	prevUpstream, prevLastKnown := upstream, lastKnown
+	upstream = u
+	lastKnown = func(ticker string) (StockEntry, bool) {
+		if ticker != "TSLA:NASDAQ" {
+			return StockEntry{}, false
+		}
+		return StockEntry{Ticker: ticker, IsStock: true, StockData: &Stock_Key_Stats{Name: "Tesla Inc", Price: 400}}, true
+	}
+	t.Cleanup(func() { upstream, lastKnown = prevUpstream, prevLastKnown })
+
+	rr := httptest.NewRecorder()
+	if !writeLastKnown(rr, httptest.NewRequest("GET", "/stocks/TSLA:NASDAQ", nil), "TSLA:NASDAQ") {
+		t.Fatal("Expected a response while the breaker is open")
+	}
+	var stock Stock_Key_Stats
+	json.Unmarshal(rr.Body.Bytes(), &stock)
+	if rr.Code != http.StatusOK || stock.Price != 400 || rr.Header().Get("Warning") == "" {
+		t.Fatalf("Expected the last known quote marked stale, got %d %s %v", rr.Code, rr.Body, rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	writeLastKnown(rr, httptest.NewRequest("GET", "/stocks/AAPL:NASDAQ", nil), "AAPL:NASDAQ")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 503 with Retry-After on a cache miss, got %d %v", rr.Code, rr.Header())
+	}
+
+	u.state = breakerClosed
+	if writeLastKnown(httptest.NewRecorder(), httptest.NewRequest("GET", "/stocks/AAPL:NASDAQ", nil), "AAPL:NASDAQ") {
+		t.Fatal("Expected nothing written while the upstream isn't blocked")
+	}
+}
+
+func TestHubUpstreamOpen(t *testing.T) {
+	h := newTestHub(t)
+	u := NewUpstream(&Config{UpstreamBackoffBase: time.Minute, UpstreamBackoffMax: time.Minute}, offlineTransport{})
+	h.UseUpstream(u)
+	h.collector.WithTransport(u)
+	h.store["TSLA:NASDAQ"] = &StockEntry{Ticker: "TSLA:NASDAQ", IsStock: true, StockData: &Stock_Key_Stats{Name: "Tesla Inc"}, Seq: 1}
+	conn := dialTestHub(t, h, subprotocolV2)
+	conn.readType(t, "session")
+
+	u.record(false, true, 0)
+	msg := conn.readType(t, "upstream")
+	if s := msg.Data.(map[string]interface{}); s["state"] != "open" || s["retryAt"] == nil {
+		t.Fatalf("Expected clients to be told the breaker opened, got %+v", msg)
+	}
+
+	// Clients connecting while it's open are told straight away.
+	dialTestURL(t, conn.url, subprotocolV2).readType(t, "upstream")
+
+	// Failed scrapes aren't held against tickers, on-demand scrapes are
+	// skipped and liveness holds.
+	h.pollTicker(context.Background(), "TSLA:NASDAQ")
+	h.mu.RLock()
+	e := *h.store["TSLA:NASDAQ"]
+	h.mu.RUnlock()
+	if e.scrapeErrors != 0 || e.StockData == nil {
+		t.Fatalf("Expected a scrape turned away by the breaker not to count, got %+v", e)
+	}
+	h.scrapeNow(context.Background(), "TSLA:NASDAQ")
+	if n := len(h.sem); n != 0 {
+		t.Fatalf("Expected no scrape while the breaker is open, %d running", n)
+	}
+	h.mu.Lock()
+	h.lastPoll = time.Now().Add(-2 * h.cfg.HealthStallTimeout)
+	h.mu.Unlock()
+	if st, ok := NewHealth(h, h.cfg).Status(false); !ok || st.Upstream.State != "open" {
+		t.Fatalf("Expected liveness to hold while the breaker is open, got %+v", st)
+	}
+
+	// Batch quotes serve what's cached, marked stale.
+	results := NewQuoteBatcher(h, h.cfg).Quotes(context.Background(), []string{"TSLA:NASDAQ", "AAPL:NASDAQ"}, "")
+	if !results[0].Stale || results[0].Data == nil || results[1].Error == "" {
+		t.Fatalf("Expected cached data marked stale and an error for the rest, got %+v", results)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ---------------------------------------------------------------------------
+// Watchlists – named, ordered ticker lists persisted to a local file
+// ---------------------------------------------------------------------------
+
+// Watchlist is a named, ordered list of tickers shared across clients.
+type Watchlist struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Tickers   []string  `json:"tickers"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// watchlistFile is the on-disk format of the watchlist store.
+type watchlistFile struct {
+	Watchlists []*Watchlist `json:"watchlists"`
+}
+
+// WatchlistChangeFunc is called after a watchlist is created, edited or
+// deleted. before holds the previous tickers (nil on create); after is nil
+// when the list was deleted.
+type WatchlistChangeFunc func(id string, before []string, after *Watchlist)
+
+var (
+	errWatchlistNotFound = errors.New("watchlist not found")
+	errEmptyName         = errors.New("watchlist name must not be empty")
+)
+
+// WatchlistStore keeps watchlists in memory and writes every change through
+// to a JSON file.
+type WatchlistStore struct {
+	mu        sync.RWMutex
+	path      string
+	lists     map[string]*Watchlist
+	listeners []WatchlistChangeFunc
+}
+
+// NewWatchlistStore loads the store from path. An empty path keeps the
+// store in memory only.
+func NewWatchlistStore(path string) (*WatchlistStore, error) {
+	s := &WatchlistStore{
+		path:  path,
+		lists: make(map[string]*Watchlist),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	var file watchlistFile
+	if _, err := readJSONFile(path, &file); err != nil {
+		return s, err
+	}
+	for _, wl := range file.Watchlists {
+		if wl != nil && wl.ID != "" {
+			s.lists[wl.ID] = wl
+		}
+	}
+	slog.Info("loaded watchlists", "component", "watchlists", "watchlists", len(s.lists))
+	return s, nil
+}
+
+// OnChange registers fn to be called after every change.
+func (s *WatchlistStore) OnChange(fn WatchlistChangeFunc) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, fn)
+	s.mu.Unlock()
+}
+
+// List returns copies of all watchlists, oldest first.
+func (s *WatchlistStore) List() []Watchlist {
+	s.mu.RLock()
+	out := make([]Watchlist, 0, len(s.lists))
+	for _, wl := range s.lists {
+		out = append(out, copyWatchlist(wl))
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// Get returns a copy of the watchlist with the given id.
+func (s *WatchlistStore) Get(id string) (Watchlist, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wl, ok := s.lists[id]
+	if !ok {
+		return Watchlist{}, false
+	}
+	return copyWatchlist(wl), true
+}
+
+// Create adds a new watchlist.
+func (s *WatchlistStore) Create(name string, tickers []string) (Watchlist, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Watchlist{}, errEmptyName
+	}
+
+	now := time.Now()
+	wl := &Watchlist{
+		ID:        newID(),
+		Name:      name,
+		Tickers:   normalizeTickers(tickers),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	s.mu.Lock()
+	s.lists[wl.ID] = wl
+	if err := s.saveLocked(); err != nil {
+		delete(s.lists, wl.ID)
+		s.mu.Unlock()
+		return Watchlist{}, err
+	}
+	out := copyWatchlist(wl)
+	s.mu.Unlock()
+
+	s.notify(wl.ID, nil, &out)
+	return out, nil
+}
+
+// Update applies fn to the watchlist with the given id and persists it.
+// fn works on a copy, so a failed update or save leaves the stored list
+// untouched.
+func (s *WatchlistStore) Update(id string, fn func(wl *Watchlist) error) (Watchlist, error) {
+	s.mu.Lock()
+	cur, ok := s.lists[id]
+	if !ok {
+		s.mu.Unlock()
+		return Watchlist{}, errWatchlistNotFound
+	}
+
+	next := copyWatchlist(cur)
+	if err := fn(&next); err != nil {
+		s.mu.Unlock()
+		return Watchlist{}, err
+	}
+	next.Name = strings.TrimSpace(next.Name)
+	if next.Name == "" {
+		s.mu.Unlock()
+		return Watchlist{}, errEmptyName
+	}
+	next.Tickers = normalizeTickers(next.Tickers)
+	next.UpdatedAt = time.Now()
+
+	before := cur.Tickers
+	stored := copyWatchlist(&next)
+	s.lists[id] = &stored
+	if err := s.saveLocked(); err != nil {
+		s.lists[id] = cur
+		s.mu.Unlock()
+		return Watchlist{}, err
+	}
+	s.mu.Unlock()
+
+	s.notify(id, before, &next)
+	return next, nil
+}
+
+// Delete removes the watchlist with the given id.
+func (s *WatchlistStore) Delete(id string) error {
+	s.mu.Lock()
+	cur, ok := s.lists[id]
+	if !ok {
+		s.mu.Unlock()
+		return errWatchlistNotFound
+	}
+	delete(s.lists, id)
+	if err := s.saveLocked(); err != nil {
+		s.lists[id] = cur
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+
+	s.notify(id, cur.Tickers, nil)
+	return nil
+}
+
+// saveLocked writes the store to disk. Caller must hold s.mu.
+func (s *WatchlistStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	file := watchlistFile{Watchlists: make([]*Watchlist, 0, len(s.lists))}
+	for _, wl := range s.lists {
+		file.Watchlists = append(file.Watchlists, wl)
+	}
+	if err := writeJSONFile(s.path, file); err != nil {
+		slog.Error("save failed", "component", "watchlists", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *WatchlistStore) notify(id string, before []string, after *Watchlist) {
+	s.mu.RLock()
+	listeners := append([]WatchlistChangeFunc(nil), s.listeners...)
+	s.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(id, before, after)
+	}
+}
+
+func copyWatchlist(wl *Watchlist) Watchlist {
+	out := *wl
+	out.Tickers = append([]string(nil), wl.Tickers...)
+	return out
+}
+
+// normalizeTicker upper-cases and trims a ticker, the same way the hub
+// keys its store.
+func normalizeTicker(ticker string) string {
+	return strings.TrimSpace(strings.ToUpper(ticker))
+}
+
+// normalizeTickers normalizes tickers, dropping blanks and duplicates while
+// keeping the first occurrence's position.
+func normalizeTickers(tickers []string) []string {
+	seen := make(map[string]struct{}, len(tickers))
+	out := make([]string, 0, len(tickers))
+	for _, t := range tickers {
+		t = normalizeTicker(t)
+		if t == "" {
+			continue
+		}
+		if _, dup := seen[t]; dup {
+			continue
+		}
+		seen[t] = struct{}{}
+		out = append(out, t)
+	}
+	return out
+}
+
+// newID returns a random 16-character hex identifier.
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ---------------------------------------------------------------------------
+// REST handlers
+// ---------------------------------------------------------------------------
+
+type watchlistRequest struct {
+	Name    *string  `json:"name"`
+	Tickers []string `json:"tickers"`
+}
+
+type watchlistTickerRequest struct {
+	Ticker   string `json:"ticker"`
+	Position *int   `json:"position"` // 0-based insert position; appended when omitted
+}
+
+func (s *WatchlistStore) getWatchlists(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.List())
+}
+
+func (s *WatchlistStore) createWatchlist(w http.ResponseWriter, r *http.Request) {
+	var req watchlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == nil {
+		writeError(w, http.StatusBadRequest, "Expected JSON body with a 'name' and optional 'tickers'.")
+		return
+	}
+
+	wl, err := s.Create(*req.Name, req.Tickers)
+	if errors.Is(err, errEmptyName) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not save watchlist.")
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, wl)
+}
+
+func (s *WatchlistStore) getWatchlist(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	wl, ok := s.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No watchlist found with id '%s'.", id))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, wl)
+}
+
+func (s *WatchlistStore) updateWatchlist(w http.ResponseWriter, r *http.Request) {
+	var req watchlistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Expected JSON body with 'name' and/or 'tickers'.")
+		return
+	}
+
+	s.respondUpdate(w, r, chi.URLParam(r, "id"), func(wl *Watchlist) error {
+		if req.Name != nil {
+			wl.Name = *req.Name
+		}
+		if req.Tickers != nil {
+			wl.Tickers = req.Tickers
+		}
+		return nil
+	})
+}
+
+func (s *WatchlistStore) deleteWatchlist(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := s.Delete(id)
+	if errors.Is(err, errWatchlistNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No watchlist found with id '%s'.", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not save watchlists.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *WatchlistStore) getWatchlistTickers(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	wl, ok := s.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No watchlist found with id '%s'.", id))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, wl.Tickers)
+}
+
+// addWatchlistTicker inserts a ticker, or moves it if already present.
+func (s *WatchlistStore) addWatchlistTicker(w http.ResponseWriter, r *http.Request) {
+	var req watchlistTickerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || normalizeTicker(req.Ticker) == "" {
+		writeError(w, http.StatusBadRequest, "Expected JSON body with a 'ticker' and optional 'position'.")
+		return
+	}
+	ticker := normalizeTicker(req.Ticker)
+
+	s.respondUpdate(w, r, chi.URLParam(r, "id"), func(wl *Watchlist) error {
+		tickers := make([]string, 0, len(wl.Tickers)+1)
+		for _, t := range wl.Tickers {
+			if t != ticker {
+				tickers = append(tickers, t)
+			}
+		}
+		pos := len(tickers)
+		if req.Position != nil && *req.Position >= 0 && *req.Position < pos {
+			pos = *req.Position
+		}
+		tickers = append(tickers[:pos], append([]string{ticker}, tickers[pos:]...)...)
+		wl.Tickers = tickers
+		return nil
+	})
+}
+
+// setWatchlistTickers replaces the ticker list, which is how clients reorder.
+func (s *WatchlistStore) setWatchlistTickers(w http.ResponseWriter, r *http.Request) {
+	var tickers []string
+	if err := json.NewDecoder(r.Body).Decode(&tickers); err != nil {
+		writeError(w, http.StatusBadRequest, "Expected a JSON array of tickers.")
+		return
+	}
+
+	s.respondUpdate(w, r, chi.URLParam(r, "id"), func(wl *Watchlist) error {
+		wl.Tickers = tickers
+		return nil
+	})
+}
+
+func (s *WatchlistStore) removeWatchlistTicker(w http.ResponseWriter, r *http.Request) {
+	ticker := normalizeTicker(chi.URLParam(r, "ticker"))
+
+	s.respondUpdate(w, r, chi.URLParam(r, "id"), func(wl *Watchlist) error {
+		tickers := make([]string, 0, len(wl.Tickers))
+		for _, t := range wl.Tickers {
+			if t != ticker {
+				tickers = append(tickers, t)
+			}
+		}
+		wl.Tickers = tickers
+		return nil
+	})
+}
+
+// respondUpdate runs Update and writes the resulting watchlist or error.
+func (s *WatchlistStore) respondUpdate(w http.ResponseWriter, r *http.Request, id string, fn func(wl *Watchlist) error) {
+	wl, err := s.Update(id, fn)
+	switch {
+	case errors.Is(err, errWatchlistNotFound):
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No watchlist found with id '%s'.", id))
+	case errors.Is(err, errEmptyName):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, "Could not save watchlist.")
+	default:
+		writeJSON(w, r, http.StatusOK, wl)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Hub integration – subscribe by watchlist
+// ---------------------------------------------------------------------------
+
+// UseWatchlists lets clients subscribe to watchlists from ws and keeps their
+// subscriptions in sync as the lists are edited.
+func (h *Hub) UseWatchlists(ws *WatchlistStore) {
+	h.watchlists = ws
+	ws.OnChange(h.watchlistChanged)
+}
+
+func (h *Hub) subscribeWatchlist(client *Client, reqID, id string) {
+	if h.watchlists == nil {
+		h.replyError(client, reqID, codeUnavailable, "", "watchlists are not available")
+		return
+	}
+	wl, ok := h.watchlists.Get(id)
+	if !ok {
+		h.replyError(client, reqID, codeNotFound, "", "watchlist not found: "+id)
+		return
+	}
+
+	client.mu.Lock()
+	client.watchlists[id] = struct{}{}
+	client.mu.Unlock()
+
+	h.reply(client, reqID, ServerMessage{
+		Type:      "watchlist_subscribed",
+		Data:      wl,
+		Timestamp: time.Now(),
+	})
+	for _, t := range wl.Tickers {
+		h.addSubscription(client, reqID, t, false)
+	}
+}
+
+func (h *Hub) unsubscribeWatchlist(client *Client, reqID, id string) {
+	if h.watchlists == nil {
+		h.replyError(client, reqID, codeUnavailable, "", "watchlists are not available")
+		return
+	}
+	client.mu.Lock()
+	_, following := client.watchlists[id]
+	delete(client.watchlists, id)
+	client.mu.Unlock()
+	if !following {
+		h.replyError(client, reqID, codeNotFound, "", "not following watchlist: "+id)
+		return
+	}
+
+	if wl, ok := h.watchlists.Get(id); ok {
+		h.dropWatchlistTickers(client, reqID, wl.Tickers)
+	}
+	h.reply(client, reqID, ServerMessage{
+		Type:      "watchlist_unsubscribed",
+		Data:      map[string]string{"id": id},
+		Timestamp: time.Now(),
+	})
+}
+
+// watchlistChanged applies a watchlist edit to every client following it:
+// new tickers are subscribed, removed ones unsubscribed, and the client is
+// sent the updated list so it can re-render in the new order.
+func (h *Hub) watchlistChanged(id string, before []string, after *Watchlist) {
+	h.mu.RLock()
+	followers := make([]*Client, 0)
+	for c := range h.clients {
+		c.mu.Lock()
+		if _, ok := c.watchlists[id]; ok {
+			followers = append(followers, c)
+		}
+		c.mu.Unlock()
+	}
+	h.mu.RUnlock()
+
+	if len(followers) == 0 {
+		return
+	}
+
+	var afterTickers []string
+	if after != nil {
+		afterTickers = after.Tickers
+	}
+	added := diffTickers(afterTickers, before)
+	removed := diffTickers(before, afterTickers)
+
+	for _, c := range followers {
+		if after == nil {
+			c.mu.Lock()
+			delete(c.watchlists, id)
+			c.mu.Unlock()
+			h.sendToClient(c, ServerMessage{
+				Type:      "watchlist_deleted",
+				Data:      map[string]string{"id": id},
+				Timestamp: time.Now(),
+			})
+		} else {
+			h.sendToClient(c, ServerMessage{
+				Type:      "watchlist_update",
+				Data:      after,
+				Timestamp: time.Now(),
+			})
+		}
+		for _, t := range added {
+			h.addSubscription(c, "", t, false)
+		}
+		h.dropWatchlistTickers(c, "", removed)
+	}
+}
+
+// dropWatchlistTickers unsubscribes the client from tickers, except those
+// it subscribed to directly or that are still in another watchlist it
+// follows.
+func (h *Hub) dropWatchlistTickers(client *Client, reqID string, tickers []string) {
+	keep := make(map[string]struct{})
+	client.mu.Lock()
+	for t := range client.direct {
+		keep[t] = struct{}{}
+	}
+	ids := make([]string, 0, len(client.watchlists))
+	for id := range client.watchlists {
+		ids = append(ids, id)
+	}
+	client.mu.Unlock()
+	for _, id := range ids {
+		if wl, ok := h.watchlists.Get(id); ok {
+			for _, t := range wl.Tickers {
+				keep[t] = struct{}{}
+			}
+		}
+	}
+
+	for _, t := range tickers {
+		if _, ok := keep[t]; !ok {
+			h.unsubscribe(client, reqID, t)
+		}
+	}
+}
+
+// diffTickers returns the tickers in a that are not in b.
+func diffTickers(a, b []string) []string {
+	inB := make(map[string]struct{}, len(b))
+	for _, t := range b {
+		inB[t] = struct{}{}
+	}
+	var out []string
+	for _, t := range a {
+		if _, ok := inB[t]; !ok {
+			out = append(out, t)
+		}
+	}
+	return out
+}
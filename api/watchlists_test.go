@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestWatchlistStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watchlists.json")
+	s, err := NewWatchlistStore(path)
+	if err != nil {
+		t.Fatalf("NewWatchlistStore failed: %v", err)
+	}
+
+	wl, err := s.Create("Tech", []string{"tsla:nasdaq", " AAPL:NASDAQ", "TSLA:NASDAQ", ""})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if want := []string{"TSLA:NASDAQ", "AAPL:NASDAQ"}; !reflect.DeepEqual(wl.Tickers, want) {
+		t.Fatalf("Expected normalized tickers %v, got %v", want, wl.Tickers)
+	}
+
+	reloaded, err := NewWatchlistStore(path)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	got, ok := reloaded.Get(wl.ID)
+	if !ok || got.Name != "Tech" || len(got.Tickers) != 2 {
+		t.Fatalf("Expected watchlist to survive a reload, got %+v", got)
+	}
+}
+
+func TestWatchlistStoreNotifiesChanges(t *testing.T) {
+	s, _ := NewWatchlistStore("")
+	wl, _ := s.Create("Crypto", []string{"BTC-USD"})
+
+	var before []string
+	var after *Watchlist
+	s.OnChange(func(id string, b []string, a *Watchlist) {
+		before, after = b, a
+	})
+
+	s.Update(wl.ID, func(w *Watchlist) error {
+		w.Tickers = []string{"ETH-USD", "BTC-USD"}
+		return nil
+	})
+	if !reflect.DeepEqual(before, []string{"BTC-USD"}) || after == nil || after.Tickers[0] != "ETH-USD" {
+		t.Fatalf("Unexpected change notification: before=%v after=%+v", before, after)
+	}
+
+	s.Delete(wl.ID)
+	if after != nil {
+		t.Fatal("Expected a nil watchlist in the delete notification")
+	}
+}
+
+func TestWatchlistTickerEndpoints(t *testing.T) {
+	s, _ := NewWatchlistStore("")
+	wl, _ := s.Create("Tech", []string{"TSLA:NASDAQ", "AAPL:NASDAQ"})
+
+	r := chi.NewRouter()
+	r.Post("/watchlists/{id}/tickers", s.addWatchlistTicker)
+	r.Delete("/watchlists/{id}/tickers/{ticker}", s.removeWatchlistTicker)
+
+	req := httptest.NewRequest("POST", "/watchlists/"+wl.ID+"/tickers", strings.NewReader(`{"ticker":"msft:nasdaq","position":0}`))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Body: %s", rr.Code, rr.Body.String())
+	}
+
+	var got Watchlist
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	if want := []string{"MSFT:NASDAQ", "TSLA:NASDAQ", "AAPL:NASDAQ"}; !reflect.DeepEqual(got.Tickers, want) {
+		t.Fatalf("Expected %v, got %v", want, got.Tickers)
+	}
+
+	req = httptest.NewRequest("DELETE", "/watchlists/"+wl.ID+"/tickers/TSLA:NASDAQ", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if stored, _ := s.Get(wl.ID); len(stored.Tickers) != 2 || stored.Tickers[1] != "AAPL:NASDAQ" {
+		t.Fatalf("Expected TSLA to be removed, got %v", stored.Tickers)
+	}
+
+	req = httptest.NewRequest("DELETE", "/watchlists/missing/tickers/TSLA:NASDAQ", nil)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown watchlist, got %d", rr.Code)
+	}
+}
+
+func TestWatchlistStoreRollsBackFailedSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watchlists.json")
+	s, _ := NewWatchlistStore(path)
+	wl, _ := s.Create("Tech", []string{"TSLA:NASDAQ"})
+	notified := 0
+	s.OnChange(func(string, []string, *Watchlist) { notified++ })
+
+	s.path = filepath.Join(path, "unwritable.json") // its directory is a file
+	if _, err := s.Create("Crypto", nil); err == nil {
+		t.Fatal("Expected Create to fail")
+	}
+	if _, err := s.Update(wl.ID, func(w *Watchlist) error { w.Name = "Renamed"; return nil }); err == nil {
+		t.Fatal("Expected Update to fail")
+	}
+	if err := s.Delete(wl.ID); err == nil {
+		t.Fatal("Expected Delete to fail")
+	}
+
+	if lists := s.List(); len(lists) != 1 || lists[0].Name != "Tech" || notified != 0 {
+		t.Fatalf("Expected failed saves to change nothing, got %+v after %d notifications", lists, notified)
+	}
+}
+
+func TestUnfollowWatchlistKeepsDirectSubscriptions(t *testing.T) {
+	h := newTestHub(t)
+	h.setPaused(true) // no scrapes
+	s, _ := NewWatchlistStore("")
+	h.UseWatchlists(s)
+	wl, _ := s.Create("Tech", []string{"TSLA:NASDAQ", "AAPL:NASDAQ"})
+	c := newClient(h, nil, 2)
+
+	h.subscribe(c, "", "TSLA:NASDAQ")
+	h.subscribeWatchlist(c, "", wl.ID)
+	h.unsubscribeWatchlist(c, "", wl.ID)
+
+	if _, ok := c.tickers["TSLA:NASDAQ"]; !ok {
+		t.Fatal("Expected the directly subscribed ticker to stay subscribed")
+	}
+	if _, ok := c.tickers["AAPL:NASDAQ"]; ok {
+		t.Fatal("Expected the ticker only in the watchlist to be dropped")
+	}
+}
+
+func TestUnsubscribeWatchlistReplies(t *testing.T) {
+	h := newTestHub(t)
+	c := newClient(h, nil, 2)
+	h.unsubscribeWatchlist(c, "w-1", "nope")
+	if msgs := readSent(c); len(msgs) != 1 || msgs[0].ID != "w-1" || msgs[0].Code != codeUnavailable {
+		t.Fatalf("Expected an unavailable error without watchlists, got %+v", msgs)
+	}
+
+	s, _ := NewWatchlistStore("")
+	h.UseWatchlists(s)
+	wl, _ := s.Create("Tech", nil)
+	h.unsubscribeWatchlist(c, "w-2", wl.ID)
+	if msgs := readSent(c); len(msgs) != 1 || msgs[0].ID != "w-2" || msgs[0].Code != codeNotFound {
+		t.Fatalf("Expected a not_found error for a watchlist not followed, got %+v", msgs)
+	}
+
+	h.subscribeWatchlist(c, "", wl.ID)
+	readSent(c)
+	h.unsubscribeWatchlist(c, "w-3", wl.ID)
+	if msgs := readSent(c); len(msgs) != 1 || msgs[0].ID != "w-3" || msgs[0].Type != "watchlist_unsubscribed" {
+		t.Fatalf("Expected watchlist_unsubscribed, got %+v", msgs)
+	}
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ---------------------------------------------------------------------------
+// Webhooks – push quote changes and alerts to HTTP endpoints
+// ---------------------------------------------------------------------------
+
+// Webhook event types.
+const (
+	webhookEventQuote = "quote" // a tracked ticker's data changed
+	webhookEventAlert = "alert" // an alert rule fired
+)
+
+// Webhook is a registered delivery target.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Tickers   []string  `json:"tickers"` // empty = every ticker
+	Events    []string  `json:"events"`  // "quote" and/or "alert"
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (wh *Webhook) wants(event, ticker string) bool {
+	eventOK := false
+	for _, e := range wh.Events {
+		if e == event {
+			eventOK = true
+			break
+		}
+	}
+	if !eventOK {
+		return false
+	}
+	if len(wh.Tickers) == 0 {
+		return true
+	}
+	for _, t := range wh.Tickers {
+		if t == ticker {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookDelivery is one message on its way to one webhook.
+type webhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhookId"`
+	Event     string          `json:"event"`
+	Ticker    string          `json:"ticker"`
+	Body      json.RawMessage `json:"body"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	FailedAt  time.Time       `json:"failedAt,omitempty"`
+}
+
+// webhookFile is the on-disk format of the webhook store.
+type webhookFile struct {
+	Webhooks    []*Webhook         `json:"webhooks"`
+	DeadLetters []*webhookDelivery `json:"deadLetters"`
+}
+
+var (
+	errWebhookNotFound    = errors.New("webhook not found")
+	errDeadLetterNotFound = errors.New("dead letter not found")
+	errPrivateTarget      = errors.New("webhook target is not a public address")
+	errInvalidWebhook     = errors.New("invalid webhook") // wrapped with the reason
+)
+
+// deadLetterSaveDelay batches the writes of the dead-letter list, so a burst
+// of failed deliveries is saved once.
+const deadLetterSaveDelay = time.Second
+
+// WebhookDispatcher stores webhook registrations and delivers events to
+// them from a pool of workers. Failed deliveries are retried with
+// exponential backoff and end up in a dead-letter list that can be replayed.
+type WebhookDispatcher struct {
+	mu          sync.RWMutex
+	path        string
+	hooks       map[string]*Webhook
+	deadLetters []*webhookDelivery
+
+	cfg      *Config
+	client   *http.Client
+	queue    chan *webhookDelivery
+	quit     chan struct{}
+	quitOnce sync.Once
+	wg       sync.WaitGroup
+
+	// retries tracks deliveries waiting for their backoff to elapse.
+	retryMu sync.Mutex
+	retries map[*webhookDelivery]*time.Timer
+
+	// saveTimer is the pending save of new dead letters, nil for none.
+	// Guarded by mu.
+	saveTimer *time.Timer
+
+	hooksChanged func(tickers []string)
+}
+
+// NewWebhookDispatcher loads registrations and dead letters from
+// cfg.WebhooksPath and starts cfg.WebhookWorkers delivery workers.
+func NewWebhookDispatcher(cfg *Config) (*WebhookDispatcher, error) {
+	d := &WebhookDispatcher{
+		path:    cfg.WebhooksPath,
+		hooks:   make(map[string]*Webhook),
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.WebhookTimeout, Transport: webhookTransport(cfg)},
+		queue:   make(chan *webhookDelivery, cfg.WebhookQueueSize),
+		quit:    make(chan struct{}),
+		retries: make(map[*webhookDelivery]*time.Timer),
+	}
+
+	if d.path != "" {
+		var file webhookFile
+		if _, err := readJSONFile(d.path, &file); err != nil {
+			return d, err
+		}
+		for _, wh := range file.Webhooks {
+			if wh != nil && wh.ID != "" {
+				d.hooks[wh.ID] = wh
+			}
+		}
+		d.deadLetters = file.DeadLetters
+		slog.Info("loaded webhooks", "component", "webhooks", "webhooks", len(d.hooks), "dead_letters", len(d.deadLetters))
+	}
+
+	for i := 0; i < cfg.WebhookWorkers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d, nil
+}
+
+// List returns all webhooks without their secrets, oldest first.
+func (d *WebhookDispatcher) List() []Webhook {
+	d.mu.RLock()
+	out := make([]Webhook, 0, len(d.hooks))
+	for _, wh := range d.hooks {
+		c := *wh
+		c.Secret = ""
+		out = append(out, c)
+	}
+	d.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// Get returns the webhook with the given id, without its secret.
+func (d *WebhookDispatcher) Get(id string) (Webhook, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	wh, ok := d.hooks[id]
+	if !ok {
+		return Webhook{}, false
+	}
+	c := *wh
+	c.Secret = ""
+	return c, true
+}
+
+// Tickers returns every ticker named by a webhook.
+func (d *WebhookDispatcher) Tickers() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var all []string
+	for _, wh := range d.hooks {
+		all = append(all, wh.Tickers...)
+	}
+	return normalizeTickers(all)
+}
+
+// Create registers a webhook. The returned copy is the only one that
+// includes the signing secret.
+func (d *WebhookDispatcher) Create(rawURL string, tickers, events []string) (Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: url must be an absolute http(s) URL", errInvalidWebhook)
+	}
+	if !d.cfg.WebhookAllowPrivate {
+		// Catches the obvious cases early; names are checked when dialing.
+		host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+		if ip, err := netip.ParseAddr(host); (err == nil && !publicAddr(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return Webhook{}, errPrivateTarget
+		}
+	}
+	if len(events) == 0 {
+		events = []string{webhookEventQuote, webhookEventAlert}
+	}
+	for _, e := range events {
+		if e != webhookEventQuote && e != webhookEventAlert {
+			return Webhook{}, fmt.Errorf("%w: unknown event '%s', use 'quote' or 'alert'", errInvalidWebhook, e)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, err
+	}
+	wh := &Webhook{
+		ID:        newID(),
+		URL:       u.String(),
+		Tickers:   normalizeTickers(tickers),
+		Events:    events,
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now(),
+	}
+
+	d.mu.Lock()
+	d.hooks[wh.ID] = wh
+	if err := d.saveLocked(); err != nil {
+		delete(d.hooks, wh.ID)
+		d.mu.Unlock()
+		return Webhook{}, err
+	}
+	d.mu.Unlock()
+
+	d.notifyHooksChanged()
+	return *wh, nil
+}
+
+// webhookTransport dials webhook targets directly, without a proxy. Unless
+// cfg.WebhookAllowPrivate is set, it refuses to connect to addresses that
+// aren't public. The check runs on the address actually dialed, after DNS
+// resolution, so neither redirects nor DNS rebinding get around it.
+func webhookTransport(cfg *Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !cfg.WebhookAllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !publicAddr(ip) {
+				return fmt.Errorf("%w: %s", errPrivateTarget, ip)
+			}
+			return nil
+		}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = dialer.DialContext
+	return t
+}
+
+// sharedAddrSpace is the carrier-grade NAT range (RFC 6598).
+var sharedAddrSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether ip may be the target of a webhook: not
+// loopback, private, link-local, multicast or unspecified.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddrSpace.Contains(ip)
+}
+
+// Delete removes a webhook. Deliveries already queued for it are dropped.
+func (d *WebhookDispatcher) Delete(id string) error {
+	d.mu.Lock()
+	wh, ok := d.hooks[id]
+	if !ok {
+		d.mu.Unlock()
+		return errWebhookNotFound
+	}
+	delete(d.hooks, id)
+	if err := d.saveLocked(); err != nil {
+		d.hooks[id] = wh
+		d.mu.Unlock()
+		return err
+	}
+	d.mu.Unlock()
+
+	d.notifyHooksChanged()
+	return nil
+}
+
+// DeadLetters returns the deliveries that exhausted their retries, newest
+// first.
+func (d *WebhookDispatcher) DeadLetters() []webhookDelivery {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	out := make([]webhookDelivery, 0, len(d.deadLetters))
+	for i := len(d.deadLetters) - 1; i >= 0; i-- {
+		out = append(out, *d.deadLetters[i])
+	}
+	return out
+}
+
+// Replay removes a dead letter and queues it for delivery again with a
+// fresh retry budget.
+func (d *WebhookDispatcher) Replay(id string) error {
+	d.mu.Lock()
+	var found *webhookDelivery
+	for i, dl := range d.deadLetters {
+		if dl.ID == id {
+			found = dl
+			d.deadLetters = append(d.deadLetters[:i], d.deadLetters[i+1:]...)
+			break
+		}
+	}
+	if found == nil {
+		d.mu.Unlock()
+		return errDeadLetterNotFound
+	}
+	if _, ok := d.hooks[found.WebhookID]; !ok {
+		d.deadLetters = append(d.deadLetters, found)
+		d.mu.Unlock()
+		return errWebhookNotFound
+	}
+	d.saveLocked()
+	d.mu.Unlock()
+
+	found.Attempts = 0
+	found.LastError = ""
+	found.FailedAt = time.Time{}
+	d.enqueue(found)
+	return nil
+}
+
+// Publish queues msg for every webhook subscribed to event and ticker.
+func (d *WebhookDispatcher) Publish(event, ticker string, msg ServerMessage) {
+	d.mu.RLock()
+	var targets []string
+	for _, wh := range d.hooks {
+		if wh.wants(event, ticker) {
+			targets = append(targets, wh.ID)
+		}
+	}
+	d.mu.RUnlock()
+	if len(targets) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("marshal error", "component", "webhooks", "error", err)
+		return
+	}
+	for _, id := range targets {
+		d.enqueue(&webhookDelivery{
+			ID:        newID(),
+			WebhookID: id,
+			Event:     event,
+			Ticker:    ticker,
+			Body:      body,
+			CreatedAt: time.Now(),
+		})
+	}
+}
+
+// Stop stops the workers and pending retries. Deliveries that never made
+// it out are moved to the dead-letter list so they can be replayed after
+// the restart.
+func (d *WebhookDispatcher) Stop(ctx context.Context) error {
+	d.quitOnce.Do(func() { close(d.quit) })
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	var pending []*webhookDelivery
+	d.retryMu.Lock()
+	for dl, timer := range d.retries {
+		timer.Stop()
+		pending = append(pending, dl)
+	}
+	d.retries = make(map[*webhookDelivery]*time.Timer)
+	d.retryMu.Unlock()
+	for {
+		select {
+		case dl := <-d.queue:
+			pending = append(pending, dl)
+			continue
+		default:
+		}
+		break
+	}
+
+	for _, dl := range pending {
+		dl.LastError = "server shut down before delivery"
+		d.deadLetter(dl)
+	}
+
+	d.mu.Lock()
+	if d.saveTimer != nil {
+		d.saveTimer.Stop()
+		d.saveTimer = nil
+	}
+	if serr := d.saveLocked(); serr != nil && err == nil {
+		err = serr
+	}
+	d.mu.Unlock()
+	return err
+}
+
+// enqueue hands a delivery to the workers. When the queue is full the
+// delivery goes straight to the dead-letter list rather than blocking the
+// hub.
+func (d *WebhookDispatcher) enqueue(dl *webhookDelivery) {
+	select {
+	case <-d.quit:
+		dl.LastError = "server shutting down"
+		d.deadLetter(dl)
+		return
+	default:
+	}
+	select {
+	case d.queue <- dl:
+	default:
+		dl.LastError = "delivery queue full"
+		d.deadLetter(dl)
+	}
+}
+
+func (d *WebhookDispatcher) worker() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case dl := <-d.queue:
+			d.attempt(dl)
+		}
+	}
+}
+
+// attempt makes one delivery attempt and schedules a retry on failure.
+func (d *WebhookDispatcher) attempt(dl *webhookDelivery) {
+	d.mu.RLock()
+	wh, ok := d.hooks[dl.WebhookID]
+	var target, secret string
+	if ok {
+		target, secret = wh.URL, wh.Secret
+	}
+	d.mu.RUnlock()
+	if !ok {
+		return // webhook deleted since the event was queued
+	}
+
+	dl.Attempts++
+	err := d.post(target, secret, dl)
+	if err == nil {
+		return
+	}
+	dl.LastError = err.Error()
+
+	if dl.Attempts >= d.cfg.WebhookMaxAttempts {
+		slog.Warn("giving up on delivery", "component", "webhooks", "delivery", dl.ID, "target", target, "attempts", dl.Attempts, "error", err)
+		d.deadLetter(dl)
+		return
+	}
+
+	backoff := d.cfg.WebhookRetryBase << (dl.Attempts - 1)
+	d.retryMu.Lock()
+	d.retries[dl] = time.AfterFunc(backoff, func() {
+		d.retryMu.Lock()
+		_, pending := d.retries[dl]
+		delete(d.retries, dl)
+		d.retryMu.Unlock()
+		if pending {
+			d.enqueue(dl)
+		}
+	})
+	d.retryMu.Unlock()
+}
+
+// post sends one signed delivery. Any non-2xx response is an error.
+func (d *WebhookDispatcher) post(target, secret string, dl *webhookDelivery) error {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(dl.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "stonksapi-webhooks")
+	req.Header.Set("X-Stonks-Event", dl.Event)
+	req.Header.Set("X-Stonks-Delivery", dl.ID)
+	req.Header.Set("X-Stonks-Timestamp", ts)
+	req.Header.Set("X-Stonks-Signature", "sha256="+signWebhook(secret, ts, dl.Body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with
+// the webhook's secret. Receivers recompute it to verify the sender and
+// reject stale timestamps to prevent replays.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter records a delivery that could not be made, keeping at most
+// cfg.WebhookDeadLetterMax entries. The list is saved deadLetterSaveDelay
+// later, together with any other dead letters recorded meanwhile.
+func (d *WebhookDispatcher) deadLetter(dl *webhookDelivery) {
+	dl.FailedAt = time.Now()
+	d.mu.Lock()
+	d.deadLetters = append(d.deadLetters, dl)
+	if over := len(d.deadLetters) - d.cfg.WebhookDeadLetterMax; over > 0 {
+		d.deadLetters = d.deadLetters[over:]
+	}
+	if d.saveTimer == nil && d.path != "" {
+		d.saveTimer = time.AfterFunc(deadLetterSaveDelay, func() {
+			d.mu.Lock()
+			d.saveTimer = nil
+			d.saveLocked()
+			d.mu.Unlock()
+		})
+	}
+	d.mu.Unlock()
+}
+
+// saveLocked writes webhooks and dead letters to disk. Caller must hold d.mu.
+func (d *WebhookDispatcher) saveLocked() error {
+	if d.path == "" {
+		return nil
+	}
+	file := webhookFile{
+		Webhooks:    make([]*Webhook, 0, len(d.hooks)),
+		DeadLetters: d.deadLetters,
+	}
+	for _, wh := range d.hooks {
+		file.Webhooks = append(file.Webhooks, wh)
+	}
+	if err := writeJSONFile(d.path, file); err != nil {
+		slog.Error("save failed", "component", "webhooks", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (d *WebhookDispatcher) notifyHooksChanged() {
+	if d.hooksChanged != nil {
+		d.hooksChanged(d.Tickers())
+	}
+}
+
+// ---------------------------------------------------------------------------
+// REST handlers
+// ---------------------------------------------------------------------------
+
+func (d *WebhookDispatcher) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, d.List())
+}
+
+// createWebhook registers a webhook and returns it with its signing secret,
+// which is never shown again.
+func (d *WebhookDispatcher) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL     string   `json:"url"`
+		Tickers []string `json:"tickers"`
+		Events  []string `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Expected JSON body with 'url' and optional 'tickers' and 'events'.")
+		return
+	}
+
+	wh, err := d.Create(req.URL, req.Tickers, req.Events)
+	if errors.Is(err, errInvalidWebhook) || errors.Is(err, errPrivateTarget) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not save webhooks.")
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, wh)
+}
+
+func (d *WebhookDispatcher) getWebhook(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	wh, ok := d.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No webhook found with id '%s'.", id))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, wh)
+}
+
+func (d *WebhookDispatcher) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := d.Delete(id)
+	if errors.Is(err, errWebhookNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No webhook found with id '%s'.", id))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not save webhooks.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *WebhookDispatcher) getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, d.DeadLetters())
+}
+
+func (d *WebhookDispatcher) replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	err := d.Replay(id)
+	switch {
+	case errors.Is(err, errDeadLetterNotFound):
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No dead letter found with id '%s'.", id))
+	case errors.Is(err, errWebhookNotFound):
+		writeError(w, http.StatusConflict, "The webhook for this delivery no longer exists.")
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Hub integration
+// ---------------------------------------------------------------------------
+
+// UseWebhooks publishes every ticker change (the same change detection that
+// drives broadcastEntry) and every fired alert to matching webhooks. Tickers
+// named by a webhook are kept polled.
+func (h *Hub) UseWebhooks(d *WebhookDispatcher, alerts *AlertEngine) {
+	d.hooksChanged = func(tickers []string) { h.Pin("webhooks", tickers) }
+	h.Pin("webhooks", d.Tickers())
+
+	h.OnChange(func(entry StockEntry) {
+		d.Publish(webhookEventQuote, entry.Ticker, entryMessage(&entry))
+	})
+
+	if alerts != nil {
+		alerts.OnAlert(func(ev AlertEvent) {
+			d.Publish(webhookEventAlert, ev.Ticker, ServerMessage{
+				Type:      "alert",
+				Ticker:    ev.Ticker,
+				Data:      ev,
+				Timestamp: ev.FiredAt,
+			})
+		})
+	}
+}
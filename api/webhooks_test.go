@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestDispatcher(t *testing.T) *WebhookDispatcher {
+	t.Helper()
+	cfg := LoadConfig()
+	cfg.WebhooksPath = filepath.Join(t.TempDir(), "webhooks.json")
+	cfg.WebhookWorkers = 1
+	cfg.WebhookMaxAttempts = 3
+	cfg.WebhookRetryBase = 10 * time.Millisecond
+	cfg.WebhookAllowPrivate = true // test servers listen on loopback
+	d, err := NewWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatalf("NewWebhookDispatcher failed: %v", err)
+	}
+	t.Cleanup(func() { d.Stop(context.Background()) })
+	return d
+}
+
+func TestWebhookDeliverySigned(t *testing.T) {
+	d := newTestDispatcher(t)
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	wh, err := d.Create(srv.URL, []string{"tsla:nasdaq"}, []string{"quote"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if wh.Secret == "" {
+		t.Fatal("Expected the created webhook to include its secret")
+	}
+
+	d.Publish(webhookEventQuote, "AAPL:NASDAQ", ServerMessage{Type: "stock_update", Ticker: "AAPL:NASDAQ"})
+	d.Publish(webhookEventAlert, "TSLA:NASDAQ", ServerMessage{Type: "alert", Ticker: "TSLA:NASDAQ"})
+	d.Publish(webhookEventQuote, "TSLA:NASDAQ", ServerMessage{Type: "stock_update", Ticker: "TSLA:NASDAQ"})
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		if got := r.Header.Get("X-Stonks-Event"); got != "quote" {
+			t.Fatalf("Expected quote event, got %q", got)
+		}
+		want := "sha256=" + signWebhook(wh.Secret, r.Header.Get("X-Stonks-Timestamp"), body)
+		if got := r.Header.Get("X-Stonks-Signature"); got != want {
+			t.Fatalf("Signature mismatch: got %s, want %s", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the delivery")
+	}
+
+	select {
+	case r := <-received:
+		t.Fatalf("Expected only the TSLA quote to be delivered, also got %s", r.Header.Get("X-Stonks-Event"))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetriesThenDeadLetters(t *testing.T) {
+	d := newTestDispatcher(t)
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	d.Create(srv.URL, nil, nil)
+	d.Publish(webhookEventAlert, "BTC-USD", ServerMessage{Type: "alert", Ticker: "BTC-USD"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(d.DeadLetters()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	letters := d.DeadLetters()
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(letters))
+	}
+	if calls.Load() != 3 || letters[0].Attempts != 3 {
+		t.Fatalf("Expected 3 attempts, server saw %d, delivery recorded %d", calls.Load(), letters[0].Attempts)
+	}
+
+	if err := d.Replay(letters[0].ID); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(d.DeadLetters()) != 0 {
+		t.Fatal("Expected the replayed delivery to leave the dead-letter list")
+	}
+}
+
+func TestWebhookDeadLettersSavedOnStop(t *testing.T) {
+	d := newTestDispatcher(t)
+	d.deadLetter(&webhookDelivery{ID: "dl-1", WebhookID: "gone"})
+
+	var file webhookFile
+	if found, _ := readJSONFile(d.path, &file); found {
+		t.Fatal("Expected the dead letter not to be written right away")
+	}
+	d.Stop(context.Background())
+	if _, err := readJSONFile(d.path, &file); err != nil || len(file.DeadLetters) != 1 {
+		t.Fatalf("Expected Stop to write the dead letter, got %+v (%v)", file.DeadLetters, err)
+	}
+}
+
+func TestWebhookPrivateTargets(t *testing.T) {
+	cfg := LoadConfig()
+	cfg.WebhooksPath = ""
+	d, _ := NewWebhookDispatcher(cfg)
+	t.Cleanup(func() { d.Stop(context.Background()) })
+
+	for _, target := range []string{"http://127.0.0.1/hook", "http://[::1]/hook", "http://10.1.2.3/hook", "http://169.254.169.254/latest", "http://localhost:8080/hook", "http://0.0.0.0/hook"} {
+		if _, err := d.Create(target, nil, nil); !errors.Is(err, errPrivateTarget) {
+			t.Errorf("Expected %s to be rejected, got %v", target, err)
+		}
+	}
+
+	// Names resolving to private addresses are refused when dialing.
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("Expected the request not to reach a loopback server")
+	}))
+	defer srv.Close()
+	if _, err := d.client.Get(strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)); !errors.Is(err, errPrivateTarget) {
+		t.Fatalf("Expected the dial to be refused, got %v", err)
+	}
+}
+
+func TestWebhookCreateValidation(t *testing.T) {
+	d := newTestDispatcher(t)
+	if _, err := d.Create("ftp://example.com/hook", nil, nil); err == nil {
+		t.Fatal("Expected a non-http URL to be rejected")
+	}
+	if _, err := d.Create("https://example.com/hook", nil, []string{"trade"}); err == nil {
+		t.Fatal("Expected an unknown event to be rejected")
+	}
+}
+
+func TestWebhookStoreRollsBackFailedSaves(t *testing.T) {
+	d := newTestDispatcher(t)
+	wh, _ := d.Create("https://example.com/hook", []string{"TSLA:NASDAQ"}, nil)
+	notified := 0
+	d.hooksChanged = func([]string) { notified++ }
+
+	d.path = filepath.Join(d.path, "unwritable.json") // its directory is a file
+	if _, err := d.Create("https://example.com/other", []string{"AAPL:NASDAQ"}, nil); err == nil {
+		t.Fatal("Expected Create to fail")
+	}
+	if err := d.Delete(wh.ID); err == nil {
+		t.Fatal("Expected Delete to fail")
+	}
+	if list := d.List(); len(list) != 1 || list[0].ID != wh.ID || notified != 0 {
+		t.Fatalf("Expected failed saves to change nothing, got %+v after %d notifications", list, notified)
+	}
+
+	for body, status := range map[string]int{
+		`{"url": "ftp://example.com/hook"}`:   http.StatusBadRequest,
+		`{"url": "https://example.com/hook"}`: http.StatusInternalServerError,
+	} {
+		rr := httptest.NewRecorder()
+		d.createWebhook(rr, httptest.NewRequest("POST", "/webhooks", strings.NewReader(body)))
+		if rr.Code != status {
+			t.Errorf("%s: expected %d, got %d", body, status, rr.Code)
+		}
+	}
+}